@@ -26,6 +26,8 @@ type UsageInfo struct {
 	Used     int64 // The number of bytes used by the storage
 	Capacity int64 // The maximum number of bytes usable by the storage
 	Locked   int64 // The number of bytes currently locked by the storage
+	Pinned   int64 // The number of bytes of pinned files, also counted as locked
+	Overhead int64 // The number of bytes used for bookkeeping rather than content, included in Used
 }
 
 func (ui UsageInfo) String() string {
@@ -44,4 +46,27 @@ type BoundedStorage interface {
 
 	// Clears any data that is not locked externally and returns the number of bytes freed.
 	FreeCache() int64
+
+	// Clears data that is not locked externally, least recently used first, until at least
+	// `target` bytes have been freed or nothing more can be freed. Returns the number of bytes freed.
+	FreeCacheBytes(target int64) int64
+
+	// Changes the maximum number of bytes usable by the storage. When lowering the capacity below
+	// the number of bytes used, data that is not locked externally is cleared, least recently used
+	// first, until it fits. Locked data is kept, so usage may remain above the new capacity, in
+	// which case storing new data requires clearing the excess first. Returns the number of bytes
+	// freed.
+	SetCapacity(capacity int64) int64
+
+	// Pins the file stored under `key`, which then counts as locked and is never cleared, until
+	// Unpin is called. This is independent of the file's handles, so a pinned file may be retained
+	// without holding a handle, e.g. for reuse in later transfers. Pinning a chunked file also
+	// retains its chunks. Pinning a file more than once has no further effect. Returns ErrNotFound
+	// if no such file exists.
+	Pin(key SKey) error
+
+	// Reverts Pin, making the file stored under `key` eligible for clearing once it isn't locked
+	// otherwise. Unpinning a file that isn't pinned has no effect. Returns ErrNotFound if no such
+	// file exists.
+	Unpin(key SKey) error
 }
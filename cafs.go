@@ -19,8 +19,11 @@
 package cafs
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 )
 
@@ -28,10 +31,38 @@ var ErrNotFound = errors.New("Not found")
 var ErrStillOpen = errors.New("Temporary still open")
 var ErrInvalidState = errors.New("Invalid temporary state")
 var ErrNotEnoughSpace = errors.New("Not enough space")
+var ErrHashMismatch = errors.New("Hash mismatch")
+var ErrInvalidKey = errors.New("Invalid key")
+var ErrAmbiguousPrefix = errors.New("Ambiguous key prefix")
 
 var LoggingEnabled = false
 
-type SKey [32]byte
+// Type SKey identifies content by its SHA-256 hash, truncated to KeySize bytes. Keys of different
+// lengths don't interoperate: Storages and remotes must agree on KeySize, i.e. be built with the
+// same tags. Decoding a key of the wrong length fails, so a SyncInfo from a remote using a
+// different KeySize is rejected rather than misinterpreted.
+type SKey [KeySize]byte
+
+// Function NewKeyHash returns a hash.Hash for computing a key from data written to it. See SumKey.
+func NewKeyHash() hash.Hash {
+	return sha256.New()
+}
+
+// Function SumKey returns the key for the data written to `h`, which must have been created
+// using NewKeyHash.
+func SumKey(h hash.Hash) SKey {
+	var key SKey
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// Function KeyOf returns the key for `data`.
+func KeyOf(data []byte) SKey {
+	sum := sha256.Sum256(data)
+	var key SKey
+	copy(key[:], sum[:])
+	return key
+}
 
 type FileStorage interface {
 	// Creates a new temporary that can be written into. The info string will stick
@@ -39,6 +70,11 @@ type FileStorage interface {
 	// informational purposes.
 	Create(info string) Temporary
 
+	// Like Create, but the temporary's content is expected to hash to a known key. If it
+	// doesn't, Close() fails with ErrHashMismatch and no file is stored under the key. This
+	// allows populating the storage from untrusted sources when the key itself is trusted.
+	CreateWithKey(info string, expected SKey) Temporary
+
 	// Queries a file from the storage that can be read from. If the file exists, a File
 	// interface is returned that has been locked once and that must be released correctly.
 	// If the file does not exist, then (nil, ErrNotFound) is returned.
@@ -47,6 +83,59 @@ type FileStorage interface {
 	DumpStatistics(log Printer)
 }
 
+// Interface MetadataStorage is implemented by FileStorage implementations that can associate
+// metadata, like a file name or modification time, with stored files. Metadata isn't part of the
+// content and doesn't affect a file's key. It is dropped when the file is evicted from storage.
+type MetadataStorage interface {
+	// Associates a copy of `meta` with the file stored under `key`, replacing any previous
+	// metadata. Returns ErrNotFound if no such file exists.
+	SetMeta(key SKey, meta map[string]string) error
+
+	// Returns a copy of the metadata associated with the file stored under `key`, which is nil
+	// if none was set. Returns ErrNotFound if no such file exists.
+	GetMeta(key SKey) (map[string]string, error)
+}
+
+// Interface PrefixStorage is implemented by FileStorage implementations that can look up files by
+// an abbreviated key, e.g. one entered by a user or taken from a URL.
+type PrefixStorage interface {
+	// Like Get, but queries the single file whose key, in its string representation, starts with
+	// `prefix`, ignoring case. Returns ErrNotFound if there is no such file, ErrAmbiguousPrefix if
+	// there are several, and ErrInvalidKey if `prefix` isn't a prefix of any valid key.
+	GetByPrefix(prefix string) (File, error)
+}
+
+// Interface PresenceStorage is implemented by FileStorage implementations that can check whether a
+// file is present without side effects. Unlike Get, checking neither locks the file nor affects which
+// files are evicted first.
+type PresenceStorage interface {
+	// Returns true if a file is stored under `key`. The file may be evicted at any time afterwards.
+	Has(key SKey) bool
+}
+
+// Interface RepairableStorage is implemented by FileStorage implementations that can replace the
+// content of a file found to be corrupted, i.e. not to hash to its key anymore.
+type RepairableStorage interface {
+	// Marks the content stored under `key` as corrupt. When content is stored under `key` the next
+	// time, it replaces the corrupted content instead of being deduplicated against it. Returns
+	// ErrNotFound if no file is stored under `key`.
+	MarkCorrupt(key SKey) error
+}
+
+// Function Contains returns true if `storage` holds a file under `key`. Uses Has if `storage`
+// implements PresenceStorage, and falls back to Get otherwise.
+func Contains(storage FileStorage, key SKey) bool {
+	if ps, ok := storage.(PresenceStorage); ok {
+		return ps.Has(key)
+	}
+	f, err := storage.Get(&key)
+	if err != nil {
+		return false
+	}
+	f.Dispose()
+	return true
+}
+
 type File interface {
 	// Signals that this file handle is no longer in use.
 	// If no handles exist on a file anymore, the storage space
@@ -56,6 +145,10 @@ type File interface {
 	Dispose()
 	Key() SKey
 	Open() io.ReadCloser
+	// Like Open, but the reader calls `cb` with the total number of bytes read so far, at least
+	// every ProgressInterval bytes and once the end of the file has been reached or the reader is
+	// closed. Implementations usually return NewProgressReader(Open(), cb).
+	OpenWithProgress(cb func(read int64)) io.ReadCloser
 	Size() int64
 	// Creates a new handle to the same file that must be Dispose()'d
 	// independently.
@@ -105,6 +198,11 @@ type Temporary interface {
 	// called and no error occurred. Otherwise, panics.
 	File() File
 
+	// Returns the key of the stored file, once Close() has been
+	// called and no error occurred. Otherwise, panics. Unlike File(),
+	// this doesn't create a new handle that must be disposed.
+	Key() SKey
+
 	// Must be called when the temporary is no longer needed.
 	// It's ok to call Dispose() more than once.
 	Dispose()
@@ -114,19 +212,27 @@ func (k SKey) String() string {
 	return hex.EncodeToString(k[:])
 }
 
-func ParseKey(s string) (*SKey, error) {
-	if len(s) != 64 {
-		return nil, errors.New("Invalid key length")
+// Function ParseSKey parses a key from its string representation, as returned by SKey.String,
+// consisting of exactly 2*KeySize hexadecimal digits. Otherwise, returns an error wrapping
+// ErrInvalidKey.
+func ParseSKey(s string) (SKey, error) {
+	var result SKey
+	if len(s) != hex.EncodedLen(KeySize) {
+		return result, fmt.Errorf("%w: expected %d hex digits, got %d characters", ErrInvalidKey, hex.EncodedLen(KeySize), len(s))
+	}
+	if _, err := hex.Decode(result[:], []byte(s)); err != nil {
+		return SKey{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
 	}
+	return result, nil
+}
 
-	var result SKey
-	if b, err := hex.DecodeString(s); err != nil {
+// Function ParseKey works like ParseSKey but returns a pointer to the key.
+func ParseKey(s string) (*SKey, error) {
+	key, err := ParseSKey(s)
+	if err != nil {
 		return nil, err
-	} else {
-		copy(result[:], b)
 	}
-
-	return &result, nil
+	return &key, nil
 }
 
 func MustParseKey(s string) *SKey {
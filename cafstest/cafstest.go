@@ -0,0 +1,272 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package cafstest provides a fake FileStorage for testing code that depends on package cafs.
+// By default, it behaves like a correct content-addressable storage, but it can be configured to
+// simulate errors and latency, and it records the operations performed on it.
+package cafstest
+
+import (
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Type Op identifies a kind of operation performed on a FakeStorage.
+type Op string
+
+const (
+	OpCreate        Op = "Create"
+	OpCreateWithKey Op = "CreateWithKey"
+	OpGet           Op = "Get"
+	OpClose         Op = "Close"
+)
+
+// Struct Operation records a single operation performed on a FakeStorage.
+type Operation struct {
+	Op   Op
+	Info string    // Info string passed to Create or CreateWithKey, or of the temporary closed
+	Key  cafs.SKey // Key queried, expected or stored; zero for Create and failed Close
+	Err  error     // Error returned, if any
+}
+
+// Struct FakeStorage is a cafs.FileStorage delegating to another storage, which can be configured
+// to fail or delay operations. It is safe for concurrent use.
+type FakeStorage struct {
+	storage cafs.FileStorage
+
+	mutex     sync.Mutex
+	missing   map[cafs.SKey]bool
+	createErr error
+	closeErr  error
+	latency   time.Duration
+	ops       []Operation
+}
+
+var _ cafs.FileStorage = &FakeStorage{}
+
+// Function NewFakeStorage returns a FakeStorage delegating to a new RAM storage of the given
+// capacity in bytes.
+func NewFakeStorage(capacity int64) *FakeStorage {
+	return WrapStorage(ram.NewRamStorage(capacity))
+}
+
+// Function WrapStorage returns a FakeStorage delegating to `storage`.
+func WrapStorage(storage cafs.FileStorage) *FakeStorage {
+	return &FakeStorage{
+		storage: storage,
+		missing: make(map[cafs.SKey]bool),
+	}
+}
+
+// Sets whether Get reports the file stored under `key` as missing, returning ErrNotFound even if
+// it is present in the underlying storage.
+func (s *FakeStorage) SetMissing(key cafs.SKey, missing bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if missing {
+		s.missing[key] = true
+	} else {
+		delete(s.missing, key)
+	}
+}
+
+// Sets the error returned by Write and Close of temporaries created from now on. A nil error
+// restores normal behavior.
+func (s *FakeStorage) SetCreateError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.createErr = err
+}
+
+// Sets the error returned by Close of any temporary, after all data has been written. A nil error
+// restores normal behavior.
+func (s *FakeStorage) SetCloseError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closeErr = err
+}
+
+// Sets the delay added to each Create, CreateWithKey, Get and Close.
+func (s *FakeStorage) SetLatency(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.latency = d
+}
+
+// Func Operations returns a copy of all operations recorded so far, in the order they completed.
+func (s *FakeStorage) Operations() []Operation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Operation(nil), s.ops...)
+}
+
+// Func Count returns the number of operations of kind `op` recorded so far.
+func (s *FakeStorage) Count(op Op) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for _, o := range s.ops {
+		if o.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// Func AssertCount reports an error to `t` unless exactly `expected` operations of kind `op`
+// have been recorded.
+func (s *FakeStorage) AssertCount(t testing.TB, op Op, expected int) {
+	t.Helper()
+	if n := s.Count(op); n != expected {
+		t.Errorf("Expected %d %v operations, got %d", expected, op, n)
+	}
+}
+
+// Func AssertGot reports an error to `t` unless Get has been called with `key`.
+func (s *FakeStorage) AssertGot(t testing.TB, key cafs.SKey) {
+	t.Helper()
+	for _, o := range s.Operations() {
+		if o.Op == OpGet && o.Key == key {
+			return
+		}
+	}
+	t.Errorf("Expected Get of key %v", key)
+}
+
+// Func Reset forgets all operations recorded so far. Configuration is not affected.
+func (s *FakeStorage) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ops = nil
+}
+
+func (s *FakeStorage) Create(info string) cafs.Temporary {
+	err := s.begin()
+	s.record(Operation{Op: OpCreate, Info: info, Err: err})
+	return &fakeTemporary{storage: s, temp: s.storage.Create(info), info: info, err: err}
+}
+
+func (s *FakeStorage) CreateWithKey(info string, expected cafs.SKey) cafs.Temporary {
+	err := s.begin()
+	s.record(Operation{Op: OpCreateWithKey, Info: info, Key: expected, Err: err})
+	return &fakeTemporary{storage: s, temp: s.storage.CreateWithKey(info, expected), info: info, err: err}
+}
+
+func (s *FakeStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	s.delay()
+	s.mutex.Lock()
+	missing := s.missing[*key]
+	s.mutex.Unlock()
+
+	var file cafs.File
+	var err error
+	if missing {
+		err = cafs.ErrNotFound
+	} else {
+		file, err = s.storage.Get(key)
+	}
+	s.record(Operation{Op: OpGet, Key: *key, Err: err})
+	return file, err
+}
+
+func (s *FakeStorage) DumpStatistics(log cafs.Printer) {
+	s.storage.DumpStatistics(log)
+}
+
+// Waits for the configured latency and returns the error configured for Create.
+func (s *FakeStorage) begin() error {
+	s.delay()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.createErr
+}
+
+func (s *FakeStorage) delay() {
+	s.mutex.Lock()
+	latency := s.latency
+	s.mutex.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
+
+func (s *FakeStorage) record(op Operation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ops = append(s.ops, op)
+}
+
+// Struct fakeTemporary delegates to a temporary of the underlying storage unless configured
+// to fail.
+type fakeTemporary struct {
+	storage *FakeStorage
+	temp    cafs.Temporary
+	info    string
+	err     error // If not nil, returned by Write and Close
+	failed  bool  // Set if Close failed
+}
+
+func (t *fakeTemporary) Write(b []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	return t.temp.Write(b)
+}
+
+func (t *fakeTemporary) Close() error {
+	t.storage.delay()
+	err := t.err
+	if err == nil {
+		t.storage.mutex.Lock()
+		err = t.storage.closeErr
+		t.storage.mutex.Unlock()
+	}
+	if err == nil {
+		err = t.temp.Close()
+	}
+
+	op := Operation{Op: OpClose, Info: t.info, Err: err}
+	if err != nil {
+		t.failed = true
+	} else {
+		op.Key = t.temp.Key()
+	}
+	t.storage.record(op)
+	return err
+}
+
+func (t *fakeTemporary) File() cafs.File {
+	t.checkValid()
+	return t.temp.File()
+}
+
+func (t *fakeTemporary) Key() cafs.SKey {
+	t.checkValid()
+	return t.temp.Key()
+}
+
+func (t *fakeTemporary) Dispose() {
+	t.temp.Dispose()
+}
+
+func (t *fakeTemporary) checkValid() {
+	if t.failed {
+		panic(cafs.ErrInvalidState)
+	}
+}
@@ -0,0 +1,73 @@
+package cafstest
+
+import (
+	"bytes"
+	"errors"
+	"github.com/indyjo/cafs"
+	"testing"
+	"time"
+)
+
+func TestFakeStorage(t *testing.T) {
+	s := NewFakeStorage(1 << 20)
+	data := []byte("some content")
+	f, err := cafs.Ingest(s, bytes.NewReader(data), "file")
+	if err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	defer f.Dispose()
+	key := f.Key()
+	if key != cafs.KeyOf(data) {
+		t.Errorf("Unexpected key %v", key)
+	}
+
+	f2, err := s.Get(&key)
+	if err != nil {
+		t.Fatalf("Error getting file: %v", err)
+	}
+	f2.Dispose()
+
+	s.SetMissing(key, true)
+	if _, err := s.Get(&key); err != cafs.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+	s.SetMissing(key, false)
+
+	s.AssertCount(t, OpCreate, 1)
+	s.AssertCount(t, OpClose, 1)
+	s.AssertCount(t, OpGet, 2)
+	s.AssertGot(t, key)
+	if ops := s.Operations(); ops[len(ops)-1].Err != cafs.ErrNotFound {
+		t.Errorf("Expected last operation to record ErrNotFound, got: %v", ops[len(ops)-1])
+	}
+}
+
+func TestFakeStorageErrors(t *testing.T) {
+	s := NewFakeStorage(1 << 20)
+	errCreate := errors.New("create failed")
+	s.SetCreateError(errCreate)
+	if _, err := cafs.Ingest(s, bytes.NewReader([]byte("data")), "file"); err != errCreate {
+		t.Errorf("Expected create error, got: %v", err)
+	}
+	s.SetCreateError(nil)
+
+	errClose := errors.New("close failed")
+	s.SetCloseError(errClose)
+	if _, err := cafs.Ingest(s, bytes.NewReader([]byte("data")), "file"); err != errClose {
+		t.Errorf("Expected close error, got: %v", err)
+	}
+	key := cafs.KeyOf([]byte("data"))
+	if _, err := s.Get(&key); err != cafs.ErrNotFound {
+		t.Errorf("Expected file to not be stored after failed Close, got: %v", err)
+	}
+	s.SetCloseError(nil)
+
+	s.Reset()
+	s.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	_, _ = s.Get(&key)
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Expected Get to be delayed, took %v", d)
+	}
+	s.AssertCount(t, OpGet, 1)
+}
@@ -30,19 +30,29 @@ const (
 	WINDOW_SIZE = 48
 	MIN_CHUNK   = 128
 	MAX_CHUNK   = 131072
+	AVG_CHUNK   = 8192
 )
 
 // type Adler32Chunker implements the Chunker interface based on the Adler-32 checksum.
 type Adler32Chunker struct {
 	a      uint32
 	n, p   int
-	window [WINDOW_SIZE]byte
+	window []byte
 }
 
-// Function NewChunker returns a new Chunker.
+// Function NewChunker returns a new Chunker using a rolling window of WINDOW_SIZE bytes.
 func NewChunker() *Adler32Chunker {
-	var c = Adler32Chunker{a: 1}
-	return &c
+	return NewChunkerWithWindowSize(WINDOW_SIZE)
+}
+
+// Function NewChunkerWithWindowSize returns a new Chunker using a rolling window of `size` bytes.
+// Smaller windows make chunk boundaries realign more quickly after small edits.
+// Panics if size is not in range 1..MAX_CHUNK.
+func NewChunkerWithWindowSize(size int) *Adler32Chunker {
+	if size <= 0 || size > MAX_CHUNK {
+		panic("invalid window size")
+	}
+	return &Adler32Chunker{a: 1, window: make([]byte, size)}
 }
 
 func (c *Adler32Chunker) Scan(data []byte) int {
@@ -50,10 +60,11 @@ func (c *Adler32Chunker) Scan(data []byte) int {
 		return 0
 	}
 
+	windowSize := len(c.window)
 	prefixLen := 0
 	// Initially, fill window
-	if c.n < WINDOW_SIZE {
-		prefixLen = WINDOW_SIZE - c.n
+	if c.n < windowSize {
+		prefixLen = windowSize - c.n
 		if len(data) < prefixLen {
 			prefixLen = len(data)
 		}
@@ -61,14 +72,14 @@ func (c *Adler32Chunker) Scan(data []byte) int {
 		c.n += prefixLen
 		copy(c.window[c.p:c.p+prefixLen], data[:prefixLen])
 		c.p += prefixLen
-		if c.p == WINDOW_SIZE {
+		if c.p == windowSize {
 			c.p = 0
 		}
 		data = data[prefixLen:]
 	}
 
 	for i, _ := range data {
-		c.a = popFront(c.a, c.window[c.p:c.p+1], WINDOW_SIZE)
+		c.a = popFront(c.a, c.window[c.p:c.p+1], windowSize)
 		c.window[c.p] = data[i]
 		c.a = pushBack(c.a, data[i:i+1])
 		c.n++
@@ -76,12 +87,12 @@ func (c *Adler32Chunker) Scan(data []byte) int {
 		// Chunk boundary at MAX_CHUNK or if hash is 4159 modulo 8191 (both are prime)
 		if c.n > MIN_CHUNK && 4159 == (c.a%8191) || c.n > MAX_CHUNK {
 			// Reset chunker and return position in data
-			*c = Adler32Chunker{a: 1}
+			c.a, c.n, c.p = 1, 0, 0
 			return i + prefixLen // Byte will become beginning of next segment
 		}
 
 		c.p++
-		if c.p == WINDOW_SIZE {
+		if c.p == windowSize {
 			c.p = 0
 		}
 	}
@@ -89,6 +100,10 @@ func (c *Adler32Chunker) Scan(data []byte) int {
 	return len(data) + prefixLen
 }
 
+func (c *Adler32Chunker) Bounds() (min, max int) {
+	return MIN_CHUNK, MAX_CHUNK
+}
+
 // Add p to the running checksum d.
 func pushBack(d uint32, p []byte) uint32 {
 	s1, s2 := uint32(d&0xffff), uint32(d>>16)
@@ -17,20 +17,65 @@
 // Package chunking implements an algorithm for content-based chunking of arbitrary files.
 package chunking
 
-import "github.com/indyjo/cafs/chunking/adler32"
+import (
+	"fmt"
+	"github.com/indyjo/cafs/chunking/adler32"
+)
 
 const (
+	// Minimum size of a chunk. Only the last chunk of a file may be smaller.
+	MinChunkSize = adler32.MIN_CHUNK
+	// Maximum size of a chunk.
 	MaxChunkSize = adler32.MAX_CHUNK
+	// Approximate average size of a chunk, as observed on random data.
+	AvgChunkSize = adler32.AVG_CHUNK
+	// Size of the rolling window used by the default chunker.
+	DefaultWindowSize = adler32.WINDOW_SIZE
 )
 
+// Function EstimateChunkCount returns the approximate number of chunks a file of `size` bytes is
+// split into, based on AvgChunkSize. Useful for preallocating per-chunk data when only the size of
+// a file is known. Always returns at least 1, as even an empty file consists of one chunk.
+func EstimateChunkCount(size int64) int {
+	if size <= 0 {
+		return 1
+	}
+	return int(size/AvgChunkSize) + 1
+}
+
+// Struct ChunkerParams contains parameters for creating a chunker using NewWithParams.
+type ChunkerParams struct {
+	// Size of the rolling window in bytes. Smaller windows make chunk boundaries realign more
+	// quickly after small edits, larger windows make boundaries less sensitive to local patterns.
+	WindowSize int
+}
+
+// Returns the parameters used by New.
+func DefaultParams() ChunkerParams {
+	return ChunkerParams{WindowSize: DefaultWindowSize}
+}
+
 type Chunker interface {
 	// Scans the byte sequence for chunk boundaries.
 	// Returns the number of bytes from data that can be added to the current chunk.
 	// A return value of len(data) means that no chunk boundary has been found in this block.
 	Scan(data []byte) int
+
+	// Returns the minimum and maximum size of chunks generated by this chunker. Only the last
+	// chunk of a file may be smaller than the minimum.
+	Bounds() (min, max int)
 }
 
 // Function New returns a new chunker.
 func New() Chunker {
 	return adler32.NewChunker()
 }
+
+// Function NewWithParams returns a new chunker using the given parameters.
+// Returns an error if the parameters are invalid.
+func NewWithParams(params ChunkerParams) (Chunker, error) {
+	if params.WindowSize <= 0 || params.WindowSize > MaxChunkSize {
+		return nil, fmt.Errorf("invalid window size: %d (must be in range 1..%d)", params.WindowSize, MaxChunkSize)
+	}
+	return adler32.NewChunkerWithWindowSize(params.WindowSize), nil
+}
@@ -48,3 +48,117 @@ func TestSingleByteBlocks(t *testing.T) {
 		t.Logf("Test produced %v blocks (avg size: %d)", blocks, size/blocks)
 	}
 }
+
+func TestBounds(t *testing.T) {
+	chunker := New()
+	min, max := chunker.Bounds()
+	if min != MinChunkSize || max != MaxChunkSize {
+		t.Fatalf("Expected bounds (%d, %d), got (%d, %d)", MinChunkSize, MaxChunkSize, min, max)
+	}
+
+	// Random data tests the minimum, constant data tests the maximum
+	random := make([]byte, 1<<22)
+	for k := range random {
+		random[k] = byte(rand.Int())
+	}
+	constant := make([]byte, 1<<20)
+	for _, data := range [][]byte{random, constant} {
+		for len(data) > 0 {
+			n := chunker.Scan(data)
+			if n < len(data) && (n < min || n > max) {
+				t.Fatalf("Chunk size %d out of bounds (%d, %d)", n, min, max)
+			}
+			data = data[n:]
+		}
+		// Reset chunker
+		chunker = New()
+	}
+}
+
+func TestNewWithParams(t *testing.T) {
+	for _, size := range []int{-1, 0, MaxChunkSize + 1} {
+		if _, err := NewWithParams(ChunkerParams{WindowSize: size}); err == nil {
+			t.Errorf("Expected window size %d to be rejected", size)
+		}
+	}
+	for _, size := range []int{1, DefaultWindowSize, MaxChunkSize} {
+		if _, err := NewWithParams(ChunkerParams{WindowSize: size}); err != nil {
+			t.Errorf("Expected window size %d to be accepted, got: %v", size, err)
+		}
+	}
+}
+
+// Tests that after inserting a single byte, chunk boundaries realign as soon as the rolling
+// window has moved past the insertion.
+func TestRealignment(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+	const insertAt = 100
+	modified := append(append(append([]byte{}, data[:insertAt]...), 0x55), data[insertAt:]...)
+
+	for _, windowSize := range []int{4, 16, DefaultWindowSize, 1024} {
+		original := boundaries(t, windowSize, data)
+		shifted := boundaries(t, windowSize, modified)
+		// Translate boundaries after the insertion to original positions
+		for i := range shifted {
+			if shifted[i] > insertAt {
+				shifted[i]--
+			}
+		}
+
+		// All boundaries beyond the window following the insertion must be identical
+		after := func(b []int) []int {
+			for i, pos := range b {
+				if pos > insertAt+windowSize {
+					return b[i:]
+				}
+			}
+			return nil
+		}
+		a, b := after(original), after(shifted)
+		if len(a) == 0 || len(a) != len(b) {
+			t.Fatalf("Window size %d: expected same number of boundaries, got %d and %d", windowSize, len(a), len(b))
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				t.Fatalf("Window size %d: boundaries differ at position %d vs %d", windowSize, a[i], b[i])
+			}
+		}
+		t.Logf("Window size %d: realigned at position %d", windowSize, a[0])
+	}
+}
+
+func boundaries(t *testing.T, windowSize int, data []byte) []int {
+	chunker, err := NewWithParams(ChunkerParams{WindowSize: windowSize})
+	if err != nil {
+		t.Fatalf("Error creating chunker: %v", err)
+	}
+	var result []int
+	for pos := 0; pos < len(data); {
+		pos += chunker.Scan(data[pos:])
+		if pos < len(data) {
+			result = append(result, pos)
+		}
+	}
+	return result
+}
+
+func TestEstimateChunkCount(t *testing.T) {
+	for _, size := range []int64{-1, 0, 1, AvgChunkSize - 1} {
+		if n := EstimateChunkCount(size); n != 1 {
+			t.Errorf("Size %d: expected 1 chunk, got %d", size, n)
+		}
+	}
+	// On random data, the estimate should be reasonably close to the actual number of chunks
+	data := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(0)).Read(data)
+	actual := 0
+	c := New()
+	for p := data; len(p) > 0; actual++ {
+		n := c.Scan(p)
+		p = p[n:]
+	}
+	if n := EstimateChunkCount(int64(len(data))); n < actual/2 || n > actual*2 {
+		t.Errorf("Estimated %d chunks, got %d", n, actual)
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/chunking"
+	"github.com/indyjo/cafs/remotesync"
 	"io"
 	"os"
 	"sort"
@@ -18,6 +21,8 @@ var versionFlag = flag.Bool("v", false, "Print the version number.")
 var numFingers = flag.Int("n", 5, "Number of fingers in handprint.")
 var matrixMode = flag.Bool("m", false, "Display similarity matrix.")
 var printChunks = flag.Bool("c", false, "Print chunks on the go.")
+var syncInfoMode = flag.Bool("syncinfo", false, "Write the SyncInfo of each file to stdout.")
+var syncInfoFormat = flag.String("format", "json", "Encoding of SyncInfo: 'json' or 'binary' (legacy stream, no permutation).")
 
 func main() {
 	flag.Parse() // Scan the arguments list
@@ -26,6 +31,16 @@ func main() {
 		fmt.Println("Version:", APP_VERSION)
 	}
 
+	if *syncInfoMode {
+		for _, arg := range flag.Args() {
+			if err := writeSyncInfo(os.Stdout, arg, *syncInfoFormat); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
 	fingerprints := make(map[string]bool)
 
 	for _, arg := range flag.Args() {
@@ -86,16 +101,25 @@ func (h *Handprint) String() string {
 	return string(result)
 }
 
+// Inserts a fingerprint into the handprint, which keeps the smallest fingerprints seen so far
+// in ascending order. Fingerprints already contained in the handprint are ignored.
 func (h *Handprint) Insert(fingerprint []byte) {
-	for i, other := range h.Fingerprints {
-		if bytes.Compare(other, fingerprint) <= 0 {
-			continue
-		}
-		fingerprint, h.Fingerprints[i] = other, fingerprint
+	i := sort.Search(len(h.Fingerprints), func(i int) bool {
+		return bytes.Compare(h.Fingerprints[i], fingerprint) >= 0
+	})
+	if i < len(h.Fingerprints) && bytes.Equal(h.Fingerprints[i], fingerprint) {
+		// duplicate
+		return
+	}
+	if i == cap(h.Fingerprints) {
+		// handprint is full and fingerprint is larger than all others
+		return
 	}
 	if len(h.Fingerprints) < cap(h.Fingerprints) {
-		h.Fingerprints = append(h.Fingerprints, fingerprint)
+		h.Fingerprints = append(h.Fingerprints, nil)
 	}
+	copy(h.Fingerprints[i+1:], h.Fingerprints[i:])
+	h.Fingerprints[i] = fingerprint
 }
 
 func chunkFile(filename string, size int, printSummary, printChunks bool) (*Handprint, error) {
@@ -107,39 +131,24 @@ func chunkFile(filename string, size int, printSummary, printChunks bool) (*Hand
 	}
 	defer fi.Close()
 
-	buffer := make([]byte, 16384)
-	chunker := chunking.New()
-
-	numChunks := 1
-	numBytes := 0
-	sha := sha256.New()
-	chunkLen := 0
-	for {
-		n, err := fi.Read(buffer)
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
-		if n == 0 {
-			handprint.Insert(sha.Sum(make([]byte, 0, 32)))
-			break
-		}
-		numBytes += n
-		slice := buffer[:n]
-		for len(slice) > 0 {
-			bytesInChunk := chunker.Scan(slice)
-			chunkLen += bytesInChunk
-			sha.Write(slice[:bytesInChunk])
-			if bytesInChunk < len(slice) {
-				handprint.Insert(sha.Sum(make([]byte, 0, 32)))
-				if printChunks {
-					fmt.Printf(" %6d %032x\n", chunkLen, sha.Sum(make([]byte, 0, 32)))
-				}
-				sha.Reset()
-				chunkLen = 0
-				numChunks++
-			}
-			slice = slice[bytesInChunk:]
+	splitter := chunking.NewSplitter(chunking.New(), func(chunk []byte, offset int64) error {
+		sum := sha256.Sum256(chunk)
+		handprint.Insert(sum[:])
+		if printChunks {
+			fmt.Printf(" %6d %032x\n", len(chunk), sum)
 		}
+		return nil
+	})
+	if _, err := io.Copy(splitter, fi); err != nil {
+		return nil, err
+	}
+	if err := splitter.Close(); err != nil {
+		return nil, err
+	}
+	if splitter.Count() == 0 {
+		// An empty file consists of a single empty chunk
+		sum := sha256.Sum256(nil)
+		handprint.Insert(sum[:])
 	}
 
 	//fmt.Printf("Generated %d chunks on avg %d bytes long.\n", numChunks, numBytes/numChunks)
@@ -148,3 +157,47 @@ func chunkFile(filename string, size int, printSummary, printChunks bool) (*Hand
 	}
 	return handprint, nil
 }
+
+// Chunks a file and returns the SyncInfo describing it, using the trivial permutation.
+func syncInfoOfFile(filename string) (*remotesync.SyncInfo, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	syncinf := &remotesync.SyncInfo{}
+	syncinf.SetTrivialPermutation()
+	splitter := chunking.NewSplitter(chunking.New(), func(chunk []byte, offset int64) error {
+		syncinf.Chunks = append(syncinf.Chunks, remotesync.ChunkInfo{Key: cafs.KeyOf(chunk), Size: len(chunk)})
+		return nil
+	})
+	if _, err := io.Copy(splitter, fi); err != nil {
+		return nil, err
+	}
+	if err := splitter.Close(); err != nil {
+		return nil, err
+	}
+	if splitter.Count() == 0 {
+		// An empty file consists of a single empty chunk
+		syncinf.Chunks = append(syncinf.Chunks, remotesync.ChunkInfo{Key: cafs.KeyOf(nil)})
+	}
+	return syncinf, nil
+}
+
+// Writes the SyncInfo of a file to w, either as JSON (one object per line) or in the legacy binary
+// stream format, which contains only chunk keys and sizes.
+func writeSyncInfo(w io.Writer, filename, format string) error {
+	syncinf, err := syncInfoOfFile(filename)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(syncinf)
+	case "binary":
+		return syncinf.WriteToLegacyStream(w)
+	default:
+		return fmt.Errorf("unknown SyncInfo format: %v", format)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func checkHandprint(t *testing.T, h *Handprint, expected ...byte) {
+	if len(h.Fingerprints) != len(expected) {
+		t.Fatalf("Expected %d fingerprints, got %d: %x", len(expected), len(h.Fingerprints), h.Fingerprints)
+	}
+	for i, b := range expected {
+		if !bytes.Equal(h.Fingerprints[i], []byte{b}) {
+			t.Fatalf("Fingerprint %d: expected %x, got %x", i, b, h.Fingerprints[i])
+		}
+	}
+}
+
+func TestHandprintFewerThanN(t *testing.T) {
+	h := NewHandprint(5)
+	checkHandprint(t, h)
+	h.Insert([]byte{7})
+	checkHandprint(t, h, 7)
+	h.Insert([]byte{3})
+	checkHandprint(t, h, 3, 7)
+	h.Insert([]byte{9})
+	checkHandprint(t, h, 3, 7, 9)
+	h.Insert([]byte{5})
+	checkHandprint(t, h, 3, 5, 7, 9)
+}
+
+func TestHandprintDuplicates(t *testing.T) {
+	h := NewHandprint(3)
+	h.Insert([]byte{4})
+	h.Insert([]byte{4})
+	checkHandprint(t, h, 4)
+	h.Insert([]byte{2})
+	h.Insert([]byte{4})
+	h.Insert([]byte{2})
+	checkHandprint(t, h, 2, 4)
+	h.Insert([]byte{6})
+	h.Insert([]byte{6})
+	checkHandprint(t, h, 2, 4, 6)
+	h.Insert([]byte{2})
+	checkHandprint(t, h, 2, 4, 6)
+}
+
+func TestHandprintKeepsSmallest(t *testing.T) {
+	h := NewHandprint(3)
+	for _, b := range []byte{9, 8, 7, 6, 5, 9, 1, 5, 8, 2} {
+		h.Insert([]byte{b})
+	}
+	checkHandprint(t, h, 1, 2, 5)
+	h.Insert([]byte{10})
+	checkHandprint(t, h, 1, 2, 5)
+	h.Insert([]byte{0})
+	checkHandprint(t, h, 0, 1, 2)
+}
+
+func TestSyncInfoOfFile(t *testing.T) {
+	for _, size := range []int{0, 100, 300000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		tempfile, err := ioutil.TempFile("", "chunktool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tempfile.Name())
+		if _, err := tempfile.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := tempfile.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The SyncInfo must match the one created from a file stored in CAFS
+		store := ram.NewRamStorage(1 << 20)
+		temp := store.Create("test data")
+		temp.Write(data)
+		if err := temp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		file := temp.File()
+		temp.Dispose()
+		expected := &remotesync.SyncInfo{}
+		expected.SetTrivialPermutation()
+		if err := expected.SetChunksFromFile(file); err != nil {
+			t.Fatal(err)
+		}
+		file.Dispose()
+
+		syncinf, err := syncInfoOfFile(tempfile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(syncinf, expected) {
+			t.Fatalf("size %d: SyncInfo differs from expected: %v vs. %v", size, syncinf, expected)
+		}
+
+		var buf bytes.Buffer
+		if err := writeSyncInfo(&buf, tempfile.Name(), "json"); err != nil {
+			t.Fatal(err)
+		}
+		decoded := &remotesync.SyncInfo{}
+		if err := json.Unmarshal(buf.Bytes(), decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded.Chunks, expected.Chunks) || !reflect.DeepEqual(decoded.Perm, expected.Perm) {
+			t.Fatalf("size %d: decoded SyncInfo differs: %v", size, decoded)
+		}
+
+		buf.Reset()
+		if err := writeSyncInfo(&buf, tempfile.Name(), "binary"); err != nil {
+			t.Fatal(err)
+		}
+		decoded = &remotesync.SyncInfo{}
+		if err := decoded.ReadFromLegacyStream(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded.Chunks, expected.Chunks) {
+			t.Fatalf("size %d: SyncInfo read from legacy stream differs: %v", size, decoded)
+		}
+
+		if err := writeSyncInfo(&buf, tempfile.Name(), "xml"); err == nil {
+			t.Fatalf("Expected an error for unknown format")
+		}
+	}
+}
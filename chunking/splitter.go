@@ -0,0 +1,87 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package chunking
+
+import (
+	"bytes"
+)
+
+// Struct Splitter is an io.Writer that splits the data written into it into chunks using a
+// Chunker. It invokes a callback with each complete chunk and the chunk's offset in the stream.
+// This relieves callers from keeping track of chunk boundaries themselves.
+// Create using NewSplitter.
+type Splitter struct {
+	chunker Chunker
+	onChunk func(chunk []byte, offset int64) error
+	buffer  bytes.Buffer
+	offset  int64
+	count   int
+}
+
+// Function NewSplitter returns a Splitter using `chunker` for finding chunk boundaries. Function
+// `onChunk` is called for every chunk, in order. The chunk passed is valid only during the call.
+// An error returned by `onChunk` is returned by Write or Close.
+func NewSplitter(chunker Chunker, onChunk func(chunk []byte, offset int64) error) *Splitter {
+	return &Splitter{
+		chunker: chunker,
+		onChunk: onChunk,
+	}
+}
+
+func (s *Splitter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		nBoundary := s.chunker.Scan(p)
+		s.buffer.Write(p[:nBoundary])
+		if nBoundary < len(p) {
+			// a chunk boundary was detected
+			if err := s.flush(); err != nil {
+				return n - len(p) + nBoundary, err
+			}
+		}
+		p = p[nBoundary:]
+	}
+	return n, nil
+}
+
+// Passes the last chunk to the callback, if it isn't empty. An empty stream produces no chunks.
+// The Splitter must not be written to afterwards.
+func (s *Splitter) Close() error {
+	if s.buffer.Len() == 0 {
+		return nil
+	}
+	return s.flush()
+}
+
+// Returns the number of chunks passed to the callback so far.
+func (s *Splitter) Count() int {
+	return s.count
+}
+
+// Returns the number of bytes contained in the chunks passed to the callback so far.
+func (s *Splitter) Offset() int64 {
+	return s.offset
+}
+
+func (s *Splitter) flush() error {
+	chunk := s.buffer.Bytes()
+	err := s.onChunk(chunk, s.offset)
+	s.offset += int64(len(chunk))
+	s.count++
+	s.buffer.Reset()
+	return err
+}
@@ -0,0 +1,105 @@
+package chunking
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Function scanBoundaries returns the end offsets of all chunks in `data`, as found by scanning
+// manually using a fresh chunker.
+func scanBoundaries(data []byte) []int64 {
+	chunker := New()
+	var boundaries []int64
+	var pos int64
+	for len(data) > 0 {
+		n := chunker.Scan(data)
+		pos += int64(n)
+		if n < len(data) {
+			boundaries = append(boundaries, pos)
+		}
+		data = data[n:]
+	}
+	if len(boundaries) == 0 || boundaries[len(boundaries)-1] != pos {
+		boundaries = append(boundaries, pos)
+	}
+	return boundaries
+}
+
+func TestSplitter(t *testing.T) {
+	data := make([]byte, 1<<21)
+	rand.Read(data)
+	expected := scanBoundaries(data)
+
+	for _, blockSize := range []int{1, 7, 4096, 16384, len(data)} {
+		var boundaries []int64
+		var joined bytes.Buffer
+		splitter := NewSplitter(New(), func(chunk []byte, offset int64) error {
+			if offset != int64(joined.Len()) {
+				t.Fatalf("Block size %d: expected offset %d, got %d", blockSize, joined.Len(), offset)
+			}
+			joined.Write(chunk)
+			boundaries = append(boundaries, offset+int64(len(chunk)))
+			return nil
+		})
+		for i := 0; i < len(data); i += blockSize {
+			end := i + blockSize
+			if end > len(data) {
+				end = len(data)
+			}
+			if n, err := splitter.Write(data[i:end]); n != end-i || err != nil {
+				t.Fatalf("Block size %d: Write returned %d, %v", blockSize, n, err)
+			}
+		}
+		if err := splitter.Close(); err != nil {
+			t.Fatalf("Block size %d: Close returned %v", blockSize, err)
+		}
+
+		if !bytes.Equal(joined.Bytes(), data) {
+			t.Errorf("Block size %d: chunks don't add up to the data written", blockSize)
+		}
+		if len(boundaries) != len(expected) || splitter.Count() != len(expected) {
+			t.Fatalf("Block size %d: expected %d chunks, got %d (count: %d)", blockSize, len(expected), len(boundaries), splitter.Count())
+		}
+		for i := range expected {
+			if boundaries[i] != expected[i] {
+				t.Fatalf("Block size %d: chunk %d ends at %d, expected %d", blockSize, i, boundaries[i], expected[i])
+			}
+		}
+		if splitter.Offset() != int64(len(data)) {
+			t.Errorf("Block size %d: expected offset %d, got %d", blockSize, len(data), splitter.Offset())
+		}
+	}
+}
+
+func TestSplitterEmpty(t *testing.T) {
+	splitter := NewSplitter(New(), func(chunk []byte, offset int64) error {
+		t.Fatalf("Unexpected chunk of %d bytes at %d", len(chunk), offset)
+		return nil
+	})
+	if err := splitter.Close(); err != nil {
+		t.Fatalf("Close returned %v", err)
+	}
+	if splitter.Count() != 0 {
+		t.Errorf("Expected no chunks, got %d", splitter.Count())
+	}
+}
+
+func TestSplitterError(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	expected := scanBoundaries(data)
+
+	errTest := errors.New("test")
+	splitter := NewSplitter(New(), func(chunk []byte, offset int64) error {
+		return errTest
+	})
+	n, err := splitter.Write(data)
+	if err != errTest {
+		t.Fatalf("Expected error %v, got %v", errTest, err)
+	}
+	if int64(n) != expected[0] {
+		t.Errorf("Expected Write to report %d bytes, got %d", expected[0], n)
+	}
+}
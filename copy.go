@@ -0,0 +1,111 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"fmt"
+	"io"
+)
+
+// Interface EnumerableStorage is implemented by FileStorage implementations that can list the
+// files they contain.
+type EnumerableStorage interface {
+	FileStorage
+
+	// Returns the keys of all files currently stored, including the chunks of chunked files, in no
+	// particular order. As files may be stored or evicted concurrently, Get isn't guaranteed to
+	// succeed for every key returned.
+	Keys() []SKey
+}
+
+// Function CopyAll copies every file stored in `src` into `dst`, skipping files already present in
+// `dst` as well as files evicted from `src` meanwhile. Copied files are verified to retain their
+// keys. If both storages implement MetadataStorage, metadata is copied, too. Returns the number of
+// files copied. Chunked files are copied first, so that their chunks, being stored along with them,
+// are neither copied nor counted separately, regardless of the order of keys returned by `src`.
+// Stops at the first error, e.g. ErrNotEnoughSpace if `dst` runs out of space.
+func CopyAll(dst FileStorage, src EnumerableStorage) (copied int, err error) {
+	// Unchunked files are held until all chunked files have been copied
+	var unchunked []File
+	defer func() {
+		for _, f := range unchunked {
+			f.Dispose()
+		}
+	}()
+
+	for _, key := range src.Keys() {
+		if Contains(dst, key) {
+			continue
+		}
+		key := key
+		f, err := src.Get(&key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return copied, err
+		}
+		if !f.IsChunked() {
+			unchunked = append(unchunked, f)
+			continue
+		}
+		err = copyFile(dst, src, f)
+		f.Dispose()
+		if err != nil {
+			return copied, err
+		}
+		copied++
+	}
+
+	for _, f := range unchunked {
+		if Contains(dst, f.Key()) {
+			continue
+		}
+		if err := copyFile(dst, src, f); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+// Function copyFile stores the content of `file`, taken from `src`, in `dst` under the same key,
+// along with its metadata if supported. The copy is left unlocked in `dst`.
+func copyFile(dst, src FileStorage, file File) error {
+	temp := dst.CreateWithKey(fmt.Sprintf("Copy of %v", file.Key()), file.Key())
+	defer temp.Dispose()
+	r := file.Open()
+	//noinspection GoUnhandledErrorResult
+	defer r.Close()
+	if _, err := io.Copy(temp, r); err != nil {
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	srcMeta, ok1 := src.(MetadataStorage)
+	dstMeta, ok2 := dst.(MetadataStorage)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	if meta, err := srcMeta.GetMeta(file.Key()); err != nil {
+		return err
+	} else if meta != nil {
+		return dstMeta.SetMeta(file.Key(), meta)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package cafs_test
+
+import (
+	"bytes"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestCopyAll(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	src := ram.NewRamStorage(1 << 20).(EnumerableStorage)
+	dst := ram.NewRamStorage(1 << 20)
+
+	var files []File
+	for _, size := range []int{0, 100, 200000, 300000} {
+		f, err := Ingest(src, bytes.NewReader(randomBytes(r, size)), "source data")
+		if err != nil {
+			t.Fatalf("Error ingesting: %v", err)
+		}
+		defer f.Dispose()
+		files = append(files, f)
+	}
+	if err := src.(MetadataStorage).SetMeta(files[1].Key(), map[string]string{"name": "foo"}); err != nil {
+		t.Fatalf("Error setting metadata: %v", err)
+	}
+
+	// Let dst overlap with src
+	overlap, err := Ingest(dst, files[2].Open(), "overlapping data")
+	if err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	defer overlap.Dispose()
+
+	copied, err := CopyAll(dst, src)
+	if err != nil {
+		t.Fatalf("Error in CopyAll: %v", err)
+	}
+	// Chunks stored along with a chunked file aren't copied separately, and files[2] is present
+	if copied != 3 {
+		t.Errorf("Expected 3 files to be copied, got %d", copied)
+	}
+	for _, key := range src.Keys() {
+		if f, err := dst.Get(&key); err != nil {
+			t.Errorf("Key %v missing in destination", key)
+		} else {
+			f.Dispose()
+		}
+	}
+
+	for _, f := range files {
+		key := f.Key()
+		c, err := dst.Get(&key)
+		if err != nil {
+			t.Fatalf("File %v missing in destination: %v", key, err)
+		}
+		a, b := f.Open(), c.Open()
+		dataA, _ := ioutil.ReadAll(a)
+		dataB, _ := ioutil.ReadAll(b)
+		_ = a.Close()
+		_ = b.Close()
+		c.Dispose()
+		if !bytes.Equal(dataA, dataB) {
+			t.Errorf("File %v differs after copying", key)
+		}
+	}
+	if meta, err := dst.(MetadataStorage).GetMeta(files[1].Key()); err != nil || meta["name"] != "foo" {
+		t.Errorf("Expected metadata to be copied, got %v, %v", meta, err)
+	}
+
+	// Copying again is a no-op
+	if copied, err := CopyAll(dst, src); err != nil || copied != 0 {
+		t.Errorf("Expected nothing to be copied, got %d, %v", copied, err)
+	}
+}
+
+func TestCopyAllCount(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	src := ram.NewRamStorage(1 << 20).(EnumerableStorage)
+	for _, size := range []int{100, 200000, 300000} {
+		f, err := Ingest(src, bytes.NewReader(randomBytes(r, size)), "source data")
+		if err != nil {
+			t.Fatalf("Error ingesting: %v", err)
+		}
+		defer f.Dispose()
+	}
+
+	// Keys are enumerated in random order, so repeat to cover chunks preceding their files
+	for i := 0; i < 20; i++ {
+		dst := ram.NewRamStorage(1 << 20)
+		counting := &getCountingStorage{EnumerableStorage: src, gets: make(map[SKey]int)}
+		if copied, err := CopyAll(dst, counting); err != nil || copied != 3 {
+			t.Fatalf("Expected 3 files to be copied, got %d, %v", copied, err)
+		}
+		for key, n := range counting.gets {
+			if n > 1 {
+				t.Fatalf("Expected key %v to be retrieved once, got %d times", key, n)
+			}
+		}
+	}
+}
+
+// Struct getCountingStorage counts how often each key is retrieved using Get.
+type getCountingStorage struct {
+	EnumerableStorage
+	gets map[SKey]int
+}
+
+func (s *getCountingStorage) Get(key *SKey) (File, error) {
+	s.gets[*key]++
+	return s.EnumerableStorage.Get(key)
+}
+
+func TestCopyAllNotEnoughSpace(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	src := ram.NewRamStorage(1 << 20).(EnumerableStorage)
+	dst := ram.NewRamStorage(100000)
+	f, err := Ingest(src, bytes.NewReader(randomBytes(r, 200000)), "source data")
+	if err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	defer f.Dispose()
+
+	if _, err := CopyAll(dst, src); err != ErrNotEnoughSpace {
+		t.Errorf("Expected ErrNotEnoughSpace, got %v", err)
+	}
+	if locked := dst.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected nothing to remain locked, got %d bytes", locked)
+	}
+}
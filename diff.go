@@ -0,0 +1,74 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+// Type Diff describes which chunks two files have in common and which are unique to either of them.
+// Each list contains distinct keys in order of their first occurrence.
+type Diff struct {
+	OnlyInA []SKey // Keys of chunks contained in file A but not in file B
+	OnlyInB []SKey // Keys of chunks contained in file B but not in file A
+	Shared  []SKey // Keys of chunks contained in both files, in order of file A
+}
+
+// Function DiffFiles compares the chunks of two files. Files that are not chunked are treated as
+// consisting of a single chunk.
+func DiffFiles(a, b File) Diff {
+	keysA := chunkKeys(a)
+	keysB := chunkKeys(b)
+
+	inA := make(map[SKey]bool, len(keysA))
+	for _, k := range keysA {
+		inA[k] = true
+	}
+	inB := make(map[SKey]bool, len(keysB))
+	for _, k := range keysB {
+		inB[k] = true
+	}
+
+	var diff Diff
+	for _, k := range keysA {
+		if inB[k] {
+			diff.Shared = append(diff.Shared, k)
+		} else {
+			diff.OnlyInA = append(diff.OnlyInA, k)
+		}
+	}
+	for _, k := range keysB {
+		if !inA[k] {
+			diff.OnlyInB = append(diff.OnlyInB, k)
+		}
+	}
+	return diff
+}
+
+// Function chunkKeys returns the distinct keys of a file's chunks in order of first occurrence.
+func chunkKeys(f File) []SKey {
+	if !f.IsChunked() {
+		return []SKey{f.Key()}
+	}
+	seen := make(map[SKey]bool)
+	keys := make([]SKey, 0, f.NumChunks())
+	iter := f.Chunks()
+	defer iter.Dispose()
+	for iter.Next() {
+		if k := iter.Key(); !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
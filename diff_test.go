@@ -0,0 +1,112 @@
+package cafs_test
+
+import (
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"math/rand"
+	"testing"
+)
+
+func storeData(t *testing.T, s FileStorage, data []byte) File {
+	temp := s.Create("test data")
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		t.Fatalf("Error on Write: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatalf("Error on Close: %v", err)
+	}
+	return temp.File()
+}
+
+func randomBytes(r *rand.Rand, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(r.Int())
+	}
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	var result []byte
+	for _, p := range parts {
+		result = append(result, p...)
+	}
+	return result
+}
+
+func TestDiffFilesSharedMiddle(t *testing.T) {
+	s := ram.NewRamStorage(4 << 20)
+	r := rand.New(rand.NewSource(0))
+	middle := randomBytes(r, 512*1024)
+	a := storeData(t, s, concat(randomBytes(r, 64*1024), middle, randomBytes(r, 64*1024)))
+	defer a.Dispose()
+	b := storeData(t, s, concat(randomBytes(r, 32*1024), middle, randomBytes(r, 96*1024)))
+	defer b.Dispose()
+
+	diff := DiffFiles(a, b)
+	if len(diff.Shared) == 0 {
+		t.Fatal("Expected files to share chunks")
+	}
+	if len(diff.OnlyInA) == 0 || len(diff.OnlyInB) == 0 {
+		t.Fatalf("Expected both files to have unique chunks: %d in A, %d in B", len(diff.OnlyInA), len(diff.OnlyInB))
+	}
+	if n := len(diff.Shared) + len(diff.OnlyInA); int64(n) != a.NumChunks() {
+		t.Errorf("Shared and unique chunks of A don't add up: %d != %d", n, a.NumChunks())
+	}
+	if n := len(diff.Shared) + len(diff.OnlyInB); int64(n) != b.NumChunks() {
+		t.Errorf("Shared and unique chunks of B don't add up: %d != %d", n, b.NumChunks())
+	}
+
+	// The first and last chunk differ, the ones in between are shared
+	iter := a.Chunks()
+	defer iter.Dispose()
+	iter.Next()
+	if diff.OnlyInA[0] != iter.Key() {
+		t.Errorf("Expected first chunk of A to be unique")
+	}
+	iter.Next()
+	if diff.Shared[0] == iter.Key() {
+		t.Errorf("Expected second chunk of A (spanning the start of the shared region) to be unique")
+	}
+}
+
+func TestDiffFilesIdentical(t *testing.T) {
+	s := ram.NewRamStorage(1 << 20)
+	r := rand.New(rand.NewSource(1))
+	a := storeData(t, s, randomBytes(r, 256*1024))
+	defer a.Dispose()
+
+	diff := DiffFiles(a, a)
+	if len(diff.OnlyInA) != 0 || len(diff.OnlyInB) != 0 {
+		t.Errorf("Expected no unique chunks: %v", diff)
+	}
+	if int64(len(diff.Shared)) != a.NumChunks() {
+		t.Errorf("Expected %d shared chunks, got %d", a.NumChunks(), len(diff.Shared))
+	}
+}
+
+func TestDiffFilesUnchunked(t *testing.T) {
+	s := ram.NewRamStorage(1 << 20)
+	r := rand.New(rand.NewSource(2))
+	small := storeData(t, s, []byte("small file"))
+	defer small.Dispose()
+	if small.IsChunked() {
+		t.Fatal("Expected small file not to be chunked")
+	}
+	big := storeData(t, s, randomBytes(r, 256*1024))
+	defer big.Dispose()
+
+	diff := DiffFiles(small, big)
+	if len(diff.OnlyInA) != 1 || diff.OnlyInA[0] != small.Key() {
+		t.Errorf("Expected small file's key as its only chunk, got %v", diff.OnlyInA)
+	}
+	if int64(len(diff.OnlyInB)) != big.NumChunks() || len(diff.Shared) != 0 {
+		t.Errorf("Unexpected diff: %v", diff)
+	}
+
+	diff = DiffFiles(small, small)
+	if len(diff.Shared) != 1 || diff.Shared[0] != small.Key() {
+		t.Errorf("Expected small file to share its only chunk with itself, got %v", diff)
+	}
+}
@@ -38,8 +38,10 @@ func (k *SKey) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &s); err != nil {
 		return err
 	}
-	if _, err := hex.Decode(k[:], []byte(s)); err != nil {
+	key, err := ParseKey(s)
+	if err != nil {
 		return err
 	}
+	*k = *key
 	return nil
 }
@@ -0,0 +1,55 @@
+package cafs_test
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/indyjo/cafs"
+	"strings"
+	"testing"
+)
+
+func TestParseSKey(t *testing.T) {
+	key := KeyOf([]byte("some data"))
+	for _, s := range []string{key.String(), strings.ToUpper(key.String())} {
+		if parsed, err := ParseSKey(s); err != nil {
+			t.Errorf("Error parsing %v: %v", s, err)
+		} else if parsed != key {
+			t.Errorf("Parsing %v returned %v", s, parsed)
+		}
+	}
+
+	valid := key.String()
+	for _, s := range []string{
+		"",
+		valid[:16],
+		valid + "00",
+		valid[:len(valid)-1],
+		"x" + valid[1:],
+		valid[:len(valid)-2] + " 0",
+	} {
+		if _, err := ParseSKey(s); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey parsing %q, got: %v", s, err)
+		}
+		if k, err := ParseKey(s); k != nil || !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ParseKey to fail with ErrInvalidKey on %q, got: %v, %v", s, k, err)
+		}
+	}
+}
+
+func TestSKeyJSON(t *testing.T) {
+	key := KeyOf([]byte("some data"))
+	b, err := json.Marshal(key)
+	if err != nil {
+		t.Fatalf("Error marshaling: %v", err)
+	}
+	if string(b) != `"`+key.String()+`"` {
+		t.Errorf("Unexpected encoding: %s", b)
+	}
+	var decoded SKey
+	if err := json.Unmarshal(b, &decoded); err != nil || decoded != key {
+		t.Errorf("Expected %v, got %v (error: %v)", key, decoded, err)
+	}
+	if err := json.Unmarshal([]byte(`"abc"`), &decoded); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got: %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+)
+
+// Function FS presents files of `storage` as an fs.FS, e.g. for use with http.FS or
+// template.ParseFS. The `manifest` maps slash-separated paths to the keys of the files, and
+// directories are derived from these paths. Paths that aren't valid according to fs.ValidPath are
+// ignored, as are files whose path is also the directory of another path. Files are looked up
+// when opened, so opening a file that is missing from storage fails with fs.ErrNotExist. The
+// manifest must not be modified afterwards.
+func FS(storage FileStorage, manifest map[string]SKey) fs.FS {
+	children := map[string]map[string]bool{".": {}}
+	for p := range manifest {
+		if !fs.ValidPath(p) || p == "." {
+			continue
+		}
+		for p != "." {
+			dir := path.Dir(p)
+			if children[dir] == nil {
+				children[dir] = make(map[string]bool)
+			}
+			children[dir][path.Base(p)] = true
+			p = dir
+		}
+	}
+	dirs := make(map[string][]string, len(children))
+	for dir, names := range children {
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		dirs[dir] = sorted
+	}
+	return &storageFS{storage: storage, files: manifest, dirs: dirs}
+}
+
+// Struct storageFS implements the fs.FS returned by function FS.
+type storageFS struct {
+	storage FileStorage
+	files   map[string]SKey
+	dirs    map[string][]string // sorted names of each directory's entries
+}
+
+func (s *storageFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if names, ok := s.dirs[name]; ok {
+		return &fsDir{fs: s, name: name, names: names}, nil
+	}
+	key, ok := s.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	file, err := s.storage.Get(&key)
+	if err == ErrNotFound {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	} else if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{file: file, info: fileInfo{name: path.Base(name), size: file.Size()}}, nil
+}
+
+// Function stat returns information about the entry `name`, which must exist in the manifest.
+func (s *storageFS) stat(name string) (fs.FileInfo, error) {
+	if _, ok := s.dirs[name]; ok {
+		return fileInfo{name: path.Base(name), dir: true}, nil
+	}
+	key := s.files[name]
+	file, err := s.storage.Get(&key)
+	if err == ErrNotFound {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	} else if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	defer file.Dispose()
+	return fileInfo{name: path.Base(name), size: file.Size()}, nil
+}
+
+// Struct fsFile implements fs.File and io.Seeker on top of a File. Seeking reopens the file and
+// skips data up to the new position, which is acceptable for serving ranges.
+type fsFile struct {
+	file File // nil once closed
+	info fileInfo
+	pos  int64
+	r    io.ReadCloser // Positioned at pos, or nil if not opened yet
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	if f.file == nil {
+		return nil, fs.ErrClosed
+	}
+	return f.info, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.file == nil {
+		return 0, fs.ErrClosed
+	}
+	if f.r == nil {
+		f.r = f.file.Open()
+		if _, err := io.CopyN(ioutil.Discard, f.r, f.pos); err == io.EOF {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if f.file == nil {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.file.Size()
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if offset != f.pos {
+		f.closeReader()
+		f.pos = offset
+	}
+	return offset, nil
+}
+
+func (f *fsFile) closeReader() {
+	if f.r != nil {
+		_ = f.r.Close()
+		f.r = nil
+	}
+}
+
+func (f *fsFile) Close() error {
+	if f.file == nil {
+		return fs.ErrClosed
+	}
+	f.closeReader()
+	f.file.Dispose()
+	f.file = nil
+	return nil
+}
+
+// Struct fsDir implements fs.ReadDirFile for a directory derived from the manifest.
+type fsDir struct {
+	fs     *storageFS
+	name   string
+	names  []string
+	offset int // number of entries already returned by ReadDir
+	closed bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	if d.closed {
+		return nil, fs.ErrClosed
+	}
+	return fileInfo{name: path.Base(d.name), dir: true}, nil
+}
+
+func (d *fsDir) Read(_ []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, fs.ErrClosed
+	}
+	names := d.names[d.offset:]
+	if n > 0 && len(names) == 0 {
+		return nil, io.EOF
+	} else if n > 0 && n < len(names) {
+		names = names[:n]
+	}
+	entries := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = dirEntry{fs: d.fs, name: path.Join(d.name, name)}
+	}
+	d.offset += len(names)
+	return entries, nil
+}
+
+func (d *fsDir) Close() error {
+	if d.closed {
+		return fs.ErrClosed
+	}
+	d.closed = true
+	return nil
+}
+
+// Struct dirEntry implements fs.DirEntry. Looking up a file's size is deferred to Info.
+type dirEntry struct {
+	fs   *storageFS
+	name string // full path
+}
+
+func (e dirEntry) Name() string {
+	return path.Base(e.name)
+}
+
+func (e dirEntry) IsDir() bool {
+	_, ok := e.fs.dirs[e.name]
+	return ok
+}
+
+func (e dirEntry) Type() fs.FileMode {
+	if e.IsDir() {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e dirEntry) Info() (fs.FileInfo, error) {
+	return e.fs.stat(e.name)
+}
+
+// Struct fileInfo implements fs.FileInfo. Files are read-only and have no modification time.
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i fileInfo) Name() string {
+	return i.name
+}
+
+func (i fileInfo) Size() int64 {
+	return i.size
+}
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i fileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (i fileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i fileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,66 @@
+package cafs_test
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io/fs"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	s := ram.NewRamStorage(1 << 20)
+	r := rand.New(rand.NewSource(0))
+	contents := map[string][]byte{
+		"index.html":          []byte("<html></html>"),
+		"empty":               nil,
+		"static/data.bin":     randomBytes(r, 200000),
+		"static/css/site.css": []byte("body {}"),
+		"static/copy.bin":     nil,
+	}
+	contents["static/copy.bin"] = contents["static/data.bin"]
+
+	manifest := make(map[string]SKey)
+	for p, data := range contents {
+		f, err := Ingest(s, bytes.NewReader(data), p)
+		if err != nil {
+			t.Fatalf("Error ingesting %v: %v", p, err)
+		}
+		defer f.Dispose()
+		manifest[p] = f.Key()
+	}
+	// Invalid paths are ignored
+	manifest["../outside"] = manifest["index.html"]
+	manifest["/absolute"] = manifest["index.html"]
+
+	lockedBefore := s.GetUsageInfo().Locked
+	fsys := FS(s, manifest)
+	if err := fstest.TestFS(fsys, "index.html", "empty", "static/data.bin", "static/css/site.css", "static/copy.bin"); err != nil {
+		t.Fatal(err)
+	}
+	for p, data := range contents {
+		if read, err := fs.ReadFile(fsys, p); err != nil {
+			t.Errorf("Error reading %v: %v", p, err)
+		} else if !bytes.Equal(read, data) {
+			t.Errorf("Content of %v differs", p)
+		}
+	}
+	if _, err := fsys.Open("../outside"); err == nil {
+		t.Errorf("Expected error opening invalid path")
+	}
+
+	// Files missing from storage don't exist
+	var missing SKey
+	missing[0] = 1
+	manifest = map[string]SKey{"missing": missing}
+	if _, err := FS(s, manifest).Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+	// All files opened have been disposed
+	if locked := s.GetUsageInfo().Locked; locked != lockedBefore {
+		t.Errorf("Expected %v locked bytes, got %v", lockedBefore, locked)
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/indyjo/cafs
 
-go 1.12
+go 1.18
+
+require github.com/klauspost/compress v1.10.11
@@ -0,0 +1,189 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"context"
+	"fmt"
+	"github.com/indyjo/cafs/chunking"
+	"io"
+)
+
+// Function Ingest reads all data from `r` into a new file in `storage`, tagged with `info`.
+// On success, returns the file, which must be disposed by the caller. On error, the temporary
+// file is disposed so that no storage space remains locked.
+func Ingest(storage FileStorage, r io.Reader, info string) (File, error) {
+	return IngestContext(context.Background(), storage, r, info)
+}
+
+// Function IngestContext works like Ingest, but stops reading from `r` as soon as `ctx` is done,
+// in which case the temporary file is disposed and ctx.Err() is returned. The context is checked
+// between reads, so a read blocking on `r` isn't interrupted.
+func IngestContext(ctx context.Context, storage FileStorage, r io.Reader, info string) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	temp := storage.Create(info)
+	defer temp.Dispose()
+	if _, err := io.Copy(temp, contextReader{ctx, r}); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+// Struct contextReader wraps a Reader, failing with the context's error once it is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Struct IngestState records the progress of IngestResumable, allowing an interrupted ingestion
+// to be resumed.
+type IngestState struct {
+	Chunks []IngestedChunk // The chunks stored so far, in order of occurrence
+}
+
+// Struct IngestedChunk describes a chunk stored by IngestResumable.
+type IngestedChunk struct {
+	Key  SKey
+	Size int64
+}
+
+// Returns the number of bytes covered by the chunks stored so far.
+func (s *IngestState) Offset() int64 {
+	var offset int64
+	for _, c := range s.Chunks {
+		offset += c.Size
+	}
+	return offset
+}
+
+// Function IngestResumable works like Ingest, but stores each chunk into `storage` as soon as it
+// is complete, recording its progress in `state`. If interrupted by an error, calling it again with
+// the same state skips the part of `r` whose chunks are still present in storage. Only a single chunk
+// is buffered at a time, so arbitrarily large inputs can be ingested.
+// Pass a pointer to a zero IngestState for starting a new ingestion.
+func IngestResumable(storage FileStorage, r io.ReadSeeker, info string, state *IngestState) (File, error) {
+	// Lock the chunks stored previously, stopping at the first one that has been evicted meanwhile.
+	var chunks []File
+	defer func() {
+		for _, c := range chunks {
+			c.Dispose()
+		}
+	}()
+	for i, c := range state.Chunks {
+		key := c.Key
+		f, err := storage.Get(&key)
+		if err != nil {
+			state.Chunks = state.Chunks[:i]
+			break
+		}
+		chunks = append(chunks, f)
+	}
+
+	if _, err := r.Seek(state.Offset(), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Split the remaining data into chunks, storing each of them on completion.
+	chunker := chunking.New()
+	var temp Temporary
+	var size int64
+	defer func() {
+		if temp != nil {
+			temp.Dispose()
+		}
+	}()
+	storeChunk := func() error {
+		if err := temp.Close(); err != nil {
+			return err
+		}
+		f := temp.File()
+		chunks = append(chunks, f)
+		state.Chunks = append(state.Chunks, IngestedChunk{Key: f.Key(), Size: size})
+		temp.Dispose()
+		temp = nil
+		return nil
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		data := buf[:n]
+		for len(data) > 0 {
+			if temp == nil {
+				temp = storage.Create(fmt.Sprintf("%v #%d", info, len(state.Chunks)))
+				size = 0
+			}
+			l := chunker.Scan(data)
+			if _, err := temp.Write(data[:l]); err != nil {
+				return nil, err
+			}
+			size += int64(l)
+			data = data[l:]
+			if len(data) > 0 {
+				// A chunk boundary was found
+				if err := storeChunk(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if temp != nil {
+		if err := storeChunk(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Assemble the file from its chunks
+	file := storage.Create(info)
+	defer file.Dispose()
+	for _, c := range chunks {
+		if err := appendFile(file, c); err != nil {
+			return nil, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return file.File(), nil
+}
+
+// Function appendFile appends the contents of `f` to `w`.
+func appendFile(w io.Writer, f File) error {
+	r := f.Open()
+	_, err := io.Copy(w, r)
+	if errClose := r.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,227 @@
+package cafs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestIngest(t *testing.T) {
+	s := ram.NewRamStorage(1 << 20)
+	r := rand.New(rand.NewSource(0))
+	for _, size := range []int{0, 100, 200000} {
+		data := randomBytes(r, size)
+		f, err := Ingest(s, bytes.NewReader(data), "ingested")
+		if err != nil {
+			t.Fatalf("Error ingesting %d bytes: %v", size, err)
+		}
+		if f.Size() != int64(size) {
+			t.Errorf("Expected size %d, got %d", size, f.Size())
+		}
+		rc := f.Open()
+		read, err := ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("Data read differs from data ingested (%d bytes)", size)
+		}
+		f.Dispose()
+	}
+	assertNothingLocked(t, s)
+}
+
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+func TestIngestReadError(t *testing.T) {
+	s := ram.NewRamStorage(1 << 20)
+	errRead := errors.New("read error")
+	data := randomBytes(rand.New(rand.NewSource(0)), 200000)
+	f, err := Ingest(s, &failingReader{bytes.NewReader(data), errRead}, "failing")
+	if err != errRead {
+		t.Errorf("Expected read error, got: %v", err)
+	}
+	if f != nil {
+		t.Errorf("Expected no file to be returned")
+	}
+	assertNothingLocked(t, s)
+}
+
+func TestIngestNotEnoughSpace(t *testing.T) {
+	s := ram.NewRamStorage(64 * 1024)
+	data := randomBytes(rand.New(rand.NewSource(0)), 200000)
+	f, err := Ingest(s, bytes.NewReader(data), "too large")
+	if err != ErrNotEnoughSpace {
+		t.Errorf("Expected ErrNotEnoughSpace, got: %v", err)
+	}
+	if f != nil {
+		t.Errorf("Expected no file to be returned")
+	}
+	assertNothingLocked(t, s)
+}
+
+// Struct cancellingReader wraps a Reader, calling `cancel` once `limit` bytes have been read.
+type cancellingReader struct {
+	r      io.Reader
+	limit  int64
+	read   int64
+	cancel context.CancelFunc
+}
+
+func (c *cancellingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.read >= c.limit {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestIngestContextCancelled(t *testing.T) {
+	s := ram.NewRamStorage(1 << 20)
+	data := randomBytes(rand.New(rand.NewSource(0)), 500000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancellingReader{r: bytes.NewReader(data), limit: 100000, cancel: cancel}
+	f, err := IngestContext(ctx, s, r, "cancelled")
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if f != nil {
+		t.Errorf("Expected no file to be returned")
+	}
+	if r.read >= int64(len(data)) {
+		t.Errorf("Expected copying to stop early, but all %d bytes were read", r.read)
+	}
+	assertNothingLocked(t, s)
+
+	// Ingesting with a context that is already done doesn't read at all
+	r = &cancellingReader{r: bytes.NewReader(data), limit: 1, cancel: cancel}
+	if _, err := IngestContext(ctx, s, r, "cancelled"); err != context.Canceled || r.read != 0 {
+		t.Errorf("Expected context.Canceled without reading, got: %v after %d bytes", err, r.read)
+	}
+	assertNothingLocked(t, s)
+}
+
+func assertNothingLocked(t *testing.T, s BoundedStorage) {
+	s.FreeCache()
+	if locked := s.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got: %v", locked)
+	}
+}
+
+// Struct interruptingReader wraps a ReadSeeker, failing once `limit` bytes have been read and
+// counting the number of bytes read.
+type interruptingReader struct {
+	r     io.ReadSeeker
+	limit int64
+	read  int64
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func (i *interruptingReader) Read(p []byte) (int, error) {
+	if i.limit >= 0 && i.read >= i.limit {
+		return 0, errInterrupted
+	}
+	if i.limit >= 0 && int64(len(p)) > i.limit-i.read {
+		p = p[:i.limit-i.read]
+	}
+	n, err := i.r.Read(p)
+	i.read += int64(n)
+	return n, err
+}
+
+func (i *interruptingReader) Seek(offset int64, whence int) (int64, error) {
+	return i.r.Seek(offset, whence)
+}
+
+func TestIngestResumable(t *testing.T) {
+	s := ram.NewRamStorage(4 << 20)
+	data := randomBytes(rand.New(rand.NewSource(0)), 1<<20)
+
+	// Ingest the whole file in one go for reference
+	expected, err := Ingest(s, bytes.NewReader(data), "reference")
+	if err != nil {
+		t.Fatalf("Error in Ingest: %v", err)
+	}
+	expected.Dispose()
+	s.FreeCache()
+
+	var state IngestState
+	r := &interruptingReader{r: bytes.NewReader(data), limit: 600000}
+	if _, err := IngestResumable(s, r, "resumable", &state); err != errInterrupted {
+		t.Fatalf("Expected ingestion to be interrupted, got: %v", err)
+	}
+	offset := state.Offset()
+	if len(state.Chunks) == 0 || offset > 600000 {
+		t.Fatalf("Unexpected state after interruption: %d chunks, offset %d", len(state.Chunks), offset)
+	}
+	// Chunks must have been released, but not evicted
+	if locked := s.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got: %v", locked)
+	}
+
+	// Resume. Only the data following the chunks already stored must be read.
+	r = &interruptingReader{r: bytes.NewReader(data), limit: -1}
+	f, err := IngestResumable(s, r, "resumable", &state)
+	if err != nil {
+		t.Fatalf("Error resuming ingestion: %v", err)
+	}
+	if r.read != int64(len(data))-offset {
+		t.Errorf("Expected %d bytes to be read on resume, got %d", int64(len(data))-offset, r.read)
+	}
+	if f.Key() != expected.Key() {
+		t.Errorf("Expected key %v, got %v", expected.Key(), f.Key())
+	}
+	if state.Offset() != int64(len(data)) {
+		t.Errorf("Expected state to cover %d bytes, got %d", len(data), state.Offset())
+	}
+	f.Dispose()
+	assertNothingLocked(t, s)
+}
+
+func TestIngestResumableAfterEviction(t *testing.T) {
+	s := ram.NewRamStorage(4 << 20)
+	data := randomBytes(rand.New(rand.NewSource(0)), 1<<20)
+
+	var state IngestState
+	r := &interruptingReader{r: bytes.NewReader(data), limit: 600000}
+	if _, err := IngestResumable(s, r, "resumable", &state); err != errInterrupted {
+		t.Fatalf("Expected ingestion to be interrupted, got: %v", err)
+	}
+
+	// Evict all chunks, so that ingestion has to start over
+	s.FreeCache()
+	r = &interruptingReader{r: bytes.NewReader(data), limit: -1}
+	f, err := IngestResumable(s, r, "resumable", &state)
+	if err != nil {
+		t.Fatalf("Error resuming ingestion: %v", err)
+	}
+	if r.read != int64(len(data)) {
+		t.Errorf("Expected %d bytes to be read, got %d", len(data), r.read)
+	}
+	if f.Size() != int64(len(data)) {
+		t.Errorf("Expected size %d, got %d", len(data), f.Size())
+	}
+	f.Dispose()
+	assertNothingLocked(t, s)
+}
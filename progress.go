@@ -0,0 +1,64 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import "io"
+
+// Readers returned by File.OpenWithProgress report progress whenever at least this many bytes have
+// been read since the last report.
+const ProgressInterval = 64 * 1024
+
+// Function NewProgressReader wraps `r` such that `cb` is called with the total number of bytes
+// read so far, at least every ProgressInterval bytes and once more when the end of the stream
+// is reached or the reader is closed, whichever happens first. Consumers that stop at a known
+// length, like http.ServeContent, never see the end of the stream. See File.OpenWithProgress.
+func NewProgressReader(r io.ReadCloser, cb func(read int64)) io.ReadCloser {
+	return &progressReader{r: r, cb: cb}
+}
+
+// Struct progressReader implements the io.ReadCloser returned by NewProgressReader.
+type progressReader struct {
+	r        io.ReadCloser
+	cb       func(read int64)
+	read     int64
+	reported int64
+	eof      bool
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if err == io.EOF && !p.eof {
+		p.eof = true
+		p.report()
+	} else if p.read-p.reported >= ProgressInterval {
+		p.report()
+	}
+	return n, err
+}
+
+func (p *progressReader) report() {
+	p.reported = p.read
+	p.cb(p.read)
+}
+
+func (p *progressReader) Close() error {
+	if p.read > p.reported {
+		p.report()
+	}
+	return p.r.Close()
+}
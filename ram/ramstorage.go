@@ -20,13 +20,14 @@ package ram
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	. "github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/chunking"
 	"hash"
 	"io"
 	"log"
+	"strings"
 	"sync"
 )
 
@@ -35,6 +36,8 @@ type ramStorage struct {
 	entries             map[SKey]*ramEntry
 	bytesUsed, bytesMax int64
 	bytesLocked         int64
+	bytesPinned         int64
+	bytesOverhead       int64
 	youngest, oldest    SKey
 }
 
@@ -60,6 +63,12 @@ type ramEntry struct {
 	// Holds a list of chunk positions if entry is of chunk list type
 	chunks []chunkRef
 	refs   int
+	// Set by Pin. A pinned entry holds one of the references counted in refs.
+	pinned bool
+	// Set by MarkCorrupt. The data is replaced when the entry is stored again.
+	corrupt bool
+	// Metadata set using SetMeta, not counted as storage size
+	meta map[string]string
 }
 
 type ramDataReader struct {
@@ -77,15 +86,15 @@ type ramChunkReader struct {
 }
 
 type ramTemporary struct {
-	storage   *ramStorage
-	info      string           // Info text given by user identifying the current file
-	buffer    bytes.Buffer     // Stores bytes since beginning of current chunk
-	fileHash  hash.Hash        // hash since the beginning of the file
-	chunkHash hash.Hash        // hash since the beginning of the current chunk
-	valid     bool             // If false, something has gone wrong
-	open      bool             // Set to false on Close()
-	chunker   chunking.Chunker // Determines chunk boundaries
-	chunks    []chunkRef       // Grows every time a chunk boundary is encountered
+	storage  *ramStorage
+	info     string           // Info text given by user identifying the current file
+	buffer   bytes.Buffer     // Stores bytes since beginning of current chunk
+	fileHash hash.Hash        // hash since the beginning of the file
+	valid    bool             // If false, something has gone wrong
+	open     bool             // Set to false on Close()
+	chunker  chunking.Chunker // Determines chunk boundaries
+	chunks   []chunkRef       // Grows every time a chunk boundary is encountered
+	expected *SKey            // If not nil, the key the file's content must hash to
 }
 
 func NewRamStorage(maxBytes int64) BoundedStorage {
@@ -98,15 +107,71 @@ func NewRamStorage(maxBytes int64) BoundedStorage {
 func (s *ramStorage) GetUsageInfo() UsageInfo {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	return UsageInfo{Used: s.bytesUsed, Capacity: s.bytesMax, Locked: s.bytesLocked}
+	return UsageInfo{Used: s.bytesUsed, Capacity: s.bytesMax, Locked: s.bytesLocked, Pinned: s.bytesPinned,
+		Overhead: s.bytesOverhead}
+}
+
+func (s *ramStorage) Pin(key SKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if !entry.pinned {
+		entry.pinned = true
+		s.bytesPinned += entry.storageSize()
+		s.lock(&key, entry)
+	}
+	return nil
+}
+
+func (s *ramStorage) Unpin(key SKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if entry.pinned {
+		entry.pinned = false
+		s.bytesPinned -= entry.storageSize()
+		s.release(&key, entry)
+	}
+	return nil
 }
 
 func (s *ramStorage) FreeCache() int64 {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	oldBytesUsed := s.bytesUsed
-	s.reserveBytes("FreeCache", s.bytesMax)
-	return oldBytesUsed - s.bytesUsed
+	return s.freeCacheBytes(s.bytesUsed)
+}
+
+func (s *ramStorage) FreeCacheBytes(target int64) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.freeCacheBytes(target)
+}
+
+func (s *ramStorage) SetCapacity(capacity int64) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bytesMax = capacity
+	return s.freeCacheBytes(s.bytesUsed - capacity)
+}
+
+// Evicts unlocked entries, least recently used first, until at least `target` bytes have been
+// freed. Must happen while mutex is held.
+func (s *ramStorage) freeCacheBytes(target int64) int64 {
+	var freed int64
+	for freed < target {
+		if n, ok := s.evictOldest("FreeCache"); ok {
+			freed += n
+		} else {
+			break
+		}
+	}
+	return freed
 }
 
 func (s *ramStorage) Get(key *SKey) (File, error) {
@@ -128,19 +193,107 @@ func (s *ramStorage) Get(key *SKey) (File, error) {
 	return nil, nil // never reached
 }
 
+func (s *ramStorage) Has(key SKey) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.entries[key]
+	return ok
+}
+
+func (s *ramStorage) GetByPrefix(prefix string) (File, error) {
+	if len(prefix) > hex.EncodedLen(KeySize) {
+		return nil, ErrInvalidKey
+	}
+	p := []byte(strings.ToLower(prefix))
+	for _, c := range p {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return nil, ErrInvalidKey
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var found *SKey
+	var buf [2 * KeySize]byte
+	for key := range s.entries {
+		hex.Encode(buf[:], key[:])
+		if !bytes.HasPrefix(buf[:], p) {
+			continue
+		}
+		if found != nil {
+			return nil, ErrAmbiguousPrefix
+		}
+		k := key
+		found = &k
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	entry := s.entries[*found]
+	s.lock(found, entry)
+	return &ramFile{s, *found, entry, false}, nil
+}
+
+func (s *ramStorage) SetMeta(key SKey, meta map[string]string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return ErrNotFound
+	}
+	entry.meta = copyMeta(meta)
+	return nil
+}
+
+func (s *ramStorage) GetMeta(key SKey) (map[string]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyMeta(entry.meta), nil
+}
+
+func (s *ramStorage) Keys() []SKey {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]SKey, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	result := make(map[string]string, len(meta))
+	for k, v := range meta {
+		result[k] = v
+	}
+	return result
+}
+
 func (s *ramStorage) Create(info string) Temporary {
 	return &ramTemporary{
-		storage:   s,
-		info:      info,
-		fileHash:  sha256.New(),
-		chunkHash: sha256.New(),
-		valid:     true,
-		open:      true,
-		chunker:   chunking.New(),
-		chunks:    make([]chunkRef, 0, 16),
+		storage:  s,
+		info:     info,
+		fileHash: NewKeyHash(),
+		valid:    true,
+		open:     true,
+		chunker:  chunking.New(),
+		chunks:   make([]chunkRef, 0, 16),
 	}
 }
 
+func (s *ramStorage) CreateWithKey(info string, expected SKey) Temporary {
+	t := s.Create(info).(*ramTemporary)
+	t.expected = &expected
+	return t
+}
+
 func (s *ramStorage) DumpStatistics(log Printer) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -157,10 +310,10 @@ func (s *ramStorage) DumpStatistics(log Printer) {
 	}
 
 	log.Printf("<html><head><title>CAFS Statistics</title></head><body><pre>")
-	log.Printf("Bytes used: %d, locked: %d, oldest: %x, youngest: %x", s.bytesUsed, s.bytesLocked, s.oldest[:4], s.youngest[:4])
+	log.Printf("Bytes used: %d, locked: %d, pinned: %d, oldest: %x, youngest: %x", s.bytesUsed, s.bytesLocked, s.bytesPinned, s.oldest[:4], s.youngest[:4])
 	for key, entry := range s.entries {
-		log.Printf("<a name=\"%v\">  [%v] refs=%d size=%v [%v] %v (older) %v (younger)</a>",
-			key, link(key, 4, false), entry.refs, entry.storageSize(), entry.info,
+		log.Printf("<a name=\"%v\">  [%v] refs=%d pinned=%v size=%v [%v] %v (older) %v (younger)</a>",
+			key, link(key, 4, false), entry.refs, entry.pinned, entry.storageSize(), entry.info,
 			link(entry.older, 4, true), link(entry.younger, 4, true))
 
 		prevPos := int64(0)
@@ -183,44 +336,57 @@ func (s *ramStorage) reserveBytes(info string, numBytes int64) error {
 			info, numBytes-bytesFree, s.bytesUsed-s.bytesLocked, numBytes)
 	}
 	for bytesFree < numBytes {
-		oldestKey := s.oldest
-		oldestEntry := s.entries[oldestKey]
-		if oldestEntry == nil {
+		if n, ok := s.evictOldest(info); ok {
+			bytesFree += n
+		} else {
 			return ErrNotEnoughSpace
 		}
-		s.removeFromChain(&s.oldest, oldestEntry)
-		delete(s.entries, oldestKey)
+	}
+	return nil
+}
 
-		oldLocked := s.bytesLocked
-		// Dereference all referenced chunks
-		for _, chunk := range oldestEntry.chunks {
-			s.release(&chunk.key, s.entries[chunk.key])
-		}
-		oldestSize := oldestEntry.storageSize()
-		s.bytesUsed -= oldestSize
-		bytesFree += oldestSize
-		if LoggingEnabled {
-			log.Printf("[%v]   Deleted object of size %v bytes: [%v] %v", info, oldestSize, oldestEntry.info, oldestKey)
-			if oldLocked != s.bytesLocked {
-				log.Printf("       -> unlocked %d bytes", oldLocked-s.bytesLocked)
-			}
+// Removes the least recently used unlocked entry, returning its size. Returns false if there is
+// no unlocked entry.
+func (s *ramStorage) evictOldest(info string) (int64, bool) {
+	oldestKey := s.oldest
+	oldestEntry := s.entries[oldestKey]
+	if oldestEntry == nil {
+		return 0, false
+	}
+	s.removeFromChain(&s.oldest, oldestEntry)
+	delete(s.entries, oldestKey)
+
+	oldLocked := s.bytesLocked
+	// Dereference all referenced chunks
+	for _, chunk := range oldestEntry.chunks {
+		s.release(&chunk.key, s.entries[chunk.key])
+	}
+	oldestSize := oldestEntry.storageSize()
+	s.bytesUsed -= oldestSize
+	s.bytesOverhead -= oldestEntry.overhead()
+	if LoggingEnabled {
+		log.Printf("[%v]   Deleted object of size %v bytes: [%v] %v", info, oldestSize, oldestEntry.info, oldestKey)
+		if oldLocked != s.bytesLocked {
+			log.Printf("       -> unlocked %d bytes", oldLocked-s.bytesLocked)
 		}
 	}
-	return nil
+	return oldestSize, true
 }
 
-// Puts an entry into the store. If an entry already exists, it must be identical to the old one.
+// Puts an entry into the store. If an entry already exists, it must be identical to the old one,
+// unless it has been marked corrupt, in which case its data is replaced.
 // The newly-created or recycled entry has been lock'ed once and must be release'd properly.
+// Must happen while mutex is held.
 func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info string) error {
 	if len(data) > 0 && len(chunks) > 0 {
 		panic("Illegal entry")
 	}
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
 
 	// Detect if we're re-writing the same data (or even handle a hash collision)
 	var newEntry *ramEntry
-	if oldEntry := s.entries[*key]; oldEntry != nil {
+	if oldEntry := s.entries[*key]; oldEntry != nil && oldEntry.corrupt && len(chunks) == 0 {
+		return s.repairEntry(key, oldEntry, data, info)
+	} else if oldEntry != nil {
 		if len(oldEntry.data) != len(data) || len(oldEntry.chunks) != len(chunks) {
 			panic(fmt.Sprintf("[%v] Key collision: %v [%v]", info, key, oldEntry.info))
 		}
@@ -253,6 +419,7 @@ func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info
 
 		s.entries[*key] = newEntry
 		s.bytesUsed += newEntry.storageSize()
+		s.bytesOverhead += newEntry.overhead()
 		s.bytesLocked += newEntry.storageSize()
 		if LoggingEnabled {
 			log.Printf("[%v] Stored key: %v (data: %d bytes, chunks: %d)", info, key, len(data), len(chunks))
@@ -262,6 +429,42 @@ func (s *ramStorage) storeEntry(key *SKey, data []byte, chunks []chunkRef, info
 	return nil
 }
 
+// Replaces the data of an entry marked corrupt, accounting for a change in size. Like storeEntry,
+// locks the entry once. Must happen while mutex is held.
+func (s *ramStorage) repairEntry(key *SKey, entry *ramEntry, data []byte, info string) error {
+	if LoggingEnabled {
+		log.Printf("[%v] Repairing corrupt data of key: %v [%v]", info, key, entry.info)
+	}
+	// Locking first prevents the entry from being evicted while reserving space
+	s.lock(key, entry)
+	delta := int64(len(data) - len(entry.data))
+	if delta > 0 {
+		if err := s.reserveBytes(info, delta); err != nil {
+			s.release(key, entry)
+			return err
+		}
+	}
+	entry.data = data
+	entry.corrupt = false
+	s.bytesUsed += delta
+	s.bytesLocked += delta
+	if entry.pinned {
+		s.bytesPinned += delta
+	}
+	return nil
+}
+
+func (s *ramStorage) MarkCorrupt(key SKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return ErrNotFound
+	}
+	entry.corrupt = true
+	return nil
+}
+
 func (s *ramStorage) removeFromChain(key *SKey, entry *ramEntry) {
 	if youngerEntry := s.entries[entry.younger]; youngerEntry != nil {
 		youngerEntry.older = entry.older
@@ -328,13 +531,23 @@ const entrySize = 112
 const chunkSize = 40
 
 func (e *ramEntry) storageSize() int64 {
-	return int64(entrySize + len(e.data) + chunkSize*len(e.chunks))
+	return int64(len(e.data)) + e.overhead()
+}
+
+// Returns the part of the storage size not occupied by content: The entry itself and, for a
+// chunked file, the references to its chunks, whose content is accounted for by their own entries.
+func (e *ramEntry) overhead() int64 {
+	return int64(entrySize + chunkSize*len(e.chunks))
 }
 
 func (f *ramFile) Key() SKey {
 	return f.key
 }
 
+func (f *ramFile) OpenWithProgress(cb func(read int64)) io.ReadCloser {
+	return NewProgressReader(f.Open(), cb)
+}
+
 func (f *ramFile) Open() io.ReadCloser {
 	if len(f.entry.chunks) > 0 {
 		f.storage.lockL(&f.key, f.entry)
@@ -504,6 +717,9 @@ func (r *ramChunkReader) Read(b []byte) (n int, err error) {
 	if r.closed {
 		err = ErrInvalidState
 		return
+	} else if len(b) == 0 {
+		// The loop below would never end
+		return
 	}
 	for n == 0 && err == nil {
 		if r.dataReader == nil {
@@ -546,8 +762,9 @@ func (r *ramChunkReader) Close() (err error) {
 	return
 }
 
-// Writes the current buffer into a new chunk and resets the buffer.
-// Assumes that chunkHash has already been updated.
+// Stores the current buffer as a chunk and resets the buffer. The storage's mutex is held only
+// while storing the chunk, not while hashing it, so that independent temporaries can be written
+// concurrently.
 func (t *ramTemporary) flushBufferIntoChunk() error {
 	if t.buffer.Len() == 0 {
 		return nil
@@ -557,29 +774,31 @@ func (t *ramTemporary) flushBufferIntoChunk() error {
 	chunkInfo := fmt.Sprintf("%v #%d", t.info, len(t.chunks))
 	chunkData := make([]byte, t.buffer.Len())
 	copy(chunkData, t.buffer.Bytes())
+	t.buffer.Reset()
 
-	// Get the chunk hash
-	var key SKey
-	t.chunkHash.Sum(key[:0])
-	t.chunkHash.Reset()
-
-	if err := t.storage.storeEntry(&key, chunkData, nil, chunkInfo); err != nil {
+	key := KeyOf(chunkData)
+	if err := t.storeEntry(&key, chunkData, nil, chunkInfo); err != nil {
 		return err
 	}
 
 	chunk := chunkRef{
 		key:     key,
-		nextPos: int64(t.buffer.Len()),
+		nextPos: int64(len(chunkData)),
 	}
 	if len(t.chunks) > 0 {
 		chunk.nextPos += t.chunks[len(t.chunks)-1].nextPos
 	}
 	t.chunks = append(t.chunks, chunk)
-
-	t.buffer.Reset()
 	return nil
 }
 
+// Calls storeEntry on the temporary's storage while holding its mutex.
+func (t *ramTemporary) storeEntry(key *SKey, data []byte, chunks []chunkRef, info string) error {
+	t.storage.mutex.Lock()
+	defer t.storage.mutex.Unlock()
+	return t.storage.storeEntry(key, data, chunks, info)
+}
+
 func (t *ramTemporary) Write(b []byte) (int, error) {
 	if !t.valid || !t.open {
 		return 0, ErrInvalidState
@@ -593,7 +812,6 @@ func (t *ramTemporary) Write(b []byte) (int, error) {
 		if _, err := t.buffer.Write(b[:nBoundary]); err != nil {
 			return 0, err
 		}
-		t.chunkHash.Write(b[:nBoundary])
 		t.fileHash.Write(b[:nBoundary])
 		if nBoundary < len(b) {
 			// a chunk boundary was detected
@@ -616,14 +834,17 @@ func (t *ramTemporary) Close() error {
 	}
 	t.open = false
 	t.valid = false // only temporary -> set to true on successful end of function
-	var key SKey
-	t.fileHash.Sum(key[:0])
+	key := SumKey(t.fileHash)
+	if t.expected != nil && key != *t.expected {
+		// Chunks stored so far remain locked until Dispose() is called
+		return ErrHashMismatch
+	}
 
 	if len(t.chunks) == 0 {
 		// File is single-chunk
 		data := make([]byte, t.buffer.Len())
 		copy(data, t.buffer.Bytes())
-		if err := t.storage.storeEntry(&key, data, nil, t.info); err != nil {
+		if err := t.storeEntry(&key, data, nil, t.info); err != nil {
 			return err
 		}
 	} else {
@@ -633,7 +854,7 @@ func (t *ramTemporary) Close() error {
 		}
 		finalChunks := make([]chunkRef, len(t.chunks))
 		copy(finalChunks, t.chunks)
-		if err := t.storage.storeEntry(&key, nil, finalChunks, t.info); err != nil {
+		if err := t.storeEntry(&key, nil, finalChunks, t.info); err != nil {
 			return err
 		}
 	}
@@ -642,6 +863,16 @@ func (t *ramTemporary) Close() error {
 }
 
 func (t *ramTemporary) File() File {
+	key := t.Key()
+	file, err := t.storage.Get(&key)
+	if err != nil {
+		// Shouldn't happen
+		panic(err)
+	}
+	return file
+}
+
+func (t *ramTemporary) Key() SKey {
 	if !t.valid {
 		panic(ErrInvalidState)
 	}
@@ -649,15 +880,8 @@ func (t *ramTemporary) File() File {
 		panic(ErrStillOpen)
 	}
 
-	var key SKey
-	t.fileHash.Sum(key[:0])
-
-	file, err := t.storage.Get(&key)
-	if err != nil {
-		// Shouldn't happen
-		panic(err)
-	}
-	return file
+	key := SumKey(t.fileHash)
+	return key
 }
 
 func (t *ramTemporary) Dispose() {
@@ -690,8 +914,7 @@ func (t *ramTemporary) releaseFromStorage() {
 
 	// dereference single-chunk entry if successfully closed
 	if !t.open && t.valid {
-		var key SKey
-		t.fileHash.Sum(key[:0])
+		key := SumKey(t.fileHash)
 		t.storage.release(&key, t.storage.entries[key])
 	} else {
 		// dereference all locked chunks otherwise
@@ -1,10 +1,17 @@
 package ram
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking"
+	"github.com/indyjo/cafs/remotesync"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -41,7 +48,8 @@ func TestEmptyFile(t *testing.T) {
 	if !iter.Next() {
 		t.Fatal("Expected empty file to have at least one chunk")
 	}
-	if iter.Key().String() != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+	// SHA-256 of the empty string, truncated to the key size
+	if iter.Key().String() != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"[:2*KeySize] {
 		t.Fatalf("Unexpected key of empty chunk: %v", iter.Key())
 	}
 	if iter.Next() {
@@ -118,6 +126,269 @@ func TestLRU(t *testing.T) {
 	}
 }
 
+func TestFreeCacheBytes(t *testing.T) {
+	s := NewRamStorage(10000)
+	// Files below the minimum chunk size consist of exactly one chunk
+	f1 := addRandomData(t, s, 100)
+	f1.Dispose()
+	f2 := addRandomData(t, s, 100)
+	f2.Dispose()
+	f3 := addRandomData(t, s, 100)
+	f3.Dispose()
+	f4 := addRandomData(t, s, 100)
+	defer f4.Dispose()
+	entrySize := s.GetUsageInfo().Used/4 - 100
+
+	isStored := func(f File) bool {
+		key := f.Key()
+		if f, err := s.Get(&key); err == nil {
+			f.Dispose()
+			return true
+		}
+		return false
+	}
+
+	// Freeing a few bytes evicts only the least recently used entry
+	if freed := s.FreeCacheBytes(10); freed != 100+entrySize {
+		t.Errorf("Expected %d bytes to be freed, got %d", 100+entrySize, freed)
+	}
+	if isStored(f1) || !isStored(f2) || !isStored(f3) {
+		t.Errorf("Expected exactly the oldest entry to be evicted")
+	}
+
+	// f2 and f3 have been used again, f2 before f3. Locked f4 is never evicted.
+	if freed := s.FreeCacheBytes(150 + entrySize); freed != 2*(100+entrySize) {
+		t.Errorf("Expected %d bytes to be freed, got %d", 2*(100+entrySize), freed)
+	}
+	if isStored(f2) || isStored(f3) || !isStored(f4) {
+		t.Errorf("Expected only the locked entry to remain")
+	}
+	if freed := s.FreeCacheBytes(100); freed != 0 {
+		t.Errorf("Expected nothing to be freed, got %d", freed)
+	}
+	if used := s.GetUsageInfo().Used; used != 100+entrySize {
+		t.Errorf("Expected %d bytes to remain used, got %d", 100+entrySize, used)
+	}
+}
+
+func TestPin(t *testing.T) {
+	s := NewRamStorage(1 << 20)
+	small := addRandomData(t, s, 100)
+	small.Dispose()
+	large := addRandomData(t, s, 200000)
+	large.Dispose()
+	other := addRandomData(t, s, 100)
+	other.Dispose()
+
+	isStored := func(key SKey) bool {
+		if f, err := s.Get(&key); err == nil {
+			f.Dispose()
+			return true
+		}
+		return false
+	}
+
+	for _, key := range []SKey{small.Key(), large.Key()} {
+		if err := s.Pin(key); err != nil {
+			t.Fatalf("Error pinning: %v", err)
+		}
+	}
+	// Pinning twice has no further effect
+	if err := s.Pin(small.Key()); err != nil {
+		t.Fatalf("Error pinning: %v", err)
+	}
+	if err := s.Pin(SKey{}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound when pinning missing key, got %v", err)
+	}
+
+	// Pinned files and the chunks of a pinned file survive FreeCache
+	s.FreeCache()
+	if !isStored(small.Key()) || !isStored(large.Key()) || isStored(other.Key()) {
+		t.Errorf("Expected exactly the pinned files to survive")
+	}
+	iter := large.Chunks()
+	for iter.Next() {
+		if !isStored(iter.Key()) {
+			t.Errorf("Chunk %v of pinned file was evicted", iter.Key())
+		}
+	}
+	iter.Dispose()
+	usage := s.GetUsageInfo()
+	if usage.Pinned == 0 || usage.Pinned > usage.Locked || usage.Locked != usage.Used {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+
+	// Unpinned files may be evicted again
+	if err := s.Unpin(large.Key()); err != nil {
+		t.Fatalf("Error unpinning: %v", err)
+	}
+	if err := s.Unpin(large.Key()); err != nil {
+		t.Fatalf("Error unpinning twice: %v", err)
+	}
+	s.FreeCache()
+	if !isStored(small.Key()) || isStored(large.Key()) {
+		t.Errorf("Expected only the pinned file to survive")
+	}
+	if err := s.Unpin(small.Key()); err != nil {
+		t.Fatalf("Error unpinning: %v", err)
+	}
+	s.FreeCache()
+	if usage := s.GetUsageInfo(); usage.Used != 0 || usage.Locked != 0 || usage.Pinned != 0 {
+		t.Errorf("Expected storage to be empty, got: %+v", usage)
+	}
+	if err := s.Unpin(small.Key()); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound when unpinning evicted key, got %v", err)
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	s := NewRamStorage(1 << 20)
+	f := addRandomData(t, s, 200000)
+	n := int64(f.NumChunks())
+	if n < 2 {
+		t.Fatalf("Expected a chunked file, got %d chunks", n)
+	}
+
+	// One entry per chunk, plus one entry for the file referencing all of its chunks
+	usage := s.GetUsageInfo()
+	expected := (n+1)*entrySize + n*chunkSize
+	if usage.Overhead != expected {
+		t.Errorf("Expected overhead of %d bytes, got %d", expected, usage.Overhead)
+	}
+	if content := usage.Used - usage.Overhead; content != f.Size() {
+		t.Errorf("Expected %d bytes of content, got %d", f.Size(), content)
+	}
+
+	f.Dispose()
+	s.FreeCache()
+	if usage := s.GetUsageInfo(); usage.Used != 0 || usage.Overhead != 0 {
+		t.Errorf("Expected storage to be empty, got: %+v", usage)
+	}
+}
+
+func TestGetByPrefix(t *testing.T) {
+	s := NewRamStorage(1 << 20)
+	var files []File
+	byFirstDigit := make(map[byte][]File)
+	for i := 0; i < 40; i++ {
+		f := addRandomData(t, s, 100)
+		defer f.Dispose()
+		files = append(files, f)
+		d := f.Key().String()[0]
+		byFirstDigit[d] = append(byFirstDigit[d], f)
+	}
+	ps := s.(PrefixStorage)
+
+	// Unique prefixes, including full keys and upper case
+	for _, prefix := range []string{files[0].Key().String(), strings.ToUpper(files[1].Key().String()), files[2].Key().String()[:16]} {
+		f, err := ps.GetByPrefix(prefix)
+		if err != nil {
+			t.Errorf("Error getting %v: %v", prefix, err)
+			continue
+		}
+		if !strings.HasPrefix(f.Key().String(), strings.ToLower(prefix)) {
+			t.Errorf("Got %v for prefix %v", f.Key(), prefix)
+		}
+		f.Dispose()
+	}
+
+	// With 40 keys, some first digit is shared, and some two-digit prefix is unused
+	for d, fs := range byFirstDigit {
+		if len(fs) > 1 {
+			if _, err := ps.GetByPrefix(string(d)); err != ErrAmbiguousPrefix {
+				t.Errorf("Expected ErrAmbiguousPrefix for %c, got: %v", d, err)
+			}
+			break
+		}
+	}
+	if _, err := ps.GetByPrefix(""); err != ErrAmbiguousPrefix {
+		t.Errorf("Expected ErrAmbiguousPrefix for empty prefix, got: %v", err)
+	}
+	used := make(map[string]bool)
+	for _, f := range files {
+		used[f.Key().String()[:2]] = true
+	}
+	for i := 0; i < 256; i++ {
+		if prefix := fmt.Sprintf("%02x", i); !used[prefix] {
+			if _, err := ps.GetByPrefix(prefix); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for %v, got: %v", prefix, err)
+			}
+			break
+		}
+	}
+
+	for _, prefix := range []string{"xyz", "0g", files[0].Key().String() + "0"} {
+		if _, err := ps.GetByPrefix(prefix); err != ErrInvalidKey {
+			t.Errorf("Expected ErrInvalidKey for %v, got: %v", prefix, err)
+		}
+	}
+}
+
+func TestHas(t *testing.T) {
+	s := NewRamStorage(10000)
+	// Files below the minimum chunk size consist of exactly one chunk
+	f1 := addRandomData(t, s, 100)
+	f1.Dispose()
+	f2 := addRandomData(t, s, 100)
+	f2.Dispose()
+	key1, key2 := f1.Key(), f2.Key()
+
+	// Checking f1 neither locks it nor makes it younger than f2
+	if !s.(PresenceStorage).Has(key1) || !Contains(s, key2) {
+		t.Errorf("Expected both files to be present")
+	}
+	if locked := s.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected nothing to be locked, got %d bytes", locked)
+	}
+	s.FreeCacheBytes(10)
+	if Contains(s, key1) || !Contains(s, key2) {
+		t.Errorf("Expected exactly the oldest entry to be evicted")
+	}
+}
+
+func TestSetCapacity(t *testing.T) {
+	s := NewRamStorage(10000)
+	// Files below the minimum chunk size consist of exactly one chunk
+	f1 := addRandomData(t, s, 100)
+	f1.Dispose()
+	f2 := addRandomData(t, s, 100)
+	f2.Dispose()
+	f3 := addRandomData(t, s, 100)
+	defer f3.Dispose()
+	entrySize := s.GetUsageInfo().Used/3 - 100
+
+	// Raising the capacity evicts nothing
+	if freed := s.SetCapacity(20000); freed != 0 {
+		t.Errorf("Expected nothing to be freed, got %d", freed)
+	}
+	if ui := s.GetUsageInfo(); ui.Capacity != 20000 || ui.Used != 3*(100+entrySize) {
+		t.Errorf("Unexpected usage after raising capacity: %v", ui)
+	}
+
+	// Lowering the capacity below usage evicts the least recently used entry
+	if freed := s.SetCapacity(250 + 2*entrySize); freed != 100+entrySize {
+		t.Errorf("Expected %d bytes to be freed, got %d", 100+entrySize, freed)
+	}
+	key1, key2 := f1.Key(), f2.Key()
+	if f, err := s.Get(&key1); err == nil {
+		f.Dispose()
+		t.Errorf("Expected oldest entry to be evicted")
+	}
+	if f, err := s.Get(&key2); err != nil {
+		t.Errorf("Expected younger entry to remain")
+	} else {
+		f.Dispose()
+	}
+
+	// Locked data is kept even if it exceeds the capacity
+	if freed := s.SetCapacity(50); freed != 100+entrySize {
+		t.Errorf("Expected %d bytes to be freed, got %d", 100+entrySize, freed)
+	}
+	if ui := s.GetUsageInfo(); ui.Capacity != 50 || ui.Used != 100+entrySize || ui.Locked != ui.Used {
+		t.Errorf("Unexpected usage after lowering capacity below locked data: %v", ui)
+	}
+}
+
 func TestCompression(t *testing.T) {
 	s := NewRamStorage(1000000)
 	f1 := addData(t, s, 1000001)
@@ -182,6 +453,259 @@ func TestRefCounting(t *testing.T) {
 	addRandomData(t, _s, 70*1024)
 }
 
+func TestOpenWithProgress(t *testing.T) {
+	s := NewRamStorage(4000000)
+	for _, size := range []int{0, 1000, 1000000} {
+		f := addRandomData(t, s, size)
+		var reports []int64
+		r := f.OpenWithProgress(func(read int64) {
+			reports = append(reports, read)
+		})
+		buf := make([]byte, 1000)
+		var total int64
+		for {
+			n, err := r.Read(buf)
+			total += int64(n)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Error reading: %v", err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("Error closing: %v", err)
+		}
+		f.Dispose()
+
+		if total != int64(size) {
+			t.Fatalf("Read %d bytes instead of %d", total, size)
+		}
+		if len(reports) == 0 || reports[len(reports)-1] != total {
+			t.Fatalf("Size %d: expected last report to be %d, got %v", size, total, reports)
+		}
+		var last int64
+		for _, read := range reports[:len(reports)-1] {
+			if read-last < ProgressInterval || read-last >= ProgressInterval+int64(len(buf)) {
+				t.Fatalf("Size %d: unexpected progress interval from %d to %d", size, last, read)
+			}
+			last = read
+		}
+	}
+}
+
+func TestReadEmptyBuffer(t *testing.T) {
+	s := NewRamStorage(4000000)
+	f := addRandomData(t, s, 1000000)
+	defer f.Dispose()
+	r := f.Open()
+	defer r.Close()
+	if n, err := r.Read(nil); n != 0 || err != nil {
+		t.Errorf("Expected empty read to return 0 and no error, got %v and %v", n, err)
+	}
+}
+
+// Tests that a chunk corrupted in storage is repaired by transferring it from a remote, when
+// verifying present chunks.
+func TestVerifyPresentChunksRepairs(t *testing.T) {
+	data := make([]byte, 200000)
+	rand.Read(data)
+	storeA := NewRamStorage(1 << 20)
+	storeB := NewRamStorage(1 << 20)
+	fileA, err := Ingest(storeA, bytes.NewReader(data), "original")
+	if err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	defer fileA.Dispose()
+	fileB, err := Ingest(storeB, bytes.NewReader(data), "copy")
+	if err != nil {
+		t.Fatalf("Error ingesting: %v", err)
+	}
+	defer fileB.Dispose()
+
+	// Corrupt the second chunk of storage B's copy
+	iter := fileB.Chunks()
+	iter.Next()
+	iter.Next()
+	key := iter.Key()
+	iter.Dispose()
+	storeB.(*ramStorage).entries[key].data[0] ^= 1
+	if read := readAll(t, fileB); bytes.Equal(read, data) {
+		t.Fatalf("Expected corrupted content")
+	}
+
+	syncinf := &remotesync.SyncInfo{}
+	syncinf.SetTrivialPermutation()
+	if err := syncinf.SetChunksFromFile(fileA); err != nil {
+		t.Fatalf("Error computing chunks: %v", err)
+	}
+	builder := remotesync.NewBuilder(storeB, syncinf, 8, "repaired").
+		WithVerifyPresentChunks(true).
+		WithStandaloneWishList()
+	defer builder.Dispose()
+	var wishlist, chunkData bytes.Buffer
+	if err := builder.WriteWishList(remotesync.NopFlushWriter{W: &wishlist}); err != nil {
+		t.Fatalf("Error writing wishlist: %v", err)
+	}
+	chunks := remotesync.ChunksOfFile(fileA)
+	defer chunks.Dispose()
+	if err := syncinf.WriteChunkData(context.Background(), chunks, &wishlist, remotesync.NopFlushWriter{W: &chunkData}, nil); err != nil {
+		t.Fatalf("Error writing chunk data: %v", err)
+	}
+	fileC, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+	if err != nil {
+		t.Fatalf("Error reconstructing: %v", err)
+	}
+	defer fileC.Dispose()
+
+	// The chunk has been replaced in storage, so that the corrupted copy is repaired, too
+	if read := readAll(t, fileC); !bytes.Equal(read, data) {
+		t.Errorf("Reconstructed file differs")
+	}
+	if read := readAll(t, fileB); !bytes.Equal(read, data) {
+		t.Errorf("Stored copy is still corrupt")
+	}
+}
+
+func TestMarkCorrupt(t *testing.T) {
+	s := NewRamStorage(1 << 20)
+	rs := s.(*ramStorage)
+	data := make([]byte, 100)
+	rand.Read(data)
+	store := func() File {
+		f, err := Ingest(s, bytes.NewReader(data), "data")
+		if err != nil {
+			t.Fatalf("Error ingesting: %v", err)
+		}
+		return f
+	}
+	f := store()
+	key := f.Key()
+	f.Dispose()
+	used := s.GetUsageInfo().Used
+
+	if err := rs.MarkCorrupt(SKey{}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Without being marked corrupt, the entry is reused as is
+	rs.entries[key].data[0] ^= 1
+	f = store()
+	if read := readAll(t, f); bytes.Equal(read, data) {
+		t.Errorf("Expected corrupt entry to be reused")
+	}
+	f.Dispose()
+
+	// Truncate the data, keeping the accounting consistent
+	rs.entries[key].data = rs.entries[key].data[:50]
+	rs.bytesUsed -= 50
+
+	if err := rs.MarkCorrupt(key); err != nil {
+		t.Fatalf("Error marking corrupt: %v", err)
+	}
+	f = store()
+	if read := readAll(t, f); !bytes.Equal(read, data) {
+		t.Errorf("Expected entry to be repaired, read %d bytes", len(read))
+	}
+	if info := s.GetUsageInfo(); info.Used != used || info.Locked != used {
+		t.Errorf("Expected %d bytes used and locked, got %v", used, info)
+	}
+	f.Dispose()
+	if locked := s.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("%d bytes remain locked", locked)
+	}
+}
+
+func readAll(t *testing.T, f File) []byte {
+	r := f.Open()
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	return data
+}
+
+func TestCreateWithKey(t *testing.T) {
+	s := NewRamStorage(200 * 1024)
+	for _, size := range []int{0, 128, 100 * 1024} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(rand.Int())
+		}
+		key := KeyOf(data)
+
+		// Writing the expected content succeeds
+		temp := s.CreateWithKey("Verified", key)
+		if _, err := temp.Write(data); err != nil {
+			t.Fatalf("Error on Write: %v", err)
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatalf("Error on Close: %v", err)
+		}
+		f := temp.File()
+		if f.Key() != key {
+			t.Errorf("Expected key %v, got %v", key, f.Key())
+		}
+		f.Dispose()
+		temp.Dispose()
+		s.FreeCache()
+
+		// Writing different content fails
+		temp = s.CreateWithKey("Tampered", key)
+		if _, err := temp.Write(append(data, 0)); err != nil {
+			t.Fatalf("Error on Write: %v", err)
+		}
+		if err := temp.Close(); err != ErrHashMismatch {
+			t.Errorf("Expected ErrHashMismatch, got: %v", err)
+		}
+		temp.Dispose()
+		if _, err := s.Get(&key); err != ErrNotFound {
+			t.Errorf("Expected no file to be stored under key, got: %v", err)
+		}
+		if locked := s.GetUsageInfo().Locked; locked != 0 {
+			t.Errorf("Expected no bytes to be locked, got: %v", locked)
+		}
+	}
+}
+
+func TestTemporaryKey(t *testing.T) {
+	s := NewRamStorage(200 * 1024)
+	for _, size := range []int{0, 128, 100 * 1024} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(rand.Int())
+		}
+		temp := s.Create(fmt.Sprintf("%v random bytes", size))
+		if _, err := temp.Write(data); err != nil {
+			t.Fatalf("Error on Write: %v", err)
+		}
+		func() {
+			defer func() {
+				if v := recover(); v != ErrStillOpen {
+					t.Errorf("Expected Key() to panic with ErrStillOpen, got: %v", v)
+				}
+			}()
+			temp.Key()
+		}()
+		if err := temp.Close(); err != nil {
+			t.Fatalf("Error on Close: %v", err)
+		}
+		if key := temp.Key(); key != KeyOf(data) {
+			t.Errorf("Unexpected key: %v", key)
+		}
+		f := temp.File()
+		if f.Key() != temp.Key() {
+			t.Errorf("Key of file %v differs from key of temporary %v", f.Key(), temp.Key())
+		}
+		f.Dispose()
+		temp.Dispose()
+		s.FreeCache()
+		if locked := s.GetUsageInfo().Locked; locked != 0 {
+			t.Errorf("Expected no bytes to be locked, got: %v", locked)
+		}
+	}
+}
+
 func addData(t *testing.T, s FileStorage, size int) File {
 	temp := s.Create(fmt.Sprintf("Adding %v bytes object", size))
 	defer temp.Dispose()
@@ -212,3 +736,178 @@ func addRandomData(t *testing.T, s FileStorage, size int) File {
 	}
 	return temp.File()
 }
+
+func TestMeta(t *testing.T) {
+	s := NewRamStorage(200 * 1024)
+	m := s.(MetadataStorage)
+	f := addData(t, s, 100*1024)
+	key := f.Key()
+
+	if meta, err := m.GetMeta(key); err != nil || meta != nil {
+		t.Errorf("Expected no metadata initially, got %v (%v)", meta, err)
+	}
+	meta := map[string]string{"name": "test.bin"}
+	if err := m.SetMeta(key, meta); err != nil {
+		t.Fatalf("Error in SetMeta: %v", err)
+	}
+	// Modifying the map afterwards has no effect
+	meta["name"] = "modified"
+
+	// Metadata survives Get and doesn't influence the key
+	f.Dispose()
+	f2, err := s.Get(&key)
+	if err != nil {
+		t.Fatalf("Error in Get: %v", err)
+	}
+	if f2.Key() != key {
+		t.Errorf("Expected key %v, got %v", key, f2.Key())
+	}
+	if meta, err := m.GetMeta(key); err != nil || meta["name"] != "test.bin" {
+		t.Errorf("Expected metadata to survive Get, got %v (%v)", meta, err)
+	}
+
+	// Metadata is dropped along with the file
+	f2.Dispose()
+	s.FreeCache()
+	if _, err := m.GetMeta(key); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after FreeCache, got: %v", err)
+	}
+	if err := m.SetMeta(key, meta); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing file, got: %v", err)
+	}
+}
+
+func TestConcurrentCreate(t *testing.T) {
+	const numFiles = 32
+	s := NewRamStorage(numFiles << 20)
+	var wg sync.WaitGroup
+	files := make([]File, numFiles)
+	errs := make([]error, numFiles)
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := make([]byte, 64<<10+rand.Intn(64<<10))
+			rand.Read(data)
+			temp := s.Create(fmt.Sprintf("concurrent #%d", i))
+			defer temp.Dispose()
+			for rest := data; len(rest) > 0; {
+				n := 1 + rand.Intn(8192)
+				if n > len(rest) {
+					n = len(rest)
+				}
+				if _, err := temp.Write(rest[:n]); err != nil {
+					errs[i] = err
+					return
+				}
+				rest = rest[n:]
+			}
+			if err := temp.Close(); err != nil {
+				errs[i] = err
+				return
+			}
+			if key := temp.Key(); key != KeyOf(data) {
+				errs[i] = fmt.Errorf("got key %v, expected %v", key, KeyOf(data))
+				return
+			}
+			files[i] = temp.File()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, f := range files {
+		if errs[i] != nil {
+			t.Fatalf("File %d: %v", i, errs[i])
+		}
+		if f.NumChunks() < 2 {
+			t.Errorf("File %d: expected multiple chunks, got %d", i, f.NumChunks())
+		}
+		f.Dispose()
+	}
+	s.FreeCache()
+	if info := s.GetUsageInfo(); info.Locked != 0 || info.Used != 0 {
+		t.Errorf("%d of %d bytes remain locked", info.Locked, info.Used)
+	}
+}
+
+func TestWriteExceedingCapacity(t *testing.T) {
+	const capacity = 1 << 20
+	// Data not yet stored: the current chunk
+	const slack = chunking.MaxChunkSize
+	s := NewRamStorage(capacity)
+	temp := s.Create("too large")
+	defer temp.Dispose()
+	data := make([]byte, 16384)
+	var written int64
+	var err error
+	for written < capacity+slack+capacity {
+		rand.Read(data)
+		var n int
+		if n, err = temp.Write(data); err != nil {
+			break
+		}
+		written += int64(n)
+	}
+	if err != ErrNotEnoughSpace {
+		t.Fatalf("Expected ErrNotEnoughSpace, got %v after writing %d bytes", err, written)
+	}
+	// Chunks must be stored while writing, and not only when closing
+	if written > capacity+slack {
+		t.Errorf("Write failed only after %d bytes, capacity is %d", written, capacity)
+	}
+	if used := s.GetUsageInfo().Used; used > capacity {
+		t.Errorf("%d bytes used, capacity is %d", used, capacity)
+	}
+	temp.Dispose()
+	if locked := s.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("%d bytes remain locked", locked)
+	}
+}
+
+func benchmarkCreate(b *testing.B, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+	s := NewRamStorage(int64(4 * size))
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		temp := s.Create("benchmark")
+		if _, err := temp.Write(data); err != nil {
+			b.Fatalf("Error writing: %v", err)
+		}
+		if err := temp.Close(); err != nil {
+			b.Fatalf("Error closing: %v", err)
+		}
+		temp.Dispose()
+		s.FreeCache()
+	}
+}
+
+func BenchmarkCreate1M(b *testing.B) {
+	benchmarkCreate(b, 1<<20)
+}
+
+func BenchmarkCreate16M(b *testing.B) {
+	benchmarkCreate(b, 16<<20)
+}
+
+func BenchmarkCreateParallel(b *testing.B) {
+	const size = 1 << 20
+	data := make([]byte, size)
+	rand.Read(data)
+	s := NewRamStorage(int64(64 * size))
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			temp := s.Create("benchmark")
+			if _, err := temp.Write(data); err != nil {
+				b.Fatalf("Error writing: %v", err)
+			}
+			if err := temp.Close(); err != nil {
+				b.Fatalf("Error closing: %v", err)
+			}
+			temp.Dispose()
+		}
+	})
+}
@@ -0,0 +1,177 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"bytes"
+	"github.com/indyjo/cafs/chunking"
+	"io"
+	"io/ioutil"
+)
+
+// Struct readerAtFile implements File on top of an io.ReaderAt, without any storage involved.
+type readerAtFile struct {
+	r      io.ReaderAt
+	key    SKey
+	size   int64
+	chunks []readerAtChunk // Empty if the file consists of a single chunk
+}
+
+type readerAtChunk struct {
+	key          SKey
+	offset, size int64
+}
+
+// Function FileFromBytes presents `data` as a File without inserting it into a FileStorage.
+// See FileFromReaderAt. The data must not be modified afterwards.
+func FileFromBytes(data []byte) File {
+	f, err := FileFromReaderAt(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		// Reading from a byte slice doesn't fail
+		panic(err)
+	}
+	return f
+}
+
+// Function FileFromReaderAt presents the first `size` bytes of `r` as a File without inserting
+// them into a FileStorage. The data is read once in order to compute the key and chunk boundaries,
+// which are the same a FileStorage would produce. Afterwards, `r` is read on demand only.
+// Dispose and Duplicate are no-ops.
+func FileFromReaderAt(r io.ReaderAt, size int64) (File, error) {
+	f := &readerAtFile{r: r, size: size}
+	chunker := chunking.New()
+	fileHash := NewKeyHash()
+	chunkHash := NewKeyHash()
+	var chunkStart, pos int64
+	addChunk := func() {
+		c := readerAtChunk{offset: chunkStart, size: pos - chunkStart}
+		c.key = SumKey(chunkHash)
+		chunkHash.Reset()
+		f.chunks = append(f.chunks, c)
+		chunkStart = pos
+	}
+
+	sr := io.NewSectionReader(r, 0, size)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := sr.Read(buf)
+		b := buf[:n]
+		for len(b) > 0 {
+			nBoundary := chunker.Scan(b)
+			fileHash.Write(b[:nBoundary])
+			chunkHash.Write(b[:nBoundary])
+			pos += int64(nBoundary)
+			if nBoundary < len(b) {
+				// a chunk boundary was detected
+				if pos > chunkStart {
+					addChunk()
+				}
+				b = b[nBoundary:]
+			} else {
+				b = nil
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if pos != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if len(f.chunks) > 0 && pos > chunkStart {
+		addChunk()
+	}
+	f.key = SumKey(fileHash)
+	return f, nil
+}
+
+func (f *readerAtFile) Dispose() {}
+
+func (f *readerAtFile) Key() SKey {
+	return f.key
+}
+
+func (f *readerAtFile) Open() io.ReadCloser {
+	return ioutil.NopCloser(io.NewSectionReader(f.r, 0, f.size))
+}
+
+func (f *readerAtFile) OpenWithProgress(cb func(read int64)) io.ReadCloser {
+	return NewProgressReader(f.Open(), cb)
+}
+
+func (f *readerAtFile) Size() int64 {
+	return f.size
+}
+
+func (f *readerAtFile) Duplicate() File {
+	return f
+}
+
+func (f *readerAtFile) IsChunked() bool {
+	return len(f.chunks) > 0
+}
+
+func (f *readerAtFile) Chunks() FileIterator {
+	chunks := f.chunks
+	if len(chunks) == 0 {
+		chunks = []readerAtChunk{{key: f.key, offset: 0, size: f.size}}
+	}
+	return &readerAtChunksIter{r: f.r, chunks: chunks, idx: -1}
+}
+
+func (f *readerAtFile) NumChunks() int64 {
+	if len(f.chunks) > 0 {
+		return int64(len(f.chunks))
+	}
+	return 1
+}
+
+type readerAtChunksIter struct {
+	r      io.ReaderAt
+	chunks []readerAtChunk
+	idx    int
+}
+
+func (it *readerAtChunksIter) Dispose() {}
+
+func (it *readerAtChunksIter) Duplicate() FileIterator {
+	dup := *it
+	return &dup
+}
+
+func (it *readerAtChunksIter) Next() bool {
+	if it.idx+1 >= len(it.chunks) {
+		return false
+	}
+	it.idx++
+	return true
+}
+
+func (it *readerAtChunksIter) Key() SKey {
+	return it.chunks[it.idx].key
+}
+
+func (it *readerAtChunksIter) Size() int64 {
+	return it.chunks[it.idx].size
+}
+
+func (it *readerAtChunksIter) File() File {
+	c := it.chunks[it.idx]
+	return &readerAtFile{r: io.NewSectionReader(it.r, c.offset, c.size), key: c.key, size: c.size}
+}
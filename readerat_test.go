@@ -0,0 +1,76 @@
+package cafs_test
+
+import (
+	"bytes"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestFileFromBytes(t *testing.T) {
+	s := ram.NewRamStorage(1 << 20)
+	r := rand.New(rand.NewSource(0))
+	for _, size := range []int{0, 100, 200000} {
+		data := randomBytes(r, size)
+		stored, err := Ingest(s, bytes.NewReader(data), "stored")
+		if err != nil {
+			t.Fatalf("Error ingesting %d bytes: %v", size, err)
+		}
+		f := FileFromBytes(data)
+
+		// Key and chunks are the same as if the data had been stored
+		if f.Key() != stored.Key() || f.Size() != stored.Size() {
+			t.Errorf("%d bytes: expected key %v and size %d, got %v and %d", size, stored.Key(), stored.Size(), f.Key(), f.Size())
+		}
+		if f.IsChunked() != stored.IsChunked() || f.NumChunks() != stored.NumChunks() {
+			t.Errorf("%d bytes: expected chunked=%v with %d chunks, got chunked=%v with %d chunks",
+				size, stored.IsChunked(), stored.NumChunks(), f.IsChunked(), f.NumChunks())
+		}
+		it, expected := f.Chunks(), stored.Chunks()
+		for expected.Next() {
+			if !it.Next() {
+				t.Fatalf("%d bytes: too few chunks", size)
+			}
+			if it.Key() != expected.Key() || it.Size() != expected.Size() {
+				t.Errorf("%d bytes: expected chunk %v (%d bytes), got %v (%d bytes)", size, expected.Key(), expected.Size(), it.Key(), it.Size())
+			}
+			chunk, expectedChunk := it.File(), expected.File()
+			if !bytes.Equal(readAll(t, chunk), readAll(t, expectedChunk)) {
+				t.Errorf("%d bytes: chunk data differs", size)
+			}
+			chunk.Dispose()
+			expectedChunk.Dispose()
+		}
+		if it.Next() {
+			t.Errorf("%d bytes: too many chunks", size)
+		}
+		it.Dispose()
+		expected.Dispose()
+
+		if !bytes.Equal(readAll(t, f), data) {
+			t.Errorf("%d bytes: data read differs", size)
+		}
+		f.Dispose()
+		stored.Dispose()
+	}
+	assertNothingLocked(t, s)
+}
+
+func TestFileFromReaderAtShort(t *testing.T) {
+	if _, err := FileFromReaderAt(bytes.NewReader(make([]byte, 100)), 200); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+}
+
+func readAll(t *testing.T, f File) []byte {
+	rc := f.Open()
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	return data
+}
@@ -0,0 +1,160 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"context"
+	"github.com/indyjo/cafs"
+	"io"
+	"sort"
+)
+
+// Type RangeFetcher retrieves `length` bytes of the data of a single chunk, starting at `offset`,
+// from a remote and writes them to `w`. See httpsync.NewChunkRangeFetcher for an implementation
+// using HTTP range requests.
+type RangeFetcher func(ctx context.Context, ci ChunkInfo, offset, length int64, w io.Writer) error
+
+// Struct ByteRange specifies `Length` bytes starting at `Offset`.
+type ByteRange struct {
+	Offset, Length int64
+}
+
+// Function CompleteChunk reconstructs the chunk described by `ci` from data that is partially
+// present locally, e.g. after an interrupted download of a very large chunk, and puts it into
+// `storage`, named `info`. Bytes within the `present` ranges are read from `partial`, at the same
+// offsets as within the chunk, and all other bytes are fetched using `fetch`. Ranges may overlap
+// and needn't be sorted.
+//
+// As the key covers the whole chunk, the data can only be verified once it is complete. If it
+// doesn't match the key, cafs.ErrHashMismatch is returned and nothing is stored. This happens if the
+// data assumed to be present is corrupt. As there is no way to tell which part of a chunk is
+// corrupt, the whole chunk must then be fetched, e.g. by passing no present ranges. Returns
+// ErrProtocolViolation if `fetch` writes more bytes than requested, and io.ErrUnexpectedEOF if
+// it writes fewer.
+func CompleteChunk(ctx context.Context, storage cafs.FileStorage, ci ChunkInfo, partial io.ReaderAt, present []ByteRange, fetch RangeFetcher, info string) (cafs.File, error) {
+	temp := storage.CreateWithKey(info, ci.Key)
+	defer temp.Dispose()
+
+	size := int64(ci.Size)
+	var pos int64 // Number of bytes written to temp so far
+	fill := func(end int64) error {
+		if end <= pos {
+			return nil
+		}
+		w := &exactWriter{w: temp, n: end - pos}
+		if err := fetch(ctx, ci, pos, end-pos, w); err != nil {
+			return err
+		} else if w.n != 0 {
+			return io.ErrUnexpectedEOF
+		}
+		pos = end
+		return nil
+	}
+
+	for _, r := range normalizeRanges(present, size) {
+		if err := fill(r.Offset); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(temp, io.NewSectionReader(partial, r.Offset, r.Length), r.Length); err != nil {
+			return nil, err
+		}
+		pos = r.Offset + r.Length
+	}
+	if err := fill(size); err != nil {
+		return nil, err
+	}
+
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+// Function normalizeRanges returns the parts of `ranges` that lie within [0, size), sorted by
+// offset, with overlapping or adjacent ranges merged.
+func normalizeRanges(ranges []ByteRange, size int64) []ByteRange {
+	var result []ByteRange
+	for _, r := range ranges {
+		start, end := r.Offset, r.Offset+r.Length
+		if start < 0 {
+			start = 0
+		}
+		if end > size {
+			end = size
+		}
+		if start < end {
+			result = append(result, ByteRange{start, end - start})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Offset < result[j].Offset })
+
+	merged := result[:0]
+	for _, r := range result {
+		if n := len(merged); n > 0 && r.Offset <= merged[n-1].Offset+merged[n-1].Length {
+			if end := r.Offset + r.Length; end > merged[n-1].Offset+merged[n-1].Length {
+				merged[n-1].Length = end - merged[n-1].Offset
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Struct exactWriter passes at most `n` bytes on to `w` and fails with ErrProtocolViolation on
+// any further bytes. Field `n` counts down the bytes still expected.
+type exactWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (e *exactWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > e.n {
+		return 0, ErrProtocolViolation
+	}
+	n, err := e.w.Write(p)
+	e.n -= int64(n)
+	return n, err
+}
+
+// Struct rangeWriter discards the first `skip` bytes written to it, passes on the following `n`
+// bytes to `w` and discards the rest.
+type rangeWriter struct {
+	w       io.Writer
+	skip, n int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	if r.skip > 0 {
+		l := r.skip
+		if l > int64(len(p)) {
+			l = int64(len(p))
+		}
+		p = p[l:]
+		r.skip -= l
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.w.Write(p)
+	r.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return total, nil
+}
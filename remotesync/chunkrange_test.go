@@ -0,0 +1,159 @@
+package remotesync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Function bytesRangeFetcher returns a RangeFetcher reading from `data` and recording the ranges
+// fetched.
+func bytesRangeFetcher(data []byte, fetched *[]ByteRange) RangeFetcher {
+	return func(ctx context.Context, ci ChunkInfo, offset, length int64, w io.Writer) error {
+		*fetched = append(*fetched, ByteRange{offset, length})
+		_, err := w.Write(data[offset : offset+length])
+		return err
+	}
+}
+
+func TestCompleteChunk(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "store", store)
+
+	data := randomBytes(100000)
+	ci := ChunkInfo{Key: cafs.KeyOf(data), Size: len(data)}
+	// Only parts of the partial data are valid
+	partial := make([]byte, len(data))
+	copy(partial[:5], data[:5])
+	copy(partial[1000:5000], data[1000:5000])
+	copy(partial[4000:20000], data[4000:20000])
+	copy(partial[50000:], data[50000:])
+	present := []ByteRange{{50000, 60000}, {4000, 16000}, {1000, 4000}, {-5, 10}}
+
+	var fetched []ByteRange
+	chunk, err := CompleteChunk(context.Background(), store, ci, bytes.NewReader(partial), present, bytesRangeFetcher(data, &fetched), "completed")
+	check(t, "completing chunk", err)
+	r := chunk.Open()
+	completed, err := ioutil.ReadAll(r)
+	r.Close()
+	chunk.Dispose()
+	check(t, "reading chunk", err)
+	if !bytes.Equal(completed, data) {
+		t.Errorf("Completed chunk differs")
+	}
+	expected := []ByteRange{{5, 995}, {20000, 30000}}
+	if len(fetched) != len(expected) || fetched[0] != expected[0] || fetched[1] != expected[1] {
+		t.Errorf("Expected ranges %v to be fetched, got %v", expected, fetched)
+	}
+
+	// Corrupt data assumed to be present is detected
+	partial[60000] ^= 1
+	store.FreeCache()
+	fetched = nil
+	if _, err := CompleteChunk(context.Background(), store, ci, bytes.NewReader(partial), present, bytesRangeFetcher(data, &fetched), "corrupt"); err != cafs.ErrHashMismatch {
+		t.Errorf("Expected ErrHashMismatch, got %v", err)
+	}
+
+	// Fetchers delivering the wrong number of bytes are detected
+	short := func(ctx context.Context, ci ChunkInfo, offset, length int64, w io.Writer) error {
+		_, err := w.Write(data[offset : offset+length-1])
+		return err
+	}
+	if _, err := CompleteChunk(context.Background(), store, ci, bytes.NewReader(partial), nil, short, "short"); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	long := func(ctx context.Context, ci ChunkInfo, offset, length int64, w io.Writer) error {
+		_, err := w.Write(data[offset:])
+		return err
+	}
+	if _, err := CompleteChunk(context.Background(), store, ci, bytes.NewReader(partial), []ByteRange{{10, 10}}, long, "long"); err != ErrProtocolViolation {
+		t.Errorf("Expected ErrProtocolViolation, got %v", err)
+	}
+}
+
+// Tests reconstructing byte ranges of a file, including ranges spanning chunk boundaries, and that
+// exactly the chunks overlapping a range are transferred.
+func TestBuilderRange(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	storeB := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	data := randomBytes(512 * 1024)
+	fileA, err := cafs.Ingest(storeA, bytes.NewReader(data), "A")
+	check(t, "ingesting", err)
+	defer fileA.Dispose()
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(shuffle.RandomSeeded(16, 0))
+	check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+	if len(syncinf.Chunks) < 4 {
+		t.Fatalf("Expected at least 4 chunks, got %d", len(syncinf.Chunks))
+	}
+	size := int64(len(data))
+	b1, b2 := syncinf.ChunkOffset(1), syncinf.ChunkOffset(2)
+
+	for _, r := range []ByteRange{
+		{0, size},             // whole file
+		{10, 20},              // within the first chunk
+		{b1 - 10, 20},         // spanning a chunk boundary
+		{b1, b2 - b1},         // exactly the second chunk
+		{b1 - 1, b2 - b1 + 2}, // spanning three chunks
+		{size - 10, 100},      // exceeding the end of the file
+		{-10, 20},             // starting before the file
+		{b1, 0},               // empty
+		{size + 10, 10},       // outside the file
+	} {
+		start, end := r.Offset, r.Offset+r.Length
+		if start < 0 {
+			start = 0
+		} else if start > size {
+			start = size
+		}
+		if end > size {
+			end = size
+		}
+		if end < start {
+			end = start
+		}
+		expectedChunks := 0
+		for i := range syncinf.Chunks {
+			if syncinf.ChunkOffset(i+1) > start && syncinf.ChunkOffset(i) < end {
+				expectedChunks++
+			}
+		}
+
+		transferred := 0
+		builder := NewBuilder(storeB, syncinf, 8, "Range of A").WithRange(r).WithStandaloneWishList().
+			WithChunkCallback(func(ci ChunkInfo, wasTransferred bool) {
+				if wasTransferred {
+					transferred++
+				}
+			})
+		var wishlist, chunkData bytes.Buffer
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+		chunks := ChunksOfFile(fileA)
+		check(t, "writing chunk data", syncinf.WriteChunkData(context.Background(), chunks, bufio.NewReader(&wishlist), NopFlushWriter{&chunkData}, nil))
+		chunks.Dispose()
+		f, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+		check(t, "reconstructing", err)
+
+		rc := f.Open()
+		actual, err := ioutil.ReadAll(rc)
+		_ = rc.Close()
+		check(t, "reading", err)
+		if !bytes.Equal(actual, data[start:end]) {
+			t.Errorf("Range %v: got %d bytes differing from the %d bytes expected", r, len(actual), end-start)
+		}
+		if transferred != expectedChunks {
+			t.Errorf("Range %v: expected %d chunks to be transferred, got %d", r, expectedChunks, transferred)
+		}
+		f.Dispose()
+		builder.Dispose()
+		storeB.FreeCache()
+	}
+}
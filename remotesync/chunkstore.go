@@ -0,0 +1,370 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// Interface ChunkStore is a minimal store of chunks, keyed by the hashes of their contents. Unlike
+// cafs.FileStorage, it has no notion of files, temporaries or locking, which makes it easy to
+// implement on top of external key-value stores. Use NewChunkStoreStorage to reconstruct files into
+// a ChunkStore using a Builder, and SyncInfo.ChunksFromStore to send chunks from it.
+type ChunkStore interface {
+	// Returns the data of the chunk stored under `key`, or cafs.ErrNotFound if there is none.
+	GetChunk(key cafs.SKey) ([]byte, error)
+
+	// Stores `data` under `key`, which is the key of `data` as computed by cafs.KeyOf. Storing a
+	// chunk that is already present is not an error.
+	PutChunk(key cafs.SKey, data []byte) error
+}
+
+// Function StorageChunkStore presents a cafs.FileStorage as a ChunkStore. Chunks put into it aren't
+// kept locked, so they may be evicted from storage like any other file.
+func StorageChunkStore(storage cafs.FileStorage) ChunkStore {
+	return storageChunkStore{storage}
+}
+
+type storageChunkStore struct {
+	storage cafs.FileStorage
+}
+
+func (s storageChunkStore) GetChunk(key cafs.SKey) ([]byte, error) {
+	file, err := s.storage.Get(&key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Dispose()
+	r := file.Open()
+	//noinspection GoUnhandledErrorResult
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (s storageChunkStore) PutChunk(key cafs.SKey, data []byte) error {
+	temp := s.storage.CreateWithKey(fmt.Sprintf("chunk %v", key), key)
+	defer temp.Dispose()
+	if _, err := temp.Write(data); err != nil {
+		return err
+	}
+	return temp.Close()
+}
+
+// Function NewChunkStoreStorage presents a ChunkStore as a cafs.FileStorage, e.g. for passing it to
+// NewBuilder. Files written to the storage are split into chunks like in any other storage, and each
+// chunk is put into `store`. The list of chunks making up a file isn't stored, so Get finds chunks
+// only. Files and temporaries need not be disposed, but it is good practice to do so nevertheless.
+func NewChunkStoreStorage(store ChunkStore) cafs.FileStorage {
+	return &chunkStoreStorage{store}
+}
+
+type chunkStoreStorage struct {
+	store ChunkStore
+}
+
+func (s *chunkStoreStorage) Create(info string) cafs.Temporary {
+	return &chunkStoreTemporary{
+		store:    s.store,
+		info:     info,
+		chunker:  chunking.New(),
+		fileHash: cafs.NewKeyHash(),
+		open:     true,
+		valid:    true,
+	}
+}
+
+func (s *chunkStoreStorage) CreateWithKey(info string, expected cafs.SKey) cafs.Temporary {
+	t := s.Create(info).(*chunkStoreTemporary)
+	t.expected = &expected
+	return t
+}
+
+func (s *chunkStoreStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	data, err := s.store.GetChunk(*key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkStoreFile{store: s.store, key: *key, size: int64(len(data)), data: data}, nil
+}
+
+func (s *chunkStoreStorage) DumpStatistics(log cafs.Printer) {
+	log.Printf("Storage backed by ChunkStore %T", s.store)
+}
+
+// Struct chunkStoreTemporary puts chunks into a ChunkStore as soon as their boundaries are known.
+type chunkStoreTemporary struct {
+	store    ChunkStore
+	info     string
+	expected *cafs.SKey // If not nil, the key the file's content must hash to
+	chunker  chunking.Chunker
+	buffer   bytes.Buffer // Stores bytes since beginning of current chunk
+	fileHash hash.Hash
+	chunks   []ChunkInfo // Chunks put so far
+	open     bool        // Set to false on Close()
+	valid    bool        // If false, something has gone wrong
+	key      cafs.SKey   // Set on Close()
+}
+
+func (t *chunkStoreTemporary) Write(b []byte) (int, error) {
+	if !t.valid || !t.open {
+		return 0, cafs.ErrInvalidState
+	}
+	nBytes := len(b)
+	for len(b) > 0 {
+		n := t.chunker.Scan(b)
+		t.buffer.Write(b[:n])
+		t.fileHash.Write(b[:n])
+		b = b[n:]
+		if len(b) > 0 {
+			// a chunk boundary was detected
+			if err := t.putChunk(); err != nil {
+				t.valid = false
+				return 0, err
+			}
+		}
+	}
+	return nBytes, nil
+}
+
+// Puts the buffer's contents into the store as a chunk and resets the buffer.
+func (t *chunkStoreTemporary) putChunk() error {
+	data := make([]byte, t.buffer.Len())
+	copy(data, t.buffer.Bytes())
+	t.buffer.Reset()
+	key := cafs.KeyOf(data)
+	if err := t.store.PutChunk(key, data); err != nil {
+		return fmt.Errorf("[%v] error putting chunk %v: %v", t.info, key, err)
+	}
+	t.chunks = append(t.chunks, ChunkInfo{key, len(data)})
+	return nil
+}
+
+func (t *chunkStoreTemporary) Close() error {
+	if !t.valid || !t.open {
+		return cafs.ErrInvalidState
+	}
+	t.open = false
+	t.valid = false
+	key := cafs.SumKey(t.fileHash)
+	if t.expected != nil && key != *t.expected {
+		return cafs.ErrHashMismatch
+	}
+	// Put the last chunk, which may be empty only if the file is
+	if t.buffer.Len() > 0 || len(t.chunks) == 0 {
+		if err := t.putChunk(); err != nil {
+			return err
+		}
+	}
+	t.key = key
+	t.valid = true
+	return nil
+}
+
+func (t *chunkStoreTemporary) File() cafs.File {
+	key := t.Key()
+	f := &chunkStoreFile{store: t.store, key: key}
+	for _, ci := range t.chunks {
+		f.size += int64(ci.Size)
+	}
+	if len(t.chunks) > 1 {
+		f.chunks = t.chunks
+	}
+	return f
+}
+
+func (t *chunkStoreTemporary) Key() cafs.SKey {
+	if !t.valid {
+		panic(cafs.ErrInvalidState)
+	}
+	if t.open {
+		panic(cafs.ErrStillOpen)
+	}
+	return t.key
+}
+
+func (t *chunkStoreTemporary) Dispose() {
+	t.open = false
+	t.buffer = bytes.Buffer{}
+}
+
+// Struct chunkStoreFile is a file whose chunks are retrieved from a ChunkStore on demand.
+type chunkStoreFile struct {
+	store  ChunkStore
+	key    cafs.SKey
+	size   int64
+	chunks []ChunkInfo // Nil if the file consists of a single chunk
+	data   []byte      // If not nil, the contents of a single-chunk file
+}
+
+func (f *chunkStoreFile) Dispose() {}
+
+func (f *chunkStoreFile) Key() cafs.SKey {
+	return f.key
+}
+
+func (f *chunkStoreFile) OpenWithProgress(cb func(read int64)) io.ReadCloser {
+	return cafs.NewProgressReader(f.Open(), cb)
+}
+
+func (f *chunkStoreFile) Open() io.ReadCloser {
+	if f.data != nil {
+		return ioutil.NopCloser(bytes.NewReader(f.data))
+	}
+	return &chunkStoreReader{store: f.store, chunks: f.allChunks()}
+}
+
+func (f *chunkStoreFile) Size() int64 {
+	return f.size
+}
+
+func (f *chunkStoreFile) Duplicate() cafs.File {
+	return f
+}
+
+func (f *chunkStoreFile) IsChunked() bool {
+	return len(f.chunks) > 0
+}
+
+func (f *chunkStoreFile) Chunks() cafs.FileIterator {
+	return &chunkStoreIter{store: f.store, chunks: f.allChunks(), idx: -1}
+}
+
+func (f *chunkStoreFile) NumChunks() int64 {
+	return int64(len(f.allChunks()))
+}
+
+func (f *chunkStoreFile) allChunks() []ChunkInfo {
+	if f.chunks != nil {
+		return f.chunks
+	}
+	return []ChunkInfo{{f.key, int(f.size)}}
+}
+
+// Struct chunkStoreReader reads a sequence of chunks from a ChunkStore.
+type chunkStoreReader struct {
+	store  ChunkStore
+	chunks []ChunkInfo // Chunks not yet retrieved
+	data   []byte      // Unread data of the current chunk
+}
+
+func (r *chunkStoreReader) Read(b []byte) (int, error) {
+	for len(r.data) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		ci := r.chunks[0]
+		data, err := r.store.GetChunk(ci.Key)
+		if err != nil {
+			return 0, err
+		} else if len(data) != ci.Size {
+			return 0, fmt.Errorf("chunk %v has size %d, expected %d", ci.Key, len(data), ci.Size)
+		}
+		r.chunks = r.chunks[1:]
+		r.data = data
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *chunkStoreReader) Close() error {
+	r.chunks, r.data = nil, nil
+	return nil
+}
+
+type chunkStoreIter struct {
+	store  ChunkStore
+	chunks []ChunkInfo
+	idx    int
+}
+
+func (it *chunkStoreIter) Dispose() {}
+
+func (it *chunkStoreIter) Duplicate() cafs.FileIterator {
+	dup := *it
+	return &dup
+}
+
+func (it *chunkStoreIter) Next() bool {
+	if it.idx+1 >= len(it.chunks) {
+		return false
+	}
+	it.idx++
+	return true
+}
+
+func (it *chunkStoreIter) Key() cafs.SKey {
+	return it.chunks[it.idx].Key
+}
+
+func (it *chunkStoreIter) Size() int64 {
+	return int64(it.chunks[it.idx].Size)
+}
+
+func (it *chunkStoreIter) File() cafs.File {
+	ci := it.chunks[it.idx]
+	return &chunkStoreFile{store: it.store, key: ci.Key, size: int64(ci.Size)}
+}
+
+// Function ChunksFromStore returns the chunks described by the SyncInfo as an implementation of
+// the Chunks interface, e.g. for passing it to SyncInfo.WriteChunkData. Chunks are retrieved from
+// `store` only when requested by the receiver. Returns cafs.ErrNotFound if a chunk is missing.
+func (s *SyncInfo) ChunksFromStore(store ChunkStore) Chunks {
+	return &storeChunks{store: store, chunks: s.Chunks, idx: -1}
+}
+
+// Struct storeChunks implements SkippableChunks for chunks retrieved from a ChunkStore.
+type storeChunks struct {
+	store  ChunkStore
+	chunks []ChunkInfo
+	idx    int
+}
+
+func (c *storeChunks) NextChunk() (cafs.File, error) {
+	if _, _, err := c.Advance(); err != nil {
+		return nil, err
+	}
+	return c.Current()
+}
+
+func (c *storeChunks) Advance() (cafs.SKey, int64, error) {
+	if c.idx+1 >= len(c.chunks) {
+		return cafs.SKey{}, 0, io.EOF
+	}
+	c.idx++
+	ci := c.chunks[c.idx]
+	return ci.Key, int64(ci.Size), nil
+}
+
+func (c *storeChunks) Current() (cafs.File, error) {
+	ci := c.chunks[c.idx]
+	data, err := c.store.GetChunk(ci.Key)
+	if err != nil {
+		return nil, err
+	} else if len(data) != ci.Size {
+		return nil, fmt.Errorf("chunk %v has size %d, expected %d", ci.Key, len(data), ci.Size)
+	}
+	return &chunkStoreFile{store: c.store, key: ci.Key, size: int64(ci.Size), data: data}, nil
+}
+
+func (c *storeChunks) Dispose() {}
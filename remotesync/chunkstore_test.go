@@ -0,0 +1,112 @@
+package remotesync
+
+import (
+	"bytes"
+	"context"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// Type mapChunkStore is a ChunkStore keeping chunks in a map.
+type mapChunkStore map[cafs.SKey][]byte
+
+func (m mapChunkStore) GetChunk(key cafs.SKey) ([]byte, error) {
+	if data, ok := m[key]; ok {
+		return data, nil
+	}
+	return nil, cafs.ErrNotFound
+}
+
+func (m mapChunkStore) PutChunk(key cafs.SKey, data []byte) error {
+	m[key] = data
+	return nil
+}
+
+// Function syncChunks transfers the file described by `syncinf` from `chunks` into `store`.
+func syncChunks(t *testing.T, store cafs.FileStorage, syncinf *SyncInfo, chunks Chunks) (cafs.File, error) {
+	builder := NewBuilder(store, syncinf, len(syncinf.Chunks)+len(syncinf.Perm), "synced")
+	defer builder.Dispose()
+	var wishlist, chunkData bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+	if err := syncinf.WriteChunkData(context.Background(), chunks, &wishlist, NopFlushWriter{&chunkData}, nil); err != nil {
+		return nil, err
+	}
+	return builder.ReconstructFileFromRequestedChunks(&chunkData)
+}
+
+func TestChunkStore(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	defer reportUsage(t, "A", storeA)
+	fileA := addRandomFile(t, storeA, 100000)
+	defer fileA.Dispose()
+	contentA := readAll(t, fileA)
+
+	for _, perm := range [][]int{{0}, rand.Perm(5)} {
+		syncinf := &SyncInfo{}
+		syncinf.SetPermutation(perm)
+		check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+		// Receive into a ChunkStore
+		kv := mapChunkStore{}
+		chunks := ChunksOfFile(fileA)
+		fileKV, err := syncChunks(t, NewChunkStoreStorage(kv), syncinf, chunks)
+		chunks.Dispose()
+		check(t, "syncing into ChunkStore", err)
+		if fileKV.Key() != fileA.Key() || !bytes.Equal(readAll(t, fileKV), contentA) {
+			t.Errorf("perm %v: File synced into ChunkStore differs", perm)
+		}
+		fileKV.Dispose()
+		for _, ci := range syncinf.Chunks {
+			if _, ok := kv[ci.Key]; !ok {
+				t.Fatalf("perm %v: Chunk %v missing from ChunkStore", perm, ci.Key)
+			}
+		}
+
+		// Send from the ChunkStore into a regular storage
+		storeB := ram.NewRamStorage(1 << 20)
+		fileB, err := syncChunks(t, storeB, syncinf, syncinf.ChunksFromStore(kv))
+		check(t, "syncing from ChunkStore", err)
+		if fileB.Key() != fileA.Key() {
+			t.Errorf("perm %v: File synced from ChunkStore differs", perm)
+		}
+		fileB.Dispose()
+		reportUsage(t, "B", storeB)
+
+		// A missing chunk makes sending fail
+		delete(kv, syncinf.Chunks[len(syncinf.Chunks)/2].Key)
+		storeC := ram.NewRamStorage(1 << 20)
+		if _, err := syncChunks(t, storeC, syncinf, syncinf.ChunksFromStore(kv)); err != cafs.ErrNotFound {
+			t.Errorf("perm %v: Expected ErrNotFound, got %v", perm, err)
+		}
+		reportUsage(t, "C", storeC)
+	}
+}
+
+func TestStorageChunkStore(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	defer reportUsage(t, "store", store)
+	cs := StorageChunkStore(store)
+	data := randomBytes(1000)
+	key := cafs.KeyOf(data)
+	if _, err := cs.GetChunk(key); err != cafs.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	check(t, "putting chunk", cs.PutChunk(key, data))
+	if got, err := cs.GetChunk(key); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected chunk data, got %d bytes and error %v", len(got), err)
+	}
+	if err := cs.PutChunk(cafs.SKey{}, data); err != cafs.ErrHashMismatch {
+		t.Errorf("Expected ErrHashMismatch for wrong key, got %v", err)
+	}
+}
+
+func readAll(t *testing.T, f cafs.File) []byte {
+	r := f.Open()
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	check(t, "reading file", err)
+	return data
+}
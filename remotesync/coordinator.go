@@ -0,0 +1,119 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"github.com/indyjo/cafs"
+	"sync"
+)
+
+// Struct ChunkCoordinator lets concurrent Builders share the transfer of chunks missing in their
+// storage. When a Builder is about to request a chunk that an older Builder (i.e. one attached to
+// the coordinator earlier) has already requested, it doesn't request the chunk itself but waits
+// for the older Builder to receive it. If the older Builder fails to receive the chunk, the
+// waiting Builder's ReconstructFileFromRequestedChunks fails with ErrTransferInterrupted.
+//
+// Waiting only ever happens for older Builders, so Builders can't wait for each other in a cycle.
+// All Builders attached to a coordinator must use the same storage and scratch storage.
+type ChunkCoordinator struct {
+	mutex    sync.Mutex
+	inflight map[cafs.SKey]*sharedChunk
+	nextSeq  int64
+}
+
+// Struct sharedChunk tracks a chunk requested by one Builder and awaited by others.
+type sharedChunk struct {
+	owner int64         // Sequence number of the Builder that requested the chunk
+	done  chan struct{} // Closed when the owner has received the chunk or given up
+	file  cafs.File     // Set before closing done if the chunk was received and is awaited
+	refs  int           // Number of waiting Builders that haven't released the chunk yet
+}
+
+// Function NewChunkCoordinator returns a new ChunkCoordinator. Attach Builders to it using
+// Builder.WithChunkCoordinator.
+func NewChunkCoordinator() *ChunkCoordinator {
+	return &ChunkCoordinator{inflight: make(map[cafs.SKey]*sharedChunk)}
+}
+
+// Function attach returns the sequence number for a newly attached Builder.
+func (c *ChunkCoordinator) attach() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nextSeq++
+	return c.nextSeq
+}
+
+// Function acquire is called by the Builder with sequence number `seq` for a chunk missing in
+// storage. If an older Builder has requested the chunk, it returns that request for waiting on it,
+// which must eventually be released. If no Builder has requested the chunk, it returns a new
+// request owned by the caller, which must eventually be completed. Otherwise, returns nil, and the
+// caller needs to request the chunk independently.
+func (c *ChunkCoordinator) acquire(seq int64, key cafs.SKey) (shared *sharedChunk, owner bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if shared = c.inflight[key]; shared == nil {
+		shared = &sharedChunk{owner: seq, done: make(chan struct{})}
+		c.inflight[key] = shared
+		return shared, true
+	} else if shared.owner < seq {
+		shared.refs++
+		return shared, false
+	}
+	return nil, false
+}
+
+// Function complete is called by the owner of a request when it has received the chunk, or with
+// a nil `file` if it has given up. Wakes up all waiting Builders.
+func (c *ChunkCoordinator) complete(key cafs.SKey, shared *sharedChunk, file cafs.File) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.inflight[key] == shared {
+		delete(c.inflight, key)
+	}
+	if file != nil && shared.refs > 0 {
+		// Keep the chunk from being evicted until all waiting Builders have released it
+		shared.file = file.Duplicate()
+	}
+	close(shared.done)
+}
+
+// Function wait blocks until the owner of the request has completed it, or until `cancel` is
+// closed. Returns a new handle to the chunk, or ErrTransferInterrupted if the owner has given up.
+func (c *ChunkCoordinator) wait(shared *sharedChunk, cancel <-chan struct{}) (cafs.File, error) {
+	select {
+	case <-shared.done:
+	case <-cancel:
+		return nil, ErrDisposed
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if shared.file == nil {
+		return nil, ErrTransferInterrupted
+	}
+	return shared.file.Duplicate(), nil
+}
+
+// Function release is called by a waiting Builder when it no longer needs the chunk.
+func (c *ChunkCoordinator) release(shared *sharedChunk) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	shared.refs--
+	if shared.refs == 0 && shared.file != nil {
+		shared.file.Dispose()
+		shared.file = nil
+	}
+}
@@ -0,0 +1,160 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"errors"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"sort"
+)
+
+var ErrDeltaBaseMismatch = errors.New("delta doesn't match base SyncInfo")
+
+// Type DeltaOpKind specifies what a DeltaOp does.
+type DeltaOpKind int
+
+const (
+	DeltaKeep   DeltaOpKind = iota // Keep a number of chunks of the base
+	DeltaRemove                    // Skip a number of chunks of the base
+	DeltaInsert                    // Insert new chunks
+)
+
+// Struct DeltaOp is a single operation of a SyncInfoDelta. Operations are applied in sequence,
+// advancing through the chunks of the base SyncInfo.
+type DeltaOp struct {
+	Kind   DeltaOpKind
+	Count  int         `json:",omitempty"` // Number of base chunks kept or removed
+	Chunks []ChunkInfo `json:",omitempty"` // Chunks inserted
+}
+
+// Struct SyncInfoDelta expresses a SyncInfo relative to a base SyncInfo the receiver already has.
+// For small edits to huge files, it is much smaller than the SyncInfo itself.
+type SyncInfoDelta struct {
+	Base cafs.SKey           // Digest of the base SyncInfo
+	Ops  []DeltaOp           // Operations transforming the base's chunks into the new chunks
+	Perm shuffle.Permutation // The permutation of the new SyncInfo
+}
+
+// Func DeltaFrom computes a delta that, applied to `base`, yields the receiver. Runs of chunks
+// common to both are found greedily, which works well for localized edits. The receiver must have a
+// valid permutation, or Apply rejects the delta.
+func (s *SyncInfo) DeltaFrom(base *SyncInfo) *SyncInfoDelta {
+	delta := &SyncInfoDelta{
+		Base: base.Digest(),
+		Perm: append(shuffle.Permutation(nil), s.Perm...),
+	}
+
+	// Index positions of base chunks
+	positions := make(map[ChunkInfo][]int)
+	for i, ci := range base.Chunks {
+		positions[ci] = append(positions[ci], i)
+	}
+	// Returns the first position >= i at which ci occurs in base, or -1
+	find := func(ci ChunkInfo, i int) int {
+		p := positions[ci]
+		k := sort.SearchInts(p, i)
+		if k == len(p) {
+			return -1
+		}
+		return p[k]
+	}
+
+	i, j := 0, 0
+	for j < len(s.Chunks) {
+		if i < len(base.Chunks) && base.Chunks[i] == s.Chunks[j] {
+			delta.add(DeltaOp{Kind: DeltaKeep, Count: 1})
+			i++
+			j++
+			continue
+		}
+		// Find the next new chunk that occurs in the remainder of base
+		jNext, iNext := j, -1
+		for ; jNext < len(s.Chunks); jNext++ {
+			if iNext = find(s.Chunks[jNext], i); iNext >= 0 {
+				break
+			}
+		}
+		if iNext < 0 {
+			iNext = len(base.Chunks)
+		}
+		if iNext > i {
+			delta.add(DeltaOp{Kind: DeltaRemove, Count: iNext - i})
+		}
+		if jNext > j {
+			delta.add(DeltaOp{Kind: DeltaInsert, Chunks: s.Chunks[j:jNext]})
+		}
+		i, j = iNext, jNext
+	}
+	if i < len(base.Chunks) {
+		delta.add(DeltaOp{Kind: DeltaRemove, Count: len(base.Chunks) - i})
+	}
+	return delta
+}
+
+// Appends an operation, merging it with the previous one if possible.
+func (d *SyncInfoDelta) add(op DeltaOp) {
+	if n := len(d.Ops); n > 0 && d.Ops[n-1].Kind == op.Kind {
+		last := &d.Ops[n-1]
+		last.Count += op.Count
+		last.Chunks = append(last.Chunks, op.Chunks...)
+		return
+	}
+	if op.Chunks != nil {
+		op.Chunks = append([]ChunkInfo(nil), op.Chunks...)
+	}
+	d.Ops = append(d.Ops, op)
+}
+
+// Func Apply applies the delta to `base`, returning the resulting SyncInfo. Returns
+// ErrDeltaBaseMismatch if `base` isn't the SyncInfo the delta was computed from, and
+// ErrInvalidPermutation if the delta's permutation is missing or isn't valid.
+func (d *SyncInfoDelta) Apply(base *SyncInfo) (*SyncInfo, error) {
+	if base.Digest() != d.Base {
+		return nil, ErrDeltaBaseMismatch
+	}
+	if !d.Perm.IsValid() {
+		return nil, ErrInvalidPermutation
+	}
+	result := &SyncInfo{}
+	result.SetPermutation(d.Perm)
+	i := 0
+	for _, op := range d.Ops {
+		switch op.Kind {
+		case DeltaKeep, DeltaRemove:
+			if op.Count < 0 || i+op.Count > len(base.Chunks) {
+				return nil, ErrDeltaBaseMismatch
+			}
+			if op.Kind == DeltaKeep {
+				result.Chunks = append(result.Chunks, base.Chunks[i:i+op.Count]...)
+			}
+			i += op.Count
+		case DeltaInsert:
+			for _, ci := range op.Chunks {
+				if err := result.addChunk(ci.Key, int64(ci.Size)); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, errors.New("invalid delta operation")
+		}
+	}
+	if i != len(base.Chunks) {
+		return nil, ErrDeltaBaseMismatch
+	}
+	return result, nil
+}
@@ -0,0 +1,117 @@
+package remotesync
+
+import (
+	"encoding/json"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"math/rand"
+	"testing"
+)
+
+func randomChunkInfos(r *rand.Rand, n int) []ChunkInfo {
+	result := make([]ChunkInfo, n)
+	for i := range result {
+		r.Read(result[i].Key[:])
+		result[i].Size = 1 + r.Intn(8192)
+	}
+	return result
+}
+
+func concatChunkInfos(parts ...[]ChunkInfo) []ChunkInfo {
+	var result []ChunkInfo
+	for _, p := range parts {
+		result = append(result, p...)
+	}
+	return result
+}
+
+func TestSyncInfoDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	old := randomChunkInfos(r, 1000)
+	fresh := randomChunkInfos(r, 10)
+
+	cases := []struct {
+		name     string
+		chunks   []ChunkInfo
+		inserted int // expected number of chunks inserted
+	}{
+		{"identical", old, 0},
+		{"insert", concatChunkInfos(old[:500], fresh, old[500:]), 10},
+		{"remove", concatChunkInfos(old[:500], old[510:]), 0},
+		{"replace", concatChunkInfos(old[:500], fresh[:3], old[503:]), 3},
+		{"prepend", concatChunkInfos(fresh, old), 10},
+		{"append", concatChunkInfos(old, fresh), 10},
+		{"truncate", old[:900], 0},
+		{"multiple", concatChunkInfos(fresh[:1], old[:100], fresh[1:2], old[200:800], fresh[2:3], old[801:]), 3},
+		// Operations advance through base sequentially, so repetitions must be inserted
+		{"repeated", concatChunkInfos(old[:10], old[:10], old[10:]), 10},
+		{"empty", nil, 0},
+		{"unrelated", fresh, 10},
+	}
+	for _, c := range cases {
+		base := &SyncInfo{Chunks: old}
+		base.SetPermutation(rand.Perm(5))
+		s := &SyncInfo{Chunks: c.chunks}
+		s.SetPermutation(rand.Perm(7))
+
+		delta := s.DeltaFrom(base)
+		inserted := 0
+		for _, op := range delta.Ops {
+			inserted += len(op.Chunks)
+		}
+		if inserted != c.inserted {
+			t.Errorf("%v: expected %d chunks to be inserted, got %d", c.name, c.inserted, inserted)
+		}
+
+		// Transmit as JSON
+		b, err := json.Marshal(delta)
+		if err != nil {
+			t.Fatalf("%v: error encoding: %v", c.name, err)
+		}
+		var received SyncInfoDelta
+		if err := json.Unmarshal(b, &received); err != nil {
+			t.Fatalf("%v: error decoding: %v", c.name, err)
+		}
+
+		applied, err := received.Apply(base)
+		if err != nil {
+			t.Fatalf("%v: error applying delta: %v", c.name, err)
+		}
+		if applied.Digest() != s.Digest() {
+			t.Errorf("%v: applying delta doesn't restore SyncInfo", c.name)
+		}
+	}
+}
+
+func TestSyncInfoDeltaBaseMismatch(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	base := &SyncInfo{Chunks: randomChunkInfos(r, 100)}
+	s := &SyncInfo{Chunks: concatChunkInfos(base.Chunks[:50], base.Chunks[60:])}
+	s.SetPermutation(r.Perm(5))
+	delta := s.DeltaFrom(base)
+
+	other := &SyncInfo{Chunks: base.Chunks[:99]}
+	if _, err := delta.Apply(other); err != ErrDeltaBaseMismatch {
+		t.Errorf("Expected ErrDeltaBaseMismatch, got: %v", err)
+	}
+
+	// Operations exceeding the base are rejected even if the digest matches
+	delta.Ops = append(delta.Ops, DeltaOp{Kind: DeltaKeep, Count: 1})
+	if _, err := delta.Apply(base); err != ErrDeltaBaseMismatch {
+		t.Errorf("Expected ErrDeltaBaseMismatch, got: %v", err)
+	}
+
+	delta = s.DeltaFrom(base)
+	delta.Ops = append(delta.Ops, DeltaOp{Kind: DeltaInsert, Chunks: []ChunkInfo{{cafs.SKey{1}, -1}}})
+	if _, err := delta.Apply(base); err == nil {
+		t.Errorf("Expected chunk of invalid size to be rejected")
+	}
+
+	delta = s.DeltaFrom(base)
+	for _, perm := range []shuffle.Permutation{{1, 1}, {}, nil} {
+		delta.Perm = perm
+		if _, err := delta.Apply(base); err != ErrInvalidPermutation {
+			t.Errorf("Permutation %v: expected ErrInvalidPermutation, got: %v", perm, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/indyjo/cafs/chunking"
+	"io"
+)
+
+// Interface ChunkFramer defines how the data of a single chunk is represented in the chunk data
+// stream sent by WriteChunkData and read by ReconstructFileFromRequestedChunks. Sender and
+// receiver must use the same ChunkFramer. The default is VarintFramer.
+type ChunkFramer interface {
+	// Writes a frame containing `size` bytes of chunk data, read from `data`, into `w`.
+	WriteChunk(w io.Writer, size int64, data io.Reader) error
+	// Reads a frame from `r` and writes the chunk data it contains into `w`. Returns io.EOF if
+	// the stream ends before the frame, io.ErrUnexpectedEOF if it ends within the frame, and
+	// ErrProtocolViolation if the frame announces more than chunking.MaxChunkSize bytes.
+	ReadChunk(r *bufio.Reader, w io.Writer) error
+}
+
+// Struct VarintFramer prefixes chunk data with its length encoded as a signed varint, as written
+// by encoding/binary.PutVarint. This is the default ChunkFramer.
+type VarintFramer struct{}
+
+func (VarintFramer) WriteChunk(w io.Writer, size int64, data io.Reader) error {
+	if err := writeVarint(w, size); err != nil {
+		return err
+	}
+	return copyChunkData(w, data, size)
+}
+
+func (VarintFramer) ReadChunk(r *bufio.Reader, w io.Writer) error {
+	length, err := readChunkLength(r)
+	if err != nil {
+		return err
+	}
+	return readChunkData(r, w, length)
+}
+
+// Struct UvarintFramer prefixes chunk data with its length encoded as an unsigned varint. This
+// matches the length-delimited encoding used for protocol buffer messages.
+type UvarintFramer struct{}
+
+func (UvarintFramer) WriteChunk(w io.Writer, size int64, data io.Reader) error {
+	var buf [binary.MaxVarintLen64]byte
+	if _, err := w.Write(buf[:binary.PutUvarint(buf[:], uint64(size))]); err != nil {
+		return err
+	}
+	return copyChunkData(w, data, size)
+}
+
+func (UvarintFramer) ReadChunk(r *bufio.Reader, w io.Writer) error {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	} else if length > chunking.MaxChunkSize {
+		return ErrProtocolViolation
+	}
+	return readChunkData(r, w, int64(length))
+}
+
+// Struct Uint32Framer prefixes chunk data with its length encoded as a 4-byte big-endian integer.
+type Uint32Framer struct{}
+
+func (Uint32Framer) WriteChunk(w io.Writer, size int64, data io.Reader) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(size))
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	return copyChunkData(w, data, size)
+}
+
+func (Uint32Framer) ReadChunk(r *bufio.Reader, w io.Writer) error {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(buf[:])
+	if length > chunking.MaxChunkSize {
+		return ErrProtocolViolation
+	}
+	return readChunkData(r, w, int64(length))
+}
+
+// Function copyChunkData copies exactly `size` bytes from `data` to `w`.
+func copyChunkData(w io.Writer, data io.Reader, size int64) error {
+	_, err := io.CopyN(w, data, size)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Function readChunkData reads `length` bytes of chunk data from `r` into `w`. The stream ending
+// early is reported as io.ErrUnexpectedEOF.
+func readChunkData(r io.Reader, w io.Writer, length int64) error {
+	_, err := io.CopyN(w, r, length)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type framerKey struct{}
+
+// Function WithChunkFramer returns a context that makes WriteChunkDataWithContext and
+// SyncInfo.WriteChunkData frame chunk data using `framer` instead of VarintFramer.
+// See Builder.WithChunkFramer for the receiving side.
+func WithChunkFramer(ctx context.Context, framer ChunkFramer) context.Context {
+	return context.WithValue(ctx, framerKey{}, framer)
+}
+
+// Function chunkFramer returns the ChunkFramer to use with a context.
+func chunkFramer(ctx context.Context) ChunkFramer {
+	if framer, ok := ctx.Value(framerKey{}).(ChunkFramer); ok {
+		return framer
+	}
+	return VarintFramer{}
+}
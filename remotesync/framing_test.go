@@ -0,0 +1,87 @@
+package remotesync
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/indyjo/cafs/chunking"
+	. "github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var framers = map[string]ChunkFramer{
+	"varint":  VarintFramer{},
+	"uvarint": UvarintFramer{},
+	"uint32":  Uint32Framer{},
+}
+
+func TestChunkFramerRoundTrip(t *testing.T) {
+	for name, framer := range framers {
+		var stream bytes.Buffer
+		chunks := [][]byte{randomBytes(100), {}, randomBytes(chunking.MaxChunkSize)}
+		for _, c := range chunks {
+			check(t, "writing chunk", framer.WriteChunk(&stream, int64(len(c)), bytes.NewReader(c)))
+		}
+		encoded := stream.Bytes()
+
+		r := bufio.NewReader(bytes.NewReader(encoded))
+		for i, c := range chunks {
+			var buf bytes.Buffer
+			if err := framer.ReadChunk(r, &buf); err != nil {
+				t.Fatalf("%v: error reading chunk %d: %v", name, i, err)
+			}
+			if !bytes.Equal(buf.Bytes(), c) {
+				t.Errorf("%v: chunk %d differs", name, i)
+			}
+		}
+		if err := framer.ReadChunk(r, &bytes.Buffer{}); err != io.EOF {
+			t.Errorf("%v: expected io.EOF at end of stream, got %v", name, err)
+		}
+
+		// Truncating the stream anywhere within a frame is detected
+		var frame bytes.Buffer
+		check(t, "writing chunk", framer.WriteChunk(&frame, 200, bytes.NewReader(randomBytes(200))))
+		for n := 1; n < frame.Len(); n++ {
+			r := bufio.NewReader(bytes.NewReader(frame.Bytes()[:n]))
+			if err := framer.ReadChunk(r, &bytes.Buffer{}); err != io.ErrUnexpectedEOF {
+				t.Fatalf("%v: expected io.ErrUnexpectedEOF when truncated to %d bytes, got %v", name, n, err)
+			}
+		}
+
+		// Data shorter than announced is an error on the sending side, too
+		if err := framer.WriteChunk(&bytes.Buffer{}, 10, bytes.NewReader(make([]byte, 5))); err != io.ErrUnexpectedEOF {
+			t.Errorf("%v: expected io.ErrUnexpectedEOF when writing short data, got %v", name, err)
+		}
+
+		// Oversized frames are rejected before reading their data
+		stream.Reset()
+		check(t, "writing oversized chunk", framer.WriteChunk(&stream, chunking.MaxChunkSize+1, bytes.NewReader(make([]byte, chunking.MaxChunkSize+1))))
+		if err := framer.ReadChunk(bufio.NewReader(&stream), &bytes.Buffer{}); err != ErrProtocolViolation {
+			t.Errorf("%v: expected ErrProtocolViolation for oversized chunk, got %v", name, err)
+		}
+	}
+}
+
+func TestTransferWithChunkFramers(t *testing.T) {
+	for name, framer := range framers {
+		storeA := NewRamStorage(1024 * 1024)
+		storeB := NewRamStorage(1024 * 1024)
+		fileA := addRandomFile(t, storeA, 300000)
+
+		syncinf := &SyncInfo{}
+		syncinf.SetPermutation(shuffle.Permutation(rand.Perm(10)))
+		check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+		builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+10, "").WithChunkFramer(framer)
+		fileB := transfer(t, builder, fileA)
+		if fileB.Key() != fileA.Key() {
+			t.Errorf("%v: transferred file differs", name)
+		}
+		fileB.Dispose()
+		builder.Dispose()
+		fileA.Dispose()
+		reportUsage(t, name+" A", storeA)
+		reportUsage(t, name+" B", storeB)
+	}
+}
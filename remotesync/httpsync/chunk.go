@@ -0,0 +1,392 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking"
+	"github.com/indyjo/cafs/remotesync"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// The maximum number of keys BatchChunkHandler accepts in a single request.
+var MaxBatchSize = 1024
+
+// Function ChunkHandler returns an http.Handler serving individual chunks (or files) of a
+// FileStorage, identified by the key given as the last element of the URL path. As content is
+// immutable, responses may be cached indefinitely and carry the key as ETag. Range requests are
+// supported, allowing clients to fetch only the missing parts of large chunks. See
+// NewChunkRangeFetcher.
+func ChunkHandler(storage cafs.FileStorage) http.Handler {
+	return ChunkHandlerWithProgress(storage, nil)
+}
+
+// Function ChunkHandlerWithProgress is like ChunkHandler, but calls `cb` with the key of the file
+// being served and the number of bytes read from it so far, as reported by File.OpenWithProgress.
+// This allows reporting the progress of downloads of large files. For range requests, the bytes
+// skipped to reach the range are counted as read. A nil `cb` disables progress reports.
+func ChunkHandlerWithProgress(storage cafs.FileStorage, cb func(key cafs.SKey, read int64)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		key, err := cafs.ParseKey(path.Base(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		file, err := storage.Get(key)
+		if err == cafs.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Dispose()
+
+		w.Header().Set("ETag", fmt.Sprintf(`"%v"`, key))
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// Handles conditional, HEAD and range requests
+		rs := &fileReadSeeker{file: file}
+		if cb != nil {
+			rs.progress = func(read int64) {
+				cb(*key, read)
+			}
+		}
+		defer rs.Close()
+		http.ServeContent(w, r, "", time.Time{}, rs)
+	})
+}
+
+// Struct fileReadSeeker implements io.ReadSeeker on top of a File. Seeking reopens the file and
+// skips data up to the new position, which is acceptable for serving ranges of chunks.
+type fileReadSeeker struct {
+	file     cafs.File
+	pos      int64
+	r        io.ReadCloser    // Positioned at pos, or nil if not opened yet
+	progress func(read int64) // If set, passed to File.OpenWithProgress
+}
+
+func (f *fileReadSeeker) Read(p []byte) (int, error) {
+	if f.r == nil {
+		if f.progress != nil {
+			f.r = f.file.OpenWithProgress(f.progress)
+		} else {
+			f.r = f.file.Open()
+		}
+		if _, err := io.CopyN(ioutil.Discard, f.r, f.pos); err == io.EOF {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fileReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.file.Size()
+	}
+	if offset < 0 {
+		return 0, remotesync.ErrNegativeOffset
+	}
+	if offset != f.pos {
+		f.Close()
+		f.pos = offset
+	}
+	return offset, nil
+}
+
+func (f *fileReadSeeker) Close() {
+	if f.r != nil {
+		_ = f.r.Close()
+		f.r = nil
+	}
+}
+
+// Function NewChunkFetcher returns a remotesync.ChunkFetcher requesting chunks from a ChunkHandler
+// reachable at `baseURL`, which is followed by the chunk's key to form the URL of a chunk.
+func NewChunkFetcher(client *http.Client, baseURL string) remotesync.ChunkFetcher {
+	baseURL = strings.TrimSuffix(baseURL, "/") + "/"
+	return func(ctx context.Context, ci remotesync.ChunkInfo, w io.Writer) error {
+		req, err := http.NewRequest(http.MethodGet, baseURL+ci.Key.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET returned status %v", resp.Status)
+		}
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+}
+
+// Function NewChunkRangeFetcher returns a remotesync.RangeFetcher requesting ranges of chunks from a
+// ChunkHandler reachable at `baseURL`, which is followed by the chunk's key to form the URL of a
+// chunk. See remotesync.CompleteChunk.
+func NewChunkRangeFetcher(client *http.Client, baseURL string) remotesync.RangeFetcher {
+	baseURL = strings.TrimSuffix(baseURL, "/") + "/"
+	return func(ctx context.Context, ci remotesync.ChunkInfo, offset, length int64, w io.Writer) error {
+		req, err := http.NewRequest(http.MethodGet, baseURL+ci.Key.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// The server doesn't support ranges and sends the whole chunk
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("GET returned status %v", resp.Status)
+		}
+		_, err = io.CopyN(w, resp.Body, length)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+}
+
+// Function OpenRemoteFile fetches the SyncInfo of a file served by a FileHandler at `url` and
+// returns a remotesync.RemoteFile for random access to it. Chunks are requested on demand from a
+// ChunkHandler at `chunkURL` and cached in `storage`. The RemoteFile must eventually be disposed.
+func OpenRemoteFile(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, chunkURL, info string) (*remotesync.RemoteFile, error) {
+	syncinfo, _, err := fetchSyncInfo(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	return remotesync.NewRemoteFile(syncinfo, storage, NewChunkFetcher(client, chunkURL), info), nil
+}
+
+// Function BatchChunkHandler returns an http.Handler serving multiple chunks of a FileStorage per
+// request. Clients POST a JSON array of at most MaxBatchSize keys and receive the chunks' data in
+// the same order, each framed as by remotesync.VarintFramer. If any of the chunks is missing, the
+// request fails with 404 Not Found before any data is sent. See FetchChunks for a client.
+func BatchChunkHandler(storage cafs.FileStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		keys, err := decodeKeys(http.MaxBytesReader(w, r.Body, maxBatchRequestSize()), MaxBatchSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Lock all chunks before sending any of them
+		files := make([]cafs.File, 0, len(keys))
+		defer func() {
+			for _, file := range files {
+				file.Dispose()
+			}
+		}()
+		for _, key := range keys {
+			file, err := storage.Get(&key)
+			if err == cafs.ErrNotFound {
+				http.Error(w, fmt.Sprintf("chunk %v not found", key), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			files = append(files, file)
+			if file.Size() > chunking.MaxChunkSize {
+				http.Error(w, fmt.Sprintf("%v is not a chunk", key), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		bw := bufio.NewWriter(w)
+		for _, file := range files {
+			rc := file.Open()
+			err := remotesync.VarintFramer{}.WriteChunk(bw, file.Size(), rc)
+			rc.Close()
+			if err != nil {
+				return
+			}
+		}
+		_ = bw.Flush()
+	})
+}
+
+// Function maxBatchRequestSize returns the maximum size of a request body accepted by
+// BatchChunkHandler. It leaves room for some whitespace around each of MaxBatchSize keys.
+func maxBatchRequestSize() int64 {
+	return int64(MaxBatchSize+1) * (2*cafs.KeySize + 16)
+}
+
+// Function decodeKeys decodes a JSON array of at most `max` keys from `r`. Decodes one key at a
+// time, so that requests with too many keys are rejected without reading all of them.
+func decodeKeys(r io.Reader, max int) ([]cafs.SKey, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('[') {
+		return nil, fmt.Errorf("expected array of keys")
+	}
+	var keys []cafs.SKey
+	for dec.More() {
+		if len(keys) == max {
+			return nil, fmt.Errorf("too many keys (maximum is %d)", max)
+		}
+		var key cafs.SKey
+		if err := dec.Decode(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Function FetchChunks retrieves the chunks identified by `keys` from a BatchChunkHandler at `url`,
+// except for those already present in `storage`. Missing chunks are requested in batches of at
+// most `batchSize` keys, or MaxBatchSize if not positive. They are verified and put into
+// `storage`, named `info`. Returns the chunks in the order of `keys`, each of which must be
+// disposed. On error, no chunks are returned, but those received remain in storage as cache data.
+func FetchChunks(ctx context.Context, storage cafs.FileStorage, client *http.Client, url string, keys []cafs.SKey, batchSize int, info string) (files []cafs.File, err error) {
+	files = make([]cafs.File, len(keys))
+	defer func() {
+		if err != nil {
+			for _, file := range files {
+				if file != nil {
+					file.Dispose()
+				}
+			}
+			files = nil
+		}
+	}()
+
+	if batchSize <= 0 {
+		batchSize = MaxBatchSize
+	}
+
+	var missing []int // Indices of keys to request
+	requested := make(map[cafs.SKey]bool)
+	for i, key := range keys {
+		if file, err := storage.Get(&key); err == nil {
+			files[i] = file
+		} else if !requested[key] {
+			requested[key] = true
+			missing = append(missing, i)
+		}
+	}
+
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > batchSize {
+			n = batchSize
+		}
+		if err = fetchBatch(ctx, storage, client, url, keys, missing[:n], files, info); err != nil {
+			return
+		}
+		missing = missing[n:]
+	}
+
+	// Fill in keys occurring repeatedly
+	for i, key := range keys {
+		if files[i] == nil {
+			if files[i], err = storage.Get(&key); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Function fetchBatch requests the chunks at indices `batch` of `keys` and stores them into `files`.
+func fetchBatch(ctx context.Context, storage cafs.FileStorage, client *http.Client, url string, keys []cafs.SKey, batch []int, files []cafs.File, info string) error {
+	batchKeys := make([]cafs.SKey, len(batch))
+	for i, idx := range batch {
+		batchKeys[i] = keys[idx]
+	}
+	body, err := json.Marshal(batchKeys)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST returned status %v", resp.Status)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for i, idx := range batch {
+		temp := storage.CreateWithKey(info, batchKeys[i])
+		err := remotesync.VarintFramer{}.ReadChunk(r, temp)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = temp.Close()
+		}
+		if err == nil {
+			files[idx] = temp.File()
+		}
+		temp.Dispose()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -24,16 +24,20 @@ import (
 	"github.com/indyjo/cafs/ram"
 	"github.com/indyjo/cafs/remotesync"
 	"github.com/indyjo/cafs/remotesync/httpsync"
-	"io"
+	"github.com/indyjo/cafs/remotesync/shuffle"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"runtime/pprof"
 )
 
 var storage cafs.FileStorage = ram.NewRamStorage(1 << 30)
-var fileHandlers = make(map[string]*httpsync.FileHandler)
+
+// Keeps loaded files from being evicted from storage
+var loadedFiles = make(map[string]cafs.File)
+
+// Progress of interrupted loads, by path
+var ingestStates = make(map[string]*cafs.IngestState)
 
 func main() {
 	addr := ":8080"
@@ -42,6 +46,10 @@ func main() {
 	preload := ""
 	flag.StringVar(&preload, "i", preload, "input file to load")
 
+	seed := int64(0)
+	flag.Int64Var(&seed, "seed", seed,
+		"seed of the permutation used when serving files, for reproducible runs (real servers should use a crypto-random permutation)")
+
 	flag.BoolVar(&remotesync.LoggingEnabled, "enable-remotesync-logging", remotesync.LoggingEnabled,
 		"enables detailed logging from the remotesync algorithm")
 
@@ -53,6 +61,12 @@ func main() {
 		}
 	}
 
+	printer := log.New(os.Stderr, "", log.LstdFlags)
+	http.Handle("/file/", httpsync.NewMultiFileHandler(storage).
+		WithPermutation(shuffle.RandomSeeded(256, seed)).
+		WithPrinter(printer))
+	http.Handle("/chunk/", httpsync.ChunkHandler(storage))
+	http.Handle("/chunks", httpsync.BatchChunkHandler(storage))
 	http.HandleFunc("/load", handleLoad)
 	http.HandleFunc("/sync", handleSyncFrom)
 	http.HandleFunc("/stackdump", func(w http.ResponseWriter, r *http.Request) {
@@ -82,30 +96,27 @@ func loadFile(storage cafs.FileStorage, path string) (err error) {
 	if err != nil {
 		return
 	}
+	defer f.Close()
 
-	tmp := storage.Create(path)
-	defer tmp.Dispose()
-	n, err := io.Copy(tmp, f)
-	if err != nil {
-		return fmt.Errorf("error after copying %v bytes: %v", n, err)
+	state := ingestStates[path]
+	if state == nil {
+		state = &cafs.IngestState{}
+		ingestStates[path] = state
 	}
-
-	err = tmp.Close()
+	file, err := cafs.IngestResumable(storage, f, path, state)
 	if err != nil {
+		log.Printf("Loading %v interrupted after %v bytes, will resume on next attempt", path, state.Offset())
 		return
 	}
+	delete(ingestStates, path)
+	log.Printf("Read file: %v (%v bytes, chunked: %v, %v chunks)", path, file.Size(), file.IsChunked(), file.NumChunks())
 
-	file := tmp.File()
-	defer file.Dispose()
-	log.Printf("Read file: %v (%v bytes, chunked: %v, %v chunks)", path, n, file.IsChunked(), file.NumChunks())
-
-	printer := log.New(os.Stderr, "", log.LstdFlags)
-	handler := httpsync.NewFileHandlerFromFile(file, rand.Perm(256)).WithPrinter(printer)
-	fileHandlers[file.Key().String()] = handler
+	if previous, ok := loadedFiles[file.Key().String()]; ok {
+		previous.Dispose()
+	}
+	loadedFiles[file.Key().String()] = file
 
-	path = fmt.Sprintf("/file/%v", file.Key().String()[:16])
-	http.Handle(path, handler)
-	log.Printf("  serving under %v", path)
+	log.Printf("  serving under /file/%v", file.Key())
 	return
 }
 
@@ -126,6 +137,15 @@ func handleSyncFrom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	source := r.FormValue("source")
+	if r.FormValue("estimate") != "" {
+		bytesToSend, chunksToSend, err := httpsync.EstimateSyncFrom(r.Context(), storage, http.DefaultClient, source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "%v bytes in %v chunks to transfer\n", bytesToSend, chunksToSend)
+		return
+	}
 	if err := syncFile(storage, source); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
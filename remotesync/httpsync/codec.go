@@ -0,0 +1,250 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interface Codec specifies a content encoding that can be used for transferring a SyncInfo
+// over HTTP. Codecs are negotiated using the Accept-Encoding and Content-Encoding headers.
+type Codec interface {
+	// Returns the token identifying the codec in HTTP headers, e.g. "gzip".
+	Name() string
+	// Returns a WriteCloser compressing into w. Must be closed to flush remaining data.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// Returns a ReadCloser decompressing from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Variable DefaultCodecs lists the codecs offered by SyncFrom and accepted by FileHandlers,
+// in order of preference. If no codec can be agreed on, the SyncInfo is sent uncompressed.
+var DefaultCodecs = []Codec{ZstdCodec, GzipCodec}
+
+// Codec using the zstd compression algorithm.
+var ZstdCodec Codec = zstdCodec{}
+
+// Codec using the gzip compression algorithm.
+var GzipCodec Codec = gzipCodec{}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if d, err := zstd.NewReader(r); err != nil {
+		return nil, err
+	} else {
+		return zstdReadCloser{d}, nil
+	}
+}
+
+// Struct zstdReadCloser adapts a zstd.Decoder, whose Close method doesn't return an error,
+// to the io.ReadCloser interface.
+type zstdReadCloser struct {
+	d *zstd.Decoder
+}
+
+func (z zstdReadCloser) Read(p []byte) (int, error) {
+	return z.d.Read(p)
+}
+
+func (z zstdReadCloser) Close() error {
+	z.d.Close()
+	return nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// Function acceptEncoding returns the value of an Accept-Encoding header offering the given codecs.
+func acceptEncoding(codecs []Codec) string {
+	names := make([]string, 0, len(codecs)+1)
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	names = append(names, "identity")
+	return strings.Join(names, ", ")
+}
+
+// Function negotiateCodec returns the first of the given codecs that is acceptable according
+// to an Accept-Encoding header, or nil if the content should be sent uncompressed.
+func negotiateCodec(codecs []Codec, header string) Codec {
+	accepted := make(map[string]bool)
+	for _, token := range strings.Split(header, ",") {
+		params := strings.Split(token, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		ok := true
+		for _, p := range params[1:] {
+			if q := strings.Replace(p, " ", "", -1); q == "q=0" || strings.HasPrefix(q, "q=0.") && strings.Trim(q[4:], "0") == "" {
+				ok = false
+			}
+		}
+		accepted[name] = ok
+	}
+	for _, c := range codecs {
+		if accepted[c.Name()] {
+			return c
+		}
+	}
+	return nil
+}
+
+// Function decodingReader returns a reader decoding the content of r according to a
+// Content-Encoding header, using one of the given codecs.
+func decodingReader(codecs []Codec, r io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	name := strings.ToLower(strings.TrimSpace(contentEncoding))
+	if name == "" || name == "identity" {
+		return ioutil.NopCloser(r), nil
+	}
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c.NewReader(r)
+		}
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %v", contentEncoding)
+}
+
+// Variable WishListFlushDelay specifies how long the wishlist compressed by SyncFrom must be idle
+// before being flushed. Regardless, it is flushed at the latest ten times this duration after data
+// was first held back. See WithCompressedWishList.
+var WishListFlushDelay = 5 * time.Millisecond
+
+// Struct delayedFlushWriter implements remotesync.FlushWriter by compressing the data written to
+// it. As flushing a compressor costs a few bytes each time, and WriteWishList flushes after every
+// byte, Flush merely schedules a flush of the compressed stream once no more data has been written
+// for a while. As long as WriteWishList doesn't wait for chunk data, it keeps writing, so flushes
+// are effectively coalesced until the wishlist is needed by the sender.
+type delayedFlushWriter struct {
+	m       sync.Mutex
+	cw      io.WriteCloser
+	flush   func() error
+	delay   time.Duration
+	timer   *time.Timer
+	gen     int       // identifies the current timer
+	pending time.Time // time the first flush was requested since the last flush
+	err     error
+	closed  bool
+}
+
+// Function newDelayedFlushWriter returns a delayedFlushWriter compressing into w using `codec`,
+// whose writers must support flushing.
+func newDelayedFlushWriter(codec Codec, w io.Writer, delay time.Duration) (*delayedFlushWriter, error) {
+	cw, err := codec.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	flusher, ok := cw.(interface{ Flush() error })
+	if !ok {
+		_ = cw.Close()
+		return nil, fmt.Errorf("%v writer doesn't support flushing", codec.Name())
+	}
+	return &delayedFlushWriter{cw: cw, flush: flusher.Flush, delay: delay}, nil
+}
+
+func (d *delayedFlushWriter) Write(p []byte) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.cw.Write(p)
+}
+
+// Schedules a flush after the delay, postponing a flush already scheduled unless data has been
+// held back for too long.
+func (d *delayedFlushWriter) Flush() {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.closed {
+		return
+	}
+	now := time.Now()
+	if d.timer == nil {
+		d.pending = now
+	} else if now.Sub(d.pending)+d.delay > 10*d.delay {
+		return
+	} else {
+		d.timer.Stop()
+	}
+	d.gen++
+	gen := d.gen
+	d.timer = time.AfterFunc(d.delay, func() {
+		d.m.Lock()
+		defer d.m.Unlock()
+		if d.gen == gen && d.timer != nil {
+			d.timer = nil
+			d.flushL()
+		}
+	})
+}
+
+// Flushes the compressed stream immediately. Errors are reported by the next call to Write or Close.
+func (d *delayedFlushWriter) flushNow() {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.flushL()
+}
+
+func (d *delayedFlushWriter) flushL() {
+	if !d.closed && d.err == nil {
+		d.err = d.flush()
+	}
+}
+
+// Stops flushing and writes the remainder of the compressed stream. Doesn't close the underlying
+// writer.
+func (d *delayedFlushWriter) Close() error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.closed {
+		return d.err
+	}
+	d.closed = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if err := d.cw.Close(); d.err == nil {
+		d.err = err
+	}
+	return d.err
+}
@@ -21,17 +21,39 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/remotesync"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// Error ErrSyncInfoMismatch is returned by SyncFromVerified when the SyncInfo fetched doesn't
+// match the expected digest.
+var ErrSyncInfoMismatch = errors.New("SyncInfo doesn't match expected digest")
+
+// Transfers served by a FileHandler are aborted after this duration by default. See
+// FileHandler.WithTransferTimeout.
+var DefaultTransferTimeout = 10 * time.Minute
+
+// Headers carrying a file's metadata in responses to HEAD requests. See Probe.
+const (
+	headerSize      = "X-Cafs-Size"
+	headerChunks    = "X-Cafs-Chunks"
+	headerDigest    = "X-Cafs-Digest"
+	headerAvailable = "X-Cafs-Available"
+)
+
+// Error ErrNotReady is returned by FileHandler.Ready when too few of the chunks to serve are present.
+var ErrNotReady = errors.New("not enough chunks present")
+
 // Struct FileHandler implements the http.Handler interface and serves a file over HTTP.
 // The protocol used matches with function SyncFrom.
 // Create using the New... functions.
@@ -40,6 +62,11 @@ type FileHandler struct {
 	source   chunksSource
 	syncinfo *remotesync.SyncInfo
 	log      cafs.Printer
+	codecs   []Codec
+	limiter  *transferLimiter
+	timeout  time.Duration
+	minReady float64
+	err      error // set if the handler can't serve its file at all
 }
 
 // It is the owner's responsibility to correctly dispose of FileHandler instances.
@@ -54,15 +81,22 @@ func (handler *FileHandler) Dispose() {
 	}
 }
 
-// Function NewFileHandlerFromFile creates a FileHandler that serves chunks of a File.
+// Function NewFileHandlerFromFile creates a FileHandler that serves chunks of a File, using
+// permutation `perm` as is. See shuffle.Permutation.Truncate for fitting it to file.NumChunks().
+// If the file contains a chunk exceeding chunking.MaxChunkSize, the FileHandler responds to all
+// requests with an error and Ready returns remotesync.ErrChunkTooLarge.
 func NewFileHandlerFromFile(file cafs.File, perm shuffle.Permutation) *FileHandler {
 	result := &FileHandler{
 		m:        sync.Mutex{},
-		source:   fileBasedChunksSource{file: file.Duplicate()},
+		source:   &fileBasedChunksSource{file: file.Duplicate()},
 		syncinfo: &remotesync.SyncInfo{Perm: perm},
 		log:      cafs.NewWriterPrinter(ioutil.Discard),
+		codecs:   DefaultCodecs,
+		timeout:  DefaultTransferTimeout,
+	}
+	if err := result.syncinfo.SetChunksFromFile(file); err != nil {
+		result.err = err
 	}
-	result.syncinfo.SetChunksFromFile(file)
 	return result
 }
 
@@ -79,6 +113,8 @@ func NewFileHandlerFromSyncInfo(syncinfo *remotesync.SyncInfo, storage cafs.File
 		},
 		syncinfo: syncinfo,
 		log:      cafs.NewWriterPrinter(ioutil.Discard),
+		codecs:   DefaultCodecs,
+		timeout:  DefaultTransferTimeout,
 	}
 	return result
 }
@@ -89,11 +125,85 @@ func (handler *FileHandler) WithPrinter(printer cafs.Printer) *FileHandler {
 	return handler
 }
 
+// Sets the codecs the FileHandler may use for compressing the SyncInfo, in order of preference.
+// Passing no codecs disables compression.
+func (handler *FileHandler) WithCodecs(codecs ...Codec) *FileHandler {
+	handler.codecs = codecs
+	return handler
+}
+
+// Limits the number of transfers the FileHandler serves concurrently to `n`. Further requests wait
+// at most `wait` for a transfer to finish and are then rejected with 503 Service Unavailable.
+// Passing a non-positive `n` removes the limit.
+func (handler *FileHandler) WithTransferLimit(n int, wait time.Duration) *FileHandler {
+	handler.limiter = newTransferLimiter(n, wait)
+	return handler
+}
+
+// Limits the time a transfer may take, including receiving the wishlist and waiting for chunks, to
+// `d`. Transfers exceeding it, e.g. because the client reads very slowly, are aborted, releasing
+// the chunks held for them. Passing a non-positive `d` removes the limit. Defaults to
+// DefaultTransferTimeout.
+func (handler *FileHandler) WithTransferTimeout(d time.Duration) *FileHandler {
+	handler.timeout = d
+	return handler
+}
+
+// Sets the fraction of chunks, between 0 and 1, that must be present in storage for Ready to
+// succeed. Only relevant for FileHandlers created using NewFileHandlerFromSyncInfo, which are
+// always ready by default.
+func (handler *FileHandler) WithReadyFraction(fraction float64) *FileHandler {
+	handler.minReady = fraction
+	return handler
+}
+
+// Function Ready returns nil if the FileHandler is able to serve its file, which makes it suitable
+// for health checks. Returns remotesync.ErrDisposed if the FileHandler has been disposed, or the
+// error that prevented it from being set up, e.g. remotesync.ErrChunkTooLarge. For a
+// FileHandler created using NewFileHandlerFromSyncInfo, returns ErrNotReady unless the fraction
+// of chunks set using WithReadyFraction is present, or the storage's error if it fails. As only a
+// sample of the chunks is looked up, Ready is cheap enough to be called frequently.
+func (handler *FileHandler) Ready() error {
+	handler.m.Lock()
+	source := handler.source
+	handler.m.Unlock()
+	if source == nil {
+		return remotesync.ErrDisposed
+	} else if handler.err != nil {
+		return handler.err
+	}
+	available, err := source.Available()
+	if err != nil {
+		return err
+	} else if available < handler.minReady {
+		return ErrNotReady
+	}
+	return nil
+}
+
+// Serves the SyncInfo on GET, chunk data on POST and the file's metadata on HEAD (see Probe).
+// Responds with 410 Gone once the FileHandler has been disposed.
 func (handler *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler.err != nil {
+		handler.log.Printf("Unable to serve file: %v", handler.err)
+		http.Error(w, handler.err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Dispose may be called concurrently, so take a consistent snapshot
+	handler.m.Lock()
+	source, syncinfo := handler.source, handler.syncinfo
+	handler.m.Unlock()
+	if source == nil {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+
 	if r.Method == http.MethodGet {
-		if err := json.NewEncoder(w).Encode(handler.syncinfo); err != nil {
-			handler.log.Printf("Error serving SyncInfo: R%v", err)
-		}
+		handler.serveSyncInfo(w, r, syncinfo)
+		return
+	} else if r.Method == http.MethodHead {
+		handler.serveProbe(w, source, syncinfo)
 		return
 	} else if r.Method != http.MethodPost {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -106,8 +216,43 @@ func (handler *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chunks, err := handler.source.GetChunks()
+	if handler.limiter != nil {
+		if !handler.limiter.acquire(r.Context()) {
+			handler.log.Printf("Too many transfers in flight, rejecting request")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer handler.limiter.release()
+	}
+
+	ctx := r.Context()
+	if handler.timeout > 0 {
+		deadline := time.Now().Add(handler.timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+		// Also interrupt reads and writes blocking on the client. The ResponseWriters of package
+		// net/http support this since Go 1.20, others might not.
+		if d, ok := w.(deadlineSetter); ok {
+			_ = d.SetReadDeadline(deadline)
+			_ = d.SetWriteDeadline(deadline)
+		}
+	}
+
+	wishlist, err := decodingReader(handler.codecs, r.Body, r.Header.Get("Content-Encoding"))
 	if err != nil {
+		handler.log.Printf("Unable to decode wishlist: %v", err)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	defer wishlist.Close()
+
+	chunks, err := source.GetChunks(ctx)
+	if err == remotesync.ErrDisposed {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	} else if err != nil {
 		handler.log.Printf("GetChunks() failed: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -117,15 +262,16 @@ func (handler *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
 
+	totalBytes := syncinfo.TotalSize()
 	var bytesSkipped, bytesTransferred int64
 	cb := func(toTransfer, transferred int64) {
-		bytesSkipped = -toTransfer
+		bytesSkipped = totalBytes - toTransfer
 		bytesTransferred = transferred
 	}
 	handler.log.Printf("Calling WriteChunkData")
 	start := time.Now()
-	err = remotesync.WriteChunkData(chunks, 0, bufio.NewReader(r.Body), handler.syncinfo.Perm,
-		remotesync.SimpleFlushWriter{w, w.(http.Flusher)}, cb)
+	err = syncinfo.WriteChunkData(ctx, chunks, bufio.NewReader(wishlist),
+		remotesync.SimpleFlushWriter{W: w, F: w.(http.Flusher)}, cb)
 	duration := time.Since(start)
 	speed := float64(bytesTransferred) / duration.Seconds()
 	handler.log.Printf("WriteChunkData took %v. KBytes transferred: %v (%.2f/s) skipped: %v",
@@ -136,25 +282,192 @@ func (handler *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Function serveSyncInfo writes the SyncInfo as JSON, compressed using the first of the handler's
+// codecs accepted by the client.
+func (handler *FileHandler) serveSyncInfo(w http.ResponseWriter, r *http.Request, syncinfo *remotesync.SyncInfo) {
+	// Advertise the codecs accepted for compressing the wishlist
+	w.Header().Set("Accept-Encoding", acceptEncoding(handler.codecs))
+	serveJSON(w, r, syncinfo, handler.codecs, handler.log)
+}
+
+// Function serveProbe responds with headers carrying the file's size, chunk count, SyncInfo digest
+// and the fraction of chunks available, but without a body.
+func (handler *FileHandler) serveProbe(w http.ResponseWriter, source chunksSource, syncinfo *remotesync.SyncInfo) {
+	available, err := source.Available()
+	if err == remotesync.ErrDisposed {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	} else if err != nil {
+		handler.log.Printf("Unable to determine available chunks: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(headerSize, strconv.FormatInt(syncinfo.TotalSize(), 10))
+	w.Header().Set(headerChunks, strconv.Itoa(syncinfo.ChunkCount()))
+	w.Header().Set(headerDigest, syncinfo.Digest().String())
+	w.Header().Set(headerAvailable, strconv.FormatFloat(available, 'f', -1, 64))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Function serveJSON writes `v` as JSON, compressed using the first of `codecs` accepted by the client.
+func serveJSON(w http.ResponseWriter, r *http.Request, v interface{}, codecs []Codec, log cafs.Printer) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	codec := negotiateCodec(codecs, r.Header.Get("Accept-Encoding"))
+	if codec == nil {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Printf("Error serving JSON: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Encoding", codec.Name())
+	cw, err := codec.NewWriter(w)
+	if err != nil {
+		log.Printf("Error creating %v writer: %v", codec.Name(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(cw).Encode(v); err != nil {
+		log.Printf("Error serving JSON: %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		log.Printf("Error closing %v writer: %v", codec.Name(), err)
+	}
+}
+
+// Type SyncOption configures optional behavior of SyncFrom and SyncFromVerified.
+type SyncOption func(*syncOptions)
+
+type syncOptions struct {
+	scratch            cafs.FileStorage
+	coord              *remotesync.ChunkCoordinator
+	compressedWishList bool
+	rng                *remotesync.ByteRange
+}
+
+// Function newSyncOptions applies `opts` to the default options for syncing into `storage`.
+func newSyncOptions(storage cafs.FileStorage, opts []SyncOption) syncOptions {
+	options := syncOptions{scratch: storage}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// Function WithScratchStorage makes SyncFrom keep received chunks and the partially reconstructed
+// file in `scratch` instead of the main storage. Scratch data is released when SyncFrom returns,
+// leaving at most unlocked cache data in `scratch`. Only if the transfer succeeds, the file is
+// copied into the main storage. See remotesync.Builder.WithScratchStorage.
+func WithScratchStorage(scratch cafs.FileStorage) SyncOption {
+	return func(o *syncOptions) {
+		o.scratch = scratch
+	}
+}
+
+// Function WithChunkCoordinator makes concurrent calls to SyncFrom using the same coordinator
+// share the transfer of chunks they all miss, instead of each requesting them from the remote.
+// All such calls must use the same storage. See remotesync.ChunkCoordinator.
+func WithChunkCoordinator(coord *remotesync.ChunkCoordinator) SyncOption {
+	return func(o *syncOptions) {
+		o.coord = coord
+	}
+}
+
+// Function WithCompressedWishList makes SyncFrom compress the wishlist it uploads using one of the
+// DefaultCodecs, if the FileHandler accepts any. This pays off for files with many chunks when
+// long runs of chunks are either all present or all missing. To allow the compressor to work on
+// more than a byte at a time, the wishlist is flushed with a delay of up to WishListFlushDelay.
+func WithCompressedWishList() SyncOption {
+	return func(o *syncOptions) {
+		o.compressedWishList = true
+	}
+}
+
+// Function WithRange makes SyncFrom fetch only the chunks overlapping the byte range `r` of the
+// remote file. The file returned contains just the bytes of the range, not the whole file. See
+// remotesync.Builder.WithRange.
+func WithRange(r remotesync.ByteRange) SyncOption {
+	return func(o *syncOptions) {
+		o.rng = &r
+	}
+}
+
 // Function SyncFrom uses an HTTP client to connect to some URL and download a fie into the
 // given FileStorage.
-func SyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string) (file cafs.File, err error) {
+//
+// Each call issues a GET request for the SyncInfo and a POST request for the chunk data. As the
+// latter streams data in both directions, it requires a connection of its own, which is closed
+// afterwards. Only connections used for fetching SyncInfos are kept alive and reused. When syncing
+// many files, possibly concurrently, use a client whose transport keeps at least as many idle
+// connections per host as there are concurrent calls, e.g. one created by NewClient, and share it
+// among all calls. Any client with a tuned transport may be passed instead.
+//
+// If `ctx` carries a remotesync.Tracer (see remotesync.WithTracer), spans are created for the
+// sync as a whole and its phases: fetching the SyncInfo, writing the wishlist and reconstructing
+// the file from the chunks transferred.
+func SyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string, opts ...SyncOption) (file cafs.File, err error) {
+	return syncFrom(ctx, storage, client, url, info, nil, opts)
+}
+
+// Function NewClient returns an HTTP client suitable for many calls to SyncFrom, keeping up to
+// `maxIdleConnsPerHost` idle connections to each host for reuse. Use the number of concurrent
+// calls to SyncFrom. Other settings are taken from http.DefaultTransport.
+func NewClient(maxIdleConnsPerHost int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	if transport.MaxIdleConns != 0 && transport.MaxIdleConns < maxIdleConnsPerHost {
+		transport.MaxIdleConns = maxIdleConnsPerHost
+	}
+	return &http.Client{Transport: transport}
+}
+
+// Function SyncFromVerified works like SyncFrom but additionally requires the SyncInfo fetched
+// from the remote to match `digest` (see remotesync.SyncInfo.Digest), which must have been obtained
+// from a trusted source. Returns ErrSyncInfoMismatch otherwise.
+func SyncFromVerified(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string, digest cafs.SKey, opts ...SyncOption) (file cafs.File, err error) {
+	return syncFrom(ctx, storage, client, url, info, &digest, opts)
+}
+
+func syncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string, digest *cafs.SKey, opts []SyncOption) (file cafs.File, err error) {
+	options := newSyncOptions(storage, opts)
+	ctx, span := remotesync.StartSpan(ctx, "httpsync.SyncFrom")
+	span.SetAttribute("url", url)
+	defer func() { span.End(err) }()
+
 	// Fetch SyncInfo from remote
-	resp, err := client.Get(url)
+	syncinfo, uploadCodec, err := fetchSyncInfo(ctx, client, url)
 	if err != nil {
 		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GET returned status %v", resp.Status)
+	if !options.compressedWishList {
+		uploadCodec = nil
 	}
-	var syncinfo remotesync.SyncInfo
-	err = json.NewDecoder(resp.Body).Decode(&syncinfo)
-	if err != nil {
+	if digest != nil && syncinfo.Digest() != *digest {
+		err = ErrSyncInfoMismatch
 		return
 	}
+	return transfer(ctx, storage, client, url, info, syncinfo, uploadCodec, options)
+}
+
+// Function transfer reconstructs the file described by `syncinfo`, which has been obtained from
+// the FileHandler at `url`, requesting missing chunks from it. The wishlist is compressed using
+// `uploadCodec` unless it is nil.
+func transfer(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string, syncinfo *remotesync.SyncInfo, uploadCodec Codec, options syncOptions) (file cafs.File, err error) {
+	if remotesync.LoggingEnabled {
+		present, total := syncinfo.OverlapWith(storage)
+		log.Printf("SyncFrom: %v of %v chunks already present", present, total)
+	}
 
 	// Create Builder and establish a bidirectional POST connection
-	builder := remotesync.NewBuilder(storage, &syncinfo, 32, info)
+	builder := remotesync.NewBuilder(storage, syncinfo, 32, info).
+		WithScratchStorage(options.scratch).
+		WithTraceContext(ctx)
+	if options.coord != nil {
+		builder.WithChunkCoordinator(options.coord)
+	}
+	if options.rng != nil {
+		builder.WithRange(*options.rng)
+	}
 	defer builder.Dispose()
 
 	pr, pw := io.Pipe()
@@ -169,8 +482,39 @@ func SyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client
 	// Trick Go's HTTP server implementation into allowing bi-directional data flow
 	req.Header.Set("Connection", "close")
 
+	var wishlist remotesync.FlushWriter = remotesync.NopFlushWriter{W: pw}
+	var compressor *delayedFlushWriter
+	if uploadCodec != nil {
+		if compressor, err = newDelayedFlushWriter(uploadCodec, pw, WishListFlushDelay); err != nil {
+			return
+		}
+		req.Header.Set("Content-Encoding", uploadCodec.Name())
+		wishlist = compressor
+	}
+
+	// On return, make sure the goroutine writing the wishlist terminates: Closing the pipe unblocks
+	// writes in case the request body isn't consumed, e.g. because client.Do failed, and disposing
+	// the builder unblocks WriteWishList waiting for the reconstruction to catch up.
+	wishlistDone := make(chan struct{})
+	defer func() {
+		_ = pr.CloseWithError(errTransferFinished)
+		builder.Dispose()
+		<-wishlistDone
+	}()
+
 	go func() {
-		if err := builder.WriteWishList(remotesync.NopFlushWriter{pw}); err != nil {
+		defer close(wishlistDone)
+		if compressor != nil {
+			// Send the compressed stream's header right away, as the FileHandler waits for it
+			compressor.flushNow()
+		}
+		err := builder.WriteWishList(wishlist)
+		if compressor != nil {
+			if errClose := compressor.Close(); err == nil {
+				err = errClose
+			}
+		}
+		if err != nil {
 			_ = pw.CloseWithError(fmt.Errorf("error in WriteWishList: %v", err))
 			return
 		}
@@ -181,6 +525,134 @@ func SyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client
 	if err != nil {
 		return
 	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("POST returned status %v", res.Status)
+		return
+	}
 	file, err = builder.ReconstructFileFromRequestedChunks(res.Body)
 	return
 }
+
+// Error errTransferFinished is reported to the wishlist writer if the transfer ends before the
+// wishlist has been written completely.
+var errTransferFinished = errors.New("transfer finished")
+
+// Function EstimateSyncFrom fetches the SyncInfo from some URL and determines how much chunk data
+// SyncFrom would have to transfer into the given FileStorage, without transferring any of it.
+// See remotesync.EstimateTransfer.
+func EstimateSyncFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client, url string) (bytesToSend int64, chunksToSend int, err error) {
+	syncinfo, _, err := fetchSyncInfo(ctx, client, url)
+	if err != nil {
+		return
+	}
+	bytesToSend, chunksToSend = remotesync.EstimateTransfer(syncinfo, storage)
+	return
+}
+
+// Struct ProbeInfo describes a file served by a FileHandler, as returned by Probe.
+type ProbeInfo struct {
+	Size   int64     // The file's size in bytes
+	Chunks int       // The number of chunks
+	Digest cafs.SKey // The digest of the SyncInfo, see SyncFromVerified
+	// The estimated fraction of chunks, between 0 and 1, that the FileHandler can send without
+	// waiting. Only FileHandlers created using NewFileHandlerFromSyncInfo report less than 1.
+	Available float64
+}
+
+// Function Probe requests a file's metadata from a FileHandler using a HEAD request, which is much
+// cheaper than fetching the SyncInfo. Can be used to check whether a file exists before calling
+// SyncFrom.
+func Probe(ctx context.Context, client *http.Client, url string) (_ *ProbeInfo, err error) {
+	ctx, span := remotesync.StartSpan(ctx, "httpsync.Probe")
+	defer func() { span.End(err) }()
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HEAD returned status %v", resp.Status)
+	}
+
+	var info ProbeInfo
+	if info.Size, err = strconv.ParseInt(resp.Header.Get(headerSize), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid %v header: %v", headerSize, err)
+	}
+	if info.Chunks, err = strconv.Atoi(resp.Header.Get(headerChunks)); err != nil {
+		return nil, fmt.Errorf("invalid %v header: %v", headerChunks, err)
+	}
+	digest, err := cafs.ParseKey(resp.Header.Get(headerDigest))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v header: %v", headerDigest, err)
+	}
+	info.Digest = *digest
+	if info.Available, err = strconv.ParseFloat(resp.Header.Get(headerAvailable), 64); err != nil {
+		return nil, fmt.Errorf("invalid %v header: %v", headerAvailable, err)
+	}
+	return &info, nil
+}
+
+// Function fetchSyncInfo requests a SyncInfo from a FileHandler, offering to receive it compressed
+// using one of the DefaultCodecs. Also returns the first of the DefaultCodecs the FileHandler
+// accepts for compressing the wishlist, or nil if there is none.
+func fetchSyncInfo(ctx context.Context, client *http.Client, url string) (_ *remotesync.SyncInfo, _ Codec, err error) {
+	ctx, span := remotesync.StartSpan(ctx, "httpsync.FetchSyncInfo")
+	defer func() { span.End(err) }()
+
+	var syncinfo remotesync.SyncInfo
+	uploadCodec, err := fetchJSON(ctx, client, url, &syncinfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !syncinfo.Perm.IsValid() {
+		return nil, nil, remotesync.ErrInvalidPermutation
+	}
+	span.SetAttribute("chunks", syncinfo.ChunkCount())
+	span.SetAttribute("bytes", syncinfo.TotalSize())
+	return &syncinfo, uploadCodec, nil
+}
+
+// Function fetchJSON requests a JSON document from `url` and decodes it into `v`, offering to
+// receive it compressed using one of the DefaultCodecs. Also returns the first of the DefaultCodecs
+// the server accepts for compressing uploads, or nil if there is none.
+func fetchJSON(ctx context.Context, client *http.Client, url string, v interface{}) (Codec, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept-Encoding", acceptEncoding(DefaultCodecs))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET returned status %v", resp.Status)
+	}
+
+	body, err := decodingReader(DefaultCodecs, resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return nil, err
+	}
+	return negotiateCodec(DefaultCodecs, resp.Header.Get("Accept-Encoding")), nil
+}
+
+// Interface deadlineSetter is implemented by ResponseWriters that can limit the time spent
+// blocking on the client's connection.
+type deadlineSetter interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
@@ -0,0 +1,1468 @@
+package httpsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking"
+	"github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func addRandomData(t *testing.T, s cafs.FileStorage, size int) cafs.File {
+	temp := s.Create("random data")
+	defer temp.Dispose()
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(rand.Int())
+	}
+	if _, err := temp.Write(buf); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	return temp.File()
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, store, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	for _, c := range []struct {
+		acceptEncoding, contentEncoding string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"zstd", "zstd"},
+		{"gzip, zstd", "zstd"},
+		{"zstd;q=0, gzip", "gzip"},
+		{"br", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if enc := rec.Header().Get("Content-Encoding"); enc != c.contentEncoding {
+			t.Errorf("Accept-Encoding %#v: expected Content-Encoding %#v, got %#v", c.acceptEncoding, c.contentEncoding, enc)
+			continue
+		}
+		body, err := decodingReader(DefaultCodecs, rec.Body, rec.Header().Get("Content-Encoding"))
+		if err != nil {
+			t.Fatalf("Accept-Encoding %#v: error decoding: %v", c.acceptEncoding, err)
+		}
+		var syncinfo struct{ Chunks []interface{} }
+		if err := json.NewDecoder(body).Decode(&syncinfo); err != nil {
+			t.Fatalf("Accept-Encoding %#v: error decoding JSON: %v", c.acceptEncoding, err)
+		}
+		if int64(len(syncinfo.Chunks)) != file.NumChunks() {
+			t.Errorf("Accept-Encoding %#v: expected %d chunks, got %d", c.acceptEncoding, file.NumChunks(), len(syncinfo.Chunks))
+		}
+	}
+}
+
+func TestSyncFrom(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	synced, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced")
+	if err != nil {
+		t.Fatalf("Error in SyncFrom: %v", err)
+	}
+	defer synced.Dispose()
+	if synced.Key() != file.Key() {
+		t.Errorf("Synced file has key %v, expected %v", synced.Key(), file.Key())
+	}
+}
+
+// Struct countingReader counts the bytes read from a request body.
+type countingReader struct {
+	r io.ReadCloser
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c countingReader) Close() error {
+	return c.r.Close()
+}
+
+// Struct recordingTracer implements remotesync.Tracer and records the spans created.
+type recordingTracer struct {
+	m     sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	ended  bool
+	err    error
+}
+
+type spanKey struct{}
+
+func (r *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, remotesync.Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	span := &recordedSpan{tracer: r, name: name, parent: parent, attrs: make(map[string]interface{})}
+	r.m.Lock()
+	r.spans = append(r.spans, span)
+	r.m.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (r *recordingTracer) find(name string) *recordedSpan {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, span := range r.spans {
+		if span.name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.tracer.m.Lock()
+	defer s.tracer.m.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End(err error) {
+	s.tracer.m.Lock()
+	defer s.tracer.m.Unlock()
+	s.ended, s.err = true, err
+}
+
+func TestSyncFromTracing(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tracer := &recordingTracer{}
+	ctx := remotesync.WithTracer(context.Background(), tracer)
+	synced, err := SyncFrom(ctx, storeB, server.Client(), server.URL, "synced")
+	if err != nil {
+		t.Fatalf("Error in SyncFrom: %v", err)
+	}
+	defer synced.Dispose()
+
+	root := tracer.find("httpsync.SyncFrom")
+	if root == nil {
+		t.Fatalf("No span for SyncFrom")
+	}
+	for _, name := range []string{"httpsync.FetchSyncInfo", "remotesync.WriteWishList", "remotesync.ReconstructFileFromRequestedChunks"} {
+		span := tracer.find(name)
+		if span == nil {
+			t.Errorf("No span %v", name)
+		} else if span.parent != root {
+			t.Errorf("Span %v isn't a child of the SyncFrom span", name)
+		}
+	}
+	fetch := tracer.find("httpsync.FetchSyncInfo")
+	reconstruct := tracer.find("remotesync.ReconstructFileFromRequestedChunks")
+	tracer.m.Lock()
+	defer tracer.m.Unlock()
+	for _, span := range tracer.spans {
+		if !span.ended || span.err != nil {
+			t.Errorf("Span %v: ended: %v, error: %v", span.name, span.ended, span.err)
+		}
+	}
+	if n := fetch.attrs["chunks"]; n != int(file.NumChunks()) {
+		t.Errorf("Expected %v chunks, got %v", file.NumChunks(), n)
+	}
+	if reconstruct.attrs["bytes_transferred"] != file.Size() {
+		t.Errorf("Expected %v bytes transferred, got %v", file.Size(), reconstruct.attrs["bytes_transferred"])
+	}
+}
+
+func TestSyncFromCompressedWishList(t *testing.T) {
+	storeA := ram.NewRamStorage(32 << 20)
+	file := addRandomData(t, storeA, 8<<20)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	var uploaded int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = countingReader{r.Body, &uploaded}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	syncFrom := func(storage cafs.FileStorage, opts ...SyncOption) int64 {
+		atomic.StoreInt64(&uploaded, 0)
+		synced, err := SyncFrom(context.Background(), storage, server.Client(), server.URL, "synced", opts...)
+		if err != nil {
+			t.Fatalf("Error in SyncFrom: %v", err)
+		}
+		defer synced.Dispose()
+		if synced.Key() != file.Key() {
+			t.Fatalf("Synced file has key %v, expected %v", synced.Key(), file.Key())
+		}
+		return atomic.LoadInt64(&uploaded)
+	}
+
+	// A fresh download requests all chunks
+	storeB := ram.NewRamStorage(32 << 20)
+	syncFrom(storeB, WithCompressedWishList())
+
+	// Now that all chunks are present, the wishlist contains only zeros. As the receiver never
+	// waits for chunk data, it needs not be flushed before the end. Make sure it isn't.
+	plain := syncFrom(storeB)
+	defer func(delay time.Duration) {
+		WishListFlushDelay = delay
+	}(WishListFlushDelay)
+	WishListFlushDelay = time.Minute
+	compressed := syncFrom(storeB, WithCompressedWishList())
+	t.Logf("Wishlist of %d chunks: %d bytes uncompressed, %d bytes compressed", file.NumChunks(), plain, compressed)
+	if plain != (file.NumChunks()+9+7)/8 {
+		t.Errorf("Unexpected size of uncompressed wishlist: %d", plain)
+	}
+	if compressed >= plain/2 {
+		t.Errorf("Expected compressed wishlist to be much smaller")
+	}
+
+	// Without codecs, the FileHandler doesn't accept a compressed wishlist
+	handler.WithCodecs()
+	if uploaded := syncFrom(storeB, WithCompressedWishList()); uploaded != plain {
+		t.Errorf("Expected uncompressed wishlist of %d bytes, got %d", plain, uploaded)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(nil))
+	req.Header.Set("Connection", "close")
+	req.Header.Set("Content-Encoding", "br")
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error in POST: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status 415 for unsupported encoding, got %v", res.Status)
+	}
+}
+
+func TestFileHandlerReady(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 300000)
+	defer file.Dispose()
+
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	if err := handler.Ready(); err != nil {
+		t.Errorf("Expected handler to be ready, got: %v", err)
+	}
+	handler.Dispose()
+	if err := handler.Ready(); err != remotesync.ErrDisposed {
+		t.Errorf("Expected ErrDisposed, got: %v", err)
+	}
+
+	syncinfo := &remotesync.SyncInfo{Perm: rand.Perm(10)}
+	if err := syncinfo.SetChunksFromFile(file); err != nil {
+		t.Fatalf("Error in SetChunksFromFile: %v", err)
+	}
+	handler = NewFileHandlerFromSyncInfo(syncinfo, storeB)
+	if err := handler.Ready(); err != nil {
+		t.Errorf("Expected handler to be ready by default, got: %v", err)
+	}
+	handler.WithReadyFraction(0.5)
+	if err := handler.Ready(); err != ErrNotReady {
+		t.Errorf("Expected ErrNotReady while chunks are missing, got: %v", err)
+	}
+	r := file.Open()
+	defer r.Close()
+	copied, err := cafs.Ingest(storeB, r, "copy")
+	if err != nil {
+		t.Fatalf("Error in Ingest: %v", err)
+	}
+	defer copied.Dispose()
+	if err := handler.Ready(); err != nil {
+		t.Errorf("Expected handler to be ready once chunks are present, got: %v", err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 300000)
+	defer file.Dispose()
+	perm := rand.Perm(10)
+	syncinfo := &remotesync.SyncInfo{Perm: perm}
+	if err := syncinfo.SetChunksFromFile(file); err != nil {
+		t.Fatalf("Error in SetChunksFromFile: %v", err)
+	}
+
+	probe := func(handler http.Handler) (*ProbeInfo, error) {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		return Probe(context.Background(), server.Client(), server.URL)
+	}
+	check := func(info *ProbeInfo, available float64) {
+		t.Helper()
+		if info.Size != file.Size() || info.Chunks != syncinfo.ChunkCount() || info.Digest != syncinfo.Digest() {
+			t.Errorf("Expected size %v, %v chunks and digest %v, got %+v", file.Size(), syncinfo.ChunkCount(), syncinfo.Digest(), info)
+		}
+		if info.Available != available {
+			t.Errorf("Expected %v of chunks to be available, got %v", available, info.Available)
+		}
+	}
+
+	handler := NewFileHandlerFromFile(file, perm)
+	if info, err := probe(handler); err != nil {
+		t.Errorf("Error probing file-based handler: %v", err)
+	} else {
+		check(info, 1)
+	}
+	handler.Dispose()
+	if _, err := probe(handler); err == nil {
+		t.Errorf("Expected error probing disposed handler")
+	}
+
+	handler = NewFileHandlerFromSyncInfo(syncinfo, storeB)
+	if info, err := probe(handler); err != nil {
+		t.Errorf("Error probing SyncInfo-based handler: %v", err)
+	} else {
+		check(info, 0)
+	}
+	r := file.Open()
+	defer r.Close()
+	copied, err := cafs.Ingest(storeB, r, "copy")
+	if err != nil {
+		t.Fatalf("Error in Ingest: %v", err)
+	}
+	defer copied.Dispose()
+	if info, err := probe(handler); err != nil {
+		t.Errorf("Error probing SyncInfo-based handler: %v", err)
+	} else {
+		check(info, 1)
+	}
+
+	if _, err := probe(http.NotFoundHandler()); err == nil {
+		t.Errorf("Expected error probing a missing file")
+	}
+}
+
+// Type unchunkedFile pretends to be a file consisting of a single chunk.
+type unchunkedFile struct {
+	cafs.File
+}
+
+func (f unchunkedFile) IsChunked() bool {
+	return false
+}
+
+func TestFileHandlerOversizedChunk(t *testing.T) {
+	file := unchunkedFile{cafs.FileFromBytes(make([]byte, chunking.MaxChunkSize+1))}
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+	if err := handler.Ready(); err != remotesync.ErrChunkTooLarge {
+		t.Errorf("Expected ErrChunkTooLarge, got: %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error in GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status %v, got %v", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+// Tests that a FileHandler can be disposed while serving requests, rejecting further requests
+// with 410 Gone. Meant to be run with -race.
+func TestFileHandlerConcurrentDispose(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				res, err := server.Client().Get(server.URL)
+				if err != nil {
+					t.Errorf("Error in GET: %v", err)
+					return
+				}
+				_, _ = io.Copy(ioutil.Discard, res.Body)
+				_ = res.Body.Close()
+				if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusGone {
+					t.Errorf("GET: unexpected status %v", res.Status)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				// Fails once the handler has been disposed
+				if synced, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced"); err == nil {
+					synced.Dispose()
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	handler.Dispose()
+	wg.Wait()
+
+	res, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error in GET: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("Expected status 410 after Dispose, got %v", res.Status)
+	}
+	res, err = server.Client().Post(server.URL, "application/octet-stream", bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Error in POST: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("Expected status 410 for POST after Dispose, got %v", res.Status)
+	}
+}
+
+// Type roundTripperFunc implements http.RoundTripper using a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSyncFromFailingPostNoLeak(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	// The server rejects transfers without reading the wishlist
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// The client fails POST requests without touching the request body
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	defer transport.CloseIdleConnections()
+	failing := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPost {
+			return nil, errors.New("connection refused")
+		}
+		return transport.RoundTrip(req)
+	})}
+
+	before := runtime.NumGoroutine()
+	for _, client := range []*http.Client{server.Client(), failing} {
+		for _, opts := range [][]SyncOption{nil, {WithCompressedWishList()}} {
+			if synced, err := SyncFrom(context.Background(), storeB, client, server.URL, "synced", opts...); err == nil {
+				synced.Dispose()
+				t.Errorf("Expected SyncFrom to fail")
+			}
+		}
+	}
+	server.Client().CloseIdleConnections()
+	transport.CloseIdleConnections()
+
+	// Allow connection goroutines to wind down
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("Leaked %v goroutines:\n%s", n-before, buf[:runtime.Stack(buf, true)])
+	}
+	storeB.FreeCache()
+	if locked := storeB.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got: %v", locked)
+	}
+}
+
+func TestSyncFromBytes(t *testing.T) {
+	storeB := ram.NewRamStorage(1 << 20)
+	data := make([]byte, 200000)
+	rand.Read(data)
+	file := cafs.FileFromBytes(data)
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	synced, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced")
+	if err != nil {
+		t.Fatalf("Error in SyncFrom: %v", err)
+	}
+	defer synced.Dispose()
+	if synced.Key() != file.Key() {
+		t.Errorf("Synced file has key %v, expected %v", synced.Key(), file.Key())
+	}
+}
+
+func TestSyncFromRange(t *testing.T) {
+	storeB := ram.NewRamStorage(1 << 20)
+	data := make([]byte, 200000)
+	rand.Read(data)
+	file := cafs.FileFromBytes(data)
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	r := remotesync.ByteRange{Offset: 50000, Length: 20000}
+	synced, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced", WithRange(r))
+	if err != nil {
+		t.Fatalf("Error in SyncFrom: %v", err)
+	}
+	defer synced.Dispose()
+	rc := synced.Open()
+	actual, err := ioutil.ReadAll(rc)
+	_ = rc.Close()
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if !bytes.Equal(actual, data[r.Offset:r.Offset+r.Length]) {
+		t.Errorf("Synced %d bytes differing from the range requested", len(actual))
+	}
+	if used := storeB.GetUsageInfo().Used; used > 2*r.Length+2*chunking.MaxChunkSize {
+		t.Errorf("Expected only chunks overlapping the range to be stored, got %d bytes", used)
+	}
+}
+
+// Tests syncing many small files concurrently using a client created by NewClient, which requires
+// a new connection only for each transfer of chunk data.
+func TestSyncFromBulk(t *testing.T) {
+	const numFiles, concurrency = 200, 8
+	storeA := ram.NewRamStorage(1 << 22)
+	storeB := ram.NewRamStorage(1 << 22)
+	var files []cafs.File
+	for i := 0; i < numFiles; i++ {
+		f := addRandomData(t, storeA, 1000)
+		defer f.Dispose()
+		files = append(files, f)
+	}
+
+	server := httptest.NewUnstartedServer(NewMultiFileHandler(storeA).WithPermutation(rand.Perm(10)))
+	var conns int64
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := NewClient(concurrency)
+	queue := make(chan cafs.File)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				synced, err := SyncFrom(context.Background(), storeB, client, server.URL+"/file/"+f.Key().String(), "synced")
+				if err != nil {
+					t.Errorf("Error in SyncFrom: %v", err)
+					continue
+				}
+				if synced.Key() != f.Key() {
+					t.Errorf("Synced file has key %v, expected %v", synced.Key(), f.Key())
+				}
+				synced.Dispose()
+			}
+		}()
+	}
+	for _, f := range files {
+		queue <- f
+	}
+	close(queue)
+	wg.Wait()
+
+	// Every POST closes its connection. All SyncInfos are fetched using pooled connections.
+	if n := atomic.LoadInt64(&conns); n > numFiles+concurrency {
+		t.Errorf("Expected at most %d connections, got %d", numFiles+concurrency, n)
+	}
+}
+
+func TestSyncFromWithChunkCoordinator(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	coord := remotesync.NewChunkCoordinator()
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			synced, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced", WithChunkCoordinator(coord))
+			if err == nil {
+				if synced.Key() != file.Key() {
+					err = fmt.Errorf("synced file has key %v, expected %v", synced.Key(), file.Key())
+				}
+				synced.Dispose()
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Error in SyncFrom: %v", err)
+		}
+	}
+	storeB.FreeCache()
+	if locked := storeB.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got: %v", locked)
+	}
+}
+
+func TestEstimateSyncFrom(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	bytesToSend, chunksToSend, err := EstimateSyncFrom(context.Background(), storeB, server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("Error in EstimateSyncFrom: %v", err)
+	}
+	if bytesToSend != file.Size() || int64(chunksToSend) != file.NumChunks() {
+		t.Errorf("Expected %d bytes in %d chunks, got %d bytes in %d chunks", file.Size(), file.NumChunks(), bytesToSend, chunksToSend)
+	}
+
+	synced, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced")
+	if err != nil {
+		t.Fatalf("Error in SyncFrom: %v", err)
+	}
+	defer synced.Dispose()
+	bytesToSend, chunksToSend, err = EstimateSyncFrom(context.Background(), storeB, server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("Error in EstimateSyncFrom: %v", err)
+	}
+	if bytesToSend != 0 || chunksToSend != 0 {
+		t.Errorf("Expected nothing to transfer after sync, got %d bytes in %d chunks", bytesToSend, chunksToSend)
+	}
+}
+
+func TestSyncFromWithScratchStorage(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	scratch := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	synced, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced", WithScratchStorage(scratch))
+	if err != nil {
+		t.Fatalf("Error in SyncFrom: %v", err)
+	}
+	defer synced.Dispose()
+	if synced.Key() != file.Key() {
+		t.Errorf("Synced file has key %v, expected %v", synced.Key(), file.Key())
+	}
+	key := synced.Key()
+	if f, err := storeB.Get(&key); err != nil {
+		t.Errorf("Expected synced file in main storage, got: %v", err)
+	} else {
+		f.Dispose()
+	}
+	scratch.FreeCache()
+	if ui := scratch.GetUsageInfo(); ui.Used != 0 {
+		t.Errorf("Expected scratch storage to be empty, got: %v", ui)
+	}
+}
+
+func TestMultiFileHandler(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file1 := addRandomData(t, storeA, 200000)
+	file2 := addRandomData(t, storeA, 100000)
+
+	server := httptest.NewServer(NewMultiFileHandler(storeA).WithPermutation(rand.Perm(10)))
+	defer server.Close()
+
+	for _, file := range []cafs.File{file1, file2} {
+		synced, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL+"/file/"+file.Key().String(), "synced")
+		if err != nil {
+			t.Fatalf("Error in SyncFrom: %v", err)
+		}
+		if synced.Key() != file.Key() {
+			t.Errorf("Synced file has key %v, expected %v", synced.Key(), file.Key())
+		}
+		synced.Dispose()
+	}
+
+	for _, p := range []string{"/file/" + cafs.SKey{}.String(), "/file/invalid", "/"} {
+		res, err := server.Client().Get(server.URL + p)
+		if err != nil {
+			t.Fatalf("Error in GET: %v", err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %v: expected status 404, got %v", p, res.Status)
+		}
+	}
+
+	// All per-request file handles must have been released
+	file1.Dispose()
+	file2.Dispose()
+	storeA.FreeCache()
+	if locked := storeA.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got: %v", locked)
+	}
+}
+
+func TestSyncFromVerified(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	perm := rand.Perm(10)
+	handler := NewFileHandlerFromFile(file, perm)
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	syncinfo := remotesync.SyncInfo{Perm: perm}
+	if err := syncinfo.SetChunksFromFile(file); err != nil {
+		t.Fatalf("Error in SetChunksFromFile: %v", err)
+	}
+
+	synced, err := SyncFromVerified(context.Background(), storeB, server.Client(), server.URL, "synced", syncinfo.Digest())
+	if err != nil {
+		t.Fatalf("Error in SyncFromVerified: %v", err)
+	}
+	defer synced.Dispose()
+	if synced.Key() != file.Key() {
+		t.Errorf("Synced file has key %v, expected %v", synced.Key(), file.Key())
+	}
+
+	if _, err := SyncFromVerified(context.Background(), storeB, server.Client(), server.URL, "synced", cafs.SKey{}); err != ErrSyncInfoMismatch {
+		t.Errorf("Expected ErrSyncInfoMismatch, got: %v", err)
+	}
+}
+
+func TestSyncFromInvalidPermutation(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	syncinfo := &remotesync.SyncInfo{Perm: []int{0, 0}}
+	if err := syncinfo.SetChunksFromFile(file); err != nil {
+		t.Fatalf("Error in SetChunksFromFile: %v", err)
+	}
+
+	server := httptest.NewServer(NewFileHandlerFromSyncInfo(syncinfo, storeA))
+	defer server.Close()
+
+	if _, err := SyncFrom(context.Background(), storeB, server.Client(), server.URL, "synced"); err != remotesync.ErrInvalidPermutation {
+		t.Errorf("Expected ErrInvalidPermutation, got: %v", err)
+	}
+}
+
+// Function startTransfer posts a transfer request to a FileHandler. The transfer stays in flight
+// until the returned wishlist writer is closed.
+func startTransfer(t *testing.T, client *http.Client, url string) (*http.Response, *io.PipeWriter) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, url, pr)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Connection", "close")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Error in POST: %v", err)
+	}
+	return res, pw
+}
+
+func TestTransferLimit(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, store, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10)).WithTransferLimit(2, 0)
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var inFlight []*io.PipeWriter
+	defer func() {
+		for _, pw := range inFlight {
+			_ = pw.Close()
+		}
+	}()
+	accepted, rejected := 0, 0
+	for i := 0; i < 10; i++ {
+		res, pw := startTransfer(t, server.Client(), server.URL)
+		_ = res.Body.Close()
+		switch res.StatusCode {
+		case http.StatusOK:
+			accepted++
+			inFlight = append(inFlight, pw)
+		case http.StatusServiceUnavailable:
+			rejected++
+			if res.Header.Get("Retry-After") == "" {
+				t.Errorf("Expected Retry-After header")
+			}
+			_ = pw.Close()
+		default:
+			t.Fatalf("Unexpected status: %v", res.Status)
+		}
+	}
+	if accepted != 2 || rejected != 8 {
+		t.Errorf("Expected 2 accepted and 8 rejected transfers, got %d and %d", accepted, rejected)
+	}
+}
+
+func TestTransferLimitQueueing(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, store, 200000)
+	defer file.Dispose()
+	handler := NewFileHandlerFromFile(file, rand.Perm(10)).WithTransferLimit(1, 5*time.Second)
+	defer handler.Dispose()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	res, pw := startTransfer(t, server.Client(), server.URL)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected first transfer to be accepted, got: %v", res.Status)
+	}
+
+	// The second transfer waits for the first one to finish
+	time.AfterFunc(50*time.Millisecond, func() { _ = pw.Close() })
+	res, pw2 := startTransfer(t, server.Client(), server.URL)
+	_ = res.Body.Close()
+	_ = pw2.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected queued transfer to be accepted, got: %v", res.Status)
+	}
+}
+
+// Struct recordingPrinter records the messages printed, for inspection by tests.
+type recordingPrinter struct {
+	m    sync.Mutex
+	msgs []string
+}
+
+func (p *recordingPrinter) Printf(format string, v ...interface{}) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.msgs = append(p.msgs, fmt.Sprintf(format, v...))
+}
+
+func (p *recordingPrinter) contains(s string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, msg := range p.msgs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTransferTimeout(t *testing.T) {
+	const size = 16 << 20
+	store := ram.NewRamStorage(2 * size)
+	file := addRandomData(t, store, size)
+	defer file.Dispose()
+	printer := &recordingPrinter{}
+	// Use the trivial permutation, which doesn't insert placeholders into the wishlist
+	handler := NewFileHandlerFromFile(file, []int{0}).
+		WithPrinter(printer).
+		WithTransferTimeout(300 * time.Millisecond)
+	defer handler.Dispose()
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		if r.Method == http.MethodPost {
+			close(done)
+		}
+	}))
+	defer server.Close()
+
+	// Request all chunks, then read the response very slowly
+	res, pw := startTransfer(t, server.Client(), server.URL)
+	defer res.Body.Close()
+	go func() {
+		_, _ = pw.Write(bytes.Repeat([]byte{0xff}, int(file.NumChunks()+7)/8))
+		_ = pw.Close()
+	}()
+	var received int64
+	buf := make([]byte, 1024)
+	timeout := time.After(10 * time.Second)
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		case <-timeout:
+			t.Fatalf("Transfer wasn't aborted")
+		case <-time.After(50 * time.Millisecond):
+			n, _ := res.Body.Read(buf)
+			received += int64(n)
+		}
+	}
+
+	if received >= size {
+		t.Errorf("Expected transfer to be incomplete, received %v bytes", received)
+	}
+	if !printer.contains(remotesync.ErrTransferTimeout.Error()) {
+		t.Errorf("Expected transfer to fail with ErrTransferTimeout, log: %v", printer.msgs)
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	syncinfo := &remotesync.SyncInfo{}
+	syncinfo.SetTrivialPermutation()
+	if err := syncinfo.SetChunksFromFile(file); err != nil {
+		t.Fatalf("Error in SetChunksFromFile: %v", err)
+	}
+	file.Dispose()
+
+	// Serve from a storage lacking the file's chunks, so that the handler waits for them to arrive
+	handler := NewFileHandlerFromSyncInfo(syncinfo, storeB)
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/", pr).WithContext(ctx)
+	req.Header.Set("Connection", "close")
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Handler didn't return after client disconnected")
+	}
+}
+
+func TestChunkHandler(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, store, 200000)
+	defer file.Dispose()
+	iter := file.Chunks()
+	defer iter.Dispose()
+	if !iter.Next() {
+		t.Fatalf("Expected file to have chunks")
+	}
+	chunk := iter.File()
+	defer chunk.Dispose()
+
+	handler := ChunkHandler(store)
+	get := func(key cafs.SKey, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/chunk/"+key.String(), nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get(chunk.Key(), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %v", rec.Code)
+	}
+	if int64(rec.Body.Len()) != chunk.Size() {
+		t.Errorf("Expected %d bytes, got %d", chunk.Size(), rec.Body.Len())
+	}
+	if key := cafs.KeyOf(rec.Body.Bytes()); key != chunk.Key() {
+		t.Errorf("Content served hashes to %v, expected %v", key, chunk.Key())
+	}
+	etag := rec.Header().Get("ETag")
+	if etag != `"`+chunk.Key().String()+`"` {
+		t.Errorf("Unexpected ETag: %v", etag)
+	}
+	if rec.Header().Get("Cache-Control") == "" {
+		t.Errorf("Expected Cache-Control header")
+	}
+
+	if rec := get(chunk.Key(), etag); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304, got %v", rec.Code)
+	}
+	if rec := get(cafs.SKey{}, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %v", rec.Code)
+	}
+}
+
+func TestChunkHandlerProgress(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, store, 200000)
+	defer file.Dispose()
+
+	var reports int
+	var last int64
+	handler := ChunkHandlerWithProgress(store, func(key cafs.SKey, read int64) {
+		if key != file.Key() {
+			t.Errorf("Progress reported for %v, expected %v", key, file.Key())
+		}
+		if read < last {
+			t.Errorf("Progress went backwards from %d to %d", last, read)
+		}
+		reports++
+		last = read
+	})
+	req := httptest.NewRequest(http.MethodGet, "/chunk/"+file.Key().String(), nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %v", rec.Code)
+	}
+	if int64(rec.Body.Len()) != file.Size() {
+		t.Errorf("Expected %d bytes, got %d", file.Size(), rec.Body.Len())
+	}
+	if reports == 0 {
+		t.Errorf("Expected progress to be reported")
+	}
+	if last != file.Size() {
+		t.Errorf("Last progress report was %d, expected %d", last, file.Size())
+	}
+}
+
+func TestOpenRemoteFile(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	r := file.Open()
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+
+	handler := NewFileHandlerFromFile(file, rand.Perm(10))
+	defer handler.Dispose()
+	mux := http.NewServeMux()
+	mux.Handle("/file", handler)
+	mux.Handle("/chunk/", ChunkHandler(storeA))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	remote, err := OpenRemoteFile(context.Background(), storeB, server.Client(), server.URL+"/file", server.URL+"/chunk", "remote")
+	if err != nil {
+		t.Fatalf("Error in OpenRemoteFile: %v", err)
+	}
+	defer remote.Dispose()
+	buf := make([]byte, 1000)
+	if _, err := remote.ReadAt(buf, 100000); err != nil {
+		t.Fatalf("Error in ReadAt: %v", err)
+	}
+	if !bytes.Equal(buf, data[100000:101000]) {
+		t.Errorf("ReadAt returned wrong data")
+	}
+}
+
+func TestFetchChunks(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	syncinfo := &remotesync.SyncInfo{}
+	if err := syncinfo.SetChunksFromFile(file); err != nil {
+		t.Fatalf("Error in SetChunksFromFile: %v", err)
+	}
+	var keys []cafs.SKey
+	for _, ci := range syncinfo.Chunks {
+		keys = append(keys, ci.Key)
+	}
+	keys = append(keys, keys[0])
+
+	var requests int
+	handler := BatchChunkHandler(storeA)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	files, err := FetchChunks(context.Background(), storeB, server.Client(), server.URL, keys, 4, "chunk")
+	if err != nil {
+		t.Fatalf("Error in FetchChunks: %v", err)
+	}
+	for i, f := range files {
+		if f.Key() != keys[i] {
+			t.Errorf("Chunk %d: expected key %v, got %v", i, keys[i], f.Key())
+		}
+		f.Dispose()
+	}
+	if expected := (len(syncinfo.Chunks) + 3) / 4; requests != expected {
+		t.Errorf("Expected %d requests, got %d", expected, requests)
+	}
+
+	// Chunks present are not requested again
+	requests = 0
+	files, err = FetchChunks(context.Background(), storeB, server.Client(), server.URL, keys, 4, "chunk")
+	if err != nil {
+		t.Fatalf("Error in FetchChunks: %v", err)
+	}
+	for _, f := range files {
+		f.Dispose()
+	}
+	if requests != 0 {
+		t.Errorf("Expected no requests, got %d", requests)
+	}
+
+	// Missing chunks fail the batch
+	if _, err := FetchChunks(context.Background(), storeB, server.Client(), server.URL, []cafs.SKey{{1}}, 4, "chunk"); err == nil {
+		t.Errorf("Expected error fetching missing chunk")
+	}
+}
+
+func TestBatchChunkHandlerRejectsLargeRequests(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	handler := BatchChunkHandler(store)
+
+	// A request with far too many keys is rejected without reading all of them
+	var body bytes.Buffer
+	body.WriteString("[")
+	for i := 0; i < 10*MaxBatchSize; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		body.WriteString(`"` + cafs.SKey{byte(i)}.String() + `"`)
+	}
+	body.WriteString("]")
+	size := int64(body.Len())
+	var read int64
+	req := httptest.NewRequest(http.MethodPost, "/chunks", nil)
+	req.Body = countingReader{ioutil.NopCloser(&body), &read}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %v", rec.Code)
+	}
+	if read > size/5 {
+		t.Errorf("Expected request to be rejected early, but %d of %d bytes were read", read, size)
+	}
+
+	// So is a request with a huge key
+	huge := `["` + strings.Repeat("0", 1<<20) + `"]`
+	req = httptest.NewRequest(http.MethodPost, "/chunks", strings.NewReader(huge))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %v", rec.Code)
+	}
+}
+
+func TestSyncLiveFrom(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	writer := remotesync.NewLiveWriter(storeA, "live")
+	defer writer.Dispose()
+
+	server := httptest.NewServer(NewLiveFileHandler(writer.SyncInfo(), storeA))
+	defer server.Close()
+
+	type result struct {
+		file cafs.File
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		file, err := SyncLiveFrom(context.Background(), storeB, server.Client(), server.URL, "synced")
+		done <- result{file, err}
+	}()
+
+	// Produce the file while it is being synced
+	data := make([]byte, 200000)
+	rand.Read(data)
+	for i := 0; i < len(data); i += 10000 {
+		time.Sleep(time.Millisecond)
+		if _, err := writer.Write(data[i : i+10000]); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("Error in SyncLiveFrom: %v", res.err)
+	}
+	defer res.file.Dispose()
+	expected := cafs.FileFromBytes(data)
+	defer expected.Dispose()
+	if res.file.Key() != expected.Key() {
+		t.Errorf("Synced file has key %v, expected %v", res.file.Key(), expected.Key())
+	}
+}
+
+func TestSyncDirFrom(t *testing.T) {
+	storeA := ram.NewRamStorage(4 << 20)
+	storeB := ram.NewRamStorage(4 << 20)
+	add := func(data []byte) cafs.File {
+		temp := storeA.Create("data")
+		defer temp.Dispose()
+		if _, err := temp.Write(data); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatalf("Error closing: %v", err)
+		}
+		return temp.File()
+	}
+
+	// b.bin shares most chunks with a.bin, and c.bin is identical to it
+	dataA := make([]byte, 200000)
+	rand.Read(dataA)
+	dataB := append(append([]byte{}, dataA...), make([]byte, 50000)...)
+	rand.Read(dataB[len(dataA):])
+	contents := map[string][]byte{
+		"a.bin":         dataA,
+		"sub/b.bin":     dataB,
+		"sub/dir/c.bin": dataA,
+		"empty":         {},
+	}
+	files := make(map[string]cafs.File)
+	for p, data := range contents {
+		files[p] = add(data)
+		defer files[p].Dispose()
+	}
+
+	handler, err := NewManifestHandler(files, rand.Perm(10))
+	if err != nil {
+		t.Fatalf("Error in NewManifestHandler: %v", err)
+	}
+	defer handler.Dispose()
+
+	var posts, bytesSent int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt64(&posts, 1)
+			w = countingResponseWriter{w, &bytesSent}
+		}
+		http.StripPrefix("/tree", handler).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cafs-syncdir")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := SyncDirFrom(context.Background(), storeB, server.Client(), server.URL+"/tree/", dir, "synced"); err != nil {
+		t.Fatalf("Error in SyncDirFrom: %v", err)
+	}
+	for p, data := range contents {
+		received, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			t.Errorf("Error reading %v: %v", p, err)
+		} else if !bytes.Equal(received, data) {
+			t.Errorf("Contents of %v differ", p)
+		}
+	}
+
+	// Identical files are transferred once, and shared chunks aren't transferred again
+	if posts != 3 {
+		t.Errorf("Expected 3 transfers, got %v", posts)
+	}
+	if limit := int64(len(dataB) + 2*chunking.MaxChunkSize); bytesSent > limit {
+		t.Errorf("Expected at most %v bytes to be transferred, got %v", limit, bytesSent)
+	}
+
+	// Files synced into storeB aren't kept locked
+	storeB.FreeCache()
+	if locked := storeB.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got: %v", locked)
+	}
+
+	// Syncing again doesn't transfer anything
+	atomic.StoreInt64(&posts, 0)
+	manifest, synced, err := SyncManifestFrom(context.Background(), storeA, server.Client(), server.URL+"/tree", "synced")
+	if err != nil {
+		t.Fatalf("Error in SyncManifestFrom: %v", err)
+	}
+	for i, file := range synced {
+		if file.Key() != manifest.Entries[i].Key {
+			t.Errorf("Entry %v: got key %v", manifest.Entries[i].Path, file.Key())
+		}
+		file.Dispose()
+	}
+	if posts != 0 {
+		t.Errorf("Expected no transfers, got %v", posts)
+	}
+}
+
+func TestManifestHandlerNotFound(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	file := addRandomData(t, store, 1000)
+	defer file.Dispose()
+	if _, err := NewManifestHandler(map[string]cafs.File{"../x": file}, rand.Perm(10)); err != remotesync.ErrInvalidManifest {
+		t.Errorf("Expected ErrInvalidManifest, got %v", err)
+	}
+	handler, err := NewManifestHandler(map[string]cafs.File{"x": file}, rand.Perm(10))
+	if err != nil {
+		t.Fatalf("Error in NewManifestHandler: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, p := range []string{"/file/" + cafs.SKey{}.String(), "/file/invalid", "/x"} {
+		res, err := server.Client().Get(server.URL + p)
+		if err != nil {
+			t.Fatalf("Error in GET: %v", err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %v: expected status 404, got %v", p, res.Status)
+		}
+	}
+
+	handler.Dispose()
+	if _, err := FetchManifest(context.Background(), server.Client(), server.URL); err == nil {
+		t.Errorf("Expected FetchManifest to fail on disposed handler")
+	}
+}
+
+// Struct countingResponseWriter counts the bytes written to a response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (c countingResponseWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.n, int64(len(p)))
+	return c.ResponseWriter.Write(p)
+}
+
+func (c countingResponseWriter) Flush() {
+	c.ResponseWriter.(http.Flusher).Flush()
+}
+
+func TestCompleteChunkFromChunkHandler(t *testing.T) {
+	storeA := ram.NewRamStorage(1 << 20)
+	storeB := ram.NewRamStorage(1 << 20)
+	// Treat a whole file as a single large chunk
+	file := addRandomData(t, storeA, 200000)
+	defer file.Dispose()
+	r := file.Open()
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+
+	var bytesSent int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ChunkHandler(storeA).ServeHTTP(countingResponseWriter{w, &bytesSent}, r)
+	}))
+	defer server.Close()
+
+	// Only the beginning and the end of the chunk are present
+	ci := remotesync.ChunkInfo{Key: file.Key(), Size: len(data)}
+	present := []remotesync.ByteRange{{Offset: 0, Length: 150000}, {Offset: 190000, Length: 10000}}
+	fetch := NewChunkRangeFetcher(server.Client(), server.URL)
+	chunk, err := remotesync.CompleteChunk(context.Background(), storeB, ci, bytes.NewReader(data), present, fetch, "completed")
+	if err != nil {
+		t.Fatalf("Error in CompleteChunk: %v", err)
+	}
+	defer chunk.Dispose()
+	if chunk.Key() != file.Key() {
+		t.Errorf("Completed chunk has key %v, expected %v", chunk.Key(), file.Key())
+	}
+	if bytesSent != 40000 {
+		t.Errorf("Expected 40000 bytes to be transferred, got %v", bytesSent)
+	}
+
+	// Unsatisfiable ranges are rejected
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/"+file.Key().String(), nil)
+	req.Header.Set("Range", "bytes=300000-")
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error in GET: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected status 416, got %v", res.Status)
+	}
+}
@@ -0,0 +1,115 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Struct LiveFileHandler implements the http.Handler interface and serves a file that may still be
+// growing, using the live protocol of package remotesync. Chunks are announced as they are appended
+// to the LiveSyncInfo, and the transfer ends only after the LiveSyncInfo has been completed.
+// The protocol used matches with function SyncLiveFrom.
+// Create using NewLiveFileHandler.
+type LiveFileHandler struct {
+	live    *remotesync.LiveSyncInfo
+	storage cafs.FileStorage
+	log     cafs.Printer
+}
+
+// Function NewLiveFileHandler creates a LiveFileHandler serving the chunks listed in `live`,
+// taken from `storage`. See remotesync.LiveWriter for a way of producing both.
+func NewLiveFileHandler(live *remotesync.LiveSyncInfo, storage cafs.FileStorage) *LiveFileHandler {
+	return &LiveFileHandler{
+		live:    live,
+		storage: storage,
+		log:     cafs.NewWriterPrinter(ioutil.Discard),
+	}
+}
+
+// Sets the LiveFileHandler's log Printer.
+func (handler *LiveFileHandler) WithPrinter(printer cafs.Printer) *LiveFileHandler {
+	handler.log = printer
+	return handler
+}
+
+func (handler *LiveFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Require a Connection: close header that will trick Go's HTTP server into allowing bi-directional streams.
+	if r.Header.Get("Connection") != "close" {
+		http.Error(w, "Connection: close required", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	handler.log.Printf("Calling WriteLiveChunkData")
+	start := time.Now()
+	err := remotesync.WriteLiveChunkData(r.Context(), handler.live, handler.storage, bufio.NewReader(r.Body),
+		remotesync.SimpleFlushWriter{W: w, F: w.(http.Flusher)})
+	handler.log.Printf("WriteLiveChunkData took %v", time.Since(start))
+	if err != nil {
+		handler.log.Printf("Error in WriteLiveChunkData: %v", err)
+	}
+	// Interrupt waiting for answers the client might never send
+	if d, ok := w.(deadlineSetter); ok {
+		_ = d.SetReadDeadline(time.Now())
+	}
+}
+
+// Function SyncLiveFrom uses an HTTP client to connect to a LiveFileHandler at some URL and
+// download a file into the given FileStorage while it is still being written. Returns when the
+// remote has completed the file.
+func SyncLiveFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string) (file cafs.File, err error) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequest(http.MethodPost, url, pr)
+	if err != nil {
+		return
+	}
+
+	// Enable cancelation
+	req = req.WithContext(ctx)
+
+	// Trick Go's HTTP server implementation into allowing bi-directional data flow
+	req.Header.Set("Connection", "close")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("POST returned status %v", res.Status)
+		return
+	}
+	file, err = remotesync.ReconstructLiveFile(storage, res.Body, remotesync.NopFlushWriter{W: pw}, info)
+	return
+}
@@ -0,0 +1,276 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"context"
+	"errors"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Error ErrManifestMismatch is returned by SyncManifestFrom when a file received doesn't match the
+// key listed in the manifest.
+var ErrManifestMismatch = errors.New("file doesn't match manifest")
+
+// Struct ManifestHandler implements the http.Handler interface and serves a set of files, e.g. a
+// directory tree, described by a remotesync.Manifest. It serves the manifest as JSON on GET "/"
+// and each file under "/file/<key>", using the protocol of function SyncFrom. Files with identical
+// content are served only once. To serve under a path other than the root, use http.StripPrefix.
+// The protocol used matches with function SyncManifestFrom.
+// Create using NewManifestHandler.
+type ManifestHandler struct {
+	m        sync.Mutex
+	manifest *remotesync.Manifest
+	files    map[cafs.SKey]*FileHandler
+	log      cafs.Printer
+	codecs   []Codec
+}
+
+// Function NewManifestHandler creates a ManifestHandler serving `files`, which are indexed by
+// relative, slash-separated path. Files are transferred using permutation `perm`.
+// Returns remotesync.ErrInvalidManifest if a path is invalid, or remotesync.ErrChunkTooLarge if a
+// file contains a chunk exceeding chunking.MaxChunkSize.
+func NewManifestHandler(files map[string]cafs.File, perm shuffle.Permutation) (*ManifestHandler, error) {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	handler := &ManifestHandler{
+		manifest: &remotesync.Manifest{},
+		files:    make(map[cafs.SKey]*FileHandler),
+		log:      cafs.NewWriterPrinter(ioutil.Discard),
+		codecs:   DefaultCodecs,
+	}
+	for _, p := range paths {
+		file := files[p]
+		if err := handler.manifest.Add(p, file, perm); err != nil {
+			handler.Dispose()
+			return nil, err
+		}
+		if _, ok := handler.files[file.Key()]; !ok {
+			handler.files[file.Key()] = NewFileHandlerFromFile(file, perm)
+		}
+	}
+	return handler, nil
+}
+
+// It is the owner's responsibility to correctly dispose of ManifestHandler instances.
+func (handler *ManifestHandler) Dispose() {
+	handler.m.Lock()
+	files := handler.files
+	handler.files = nil
+	handler.m.Unlock()
+	for _, fileHandler := range files {
+		fileHandler.Dispose()
+	}
+}
+
+// Returns the manifest served by the ManifestHandler. It must not be modified.
+func (handler *ManifestHandler) Manifest() *remotesync.Manifest {
+	return handler.manifest
+}
+
+// Sets the ManifestHandler's log Printer.
+func (handler *ManifestHandler) WithPrinter(printer cafs.Printer) *ManifestHandler {
+	handler.log = printer
+	for _, fileHandler := range handler.files {
+		fileHandler.WithPrinter(printer)
+	}
+	return handler
+}
+
+// Sets the codecs the ManifestHandler may use for compressing the manifest and the SyncInfos, in
+// order of preference. Passing no codecs disables compression.
+func (handler *ManifestHandler) WithCodecs(codecs ...Codec) *ManifestHandler {
+	handler.codecs = codecs
+	for _, fileHandler := range handler.files {
+		fileHandler.WithCodecs(codecs...)
+	}
+	return handler
+}
+
+// Serves the manifest on GET "/" and delegates requests to "/file/<key>" to the file's FileHandler.
+// Responds with 410 Gone once the ManifestHandler has been disposed.
+func (handler *ManifestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler.m.Lock()
+	files := handler.files
+	handler.m.Unlock()
+	if files == nil {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if p == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		// Advertise the codecs accepted for compressing wishlists
+		w.Header().Set("Accept-Encoding", acceptEncoding(handler.codecs))
+		serveJSON(w, r, handler.manifest, handler.codecs, handler.log)
+		return
+	}
+
+	if !strings.HasPrefix(p, "file/") {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := cafs.ParseKey(strings.TrimPrefix(p, "file/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	fileHandler, ok := files[*key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fileHandler.ServeHTTP(w, r)
+}
+
+// Function FetchManifest requests the manifest from a ManifestHandler at `url` and validates it.
+func FetchManifest(ctx context.Context, client *http.Client, url string) (*remotesync.Manifest, error) {
+	manifest, _, err := fetchManifest(ctx, client, url)
+	return manifest, err
+}
+
+// Function fetchManifest works like FetchManifest but also returns the first of the DefaultCodecs
+// the ManifestHandler accepts for compressing wishlists, or nil if there is none.
+func fetchManifest(ctx context.Context, client *http.Client, url string) (*remotesync.Manifest, Codec, error) {
+	var manifest remotesync.Manifest
+	uploadCodec, err := fetchJSON(ctx, client, url, &manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return &manifest, uploadCodec, nil
+}
+
+// Function SyncManifestFrom uses an HTTP client to fetch the manifest from a ManifestHandler at
+// `url` and download all files listed into the given FileStorage. Returns the manifest and the
+// files, in the order of the manifest's entries. It is the caller's responsibility to dispose of
+// the files.
+//
+// Files are transferred one after the other, keeping those already received locked in storage.
+// This way, chunks shared among files are transferred only once. Files already present in storage
+// and files identical to an earlier one aren't transferred at all. Returns ErrManifestMismatch if
+// a file received doesn't match its key in the manifest. Options are applied to all files as in
+// SyncFrom, and so is tracing.
+func SyncManifestFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, info string, opts ...SyncOption) (manifest *remotesync.Manifest, files []cafs.File, err error) {
+	options := newSyncOptions(storage, opts)
+	ctx, span := remotesync.StartSpan(ctx, "httpsync.SyncManifestFrom")
+	span.SetAttribute("url", url)
+	defer func() { span.End(err) }()
+	manifest, uploadCodec, err := fetchManifest(ctx, client, url)
+	if err != nil {
+		return
+	}
+	if !options.compressedWishList {
+		uploadCodec = nil
+	}
+
+	defer func() {
+		if err != nil {
+			for _, file := range files {
+				file.Dispose()
+			}
+			manifest, files = nil, nil
+		}
+	}()
+
+	baseURL := strings.TrimSuffix(url, "/")
+	received := make(map[cafs.SKey]cafs.File)
+	for _, entry := range manifest.Entries {
+		var file cafs.File
+		if f, ok := received[entry.Key]; ok {
+			file = f.Duplicate()
+		} else if file, err = storage.Get(&entry.Key); err == cafs.ErrNotFound {
+			fileURL := baseURL + "/file/" + entry.Key.String()
+			if file, err = transfer(ctx, storage, client, fileURL, info+" "+entry.Path, entry.SyncInfo, uploadCodec, options); err != nil {
+				return
+			}
+			if file.Key() != entry.Key {
+				file.Dispose()
+				err = ErrManifestMismatch
+				return
+			}
+		} else if err != nil {
+			return
+		}
+		received[entry.Key] = file
+		files = append(files, file)
+	}
+	return
+}
+
+// Function SyncDirFrom works like SyncManifestFrom but additionally recreates the directory tree
+// described by the manifest under `dir`, which is created if necessary. Existing files are
+// overwritten. The files synchronized aren't kept locked in storage.
+func SyncDirFrom(ctx context.Context, storage cafs.FileStorage, client *http.Client, url, dir, info string, opts ...SyncOption) error {
+	manifest, files, err := SyncManifestFrom(ctx, storage, client, url, info, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Dispose()
+		}
+	}()
+
+	for i, entry := range manifest.Entries {
+		if err := writeFile(filepath.Join(dir, filepath.FromSlash(entry.Path)), files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function writeFile writes the contents of `file` to `filename`, creating parent directories
+// as necessary.
+func writeFile(filename string, file cafs.File) (err error) {
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+	}()
+	r := file.Open()
+	defer r.Close()
+	_, err = io.Copy(f, r)
+	return
+}
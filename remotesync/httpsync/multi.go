@@ -0,0 +1,113 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsync
+
+import (
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Struct MultiFileHandler implements the http.Handler interface and serves any file present
+// in a FileStorage. The file is identified by the key given as the last element of the URL path.
+// The protocol used for each file matches with function SyncFrom.
+// Create using NewMultiFileHandler.
+type MultiFileHandler struct {
+	storage cafs.FileStorage
+	perm    shuffle.Permutation
+	log     cafs.Printer
+	codecs  []Codec
+	limiter *transferLimiter
+	timeout time.Duration
+}
+
+// Function NewMultiFileHandler creates a MultiFileHandler serving files from `storage`.
+// Files are transferred using a random permutation of length 256.
+func NewMultiFileHandler(storage cafs.FileStorage) *MultiFileHandler {
+	return &MultiFileHandler{
+		storage: storage,
+		perm:    rand.Perm(256),
+		log:     cafs.NewWriterPrinter(ioutil.Discard),
+		codecs:  DefaultCodecs,
+		timeout: DefaultTransferTimeout,
+	}
+}
+
+// Sets the permutation used when transferring files.
+func (handler *MultiFileHandler) WithPermutation(perm shuffle.Permutation) *MultiFileHandler {
+	handler.perm = perm
+	return handler
+}
+
+// Sets the MultiFileHandler's log Printer.
+func (handler *MultiFileHandler) WithPrinter(printer cafs.Printer) *MultiFileHandler {
+	handler.log = printer
+	return handler
+}
+
+// Sets the codecs the MultiFileHandler may use for compressing the SyncInfo, in order of preference.
+// Passing no codecs disables compression.
+func (handler *MultiFileHandler) WithCodecs(codecs ...Codec) *MultiFileHandler {
+	handler.codecs = codecs
+	return handler
+}
+
+// Limits the number of transfers the MultiFileHandler serves concurrently, across all files, to `n`.
+// Further requests wait at most `wait` for a transfer to finish and are then rejected with
+// 503 Service Unavailable. Passing a non-positive `n` removes the limit.
+func (handler *MultiFileHandler) WithTransferLimit(n int, wait time.Duration) *MultiFileHandler {
+	handler.limiter = newTransferLimiter(n, wait)
+	return handler
+}
+
+// Limits the time each transfer may take to `d`. See FileHandler.WithTransferTimeout.
+func (handler *MultiFileHandler) WithTransferTimeout(d time.Duration) *MultiFileHandler {
+	handler.timeout = d
+	return handler
+}
+
+func (handler *MultiFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := cafs.ParseKey(path.Base(r.URL.Path))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := handler.storage.Get(key)
+	if err == cafs.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		handler.log.Printf("Error getting file %v: %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Dispose()
+
+	// Serve the request using a FileHandler that lives only as long as the request.
+	fileHandler := NewFileHandlerFromFile(file, handler.perm).
+		WithPrinter(handler.log).
+		WithCodecs(handler.codecs...).
+		WithTransferTimeout(handler.timeout)
+	fileHandler.limiter = handler.limiter
+	defer fileHandler.Dispose()
+	fileHandler.ServeHTTP(w, r)
+}
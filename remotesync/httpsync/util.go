@@ -17,6 +17,7 @@
 package httpsync
 
 import (
+	"context"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/remotesync"
 	"io"
@@ -26,7 +27,11 @@ import (
 
 // Interface chunksSource specifies a factory for Chunks
 type chunksSource interface {
-	GetChunks() (remotesync.Chunks, error)
+	// Returns the chunks to send. Waiting for chunks is aborted once ctx is done.
+	GetChunks(ctx context.Context) (remotesync.Chunks, error)
+	// Returns the fraction of chunks, between 0 and 1, that can be produced without waiting, or
+	// an error if no chunks can be produced at all. Must be cheap, so it may be an estimate.
+	Available() (float64, error)
 	Dispose()
 }
 
@@ -36,17 +41,27 @@ type fileBasedChunksSource struct {
 	file cafs.File
 }
 
-func (f fileBasedChunksSource) GetChunks() (remotesync.Chunks, error) {
+func (f *fileBasedChunksSource) GetChunks(_ context.Context) (remotesync.Chunks, error) {
+	// Hold the lock while creating the iterator, which keeps the chunks locked even if the
+	// file is disposed concurrently.
 	f.m.Lock()
-	file := f.file
-	f.m.Unlock()
-	if file == nil {
+	defer f.m.Unlock()
+	if f.file == nil {
 		return nil, remotesync.ErrDisposed
 	}
-	return remotesync.ChunksOfFile(file), nil
+	return remotesync.ChunksOfFile(f.file), nil
+}
+
+func (f *fileBasedChunksSource) Available() (float64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.file == nil {
+		return 0, remotesync.ErrDisposed
+	}
+	return 1, nil
 }
 
-func (f fileBasedChunksSource) Dispose() {
+func (f *fileBasedChunksSource) Dispose() {
 	f.m.Lock()
 	file := f.file
 	f.file = nil
@@ -65,19 +80,48 @@ type syncInfoChunksSource struct {
 	storage  cafs.FileStorage
 }
 
-func (s syncInfoChunksSource) GetChunks() (remotesync.Chunks, error) {
+func (s syncInfoChunksSource) GetChunks(ctx context.Context) (remotesync.Chunks, error) {
 	return &syncInfoChunks{
+		ctx:     ctx,
 		chunks:  s.syncinfo.Chunks,
 		storage: s.storage,
 		done:    make(chan struct{}),
 	}, nil
 }
 
+// The maximum number of chunks a syncInfoChunksSource looks up when checking availability.
+const readySamples = 16
+
+// Looks up evenly spaced samples of the chunks, which is cheap but only estimates the fraction
+// of chunks present. The first chunk is always looked up, detecting storage failures.
+func (s syncInfoChunksSource) Available() (float64, error) {
+	chunks := s.syncinfo.Chunks
+	n := len(chunks)
+	if n > readySamples {
+		n = readySamples
+	}
+	present := 0
+	for i := 0; i < n; i++ {
+		key := chunks[i*len(chunks)/n].Key
+		if f, err := s.storage.Get(&key); err == nil {
+			f.Dispose()
+			present++
+		} else if err != cafs.ErrNotFound {
+			return 0, err
+		}
+	}
+	if n == 0 {
+		return 1, nil
+	}
+	return float64(present) / float64(n), nil
+}
+
 func (s syncInfoChunksSource) Dispose() {
 }
 
 // Struct syncInfoChunks implements the Chunks interface and does the actual waiting.
 type syncInfoChunks struct {
+	ctx     context.Context
 	chunks  []remotesync.ChunkInfo
 	storage cafs.FileStorage
 	done    chan struct{}
@@ -103,6 +147,8 @@ func (s *syncInfoChunks) NextChunk() (cafs.File, error) {
 		select {
 		case <-s.done:
 			return nil, remotesync.ErrDisposed
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
 		case <-ticker.C:
 			// next try
 		}
@@ -112,3 +158,51 @@ func (s *syncInfoChunks) NextChunk() (cafs.File, error) {
 func (s *syncInfoChunks) Dispose() {
 	close(s.done)
 }
+
+// Struct transferLimiter limits the number of transfers in flight.
+type transferLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// Function newTransferLimiter returns a transferLimiter allowing `n` concurrent transfers, or nil
+// if n is not positive.
+func newTransferLimiter(n int, wait time.Duration) *transferLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &transferLimiter{
+		slots: make(chan struct{}, n),
+		wait:  wait,
+	}
+}
+
+// Function acquire tries to obtain a slot for a transfer. If all slots are taken, it waits until
+// either a slot is released, the configured waiting time has passed, or ctx is done. Returns true
+// if a slot was obtained, which must then be released.
+func (l *transferLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Function release releases a slot obtained by acquire.
+func (l *transferLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,444 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking"
+	"io"
+	"sync"
+)
+
+// The live protocol transfers a file while it is still being written. Unlike with SyncInfo, the
+// chunks aren't known in advance. Instead, the sender announces them one by one as they become
+// available, and the receiver answers each announcement, requesting the chunks it is missing.
+//
+// The sender writes a sequence of frames, each starting with a frame type byte:
+//   - liveFrameAnnounce: the key (cafs.KeySize bytes) and size (varint) of the next chunk.
+//   - liveFrameData:     size (varint) and data of the oldest chunk requested but not yet sent.
+//   - liveFrameEnd:      the number of chunks announced (varint). Signals that the file is
+//     complete and all requested chunks have been sent. No frames follow.
+//
+// The receiver writes one byte per announcement, in order: 1 if it requests the chunk, 0 if not.
+const (
+	liveFrameAnnounce byte = 1
+	liveFrameData     byte = 2
+	liveFrameEnd      byte = 3
+)
+
+// Struct LiveSyncInfo describes a file whose list of chunks is still growing. It is safe for
+// concurrent use.
+type LiveSyncInfo struct {
+	mutex    sync.Mutex
+	chunks   []ChunkInfo
+	complete bool
+	changed  chan struct{} // Closed and replaced whenever chunks are added or the file is completed
+}
+
+// Function NewLiveSyncInfo returns an empty LiveSyncInfo.
+func NewLiveSyncInfo() *LiveSyncInfo {
+	return &LiveSyncInfo{changed: make(chan struct{})}
+}
+
+// Appends a chunk to the file. Panics if the file has been completed.
+func (l *LiveSyncInfo) Append(ci ChunkInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.complete {
+		panic("LiveSyncInfo already complete")
+	}
+	l.chunks = append(l.chunks, ci)
+	l.notify()
+}
+
+// Marks the file as complete. No more chunks can be appended afterwards.
+func (l *LiveSyncInfo) Complete() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.complete {
+		l.complete = true
+		l.notify()
+	}
+}
+
+// Returns a SyncInfo containing the chunks appended so far, and whether the file is complete. As
+// the live protocol transfers chunks in order, the SyncInfo uses the trivial permutation.
+func (l *LiveSyncInfo) Snapshot() (syncinf *SyncInfo, complete bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	syncinf = &SyncInfo{Chunks: append([]ChunkInfo(nil), l.chunks...)}
+	syncinf.SetTrivialPermutation()
+	return syncinf, l.complete
+}
+
+func (l *LiveSyncInfo) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Function since returns the chunks appended after the first `n`, whether the file is complete,
+// and a channel that is closed on the next change.
+func (l *LiveSyncInfo) since(n int) (chunks []ChunkInfo, complete bool, changed <-chan struct{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.chunks[n:len(l.chunks):len(l.chunks)], l.complete, l.changed
+}
+
+// Struct LiveWriter stores the data written into it in storage, chunk by chunk, and appends every
+// chunk to a LiveSyncInfo as soon as it is complete. The chunks are kept in storage until the
+// LiveWriter is disposed.
+type LiveWriter struct {
+	storage  cafs.FileStorage
+	info     string
+	live     *LiveSyncInfo
+	splitter *chunking.Splitter
+	chunks   []cafs.File
+}
+
+// Function NewLiveWriter returns a LiveWriter storing data in `storage`. Chunks are named after
+// `info`. The LiveWriter must be closed when all data is written, and must eventually be disposed.
+func NewLiveWriter(storage cafs.FileStorage, info string) *LiveWriter {
+	w := &LiveWriter{
+		storage: storage,
+		info:    info,
+		live:    NewLiveSyncInfo(),
+	}
+	w.splitter = chunking.NewSplitter(chunking.New(), w.storeChunk)
+	return w
+}
+
+// Returns the LiveSyncInfo describing the data written so far.
+func (w *LiveWriter) SyncInfo() *LiveSyncInfo {
+	return w.live
+}
+
+func (w *LiveWriter) Write(p []byte) (int, error) {
+	return w.splitter.Write(p)
+}
+
+// Stores the last chunk and marks the LiveSyncInfo as complete.
+func (w *LiveWriter) Close() error {
+	if err := w.splitter.Close(); err != nil {
+		return err
+	}
+	w.live.Complete()
+	return nil
+}
+
+// Releases the chunks written.
+func (w *LiveWriter) Dispose() {
+	for _, f := range w.chunks {
+		f.Dispose()
+	}
+	w.chunks = nil
+}
+
+func (w *LiveWriter) storeChunk(chunk []byte, _ int64) error {
+	temp := w.storage.Create(fmt.Sprintf("%v #%d", w.info, len(w.chunks)))
+	defer temp.Dispose()
+	if _, err := temp.Write(chunk); err != nil {
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	f := temp.File()
+	w.chunks = append(w.chunks, f)
+	w.live.Append(ChunkInfo{Key: f.Key(), Size: int(f.Size())})
+	return nil
+}
+
+// Function WriteLiveChunkData implements the sending side of the live protocol. It announces the
+// chunks of `live` as they are appended, reads the receiver's answers from `r` and sends the
+// requested chunks, taken from `storage`. Returns when the file is complete and all requested
+// chunks have been sent, or when `ctx` is done.
+//
+// Answers are read from `r` by a separate goroutine, which stops reading on return. A read in
+// progress at that time can't be interrupted, though. If the receiver may not send anything more,
+// the caller should make that read fail, e.g. by closing the connection.
+func WriteLiveChunkData(ctx context.Context, live *LiveSyncInfo, storage cafs.FileStorage, r io.ByteReader, w FlushWriter) error {
+	// Answers are collected by a separate goroutine so that the receiver never blocks on writing
+	// them while the sender is busy writing announcements.
+	var mutex sync.Mutex
+	var answers []bool
+	var answerErr error
+	answered := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b, err := r.ReadByte()
+			if err == nil && b > 1 {
+				err = ErrProtocolViolation
+			}
+			mutex.Lock()
+			if err != nil {
+				answerErr = err
+			} else {
+				answers = append(answers, b == 1)
+			}
+			mutex.Unlock()
+			select {
+			case answered <- struct{}{}:
+			default:
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var pending []ChunkInfo // Announced, but not answered yet
+	announced := 0
+	for {
+		chunks, complete, changed := live.since(announced)
+		for _, ci := range chunks {
+			if err := writeLiveAnnouncement(w, ci); err != nil {
+				return err
+			}
+		}
+		if len(chunks) > 0 {
+			w.Flush()
+			pending = append(pending, chunks...)
+			announced += len(chunks)
+		}
+
+		if complete && len(pending) == 0 {
+			if _, err := w.Write([]byte{liveFrameEnd}); err != nil {
+				return err
+			}
+			if err := writeVarint(w, int64(announced)); err != nil {
+				return err
+			}
+			w.Flush()
+			return nil
+		} else if complete {
+			// Only wait for answers
+			changed = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-answered:
+			mutex.Lock()
+			received, err := answers, answerErr
+			answers = nil
+			mutex.Unlock()
+			for _, requested := range received {
+				if len(pending) == 0 {
+					return ErrProtocolViolation
+				}
+				ci := pending[0]
+				pending = pending[1:]
+				if requested {
+					if err := writeLiveData(w, storage, ci); err != nil {
+						return err
+					}
+					w.Flush()
+				}
+			}
+			if err == io.EOF {
+				return ErrTransferInterrupted
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeLiveAnnouncement(w io.Writer, ci ChunkInfo) error {
+	if _, err := w.Write([]byte{liveFrameAnnounce}); err != nil {
+		return err
+	}
+	if _, err := w.Write(ci.Key[:]); err != nil {
+		return err
+	}
+	return writeVarint(w, int64(ci.Size))
+}
+
+func writeLiveData(w io.Writer, storage cafs.FileStorage, ci ChunkInfo) error {
+	chunk, err := storage.Get(&ci.Key)
+	if err != nil {
+		return fmt.Errorf("chunk %v not available: %v", ci.Key, err)
+	}
+	defer chunk.Dispose()
+	if _, err := w.Write([]byte{liveFrameData}); err != nil {
+		return err
+	}
+	if err := writeVarint(w, chunk.Size()); err != nil {
+		return err
+	}
+	rc := chunk.Open()
+	_, err = io.Copy(w, rc)
+	if errClose := rc.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// Function ReconstructLiveFile implements the receiving side of the live protocol. It reads frames
+// from `r`, writes answers into `w` and reconstructs the file in `storage`, tagging it with `info`.
+// Returns ErrTransferInterrupted if the stream ends before the sender has signalled completion,
+// and ErrProtocolViolation if the sender doesn't adhere to the protocol.
+func ReconstructLiveFile(storage cafs.FileStorage, r io.Reader, w FlushWriter, info string) (cafs.File, error) {
+	br := bufio.NewReader(r)
+	temp := storage.Create(info)
+	defer temp.Dispose()
+
+	// Handles to chunks that are available locally, kept until appended to temp for the last time
+	have := make(map[cafs.SKey]cafs.File)
+	defer func() {
+		for _, f := range have {
+			f.Dispose()
+		}
+	}()
+	requested := make(map[cafs.SKey]bool)
+	queued := make(map[cafs.SKey]int) // Number of times each key occurs in queue
+	var queue []ChunkInfo             // Announced chunks not yet appended to temp, in order
+	var requestQueue []ChunkInfo      // Requested chunks not yet received, in order
+
+	// Appends chunks to temp for as long as they are available. Releases chunks that aren't needed
+	// anymore. Should they be announced again, they are looked up in storage or requested anew.
+	drain := func() error {
+		for len(queue) > 0 {
+			key := queue[0].Key
+			f := have[key]
+			if f == nil {
+				return nil
+			}
+			rc := f.Open()
+			_, err := io.Copy(temp, rc)
+			if errClose := rc.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				return err
+			}
+			queue = queue[1:]
+			if queued[key]--; queued[key] == 0 {
+				f.Dispose()
+				delete(have, key)
+				delete(requested, key)
+				delete(queued, key)
+			}
+		}
+		return nil
+	}
+
+	announced := 0
+	for {
+		frameType, err := br.ReadByte()
+		if err == io.EOF {
+			return nil, ErrTransferInterrupted
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch frameType {
+		case liveFrameAnnounce:
+			var ci ChunkInfo
+			if _, err := io.ReadFull(br, ci.Key[:]); err != nil {
+				return nil, liveReadError(err)
+			}
+			size, err := readChunkLength(br)
+			if err != nil {
+				return nil, liveReadError(err)
+			}
+			ci.Size = int(size)
+			announced++
+
+			request := false
+			if have[ci.Key] == nil && !requested[ci.Key] {
+				if f, err := storage.Get(&ci.Key); err == nil {
+					have[ci.Key] = f
+				} else {
+					request = true
+					requested[ci.Key] = true
+					requestQueue = append(requestQueue, ci)
+				}
+			}
+			var answer byte
+			if request {
+				answer = 1
+			}
+			if _, err := w.Write([]byte{answer}); err != nil {
+				return nil, err
+			}
+			w.Flush()
+			queue = append(queue, ci)
+			queued[ci.Key]++
+
+		case liveFrameData:
+			if len(requestQueue) == 0 {
+				return nil, ErrProtocolViolation
+			}
+			ci := requestQueue[0]
+			requestQueue = requestQueue[1:]
+			chunk, err := readChunk(storage, br, VarintFramer{}, fmt.Sprintf("%v #%d", info, announced))
+			if err != nil {
+				return nil, liveReadError(err)
+			}
+			if chunk.Key() != ci.Key || chunk.Size() != int64(ci.Size) {
+				chunk.Dispose()
+				return nil, ErrProtocolViolation
+			}
+			have[ci.Key] = chunk
+
+		case liveFrameEnd:
+			n, err := binary.ReadVarint(br)
+			if err != nil {
+				return nil, liveReadError(err)
+			}
+			if n != int64(announced) || len(requestQueue) != 0 {
+				return nil, ErrProtocolViolation
+			}
+			if err := drain(); err != nil {
+				return nil, err
+			}
+			if err := temp.Close(); err != nil {
+				return nil, err
+			}
+			return temp.File(), nil
+
+		default:
+			return nil, ErrProtocolViolation
+		}
+
+		if err := drain(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Function liveReadError classifies an error that occurred while reading a frame.
+func liveReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTransferInterrupted
+	}
+	return err
+}
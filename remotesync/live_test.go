@@ -0,0 +1,268 @@
+package remotesync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Struct countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Function liveTransfer transfers a live file using a sender and a receiver connected via pipes.
+// Returns the reconstructed file and the number of bytes sent.
+func liveTransfer(t *testing.T, live *LiveSyncInfo, storeA, storeB cafs.FileStorage) (cafs.File, int64) {
+	pipeReader1, pipeWriter1 := io.Pipe()
+	pipeReader2, pipeWriter2 := io.Pipe()
+	counter := &countingWriter{w: pipeWriter2}
+	sent := make(chan int64)
+	go func() {
+		err := WriteLiveChunkData(context.Background(), live, storeA, bufio.NewReader(pipeReader1), NopFlushWriter{counter})
+		_ = pipeWriter2.CloseWithError(err)
+		sent <- counter.n
+	}()
+	f, err := ReconstructLiveFile(storeB, pipeReader2, NopFlushWriter{pipeWriter1}, "Live file")
+	_ = pipeWriter1.Close()
+	n := <-sent
+	if err != nil {
+		t.Fatalf("Error reconstructing live file: %v", err)
+	}
+	return f, n
+}
+
+func TestLiveTransfer(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	storeB := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	block := randomBytes(200000)
+	data := append(append([]byte{}, block...), block...)
+
+	// Write the data in pieces while it is being transferred
+	writer := NewLiveWriter(storeA, "Live file")
+	defer writer.Dispose()
+	go func() {
+		for i := 0; i < len(data); i += 10000 {
+			time.Sleep(time.Millisecond)
+			_, _ = writer.Write(data[i : i+10000])
+		}
+		_ = writer.Close()
+	}()
+
+	f, sent := liveTransfer(t, writer.SyncInfo(), storeA, storeB)
+	defer f.Dispose()
+	assertEqual(t, ioutil.NopCloser(bytes.NewReader(data)), f.Open())
+	// Repeated chunks are sent only once
+	if sent > int64(len(data))*3/4 {
+		t.Errorf("Expected repeated data to be sent once, but %d bytes were sent for %d bytes of data", sent, len(data))
+	}
+
+	// Once complete, the file can still be transferred. Chunks already present aren't sent again.
+	f2, sent := liveTransfer(t, writer.SyncInfo(), storeA, storeB)
+	defer f2.Dispose()
+	assertEqual(t, ioutil.NopCloser(bytes.NewReader(data)), f2.Open())
+	if syncinf, _ := writer.SyncInfo().Snapshot(); sent > int64(len(syncinf.Chunks)*64) {
+		t.Errorf("Expected no chunk data to be sent again, but %d bytes were sent", sent)
+	}
+}
+
+func TestLiveEmptyFile(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "", store)
+	writer := NewLiveWriter(store, "Live file")
+	defer writer.Dispose()
+	check(t, "closing", writer.Close())
+	f, _ := liveTransfer(t, writer.SyncInfo(), store, store)
+	defer f.Dispose()
+	if f.Size() != 0 {
+		t.Errorf("Expected empty file, got %d bytes", f.Size())
+	}
+}
+
+// Tests that a snapshot of a complete live file can be transferred using the regular protocol.
+func TestLiveSnapshot(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	storeB := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	data := randomBytes(300000)
+	writer := NewLiveWriter(storeA, "Live file")
+	defer writer.Dispose()
+	_, err := writer.Write(data)
+	check(t, "writing", err)
+	check(t, "closing", writer.Close())
+
+	syncinf, complete := writer.SyncInfo().Snapshot()
+	if !complete {
+		t.Fatal("Expected snapshot to be complete")
+	}
+	if !syncinf.Perm.IsValid() || !syncinf.Perm.IsTrivial() {
+		t.Fatalf("Expected trivial permutation, got %v", syncinf.Perm)
+	}
+
+	temp := storeA.Create("Complete file")
+	defer temp.Dispose()
+	_, err = temp.Write(data)
+	check(t, "writing", err)
+	check(t, "closing", temp.Close())
+	fileA := temp.File()
+	defer fileA.Dispose()
+
+	chunks := ChunksOfFile(fileA)
+	defer chunks.Dispose()
+	fileB, err := syncChunks(t, storeB, syncinf, chunks)
+	check(t, "syncing snapshot", err)
+	defer fileB.Dispose()
+	assertEqual(t, ioutil.NopCloser(bytes.NewReader(data)), fileB.Open())
+}
+
+// Struct handleCountingStorage counts the handles obtained using Get that haven't been disposed.
+type handleCountingStorage struct {
+	cafs.FileStorage
+	open, max int
+}
+
+// Struct countedFile is a file handle counted by a handleCountingStorage.
+type countedFile struct {
+	cafs.File
+	s        *handleCountingStorage
+	disposed bool
+}
+
+func (s *handleCountingStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	f, err := s.FileStorage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	s.open++
+	if s.open > s.max {
+		s.max = s.open
+	}
+	return &countedFile{File: f, s: s}, nil
+}
+
+func (f *countedFile) Dispose() {
+	if !f.disposed {
+		f.disposed = true
+		f.s.open--
+	}
+	f.File.Dispose()
+}
+
+// Tests that the receiver releases chunks found in storage once it has used them.
+func TestLiveReleasesChunks(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	storeB := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	writer := NewLiveWriter(storeA, "Live file")
+	defer writer.Dispose()
+	_, _ = writer.Write(randomBytes(400000))
+	check(t, "closing", writer.Close())
+
+	f1, _ := liveTransfer(t, writer.SyncInfo(), storeA, storeB)
+	defer f1.Dispose()
+
+	// All chunks are present now
+	counting := &handleCountingStorage{FileStorage: storeB}
+	f2, _ := liveTransfer(t, writer.SyncInfo(), storeA, counting)
+	defer f2.Dispose()
+	if counting.max > 1 || counting.open != 0 {
+		t.Errorf("Expected at most one chunk to be held at a time, got %d of %d chunks, %d left open",
+			counting.max, f1.NumChunks(), counting.open)
+	}
+}
+
+// Tests that the sender stops reading answers once it has returned.
+func TestLiveSenderStopsReading(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "", store)
+	writer := NewLiveWriter(store, "Live file")
+	defer writer.Dispose()
+	_, _ = writer.Write(randomBytes(100000))
+
+	before := runtime.NumGoroutine()
+	pipeReader, pipeWriter := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- WriteLiveChunkData(ctx, writer.SyncInfo(), store, bufio.NewReader(pipeReader), NopFlushWriter{ioutil.Discard})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// An answer arriving late completes the read in progress, but no further reads follow
+	_, _ = pipeWriter.Write([]byte{0})
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Leaked %v goroutines", n-before)
+	}
+	_ = pipeWriter.Close()
+}
+
+func TestLiveProtocolErrors(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "", store)
+
+	var announcement bytes.Buffer
+	check(t, "writing announcement", writeLiveAnnouncement(&announcement, ChunkInfo{Key: cafs.SKey{1}, Size: 100}))
+	ann := announcement.Bytes()
+	cat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	for _, c := range []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"empty", nil, ErrTransferInterrupted},
+		{"truncated announcement", ann[:10], ErrTransferInterrupted},
+		{"missing data", ann, ErrTransferInterrupted},
+		{"truncated data", cat(ann, []byte{liveFrameData}, varint(100), make([]byte, 50)), ErrTransferInterrupted},
+		{"wrong data", cat(ann, []byte{liveFrameData}, varint(100), make([]byte, 100)), ErrProtocolViolation},
+		{"unsolicited data", cat([]byte{liveFrameData}, varint(1), []byte{0}), ErrProtocolViolation},
+		{"unknown frame", []byte{42}, ErrProtocolViolation},
+		{"wrong count", cat(ann, []byte{liveFrameEnd}, varint(2)), ErrProtocolViolation},
+		{"data missing at end", cat(ann, []byte{liveFrameEnd}, varint(1)), ErrProtocolViolation},
+	} {
+		f, err := ReconstructLiveFile(store, bytes.NewReader(c.stream), NopFlushWriter{ioutil.Discard}, "Live file")
+		if f != nil {
+			f.Dispose()
+		}
+		if err != c.err {
+			t.Errorf("Case %v: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func varint(v int64) []byte {
+	var buf bytes.Buffer
+	_ = writeVarint(&buf, v)
+	return buf.Bytes()
+}
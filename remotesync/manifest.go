@@ -0,0 +1,98 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"errors"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"path"
+	"strings"
+)
+
+// Error ErrInvalidManifest is returned when a Manifest contains an invalid or duplicate path, or an
+// entry lacking a valid SyncInfo.
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// Struct Manifest describes a set of files to be synchronized together, e.g. a directory tree. It is
+// encoded as JSON. Files may share chunks, which are transferred only once when the files are
+// synchronized into the same storage one after the other.
+type Manifest struct {
+	Entries []ManifestEntry
+}
+
+// Struct ManifestEntry describes a file of a Manifest.
+type ManifestEntry struct {
+	Path     string    // relative path of the file, using '/' as separator
+	Key      cafs.SKey // the file's key
+	SyncInfo *SyncInfo // the file's chunks and the permutation used for transferring them
+}
+
+// Func Add appends an entry for `file` under `path`, which must be relative, using '/' as separator
+// and free of '.' and '..' elements. The entry's SyncInfo uses permutation `perm`.
+// Returns ErrInvalidManifest if the path is invalid or already present, and ErrChunkTooLarge if the
+// file contains a chunk exceeding chunking.MaxChunkSize.
+func (m *Manifest) Add(path string, file cafs.File, perm shuffle.Permutation) error {
+	if !isValidManifestPath(path) {
+		return ErrInvalidManifest
+	}
+	for _, e := range m.Entries {
+		if e.Path == path {
+			return ErrInvalidManifest
+		}
+	}
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	if err := syncinf.SetChunksFromFile(file); err != nil {
+		return err
+	}
+	m.Entries = append(m.Entries, ManifestEntry{Path: path, Key: file.Key(), SyncInfo: syncinf})
+	return nil
+}
+
+// Func Validate checks that all paths are valid and distinct, and that all entries have a SyncInfo
+// with a valid permutation. Must be called on manifests received from a remote before using them.
+// Returns ErrInvalidManifest otherwise.
+func (m *Manifest) Validate() error {
+	paths := make(map[string]bool, len(m.Entries))
+	for _, e := range m.Entries {
+		if !isValidManifestPath(e.Path) || paths[e.Path] {
+			return ErrInvalidManifest
+		} else if e.SyncInfo == nil || !e.SyncInfo.Perm.IsValid() {
+			return ErrInvalidManifest
+		}
+		paths[e.Path] = true
+	}
+	return nil
+}
+
+// Function isValidManifestPath returns true if `p` is a non-empty, relative, slash-separated path
+// that doesn't escape the directory it is relative to.
+func isValidManifestPath(p string) bool {
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, "\\") || strings.ContainsRune(p, 0) {
+		return false
+	}
+	if path.Clean(p) != p {
+		return false
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
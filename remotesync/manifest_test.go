@@ -0,0 +1,62 @@
+package remotesync
+
+import (
+	"encoding/json"
+	"github.com/indyjo/cafs/ram"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	store := ram.NewRamStorage(1 << 20)
+	defer reportUsage(t, "store", store)
+	file := addRandomFile(t, store, 10000)
+	defer file.Dispose()
+
+	var m Manifest
+	for _, p := range []string{"a", "dir/b", "dir/sub/.c"} {
+		if err := m.Add(p, file, []int{1, 0}); err != nil {
+			t.Errorf("Add(%#v) failed: %v", p, err)
+		}
+	}
+	for _, p := range []string{"", "/a", "a/", "./a", "dir/../a", "..", "a//b", `a\b`, "dir/b"} {
+		if err := m.Add(p, file, []int{1, 0}); err != ErrInvalidManifest {
+			t.Errorf("Add(%#v): expected ErrInvalidManifest, got %v", p, err)
+		}
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	// The manifest survives encoding as JSON
+	b, err := json.Marshal(&m)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	var m2 Manifest
+	if err := json.Unmarshal(b, &m2); err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if err := m2.Validate(); err != nil {
+		t.Fatalf("Validate failed after decoding: %v", err)
+	}
+	for i, e := range m2.Entries {
+		if e.Path != m.Entries[i].Path || e.Key != file.Key() || e.SyncInfo.Digest() != m.Entries[i].SyncInfo.Digest() {
+			t.Errorf("Entry %v differs after decoding", i)
+		}
+	}
+
+	// Manipulated manifests are rejected
+	m2.Entries[1].Path = "../b"
+	if err := m2.Validate(); err != ErrInvalidManifest {
+		t.Errorf("Expected ErrInvalidManifest for invalid path, got %v", err)
+	}
+	m2.Entries[1].Path = "a"
+	if err := m2.Validate(); err != ErrInvalidManifest {
+		t.Errorf("Expected ErrInvalidManifest for duplicate path, got %v", err)
+	}
+	m2.Entries[1].Path = "b"
+	m2.Entries[2].SyncInfo = nil
+	if err := m2.Validate(); err != ErrInvalidManifest {
+		t.Errorf("Expected ErrInvalidManifest for missing SyncInfo, got %v", err)
+	}
+}
@@ -18,6 +18,7 @@ package remotesync
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
@@ -25,71 +26,570 @@ import (
 	"io"
 	"log"
 	"sync"
+	"time"
 )
 
 var ErrDisposed = errors.New("disposed")
+
+// Returned by ReconstructFileFromRequestedChunks if the chunk data stream ended prematurely, e.g.
+// because the connection dropped. The transfer may be retried.
+var ErrTransferInterrupted = errors.New("transfer interrupted")
+
+// Returned by ReconstructFileFromRequestedChunks if the chunk data stream doesn't conform to the
+// protocol, e.g. because it contains chunks other than those requested. Retrying won't help.
+var ErrProtocolViolation = errors.New("protocol violation")
+
+// Returned by ReconstructFileFromRequestedChunks if the data of a single requested chunk took
+// longer to arrive than allowed using Builder.WithChunkTimeout. The transfer may be retried.
+var ErrChunkTimeout = errors.New("timeout receiving chunk")
+
+// Returned by ReconstructFileFromRequestedChunks if chunks needed for reconstructing the file
+// weren't requested because of the quota set using Builder.WithRequestQuota.
+var ErrQuotaExceeded = errors.New("request quota exceeded")
+
+// Returned by Builder.Reset if a transfer is still in progress.
+var ErrBuilderBusy = errors.New("builder busy")
+
+// Wrapped by UnexpectedChunkError. Chunk mismatches are protocol violations, too, but other
+// protocol violations don't match ErrUnexpectedChunk.
 var ErrUnexpectedChunk = errors.New("unexpected chunk")
 
+// Struct UnexpectedChunkError is returned by ReconstructFileFromRequestedChunks if the chunk data
+// stream contains a chunk other than the one requested. It wraps ErrUnexpectedChunk and also
+// matches ErrProtocolViolation when using errors.Is.
+type UnexpectedChunkError struct {
+	Index        int // Position of the chunk in the chunk data stream, in permuted order
+	ExpectedKey  cafs.SKey
+	ActualKey    cafs.SKey
+	ExpectedSize int64
+	ActualSize   int64
+	Reason       string // "key mismatch", "size mismatch" or "unsolicited chunk"
+}
+
+func (e *UnexpectedChunkError) Error() string {
+	if e.Reason == "unsolicited chunk" {
+		return fmt.Sprintf("unexpected chunk #%d: %v, got %v (%d bytes) after the last chunk",
+			e.Index, e.Reason, e.ActualKey, e.ActualSize)
+	}
+	return fmt.Sprintf("unexpected chunk #%d: %v, expected %v (%d bytes), got %v (%d bytes)",
+		e.Index, e.Reason, e.ExpectedKey, e.ExpectedSize, e.ActualKey, e.ActualSize)
+}
+
+// Returns ErrUnexpectedChunk.
+func (e *UnexpectedChunkError) Unwrap() error {
+	return ErrUnexpectedChunk
+}
+
+// Reports whether `target` is ErrProtocolViolation, which every unexpected chunk constitutes.
+func (e *UnexpectedChunkError) Is(target error) bool {
+	return target == ErrProtocolViolation
+}
+
+// The size of the buffer used by ReconstructFileFromRequestedChunks for reading chunk data,
+// unless set otherwise using Builder.WithReadBufferSize.
+var DefaultReadBufferSize = 4096
+
 // Used by receiver to memorize information about a chunk in the time window between
 // putting it into the wishlist and receiving the actual chunk data.
 type memo struct {
-	ci        ChunkInfo // key and length
-	file      cafs.File // A File if the chunk existed already, nil otherwise
-	requested bool      // Whether the chunk was requested from the sender
+	ci        ChunkInfo    // key and length
+	file      cafs.File    // A File if the chunk existed already, nil otherwise
+	requested bool         // Whether the chunk was requested from the sender
+	shared    *sharedChunk // If not nil, a request shared with other Builders via a ChunkCoordinator
+	owner     bool         // Whether this Builder is responsible for completing the shared request
+	skipped   bool         // Whether the chunk is missing but wasn't requested due to the quota
+	excluded  bool         // Whether the chunk lies outside the range set using Builder.WithRange
 }
 
+// Function pinned returns the number of bytes the memo keeps locked in storage.
+func (mem memo) pinned() int64 {
+	if mem.file != nil {
+		return mem.file.Size()
+	}
+	return 0
+}
+
+// Type InfoFunc is used by a Builder to name the temporaries it creates in storage.
+// It is called with the index of a received chunk, or with -1 for the reconstructed file.
+type InfoFunc func(chunkIdx int) string
+
+// Function DefaultInfoFunc returns the InfoFunc used by NewBuilder. The reconstructed file is
+// named `info` and the chunks are named `info` followed by their index.
+func DefaultInfoFunc(info string) InfoFunc {
+	return func(chunkIdx int) string {
+		if chunkIdx < 0 {
+			return info
+		}
+		return fmt.Sprintf("%v #%d", info, chunkIdx)
+	}
+}
+
+// Type ChunkCallback is called by ReconstructFileFromRequestedChunks for every chunk of the file,
+// in the order the chunks are processed, which is the permuted order also seen by the sender.
+// Argument `transferred` is true if the chunk's data was received from the sender, and false if
+// it was taken from local storage, including chunks occurring multiple times within the file and
+// chunks transferred by another Builder sharing the same ChunkCoordinator. The number of bytes
+// reported as transferred matches the number of bytes reported by the sender's
+// TransferStatusCallback. Chunks left out because of Builder.WithRequestQuota are not reported.
+type ChunkCallback func(ci ChunkInfo, transferred bool)
+
 // Type Builder contains state needed for the duration of a file transmission.
 type Builder struct {
-	done    chan struct{}
-	storage cafs.FileStorage
-	memos   chan memo
-	info    string
-	syncinf *SyncInfo
+	done     chan struct{}
+	storage  cafs.FileStorage
+	scratch  cafs.FileStorage
+	memos    chan memo
+	infoFunc InfoFunc
+	syncinf  *SyncInfo
+	bufSize  int
+	strict   cafs.Printer
+	verbose  bool
+	coord    *ChunkCoordinator
+	seq      int64 // Sequence number assigned by coord
+	framer   ChunkFramer
+	chunkCb  ChunkCallback
+	startCb  func()          // Called before reading the first requested chunk, see WithDownloadCallback
+	timeout  time.Duration   // Per-chunk timeout, 0 if disabled
+	verify   bool            // Whether to re-hash chunks found in storage
+	window   *adaptiveWindow // Set if the window adapts to throughput, nil if fixed
+	quota    int64           // Maximum number of chunk bytes to request, negative if unlimited
+	traceCtx context.Context // Parent of the spans created, see WithTraceContext
+	rng      *ByteRange      // The range of bytes to reconstruct, nil for the whole file
+	solo     bool            // Whether the window covers the whole file, see WithStandaloneWishList
 
-	mutex    sync.Mutex // Guards subsequent variables
-	disposed bool       // Set in Dispose
-	started  bool       // Set in WriteWishList. Signals that chunks channel will be used.
+	mutex          sync.Mutex    // Guards subsequent variables
+	disposed       bool          // Set in Dispose
+	started        bool          // Set in WriteWishList. Signals that chunks channel will be used.
+	wishlistDone   bool          // Set when WriteWishList returns
+	reconstructing bool          // Set while ReconstructFileFromRequestedChunks is running
+	resumed        chan struct{} // Set in Pause, closed and reset in Resume
+	seeded         []cafs.File   // Chunks locked by Seed until Dispose or Reset
 }
 
 // Returns a new Builder for reconstructing a file. Must eventually be disposed.
 // The builder can then proceed sending a "wishlist" of chunks that are missing
 // in the local storage for complete reconstruction of the file.
+//
+// The `windowSize` is the number of chunks WriteWishList may get ahead of
+// ReconstructFileFromRequestedChunks, and thereby the number of chunks the sender may send without
+// waiting for the receiver. A larger window improves throughput on connections with high latency.
+// However, every chunk in the window that is already present in storage stays locked until it has
+// been processed, so the window also bounds the storage pinned by a transfer to about
+// `windowSize` times chunking.MaxChunkSize. It should be at least 8, as the wishlist is sent in
+// bytes. See WithAdaptiveWindow for adjusting the window to the connection.
 func NewBuilder(storage cafs.FileStorage, syncinf *SyncInfo, windowSize int, info string) *Builder {
 	return &Builder{
-		done:    make(chan struct{}),
-		storage: storage,
-		memos:   make(chan memo, windowSize),
-		info:    info,
-		syncinf: syncinf,
+		done:     make(chan struct{}),
+		storage:  storage,
+		scratch:  storage,
+		memos:    make(chan memo, windowSize),
+		infoFunc: DefaultInfoFunc(info),
+		syncinf:  syncinf,
+		bufSize:  DefaultReadBufferSize,
+		verbose:  LoggingEnabled,
+		framer:   VarintFramer{},
+		quota:    -1,
+		traceCtx: context.Background(),
+	}
+}
+
+// Sets the function used for naming the temporaries created in storage. Must be called
+// before ReconstructFileFromRequestedChunks.
+func (b *Builder) WithInfoFunc(f InfoFunc) *Builder {
+	b.infoFunc = f
+	return b
+}
+
+// Sets the size of the buffer used for reading chunk data. Larger buffers reduce the number of
+// read calls on high-bandwidth connections. Must be called before ReconstructFileFromRequestedChunks.
+func (b *Builder) WithReadBufferSize(size int) *Builder {
+	b.bufSize = size
+	return b
+}
+
+// Enables strict mode: Whenever ReconstructFileFromRequestedChunks encounters chunk data not matching
+// the expected chunk, details about the offending chunk are reported to `log` before aborting with
+// an UnexpectedChunkError. Must be called before ReconstructFileFromRequestedChunks.
+func (b *Builder) WithStrictMode(log cafs.Printer) *Builder {
+	b.strict = log
+	return b
+}
+
+// Sets a separate storage for data needed only while a transfer is in progress. Received chunks
+// and the file being reconstructed are created in `scratch` instead of the Builder's storage.
+// When ReconstructFileFromRequestedChunks returns, it has released all of its scratch data,
+// which then remains in `scratch` as unlocked cache data at most. Only on success is the
+// reconstructed file copied into the Builder's storage. Chunks already present in the Builder's
+// storage are still used and not requested. Must be called before ReconstructFileFromRequestedChunks.
+func (b *Builder) WithScratchStorage(scratch cafs.FileStorage) *Builder {
+	b.scratch = scratch
+	return b
+}
+
+// Attaches the Builder to a ChunkCoordinator, allowing it to share the transfer of chunks with
+// other Builders attached to the same coordinator. Must be called before WriteWishList.
+func (b *Builder) WithChunkCoordinator(c *ChunkCoordinator) *Builder {
+	b.coord = c
+	b.seq = c.attach()
+	return b
+}
+
+// Sets the ChunkFramer used for decoding chunk data. Must match the sender's, see WithChunkFramer.
+// Defaults to VarintFramer. Must be called before ReconstructFileFromRequestedChunks.
+func (b *Builder) WithChunkFramer(framer ChunkFramer) *Builder {
+	b.framer = framer
+	return b
+}
+
+// Sets the maximum time ReconstructFileFromRequestedChunks waits for the data of a single
+// requested chunk to arrive, measured from when it starts reading the chunk. If exceeded, it fails
+// with ErrChunkTimeout, even if the transfer as a whole is making progress otherwise. A zero
+// duration, the default, disables the timeout. Must be called before
+// ReconstructFileFromRequestedChunks.
+//
+// The chunk data stream can't be resumed after a timeout, as its position within the stream is
+// lost. The sender is not notified and may still push the slow chunk later, so the caller should
+// close the connection. Chunks received up to then remain in storage as cache data, so a retry
+// won't request them again unless they are evicted meanwhile.
+//
+// With a timeout set, the stream is read by a separate goroutine, which terminates only once a
+// read from the stream returns. Closing the underlying connection ensures that.
+func (b *Builder) WithChunkTimeout(timeout time.Duration) *Builder {
+	b.timeout = timeout
+	return b
+}
+
+// Enables or disables verification of chunks already present in storage. If enabled, WriteWishList
+// re-hashes the content of every chunk it finds in storage and requests it if the content doesn't
+// match the chunk's key, as if it were absent. This trades CPU time for robustness against
+// corrupted storage. Storing the chunk received replaces the corrupted content if the storage
+// implements cafs.RepairableStorage.
+// Must be called before WriteWishList.
+func (b *Builder) WithVerifyPresentChunks(verify bool) *Builder {
+	b.verify = verify
+	return b
+}
+
+// Enables adaptive mode: Starting small, the number of chunks in flight between WriteWishList and
+// ReconstructFileFromRequestedChunks is adjusted to maximize observed throughput, between 8 and the
+// `windowSize` passed to NewBuilder. Additionally, if `memoryBudget` is positive, the total size
+// of chunks in flight that are locked in storage is kept below it, except for the first 8 chunks.
+// Must be called before WriteWishList.
+func (b *Builder) WithAdaptiveWindow(memoryBudget int64) *Builder {
+	b.window = newAdaptiveWindow(cap(b.memos), memoryBudget)
+	return b
+}
+
+// Enables standalone mode: WriteWishList runs to completion without a concurrent call to
+// ReconstructFileFromRequestedChunks, e.g. for writing the wishlist to a file before any chunk
+// data is received. The window is widened to the whole file, so every chunk present in storage
+// stays locked until it has been processed or the Builder is disposed. Disables adaptive mode.
+// Must be called before WriteWishList.
+func (b *Builder) WithStandaloneWishList() *Builder {
+	b.solo = true
+	b.memos = make(chan memo, b.standaloneWindowSize())
+	b.window = nil
+	return b
+}
+
+// Function standaloneWindowSize returns the number of memos WriteWishList produces for the file.
+func (b *Builder) standaloneWindowSize() int {
+	return len(b.syncinf.Chunks) + len(b.syncinf.Perm)
+}
+
+// Restricts the Builder to the bytes of the file within `r`. Only chunks overlapping the range are
+// requested, and ReconstructFileFromRequestedChunks produces a file containing just the bytes of
+// the range, not a file of the original size. Parts of the range lying outside the file are
+// ignored. Must be called before WriteWishList.
+func (b *Builder) WithRange(r ByteRange) *Builder {
+	b.rng = &r
+	return b
+}
+
+// Function rangeBounds returns the chunks overlapping the Builder's range, from `first` up to but
+// excluding `last`, as well as the range itself, clamped to the file, from `start` up to but
+// excluding `end`. Without a range, the whole file is covered.
+func (b *Builder) rangeBounds() (first, last int, start, end int64) {
+	total := b.syncinf.TotalSize()
+	if b.rng == nil {
+		return 0, len(b.syncinf.Chunks), 0, total
+	}
+	start, end = b.rng.Offset, b.rng.Offset+b.rng.Length
+	if start < 0 {
+		start = 0
+	} else if start > total {
+		start = total
+	}
+	if end > total {
+		end = total
+	}
+	if end < start {
+		end = start
+	}
+	var offset int64
+	first, last = len(b.syncinf.Chunks), 0
+	for i, ci := range b.syncinf.Chunks {
+		next := offset + int64(ci.Size)
+		if next > start && offset < end {
+			if i < first {
+				first = i
+			}
+			last = i + 1
+		}
+		offset = next
+	}
+	if last == 0 {
+		first = 0
+	}
+	return
+}
+
+// Returns the current number of chunks WriteWishList may get ahead of
+// ReconstructFileFromRequestedChunks. Changes over time in adaptive mode.
+func (b *Builder) WindowSize() int {
+	if b.window != nil {
+		return b.window.size()
+	}
+	return cap(b.memos)
+}
+
+// Limits the number of bytes of chunk data requested from the sender to `quota`. Once requesting
+// the next missing chunk would exceed the quota, WriteWishList stops requesting chunks. The
+// transfer then completes normally, receiving the chunks requested so far, but
+// ReconstructFileFromRequestedChunks doesn't produce a file and returns ErrQuotaExceeded instead.
+// The chunks received remain in scratch storage as cache data, so that a later transfer of the
+// same file needn't request them again unless they are evicted meanwhile. Chunks received by
+// another Builder sharing a ChunkCoordinator don't count towards the quota. A negative quota,
+// the default, disables the limit. Must be called before WriteWishList.
+func (b *Builder) WithRequestQuota(quota int64) *Builder {
+	b.quota = quota
+	return b
+}
+
+// Sets a callback notified about every chunk processed. Must be called before
+// ReconstructFileFromRequestedChunks.
+func (b *Builder) WithChunkCallback(cb ChunkCallback) *Builder {
+	b.chunkCb = cb
+	return b
+}
+
+// Sets a callback that ReconstructFileFromRequestedChunks calls once, right before reading the data
+// of the first chunk requested from the sender. It marks the point where the chunks found in local
+// storage have been used up and the transfer starts waiting for the network, e.g. for showing that
+// a download is resumed. It isn't called if no chunks are requested. Must be called before
+// ReconstructFileFromRequestedChunks.
+func (b *Builder) WithDownloadCallback(cb func()) *Builder {
+	b.startCb = cb
+	return b
+}
+
+// Enables or disables detailed logging for this Builder. Defaults to the value of LoggingEnabled
+// at the time the Builder was created.
+func (b *Builder) WithVerbose(verbose bool) *Builder {
+	b.verbose = verbose
+	return b
+}
+
+// Makes WriteWishList and ReconstructFileFromRequestedChunks create spans as children of the span
+// carried by `ctx`, using the Tracer set with WithTracer. The spans report the number of chunks
+// and bytes requested and transferred, and the number of chunks found in storage.
+func (b *Builder) WithTraceContext(ctx context.Context) *Builder {
+	b.traceCtx = ctx
+	return b
+}
+
+// Seeds the Builder with the leading chunks of `partial`, e.g. an interrupted earlier download of
+// the file being reconstructed. As chunk boundaries depend on content only, a prefix of the file
+// yields the same chunks, except for the last one, which is usually cut short. Chunks matching the
+// SyncInfo (see SyncInfo.MatchingPrefix) are copied into the Builder's storage if not present there
+// and are kept locked until the Builder is disposed or reset, so that WriteWishList requests the
+// remainder of the file only. Returns the number of chunks seeded. Must be called before
+// WriteWishList.
+func (b *Builder) Seed(partial cafs.File) (int, error) {
+	iter := partial.Chunks()
+	defer iter.Dispose()
+	n := 0
+	for ; n < len(b.syncinf.Chunks) && iter.Next(); n++ {
+		ci := b.syncinf.Chunks[n]
+		if iter.Key() != ci.Key || iter.Size() != int64(ci.Size) {
+			break
+		}
+		chunk, err := b.storage.Get(&ci.Key)
+		if err == cafs.ErrNotFound {
+			chunk, err = b.copyChunk(iter.File())
+		}
+		if err != nil {
+			return n, err
+		}
+
+		b.mutex.Lock()
+		if b.disposed {
+			b.mutex.Unlock()
+			chunk.Dispose()
+			return n, ErrDisposed
+		}
+		b.seeded = append(b.seeded, chunk)
+		b.mutex.Unlock()
 	}
+	return n, nil
 }
 
-// Disposes the Builder. Must be called exactly once per Builder. May cause the goroutines running
-// WriteWishList and ReconstructFileFromRequestedChunks to terminate with error ErrDisposed.
+// Function copyChunk copies a chunk from another storage into the Builder's storage. The chunk
+// passed is disposed.
+func (b *Builder) copyChunk(chunk cafs.File) (cafs.File, error) {
+	defer chunk.Dispose()
+	temp := b.storage.CreateWithKey(b.infoFunc(-1), chunk.Key())
+	defer temp.Dispose()
+	r := chunk.Open()
+	//noinspection GoUnhandledErrorResult
+	defer r.Close()
+	if _, err := io.Copy(temp, r); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+// Disposes the Builder. Must be called at least once per Builder; calling it again has no effect.
+// May cause the goroutines running WriteWishList and ReconstructFileFromRequestedChunks to
+// terminate with error ErrDisposed.
 func (b *Builder) Dispose() {
 	b.mutex.Lock()
 	if b.disposed {
-		panic("Builder must be disposed exactly once")
+		b.mutex.Unlock()
+		return
 	}
 	b.disposed = true
 	started := b.started
+	seeded := b.seeded
+	b.seeded = nil
 	b.mutex.Unlock()
 
+	for _, chunk := range seeded {
+		chunk.Dispose()
+	}
+
 	close(b.done)
+	if b.window != nil {
+		b.window.close()
+	}
 
 	if started {
-		for chunk := range b.memos {
-			if chunk.file != nil {
-				chunk.file.Dispose()
-			}
+		for mem := range b.memos {
+			b.disposeMemo(mem)
 		}
 	}
 }
 
+// Prepares a Builder whose transfer has finished for reconstructing another file, described by
+// `syncinf` and named `info` as with NewBuilder. This avoids allocating a new Builder for each of
+// many files synced from the same peer. Settings made using the With... functions are kept, except
+// for the range, see WithRange, and the InfoFunc, which is replaced by DefaultInfoFunc(info). An
+// adaptive window keeps the size it has adapted to. Chunks seeded or left unprocessed by the
+// previous transfer are released, as on Dispose.
+//
+// Returns ErrBuilderBusy if WriteWishList or ReconstructFileFromRequestedChunks is still running,
+// and ErrDisposed if the Builder has been disposed. A Builder that has been reset must still be
+// disposed eventually.
+func (b *Builder) Reset(syncinf *SyncInfo, info string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.disposed {
+		return ErrDisposed
+	}
+	if b.started && !b.wishlistDone || b.reconstructing {
+		return ErrBuilderBusy
+	}
+
+	for _, chunk := range b.seeded {
+		chunk.Dispose()
+	}
+	b.seeded = nil
+	if b.started {
+		// WriteWishList has closed the channel, which can't be reused
+		for mem := range b.memos {
+			b.disposeMemo(mem)
+		}
+		b.memos = make(chan memo, cap(b.memos))
+	}
+	b.started, b.wishlistDone = false, false
+
+	b.syncinf = syncinf
+	b.infoFunc = DefaultInfoFunc(info)
+	b.rng = nil
+	if b.solo {
+		b.memos = make(chan memo, b.standaloneWindowSize())
+	}
+	if b.window != nil {
+		b.window.reset()
+	}
+	if b.coord != nil {
+		// Builders attached later have been waiting for this one's chunks, so the next transfer
+		// must queue up behind them
+		b.seq = b.coord.attach()
+	}
+	return nil
+}
+
+// Function disposeMemo releases all resources held by a memo that won't be processed.
+func (b *Builder) disposeMemo(mem memo) {
+	if mem.file != nil {
+		mem.file.Dispose()
+	}
+	if mem.shared != nil && mem.owner {
+		b.coord.complete(mem.ci.Key, mem.shared, nil)
+	} else if mem.shared != nil {
+		b.coord.release(mem.shared)
+	}
+}
+
+// Pauses the transfer. Until Resume is called, ReconstructFileFromRequestedChunks stops reading
+// chunk data, which eventually blocks the sender. The connection is kept intact. Calling Pause
+// on a paused Builder has no effect.
+func (b *Builder) Pause() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.resumed == nil {
+		b.resumed = make(chan struct{})
+	}
+}
+
+// Resumes a transfer paused by Pause. Calling Resume on a Builder that isn't paused has no effect.
+func (b *Builder) Resume() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.resumed != nil {
+		close(b.resumed)
+		b.resumed = nil
+	}
+}
+
+// Function waitWhilePaused blocks until the Builder is either resumed or disposed.
+func (b *Builder) waitWhilePaused() error {
+	b.mutex.Lock()
+	resumed := b.resumed
+	b.mutex.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-b.done:
+		return ErrDisposed
+	}
+}
+
 // Outputs a bit stream with '1' for each missing chunk, and
 // '0' for each chunk that is already available or already requested.
-func (b *Builder) WriteWishList(w FlushWriter) error {
-	if LoggingEnabled {
+// Consequently, a chunk occurring multiple times within a file is requested at most once.
+// All of its occurrences are reconstructed from the single copy received.
+// Unless in standalone mode, see WithStandaloneWishList, ReconstructFileFromRequestedChunks must be
+// called concurrently, as WriteWishList blocks while it is a whole window ahead.
+func (b *Builder) WriteWishList(w FlushWriter) (err error) {
+	if b.verbose {
 		log.Printf("Receiver: Begin WriteWishList")
 		defer log.Printf("Receiver: End WriteWishList")
 	}
@@ -98,31 +598,84 @@ func (b *Builder) WriteWishList(w FlushWriter) error {
 		return err
 	}
 
+	defer func() {
+		b.mutex.Lock()
+		b.wishlistDone = true
+		b.mutex.Unlock()
+	}()
 	defer close(b.memos)
 
 	requested := make(map[cafs.SKey]bool)
-	bitWriter := newBitWriter(w)
+	skipped := make(map[cafs.SKey]bool)
+	var requestedBytes int64
+	var requestedChunks, presentChunks int
+	bitWriter := NewBitWriter(w)
+
+	_, span := StartSpan(b.traceCtx, "remotesync.WriteWishList")
+	defer func() {
+		span.SetAttribute("chunks", len(b.syncinf.Chunks))
+		span.SetAttribute("chunks_requested", requestedChunks)
+		span.SetAttribute("bytes_requested", requestedBytes)
+		span.SetAttribute("cache_hits", presentChunks)
+		span.End(err)
+	}()
+
+	first, last, _, _ := b.rangeBounds()
+	consume := func(ci ChunkInfo, excluded bool) error {
+		if b.isDisposed() {
+			return ErrDisposed
+		}
 
-	consumeFunc := func(v interface{}) error {
-		ci := v.(ChunkInfo)
 		key := ci.Key
 
 		mem := memo{
 			ci: ci,
 		}
 
-		if key == emptyKey || requested[key] {
+		if excluded {
+			// The chunk lies outside the range to reconstruct
+			mem.excluded = true
+		} else if skipped[key] {
+			mem.skipped = true
+		} else if key == emptyKey || requested[key] {
 			// This key was already requested. Also, the empty key is never requested.
 			mem.requested = false
-		} else if file, err := b.storage.Get(&key); err != nil {
-			// File was not found in storage -> request and remember
-			mem.requested = true
-			requested[key] = true
+		} else if file, err := b.getPresentChunk(&key); err != nil {
+			// File was not found in storage -> request and remember, unless an older Builder
+			// has already requested it
+			if b.coord != nil {
+				mem.shared, mem.owner = b.coord.acquire(b.seq, key)
+			}
+			mem.requested = mem.shared == nil || mem.owner
+			if mem.requested && b.quota >= 0 && (len(skipped) > 0 || requestedBytes+int64(ci.Size) > b.quota) {
+				// Requesting the chunk would exceed the quota -> stop requesting
+				if mem.shared != nil {
+					b.coord.complete(key, mem.shared, nil)
+					mem.shared = nil
+				}
+				mem.requested = false
+				mem.skipped = true
+				skipped[key] = true
+			} else {
+				if mem.requested {
+					requestedBytes += int64(ci.Size)
+					requestedChunks++
+				}
+				requested[key] = true
+			}
 		} else {
 			// File was already in storage -> prevent it from being collected until it is needed
 			mem.file = file
 			mem.requested = false
 			requested[key] = true
+			presentChunks++
+		}
+
+		if b.window != nil {
+			if err := b.window.acquire(mem.pinned()); err != nil {
+				b.disposeMemo(mem)
+				return err
+			}
 		}
 
 		// Write memo into channel. This might block if channel buffer is full.
@@ -131,9 +684,7 @@ func (b *Builder) WriteWishList(w FlushWriter) error {
 		case b.memos <- mem:
 			// Responsibility for disposing chunk.file is passed to the channel
 		case <-b.done:
-			if mem.file != nil {
-				mem.file.Dispose()
-			}
+			b.disposeMemo(mem)
 			return ErrDisposed
 		}
 
@@ -144,22 +695,133 @@ func (b *Builder) WriteWishList(w FlushWriter) error {
 		return nil // success
 	}
 
-	// Create a shuffler using the above consumeFunc and push the SyncInfo's chunk infos through it.
-	// For every ChunkInfo leaving the shuffler (in shuffled order), the consumeFunc
-	// writes a bit into the wishlist.
-	shuffler := shuffle.NewStreamShuffler(b.syncinf.Perm, emptyChunkInfo, consumeFunc)
 	nChunks := len(b.syncinf.Chunks)
+	if b.syncinf.Perm.IsTrivial() {
+		// Fast path: Without a permutation, chunk infos are consumed in natural order.
+		for idx := 0; idx < nChunks; idx++ {
+			if err := consume(b.syncinf.Chunks[idx], idx < first || idx >= last); err != nil {
+				return err
+			}
+		}
+		return bitWriter.Flush()
+	}
+
+	// Create a shuffler using the above consume function and push the indices of the SyncInfo's
+	// chunks through it, using -1 as placeholder. For every chunk leaving the shuffler (in shuffled
+	// order), the consume function writes a bit into the wishlist.
+	shuffler := shuffle.NewStreamShuffler(b.syncinf.Perm, -1, func(v interface{}) error {
+		idx := v.(int)
+		if idx < 0 {
+			return consume(emptyChunkInfo, false)
+		}
+		return consume(b.syncinf.Chunks[idx], idx < first || idx >= last)
+	})
 	for idx := 0; idx < nChunks; idx++ {
-		if err := shuffler.Put(b.syncinf.Chunks[idx]); err != nil {
+		if b.isDisposed() {
+			return ErrDisposed
+		}
+		if err := shuffler.Put(idx); err == ErrDisposed {
+			return err
+		} else if err != nil {
 			return fmt.Errorf("error from shuffler.Put: %v", err)
 		}
 	}
-	if err := shuffler.End(); err != nil {
+	if err := shuffler.End(); err == ErrDisposed {
+		return err
+	} else if err != nil {
 		return fmt.Errorf("error from shuffler.End: %v", err)
 	}
 	return bitWriter.Flush()
 }
 
+// Function getPresentChunk retrieves a chunk from the Builder's storage. If verification is
+// enabled, a chunk whose content doesn't match its key is reported as not found and, if the
+// storage implements cafs.RepairableStorage, marked as corrupt.
+func (b *Builder) getPresentChunk(key *cafs.SKey) (cafs.File, error) {
+	file, err := b.storage.Get(key)
+	if err != nil || !b.verify {
+		return file, err
+	}
+	if !contentMatchesKey(file) {
+		if b.verbose {
+			log.Printf("Receiver: chunk %v in storage is corrupt, requesting it", key)
+		}
+		file.Dispose()
+		if r, ok := b.storage.(cafs.RepairableStorage); ok {
+			_ = r.MarkCorrupt(*key)
+		}
+		return nil, cafs.ErrNotFound
+	}
+	return file, nil
+}
+
+// Returns the keys of the chunks missing in storage, in the order they occur in the file, applying
+// the same checks as WriteWishList, including verification if enabled. Like WriteWishList, lists
+// a chunk occurring multiple times only once. Unlike it, doesn't lock the chunks found in storage,
+// so the result is exact only if the storage's contents don't change in between, and ignores the
+// ChunkCoordinator and the request quota. This allows feeding the missing chunks into a fetcher of
+// one's own choosing, e.g. FetchChunks in package httpsync. Doesn't affect a subsequent call to
+// WriteWishList. Returns ErrDisposed if the Builder has been disposed.
+func (b *Builder) MissingChunks() ([]cafs.SKey, error) {
+	var missing []cafs.SKey
+	seen := make(map[cafs.SKey]bool)
+	for _, ci := range b.syncinf.Chunks {
+		if b.isDisposed() {
+			return nil, ErrDisposed
+		}
+		key := ci.Key
+		if key == emptyKey || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if file, err := b.getPresentChunk(&key); err == nil {
+			file.Dispose()
+			continue
+		}
+		missing = append(missing, key)
+	}
+	return missing, nil
+}
+
+// Function EstimateTransfer determines which chunks WriteWishList would request if called now,
+// without requiring a connection. Returns the number of chunks and the number of bytes of chunk
+// data (excluding framing) the sender would have to send. Like WriteWishList, it requests
+// repeated chunks only once. The result is exact unless the storage's contents change in between.
+// Leaves storages implementing cafs.PresenceStorage unaffected, see cafs.Contains.
+func EstimateTransfer(syncinf *SyncInfo, storage cafs.FileStorage) (bytesToSend int64, chunksToSend int) {
+	seen := make(map[cafs.SKey]bool)
+	for _, ci := range syncinf.Chunks {
+		key := ci.Key
+		if key == emptyKey || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if cafs.Contains(storage, key) {
+			continue
+		}
+		bytesToSend += int64(ci.Size)
+		chunksToSend++
+	}
+	return
+}
+
+// Function isDisposed returns true if Dispose has been called.
+func (b *Builder) isDisposed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Function setReconstructing records whether ReconstructFileFromRequestedChunks is running.
+func (b *Builder) setReconstructing(reconstructing bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reconstructing = reconstructing
+}
+
 // Function start is called by WriteWishList to mark the Builder as started.
 // This has consequences for the Dispose method.
 func (b *Builder) start() error {
@@ -178,28 +840,70 @@ func (b *Builder) start() error {
 var placeholder interface{} = struct{}{}
 var zeroMemo = memo{}
 
-// Reads a sequence of length-prefixed data chunks and tries to reconstruct a file from that
-// information.
-func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, error) {
-	if LoggingEnabled {
+// Reads a sequence of framed data chunks and tries to reconstruct a file from that
+// information. If the stream ends prematurely, ErrTransferInterrupted is returned. If it contains
+// chunks not matching the requested chunks, an UnexpectedChunkError is returned, which matches
+// both ErrUnexpectedChunk and ErrProtocolViolation. Other violations of the protocol yield
+// ErrProtocolViolation directly.
+// Like WriteChunkData, expects a chunk requested repeatedly to be sent only once, and reuses the
+// copy received for repeated requests.
+func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (file cafs.File, err error) {
+	if b.verbose {
 		log.Printf("Receiver: Begin ReconstructFileFromRequestedChunks")
 		defer log.Printf("Receiver: End ReconstructFileFromRequestedChunks")
 	}
 
-	temp := b.storage.Create(b.info)
+	b.setReconstructing(true)
+	defer b.setReconstructing(false)
+
+	var transferredChunks, localChunks int
+	var transferredBytes int64
+	_, span := StartSpan(b.traceCtx, "remotesync.ReconstructFileFromRequestedChunks")
+	defer func() {
+		span.SetAttribute("chunks_transferred", transferredChunks)
+		span.SetAttribute("bytes_transferred", transferredBytes)
+		span.SetAttribute("chunks_local", localChunks)
+		span.End(err)
+	}()
+
+	temp := b.scratch.Create(b.infoFunc(-1))
 	defer temp.Dispose()
 
-	r := bufio.NewReader(_r)
+	// Chunks are appended to w, which cuts the first and last chunk to the range, if set.
+	var w io.Writer = temp
+	if b.rng != nil {
+		first, _, start, end := b.rangeBounds()
+		w = &rangeWriter{w: temp, skip: start - b.syncinf.ChunkOffset(first), n: end - start}
+	}
+
+	var dr *deadlineReader
+	if b.timeout > 0 {
+		dr = newDeadlineReader(_r, b.bufSize)
+		defer dr.Close()
+		_r = dr
+	}
+	r := bufio.NewReaderSize(_r, b.bufSize)
 
 	errDone := errors.New("done")
 
-	unshuffler := shuffle.NewInverseStreamShuffler(b.syncinf.Perm, placeholder, func(v interface{}) error {
+	consume := func(v interface{}) error {
 		chunk := v.(cafs.File)
 		// Write a chunk of the work file
-		err := appendChunk(temp, chunk)
+		err := b.appendChunk(w, chunk)
 		chunk.Dispose()
 		return err
-	})
+	}
+	unshuffler := shuffle.NewInverseStreamShuffler(b.syncinf.Perm, placeholder, consume)
+	put := unshuffler.Put
+	if b.syncinf.Perm.IsTrivial() {
+		// Fast path: Without a permutation, chunks are appended in the order received.
+		put = func(v interface{}) error {
+			if v == placeholder {
+				return nil
+			}
+			return consume(v)
+		}
+	}
 
 	// Make sure all chunks in the unshuffler are disposed in the end
 	defer unshuffler.WithFunc(func(v interface{}) error {
@@ -208,7 +912,14 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 	}).End()
 
 	idx := 0
+	quotaExceeded := false
+	downloading := false                     // Set once the first requested chunk is read
+	receivedKeys := make(map[cafs.SKey]bool) // The sender sends every chunk only once
 	iteration := func() error {
+		if err := b.waitWhilePaused(); err != nil {
+			return err
+		}
+
 		var mem memo
 
 		// Wait until either a chunk info can be read from the channel, or the builder
@@ -220,47 +931,114 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 			// successfully read, continue...
 		}
 
+		// Dispose may be draining memos concurrently, so the memo stream can't be trusted anymore
+		if b.isDisposed() {
+			b.disposeMemo(mem)
+			return ErrDisposed
+		}
+
 		// It is our responsibility to dispose the file.
 		if mem.file != nil {
 			defer mem.file.Dispose()
 		}
+		if b.window != nil && mem != zeroMemo {
+			defer b.window.release(int64(mem.ci.Size), mem.pinned())
+		}
+		// Other Builders may be waiting for a chunk we requested. Let them know if we fail.
+		if mem.shared != nil && mem.owner {
+			defer func() {
+				if mem.shared != nil {
+					b.coord.complete(mem.ci.Key, mem.shared, nil)
+				}
+			}()
+		}
 
-		if mem.ci == emptyChunkInfo {
-			return unshuffler.Put(placeholder)
+		if mem.ci == emptyChunkInfo || mem.excluded {
+			return put(placeholder)
+		}
+		if mem.skipped {
+			// The file can't be reconstructed, but the remaining chunk data is still received
+			quotaExceeded = true
+			return put(placeholder)
+		}
+
+		if mem.requested && receivedKeys[mem.ci.Key] {
+			// The chunk has been requested repeatedly, and the sender omits repeats
+			mem.requested = false
 		}
 
 		// Under the following circumstances, read chunk data from the stream.
 		//  - chunk data was requested
 		//  - the chunk memo stream has ended (to check whether the chunk data stream also ends).
 		// If there was a real error, abort.
+		var received cafs.File
 		if mem.requested || mem == zeroMemo {
-			chunkFile, err := readChunk(b.storage, r, fmt.Sprintf("%v #%d", b.info, idx))
+			if mem.requested && !downloading {
+				downloading = true
+				if b.startCb != nil {
+					b.startCb()
+				}
+			}
+			if dr != nil && mem.requested {
+				dr.SetDeadline(time.Now().Add(b.timeout))
+			}
+			chunkFile, err := readChunk(b.scratch, r, b.framer, b.infoFunc(idx))
+			if dr != nil {
+				dr.SetDeadline(time.Time{})
+			}
 			if chunkFile != nil {
 				defer chunkFile.Dispose()
 			}
 			if err == io.EOF && mem == zeroMemo {
 				return errDone
-			} else if err == io.EOF {
-				return io.ErrUnexpectedEOF
+			} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ErrTransferInterrupted
 			} else if err != nil {
 				return err
-			} else if mem == zeroMemo {
-				return fmt.Errorf("unsolicited chunk data")
-			} else if chunkFile.Key() != mem.ci.Key {
-				return ErrUnexpectedChunk
-			} else if chunkFile.Size() != int64(mem.ci.Size) {
-				return ErrUnexpectedChunk
+			} else if mem == zeroMemo || chunkFile.Key() != mem.ci.Key || chunkFile.Size() != int64(mem.ci.Size) {
+				return b.unexpectedChunk(idx, mem, chunkFile)
 			}
+			if mem.shared != nil && mem.owner {
+				b.coord.complete(mem.ci.Key, mem.shared, chunkFile)
+				mem.shared = nil
+			}
+			received = chunkFile
+			receivedKeys[mem.ci.Key] = true
 		}
 
-		// Retrieve the chunk from CAFS (we can expect to find it)
-		chunk, _ := b.storage.Get(&mem.ci.Key)
+		var chunk cafs.File
+		if mem.shared != nil && !mem.owner {
+			// Wait for the chunk requested by another Builder
+			defer b.coord.release(mem.shared)
+			if f, err := b.coord.wait(mem.shared, b.done); err != nil {
+				return err
+			} else {
+				chunk = f
+			}
+		} else if received != nil {
+			chunk = received.Duplicate()
+		} else if mem.file != nil {
+			// Use the chunk found by WriteWishList, which may have been verified
+			chunk = mem.file.Duplicate()
+		} else {
+			// Retrieve the chunk from CAFS (we can expect to find it)
+			chunk = b.getChunk(&mem.ci.Key)
+		}
+		if mem.requested {
+			transferredChunks++
+			transferredBytes += int64(mem.ci.Size)
+		} else {
+			localChunks++
+		}
+		if b.chunkCb != nil {
+			b.chunkCb(mem.ci, mem.requested)
+		}
 		// ... and dispatch it to the unshuffler, where it will be buffered for a while.
 		// Disposing is done by the unshuffler's ConsumeFunc.
-		if LoggingEnabled {
+		if b.verbose {
 			log.Printf("Receiver: unshuffler.Put(total:%v, %v)", chunk.Size(), chunk.Key())
 		}
-		return unshuffler.Put(chunk)
+		return put(chunk)
 	}
 
 	for {
@@ -272,6 +1050,10 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 		idx++
 	}
 
+	if quotaExceeded {
+		return nil, ErrQuotaExceeded
+	}
+
 	if err := unshuffler.End(); err != nil {
 		return nil, err
 	}
@@ -280,12 +1062,64 @@ func (b *Builder) ReconstructFileFromRequestedChunks(_r io.Reader) (cafs.File, e
 		return nil, err
 	}
 
+	if b.scratch != b.storage {
+		return b.promote(temp.File())
+	}
 	return temp.File(), nil
 }
 
+// Function getChunk retrieves a chunk from the Builder's storage or, failing that, from scratch storage.
+func (b *Builder) getChunk(key *cafs.SKey) cafs.File {
+	chunk, err := b.storage.Get(key)
+	if err != nil && b.scratch != b.storage {
+		chunk, _ = b.scratch.Get(key)
+	}
+	return chunk
+}
+
+// Function promote copies a file reconstructed in scratch storage into the Builder's storage.
+// The scratch file is disposed.
+func (b *Builder) promote(file cafs.File) (cafs.File, error) {
+	defer file.Dispose()
+	temp := b.storage.Create(b.infoFunc(-1))
+	defer temp.Dispose()
+	r := file.Open()
+	//noinspection GoUnhandledErrorResult
+	defer r.Close()
+	if _, err := io.Copy(temp, r); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
+
+// Function unexpectedChunk returns an UnexpectedChunkError, reporting the mismatch if in strict mode.
+func (b *Builder) unexpectedChunk(idx int, mem memo, actual cafs.File) error {
+	err := &UnexpectedChunkError{
+		Index:        idx,
+		ExpectedKey:  mem.ci.Key,
+		ActualKey:    actual.Key(),
+		ExpectedSize: int64(mem.ci.Size),
+		ActualSize:   actual.Size(),
+	}
+	if mem == zeroMemo {
+		err.Reason = "unsolicited chunk"
+	} else if err.ActualSize != err.ExpectedSize {
+		err.Reason = "size mismatch"
+	} else {
+		err.Reason = "key mismatch"
+	}
+	if b.strict != nil {
+		b.strict.Printf("Receiver: %v", err)
+	}
+	return err
+}
+
 // Function appendChunk appends data of `chunk` to `temp`.
-func appendChunk(temp io.Writer, chunk cafs.File) error {
-	if LoggingEnabled {
+func (b *Builder) appendChunk(temp io.Writer, chunk cafs.File) error {
+	if b.verbose {
 		log.Printf("Receiver: appendChunk(total:%v, %v)", chunk.Size(), chunk.Key())
 	}
 	r := chunk.Open()
@@ -0,0 +1,200 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"context"
+	"errors"
+	"github.com/indyjo/cafs"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// Error ErrNegativeOffset is returned by RemoteFile.ReadAt when called with a negative offset.
+var ErrNegativeOffset = errors.New("negative offset")
+
+// Type ChunkFetcher retrieves the data of a single chunk from a remote and writes it to `w`.
+// See httpsync.NewChunkFetcher for an implementation using HTTP.
+type ChunkFetcher func(ctx context.Context, ci ChunkInfo, w io.Writer) error
+
+// Struct RemoteFile gives random access to a remote file described by a SyncInfo, without
+// downloading it as a whole. It implements io.ReaderAt, fetching the chunks touched by a read
+// from the remote unless they are present in local storage. Fetched chunks are verified against
+// their keys and kept in storage as cache data, so they are fetched again only once evicted.
+// Concurrent reads touching the same missing chunk fetch it only once.
+type RemoteFile struct {
+	syncinf *SyncInfo
+	storage cafs.FileStorage
+	fetch   ChunkFetcher
+	info    string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	offsets []int64 // Offset of each chunk, followed by the file's size
+
+	mutex   sync.Mutex
+	pending map[cafs.SKey]*pendingFetch
+}
+
+// Struct pendingFetch tracks a chunk being fetched by one reader and awaited by others.
+type pendingFetch struct {
+	done chan struct{} // Closed when the fetch has completed
+	err  error         // Set before closing done
+}
+
+// Function NewRemoteFile returns a RemoteFile reading the file described by `syncinf`. Missing
+// chunks are fetched using `fetch` and stored in `storage`, named `info`. Must eventually be
+// disposed.
+func NewRemoteFile(syncinf *SyncInfo, storage cafs.FileStorage, fetch ChunkFetcher, info string) *RemoteFile {
+	ctx, cancel := context.WithCancel(context.Background())
+	offsets := make([]int64, 0, len(syncinf.Chunks)+1)
+	var offset int64
+	for _, ci := range syncinf.Chunks {
+		offsets = append(offsets, offset)
+		offset += int64(ci.Size)
+	}
+	offsets = append(offsets, offset)
+	return &RemoteFile{
+		syncinf: syncinf,
+		storage: storage,
+		fetch:   fetch,
+		info:    info,
+		ctx:     ctx,
+		cancel:  cancel,
+		offsets: offsets,
+		pending: make(map[cafs.SKey]*pendingFetch),
+	}
+}
+
+// Returns the size of the remote file.
+func (f *RemoteFile) Size() int64 {
+	return f.offsets[len(f.offsets)-1]
+}
+
+// Cancels all fetches in progress. Subsequent reads fail with ErrDisposed.
+// It's ok to call Dispose() more than once.
+func (f *RemoteFile) Dispose() {
+	f.cancel()
+}
+
+// Reads len(p) bytes starting at offset `off`, fetching chunks as needed. Returns io.EOF if
+// fewer bytes are available. Safe for concurrent use.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	// Find the first chunk ending after `off`
+	idx := sort.Search(len(f.syncinf.Chunks), func(i int) bool { return f.offsets[i+1] > off })
+	within := off
+	if idx < len(f.syncinf.Chunks) {
+		within -= f.offsets[idx]
+	}
+	for n < len(p) {
+		if idx >= len(f.syncinf.Chunks) {
+			return n, io.EOF
+		}
+		m, err := f.readChunkAt(idx, p[n:], within)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		idx, within = idx+1, 0
+	}
+	return n, nil
+}
+
+// Function readChunkAt reads from chunk number `idx`, starting at position `within`, until
+// either `p` is full or the chunk ends.
+func (f *RemoteFile) readChunkAt(idx int, p []byte, within int64) (int, error) {
+	ci := f.syncinf.Chunks[idx]
+	if l := int64(ci.Size) - within; l < int64(len(p)) {
+		p = p[:l]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	chunk, err := f.getChunk(ci)
+	if err != nil {
+		return 0, err
+	}
+	defer chunk.Dispose()
+	r := chunk.Open()
+	//noinspection GoUnhandledErrorResult
+	defer r.Close()
+	if _, err := io.CopyN(ioutil.Discard, r, within); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r, p)
+}
+
+// Function getChunk returns a chunk from storage, fetching it first if necessary.
+func (f *RemoteFile) getChunk(ci ChunkInfo) (cafs.File, error) {
+	for {
+		if f.ctx.Err() != nil {
+			return nil, ErrDisposed
+		}
+		if chunk, err := f.storage.Get(&ci.Key); err == nil {
+			return chunk, nil
+		}
+
+		f.mutex.Lock()
+		p := f.pending[ci.Key]
+		owner := p == nil
+		if owner {
+			p = &pendingFetch{done: make(chan struct{})}
+			f.pending[ci.Key] = p
+		}
+		f.mutex.Unlock()
+
+		if owner {
+			chunk, err := f.fetchChunk(ci)
+			f.mutex.Lock()
+			delete(f.pending, ci.Key)
+			f.mutex.Unlock()
+			p.err = err
+			close(p.done)
+			return chunk, err
+		}
+
+		// Another reader is fetching the chunk. Once done, look it up in storage again.
+		select {
+		case <-p.done:
+			if p.err != nil {
+				return nil, p.err
+			}
+		case <-f.ctx.Done():
+			return nil, ErrDisposed
+		}
+	}
+}
+
+// Function fetchChunk fetches a chunk from the remote and stores it, verifying its key.
+func (f *RemoteFile) fetchChunk(ci ChunkInfo) (cafs.File, error) {
+	temp := f.storage.CreateWithKey(f.info, ci.Key)
+	defer temp.Dispose()
+	if err := f.fetch(f.ctx, ci, temp); err != nil {
+		if f.ctx.Err() != nil {
+			return nil, ErrDisposed
+		}
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	return temp.File(), nil
+}
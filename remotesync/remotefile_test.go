@@ -0,0 +1,142 @@
+package remotesync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Function storageFetcher returns a ChunkFetcher reading chunks from `storage` and counting calls.
+func storageFetcher(storage cafs.FileStorage, calls *int32) ChunkFetcher {
+	return func(ctx context.Context, ci ChunkInfo, w io.Writer) error {
+		atomic.AddInt32(calls, 1)
+		f, err := storage.Get(&ci.Key)
+		if err != nil {
+			return err
+		}
+		defer f.Dispose()
+		r := f.Open()
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	}
+}
+
+func TestRemoteFile(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+
+	fileA := addRandomFile(t, storeA, 300000)
+	defer fileA.Dispose()
+	r := fileA.Open()
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	check(t, "reading file A", err)
+	syncinf := &SyncInfo{}
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	var calls int32
+	remote := NewRemoteFile(syncinf, storeB, storageFetcher(storeA, &calls), "remote A")
+	defer remote.Dispose()
+	if remote.Size() != int64(len(data)) {
+		t.Fatalf("Expected size %d, got %d", len(data), remote.Size())
+	}
+
+	// A small read touches at most two chunks
+	buf := make([]byte, 100)
+	n, err := remote.ReadAt(buf, 150000)
+	check(t, "reading", err)
+	if n != len(buf) || !bytes.Equal(buf, data[150000:150100]) {
+		t.Errorf("Read returned wrong data")
+	}
+	if calls < 1 || calls > 2 {
+		t.Errorf("Expected one or two chunks to be fetched, got %d", calls)
+	}
+
+	// Reading the same range again uses the cached chunks
+	before := calls
+	_, err = remote.ReadAt(buf, 150000)
+	check(t, "reading again", err)
+	if calls != before {
+		t.Errorf("Expected no chunks to be fetched again, got %d fetches", calls-before)
+	}
+
+	// Concurrent reads of random ranges
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for j := 0; j < 20; j++ {
+				off := rnd.Int63n(int64(len(data)))
+				buf := make([]byte, rnd.Intn(20000))
+				n, err := remote.ReadAt(buf, off)
+				end := off + int64(len(buf))
+				if end > int64(len(data)) {
+					end = int64(len(data))
+					if err != io.EOF {
+						t.Errorf("Expected io.EOF when reading past the end, got: %v", err)
+					}
+				} else if err != nil {
+					t.Errorf("Error reading: %v", err)
+				}
+				if !bytes.Equal(buf[:n], data[off:end]) {
+					t.Errorf("Read at %d returned wrong data", off)
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	if int(calls) > len(syncinf.Chunks) {
+		t.Errorf("Expected each of %d chunks to be fetched at most once, got %d fetches", len(syncinf.Chunks), calls)
+	}
+
+	if n, err := remote.ReadAt(buf, remote.Size()); n != 0 || err != io.EOF {
+		t.Errorf("Expected io.EOF at end of file, got %d bytes and %v", n, err)
+	}
+	if _, err := remote.ReadAt(buf, -1); err != ErrNegativeOffset {
+		t.Errorf("Expected ErrNegativeOffset, got: %v", err)
+	}
+	remote.Dispose()
+	if _, err := remote.ReadAt(buf, 0); err != ErrDisposed {
+		t.Errorf("Expected ErrDisposed after Dispose, got: %v", err)
+	}
+}
+
+func TestRemoteFileErrors(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	fileA := addRandomFile(t, storeA, 100000)
+	defer fileA.Dispose()
+	syncinf := &SyncInfo{}
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	errFetch := errors.New("fetch failed")
+	failing := NewRemoteFile(syncinf, storeB, func(ctx context.Context, ci ChunkInfo, w io.Writer) error {
+		return errFetch
+	}, "failing")
+	defer failing.Dispose()
+	if _, err := failing.ReadAt(make([]byte, 10), 0); err != errFetch {
+		t.Errorf("Expected fetcher's error, got: %v", err)
+	}
+
+	corrupting := NewRemoteFile(syncinf, storeB, func(ctx context.Context, ci ChunkInfo, w io.Writer) error {
+		_, err := w.Write(randomBytes(ci.Size))
+		return err
+	}, "corrupting")
+	defer corrupting.Dispose()
+	if _, err := corrupting.ReadAt(make([]byte, 10), 0); err != cafs.ErrHashMismatch {
+		t.Errorf("Expected ErrHashMismatch, got: %v", err)
+	}
+}
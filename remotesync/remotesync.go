@@ -18,7 +18,27 @@
 // that is used by CAFS internally.
 // Step 1: Sender and receiver agree on hashes of the file's chunks
 // Step 2: Receiver streams missing chunks (one bit per chunk)
-// Step 3: Sender responds by sending content of requested chunks
+// Step 3: Sender responds by sending content of requested chunks, each distinct chunk only once
 package remotesync
 
+import "context"
+
+// Enables detailed logging by default. Can be overridden per Builder using Builder.WithVerbose,
+// and per call to WriteChunkDataWithContext using WithVerbose.
 var LoggingEnabled = false
+
+type verboseKey struct{}
+
+// Function WithVerbose returns a context that enables or disables detailed logging in functions
+// it is passed to, overriding LoggingEnabled.
+func WithVerbose(ctx context.Context, verbose bool) context.Context {
+	return context.WithValue(ctx, verboseKey{}, verbose)
+}
+
+// Function isVerbose reports whether detailed logging is enabled for a context.
+func isVerbose(ctx context.Context) bool {
+	if verbose, ok := ctx.Value(verboseKey{}).(bool); ok {
+		return verbose
+	}
+	return LoggingEnabled
+}
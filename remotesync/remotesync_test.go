@@ -2,13 +2,26 @@ package remotesync
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking"
 	. "github.com/indyjo/cafs/ram"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
+	"io/ioutil"
+	"log"
 	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // This is a regression test that deadlocks as long as indyjo/bitwrk#152 isn't solved.
@@ -31,8 +44,8 @@ func TestRemoteSync(t *testing.T) {
 	// Test for different amounts of overlapping data
 	for _, p := range []float64{0, 0.01, 0.25, 0.5, 0.75, 0.99, 1} {
 		// Test for different number of blocks, so that storeB will _almost_ be filled up.
-		// We can't test up to 512 because we don't know how much overhead data was produced
-		// by the chunking algorithm (yes, RAM storage counts that overhead!)
+		// We can't test up to 512 because we don't know in advance how much overhead data will be
+		// produced by the chunking algorithm (RAM storage counts that overhead, see UsageInfo.Overhead)
 		for _, nBlocks := range []int{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 400} {
 			sigma := 0.25
 			if nBlocks > 256 {
@@ -78,40 +91,1765 @@ func testWithParams(t *testing.T, storeA, storeB cafs.BoundedStorage, p, sigma f
 	builder := NewBuilder(storeB, syncinf, 8, fmt.Sprintf("Recovered A(%.2f,%d)", p, nBlocks))
 	defer builder.Dispose()
 
+	fileB := transfer(t, builder, fileA)
+	defer fileB.Dispose()
+
+	assertEqual(t, fileA.Open(), fileB.Open())
+}
+
+// Transfers fileA using a builder connected to a sender via pipes. Returns the reconstructed file.
+func transfer(t testing.TB, builder *Builder, fileA cafs.File) cafs.File {
 	// task: transfer file A to storage B
 	// Pipe 1 is used to transfer the wishlist bit-stream from the receiver to the sender
 	pipeReader1, pipeWriter1 := io.Pipe()
 	// Pipe 2 is used to transfer the actual requested chunk data to the receiver
 	pipeReader2, pipeWriter2 := io.Pipe()
 
-	go func() {
-		if err := builder.WriteWishList(NopFlushWriter{pipeWriter1}); err != nil {
-			_ = pipeWriter1.CloseWithError(fmt.Errorf("Error generating wishlist: %v", err))
+	go func() {
+		if err := builder.WriteWishList(NopFlushWriter{pipeWriter1}); err != nil {
+			_ = pipeWriter1.CloseWithError(fmt.Errorf("Error generating wishlist: %v", err))
+		} else {
+			_ = pipeWriter1.Close()
+		}
+	}()
+
+	go func() {
+		chunks := ChunksOfFile(fileA)
+		defer chunks.Dispose()
+		err := builder.syncinf.WriteChunkData(WithChunkFramer(context.Background(), builder.framer), chunks, bufio.NewReader(pipeReader1), NopFlushWriter{pipeWriter2}, nil)
+		if err != nil {
+			_ = pipeWriter2.CloseWithError(fmt.Errorf("Error sending requested chunk data: %v", err))
+		} else {
+			_ = pipeWriter2.Close()
+		}
+	}()
+
+	f, err := builder.ReconstructFileFromRequestedChunks(pipeReader2)
+	if err != nil {
+		t.Fatalf("Error reconstructing: %v", err)
+	}
+	return f
+}
+
+func TestInfoFunc(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	_, err := tempA.Write(randomBytes(64 * 1024))
+	check(t, "writing data", err)
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	syncinf.SetChunksFromFile(fileA)
+
+	var indices []int
+	builder := NewBuilder(storeB, syncinf, 8, "unused").WithInfoFunc(func(chunkIdx int) string {
+		indices = append(indices, chunkIdx)
+		return fmt.Sprintf("transfer-42 %d", chunkIdx)
+	})
+	defer builder.Dispose()
+
+	fileB := transfer(t, builder, fileA)
+	defer fileB.Dispose()
+	assertEqual(t, fileA.Open(), fileB.Open())
+
+	if len(indices) == 0 || indices[0] != -1 {
+		t.Fatalf("Expected InfoFunc to be called for the reconstructed file first, got: %v", indices)
+	}
+	// All chunks are missing on B, so each must have been named (the last call stems from detecting end of stream)
+	if len(indices)-2 != len(syncinf.Chunks) {
+		t.Errorf("Expected InfoFunc to be called for each of %d chunks, got: %v", len(syncinf.Chunks), indices)
+	}
+	for _, idx := range indices[1:] {
+		if idx < 0 {
+			t.Errorf("Expected non-negative chunk indices, got: %v", indices)
+		}
+	}
+}
+
+// Tests the legacy-compatible path, where chunk hashes are exchanged using the legacy stream format
+// and the trivial permutation {0} is used.
+func TestTrivialPermutation(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+
+	for _, p := range []float64{0, 0.5, 1} {
+		for _, nBlocks := range []int{0, 1, 2, 3, 64} {
+			func() {
+				defer reportUsage(t, "B", storeB)
+				defer reportUsage(t, "A", storeA)
+
+				tempA := storeA.Create(fmt.Sprintf("Data A(%.2f,%d)", p, nBlocks))
+				defer tempA.Dispose()
+				tempB := storeB.Create(fmt.Sprintf("Data B(%.2f,%d)", p, nBlocks))
+				defer tempB.Dispose()
+				check(t, "creating similar data", createSimilarData(tempA, tempB, p, 0.25, 8192, nBlocks))
+				check(t, "closing tempA", tempA.Close())
+				check(t, "closing tempB", tempB.Close())
+				fileA := tempA.File()
+				defer fileA.Dispose()
+
+				// Pass chunk hashes through the legacy stream format
+				var buf bytes.Buffer
+				syncinfA := &SyncInfo{}
+				syncinfA.SetChunksFromFile(fileA)
+				check(t, "writing legacy stream", syncinfA.WriteToLegacyStream(&buf))
+				syncinf := &SyncInfo{}
+				syncinf.SetTrivialPermutation()
+				check(t, "reading legacy stream", syncinf.ReadFromLegacyStream(&buf))
+				if len(syncinf.Chunks) != len(syncinfA.Chunks) {
+					t.Fatalf("Expected %d chunks, got %d", len(syncinfA.Chunks), len(syncinf.Chunks))
+				}
+
+				builder := NewBuilder(storeB, syncinf, 8, fmt.Sprintf("Recovered A(%.2f,%d)", p, nBlocks))
+				defer builder.Dispose()
+
+				fileB := transfer(t, builder, fileA)
+				defer fileB.Dispose()
+
+				if fileB.Key() != fileA.Key() || fileB.Size() != fileA.Size() {
+					t.Fatalf("Expected reconstructed file %v (%d bytes), got %v (%d bytes)",
+						fileA.Key(), fileA.Size(), fileB.Key(), fileB.Size())
+				}
+				syncinfB := &SyncInfo{}
+				syncinfB.SetChunksFromFile(fileB)
+				if !reflect.DeepEqual(syncinfA.Chunks, syncinfB.Chunks) {
+					t.Fatalf("Chunks of reconstructed file differ")
+				}
+				assertEqual(t, fileA.Open(), fileB.Open())
+			}()
+		}
+	}
+}
+
+// Struct disposingWriter disposes a Builder on the first write, waiting for disposal to begin.
+type disposingWriter struct {
+	builder  *Builder
+	disposed chan struct{}
+	writes   int
+}
+
+func (w *disposingWriter) Write(p []byte) (int, error) {
+	if w.writes == 0 {
+		go func() {
+			w.builder.Dispose()
+			close(w.disposed)
+		}()
+		<-w.builder.done
+	}
+	w.writes++
+	return len(p), nil
+}
+
+func TestDisposeDuringWishList(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(10))
+	for i := 0; i < 100000; i++ {
+		syncinf.Chunks = append(syncinf.Chunks, ChunkInfo{Key: cafs.SKey{byte(i), byte(i >> 8), byte(i >> 16)}, Size: 1000})
+	}
+	// Make the window large enough so that the wishlist never blocks
+	builder := NewBuilder(store, syncinf, len(syncinf.Chunks)+len(syncinf.Perm), "Test file")
+	w := &disposingWriter{builder: builder, disposed: make(chan struct{})}
+
+	if err := builder.WriteWishList(NopFlushWriter{w}); err != ErrDisposed {
+		t.Errorf("Expected ErrDisposed, got: %v", err)
+	}
+	if w.writes != 1 {
+		t.Errorf("Expected WriteWishList to return right after disposal, but it wrote %d times", w.writes)
+	}
+	<-w.disposed
+}
+
+func TestPauseResume(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	fileA := addRandomFile(t, storeA, 64*1024)
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	syncinf.SetChunksFromFile(fileA)
+
+	builder := NewBuilder(storeB, syncinf, 8, "Recovered A")
+	defer builder.Dispose()
+
+	builder.Pause()
+	builder.Pause()
+	var resumed int32
+	time.AfterFunc(50*time.Millisecond, func() {
+		atomic.StoreInt32(&resumed, 1)
+		builder.Resume()
+	})
+
+	fileB := transfer(t, builder, fileA)
+	defer fileB.Dispose()
+	if atomic.LoadInt32(&resumed) == 0 {
+		t.Errorf("Transfer finished while paused")
+	}
+	assertEqual(t, fileA.Open(), fileB.Open())
+	builder.Resume()
+}
+
+// Tests that a wishlist can be written to a buffer before the chunk data is received, even if the
+// file has many more chunks than fit into the window.
+func TestStandaloneWishList(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	storeB := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	fileA := addRandomFile(t, storeA, 1024*1024)
+	defer fileA.Dispose()
+	syncinfo := &SyncInfo{}
+	syncinfo.SetPermutation(rand.Perm(32))
+	check(t, "computing chunks", syncinfo.SetChunksFromFile(fileA))
+	if len(syncinfo.Chunks) <= 8 {
+		t.Fatalf("Expected more chunks than fit into the window, got %d", len(syncinfo.Chunks))
+	}
+
+	builder := NewBuilder(storeB, syncinfo, 8, "Recovered A").WithAdaptiveWindow(64 * 1024).WithStandaloneWishList()
+	defer builder.Dispose()
+	var wishlist bytes.Buffer
+	errs := make(chan error, 1)
+	go func() {
+		errs <- builder.WriteWishList(NopFlushWriter{&wishlist})
+	}()
+	select {
+	case err := <-errs:
+		check(t, "writing wishlist", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WriteWishList blocked without a concurrent reconstruction")
+	}
+
+	var data bytes.Buffer
+	chunks := ChunksOfFile(fileA)
+	defer chunks.Dispose()
+	check(t, "writing chunk data", syncinfo.WriteChunkData(context.Background(), chunks, bufio.NewReader(&wishlist), NopFlushWriter{&data}, nil))
+	fileB, err := builder.ReconstructFileFromRequestedChunks(&data)
+	check(t, "reconstructing", err)
+	defer fileB.Dispose()
+	assertEqual(t, fileA.Open(), fileB.Open())
+}
+
+// Tests several sequential transfers using a single Builder, including a transfer abandoned after
+// writing the wishlist, and that Reset refuses to interrupt a transfer in progress.
+func TestBuilderReset(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	storeB := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+
+	var builder *Builder
+	var first cafs.File
+	for i, size := range []int{200000, 100, 0, 300000, 150000} {
+		fileA := addRandomFile(t, storeA, size)
+		if i == 0 {
+			first = fileA.Duplicate()
+			defer first.Dispose()
+		} else if i == 3 {
+			// Sync the first file again, whose chunks are present in storeB
+			fileA.Dispose()
+			fileA = first.Duplicate()
+		}
+		syncinf := &SyncInfo{}
+		syncinf.SetPermutation(rand.Perm(1 + i*7))
+		check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+		if builder == nil {
+			builder = NewBuilder(storeB, syncinf, 8, "Recovered").WithStandaloneWishList()
+			defer builder.Dispose()
+		} else {
+			check(t, "resetting", builder.Reset(syncinf, "Recovered"))
+		}
+
+		var wishlist, chunkData bytes.Buffer
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+		if i == 3 {
+			// Abandon the transfer, leaving the chunks present in storeB locked but unprocessed
+			fileA.Dispose()
+			continue
+		}
+		chunks := ChunksOfFile(fileA)
+		check(t, "writing chunk data", syncinf.WriteChunkData(context.Background(), chunks, &wishlist, NopFlushWriter{&chunkData}, nil))
+		chunks.Dispose()
+		fileB, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+		check(t, "reconstructing", err)
+		if fileB.Key() != fileA.Key() {
+			t.Errorf("Transfer %d: reconstructed file differs", i)
+		}
+		fileB.Dispose()
+		fileA.Dispose()
+	}
+
+	// Reset is refused while a transfer is in progress
+	fileA := addRandomFile(t, storeA, 100000)
+	defer fileA.Dispose()
+	syncinf := &SyncInfo{}
+	syncinf.SetTrivialPermutation()
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+	check(t, "resetting", builder.Reset(syncinf, "Recovered"))
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		_ = builder.WriteWishList(NopFlushWriter{ioutil.Discard})
+	}()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := builder.ReconstructFileFromRequestedChunks(pr)
+		errs <- err
+	}()
+	// The reconstruction blocks reading from the pipe
+	if _, err := pw.Write([]byte{}); err != nil {
+		t.Fatalf("Error writing to pipe: %v", err)
+	}
+	if err := builder.Reset(syncinf, "Recovered"); err != ErrBuilderBusy {
+		t.Fatalf("Expected ErrBuilderBusy, got: %v", err)
+	}
+	builder.Dispose()
+	_ = pw.CloseWithError(ErrDisposed)
+	<-errs
+	if err := builder.Reset(syncinf, "Recovered"); err != ErrDisposed {
+		t.Errorf("Expected ErrDisposed after Dispose, got: %v", err)
+	}
+}
+
+func TestDoubleDispose(t *testing.T) {
+	store := NewRamStorage(256 * 1024)
+	defer reportUsage(t, "", store)
+	fileA := addRandomFile(t, store, 64*1024)
+	defer fileA.Dispose()
+	syncinfo := &SyncInfo{}
+	syncinfo.SetPermutation(rand.Perm(10))
+	check(t, "computing chunks", syncinfo.SetChunksFromFile(fileA))
+
+	// Before and after WriteWishList
+	builder := NewBuilder(store, syncinfo, 8, "Test file")
+	builder.Dispose()
+	builder.Dispose()
+	builder = NewBuilder(store, syncinfo, len(syncinfo.Chunks)+len(syncinfo.Perm), "Test file")
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{ioutil.Discard}))
+	builder.Dispose()
+	builder.Dispose()
+
+	// Concurrently, while ReconstructFileFromRequestedChunks is waiting for the wishlist
+	builder = NewBuilder(store, syncinfo, 8, "Test file")
+	errs := make(chan error)
+	go func() {
+		_, err := builder.ReconstructFileFromRequestedChunks(bytes.NewReader(nil))
+		errs <- err
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			builder.Dispose()
+		}()
+	}
+	if err := <-errs; err != ErrDisposed {
+		t.Errorf("Expected ErrDisposed, got: %v", err)
+	}
+	wg.Wait()
+}
+
+func TestDisposeDuringReconstruct(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	fileA := addRandomFile(t, storeA, 256*1024)
+	defer fileA.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(5))
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	for i := 0; i < 50; i++ {
+		builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(syncinf.Perm), "Recovered A")
+		var wishlist, chunkData bytes.Buffer
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+		chunks := ChunksOfFile(fileA)
+		check(t, "writing chunk data", syncinf.WriteChunkData(context.Background(), chunks, &wishlist, NopFlushWriter{&chunkData}, nil))
+		chunks.Dispose()
+
+		// Dispose at some point during reconstruction. The result must either be correct or ErrDisposed.
+		disposed := make(chan struct{})
+		time.AfterFunc(time.Duration(rand.Intn(1000))*time.Microsecond, func() {
+			builder.Dispose()
+			close(disposed)
+		})
+		f, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+		if err == nil {
+			assertEqual(t, fileA.Open(), f.Open())
+			f.Dispose()
+		} else if err != ErrDisposed {
+			t.Errorf("Expected ErrDisposed, got: %v", err)
+		}
+		<-disposed
+		builder.Dispose()
+		storeB.FreeCache()
+	}
+}
+
+func TestDisposePaused(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	fileA := addRandomFile(t, storeA, 64*1024)
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	syncinf.SetChunksFromFile(fileA)
+
+	builder := NewBuilder(storeB, syncinf, 8, "Recovered A")
+	builder.Pause()
+
+	pipeReader1, pipeWriter1 := io.Pipe()
+	pipeReader2, pipeWriter2 := io.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = pipeWriter1.CloseWithError(builder.WriteWishList(NopFlushWriter{pipeWriter1}))
+	}()
+	go func() {
+		defer wg.Done()
+		chunks := ChunksOfFile(fileA)
+		defer chunks.Dispose()
+		_ = pipeWriter2.CloseWithError(WriteChunkData(chunks, fileA.Size(), bufio.NewReader(pipeReader1), perm, NopFlushWriter{pipeWriter2}, nil))
+	}()
+
+	disposed := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() {
+		builder.Dispose()
+		close(disposed)
+	})
+
+	f, err := builder.ReconstructFileFromRequestedChunks(pipeReader2)
+	if f != nil {
+		f.Dispose()
+	}
+	if err != ErrDisposed {
+		t.Errorf("Expected ErrDisposed, got: %v", err)
+	}
+
+	_ = pipeReader2.CloseWithError(err)
+	_ = pipeReader1.CloseWithError(err)
+	<-disposed
+	wg.Wait()
+}
+
+// Tests that the sender detects a receiver using a different permutation.
+func TestPermutationMismatch(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	storeB := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	fileA := addRandomFile(t, storeA, 256*1024)
+	defer fileA.Dispose()
+
+	cases := []struct {
+		sender, receiver shuffle.Permutation
+	}{
+		{shuffle.Permutation{0}, shuffle.Permutation{1, 0}},
+		{shuffle.Permutation{1, 0}, shuffle.Permutation{0}},
+		{shuffle.Permutation{3, 4, 2, 1, 0}, shuffle.Permutation{4, 6, 3, 1, 5, 2, 0}},
+		{shuffle.Permutation{4, 6, 3, 1, 5, 2, 0}, shuffle.Permutation{3, 4, 2, 1, 0}},
+		{shuffle.Permutation{0}, shuffle.Permutation{3, 4, 2, 1, 0, 5, 6, 7, 8, 9}},
+	}
+	for _, c := range cases {
+		syncinf := &SyncInfo{}
+		syncinf.SetPermutation(c.receiver)
+		check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+
+		// Generate the receiver's wishlist. Make the window large enough not to block.
+		var wishlist bytes.Buffer
+		builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(c.receiver), "Recovered A")
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+		builder.Dispose()
+
+		chunks := ChunksOfFile(fileA)
+		err := WriteChunkData(chunks, fileA.Size(), &wishlist, c.sender, NopFlushWriter{ioutil.Discard}, nil)
+		chunks.Dispose()
+		// Permutations of different lengths yield wishlists of different lengths. Depending on
+		// whether a placeholder is requested first, the mismatch is reported either way.
+		if err != ErrPermutationMismatch && err != ErrMalformedWishlist {
+			t.Errorf("Sender %v, receiver %v: expected ErrPermutationMismatch or ErrMalformedWishlist, got: %v",
+				c.sender, c.receiver, err)
+		}
+	}
+}
+
+// Tests that the sender rejects wishlists not containing exactly one bit per chunk.
+func TestMalformedWishlist(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	storeB := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	fileA := addRandomFile(t, storeA, 256*1024)
+	defer fileA.Dispose()
+
+	for _, perm := range []shuffle.Permutation{{0}, {3, 4, 2, 1, 0}} {
+		syncinf := &SyncInfo{}
+		syncinf.SetPermutation(perm)
+		check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+
+		var buf bytes.Buffer
+		builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A")
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&buf}))
+		builder.Dispose()
+		wishlist := buf.Bytes()
+
+		// Number of bits in the wishlist: one per chunk plus the placeholders flushed from the shuffler
+		numBits := len(syncinf.Chunks) + len(perm) - 1
+		if len(wishlist) != (numBits+7)/8 {
+			t.Fatalf("Perm %v: expected %d wishlist bytes, got %d", perm, (numBits+7)/8, len(wishlist))
+		}
+
+		cases := map[string][]byte{
+			"empty":     {},
+			"truncated": wishlist[:len(wishlist)-1],
+			"extended":  append(append([]byte{}, wishlist...), 0),
+			"long":      append(append([]byte{}, wishlist...), wishlist...),
+		}
+		if numBits%8 != 0 {
+			// Set the first padding bit, as if the wishlist contained an additional bit
+			padded := append([]byte{}, wishlist...)
+			padded[len(padded)-1] |= 0x80 >> uint(numBits%8)
+			cases["padding"] = padded
+		}
+
+		for name, data := range cases {
+			chunks := ChunksOfFile(fileA)
+			err := syncinf.WriteChunkData(context.Background(), chunks, bytes.NewReader(data), NopFlushWriter{ioutil.Discard}, nil)
+			chunks.Dispose()
+			if err != ErrMalformedWishlist {
+				t.Errorf("Perm %v, case %v: expected ErrMalformedWishlist, got: %v", perm, name, err)
+			}
+		}
+
+		// The unmodified wishlist is accepted
+		chunks := ChunksOfFile(fileA)
+		err := syncinf.WriteChunkData(context.Background(), chunks, bytes.NewReader(wishlist), NopFlushWriter{ioutil.Discard}, nil)
+		chunks.Dispose()
+		check(t, "sending chunk data", err)
+	}
+}
+
+// Tests that a file consisting of many repetitions of the same chunk is transferred by sending
+// each distinct chunk only once.
+func TestRepeatedChunks(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	// With this seed, the chunker finds exactly one chunk boundary per cycle, so that every
+	// cycle except for the first and last one yields the same chunk.
+	cycle := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(cycle)
+	tempA := storeA.Create("Repeated data")
+	defer tempA.Dispose()
+	for i := 0; i < 1001; i++ {
+		_, err := tempA.Write(cycle)
+		check(t, "writing data", err)
+	}
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(10))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+
+	distinct := make(map[cafs.SKey]int)
+	var distinctBytes int64
+	for _, ci := range syncinf.Chunks {
+		if distinct[ci.Key] == 0 {
+			distinctBytes += int64(ci.Size)
+		}
+		distinct[ci.Key]++
+	}
+	maxCount := 0
+	for _, count := range distinct {
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+	if maxCount < 1000 {
+		t.Fatalf("Expected a chunk to occur at least 1000 times, got %d (%d chunks, %d distinct)",
+			maxCount, len(syncinf.Chunks), len(distinct))
+	}
+
+	// Run the transfer sequentially. Make the window large enough for the wishlist not to block.
+	builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A")
+	defer builder.Dispose()
+	var wishlist, chunkData bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+
+	var bytesTransferred int64
+	chunks := ChunksOfFile(fileA)
+	err := WriteChunkData(chunks, fileA.Size(), &wishlist, perm, NopFlushWriter{&chunkData}, func(_, transferred int64) {
+		bytesTransferred = transferred
+	})
+	chunks.Dispose()
+	check(t, "writing chunk data", err)
+	if bytesTransferred != distinctBytes {
+		t.Errorf("Expected %d bytes of chunk data to be sent, got %d", distinctBytes, bytesTransferred)
+	}
+	t.Logf("Sent %d bytes (%d including framing) for a file of %d bytes in %d chunks",
+		bytesTransferred, chunkData.Len(), fileA.Size(), len(syncinf.Chunks))
+
+	fileB, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+	check(t, "reconstructing", err)
+	defer fileB.Dispose()
+	assertEqual(t, fileA.Open(), fileB.Open())
+}
+
+func TestRepeatedRequests(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	// As in TestRepeatedChunks, the same chunk occurs about 1000 times
+	cycle := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(cycle)
+	tempA := storeA.Create("Repeated data")
+	defer tempA.Dispose()
+	for i := 0; i < 1001; i++ {
+		_, err := tempA.Write(cycle)
+		check(t, "writing data", err)
+	}
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetTrivialPermutation()
+	check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+	distinct := make(map[cafs.SKey]bool)
+	var distinctBytes int64
+	for _, ci := range syncinf.Chunks {
+		if !distinct[ci.Key] {
+			distinctBytes += int64(ci.Size)
+		}
+		distinct[ci.Key] = true
+	}
+
+	// Request every chunk, including all repetitions
+	wishlist := bytes.Repeat([]byte{0xff}, len(syncinf.Chunks)/8)
+	if n := len(syncinf.Chunks) % 8; n > 0 {
+		wishlist = append(wishlist, byte(0xff<<uint(8-n)))
+	}
+	var chunkData bytes.Buffer
+	var bytesTransferred int64
+	chunks := ChunksOfFile(fileA)
+	err := syncinf.WriteChunkData(context.Background(), chunks, bytes.NewReader(wishlist), NopFlushWriter{&chunkData},
+		func(_, transferred int64) {
+			bytesTransferred = transferred
+		})
+	chunks.Dispose()
+	check(t, "writing chunk data", err)
+	if bytesTransferred != distinctBytes {
+		t.Errorf("Expected %d bytes of chunk data to be sent, got %d", distinctBytes, bytesTransferred)
+	}
+
+	// Feed the receiver the same requests, bypassing WriteWishList, which requests every chunk once
+	builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks), "Recovered A")
+	defer builder.Dispose()
+	check(t, "starting builder", builder.start())
+	for _, ci := range syncinf.Chunks {
+		builder.memos <- memo{ci: ci, requested: true}
+	}
+	close(builder.memos)
+	fileB, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+	check(t, "reconstructing", err)
+	defer fileB.Dispose()
+	assertEqual(t, fileA.Open(), fileB.Open())
+}
+
+// Struct substitutingChunks wraps a Chunks and replaces the chunk at position `idx` by `substitute`.
+type substitutingChunks struct {
+	Chunks
+	idx        int
+	substitute cafs.File
+}
+
+func (c *substitutingChunks) NextChunk() (cafs.File, error) {
+	chunk, err := c.Chunks.NextChunk()
+	if err == nil && c.idx == 0 {
+		chunk.Dispose()
+		chunk = c.substitute.Duplicate()
+	}
+	c.idx--
+	return chunk, err
+}
+
+type recordingPrinter struct {
+	lines []string
+}
+
+func (p *recordingPrinter) Printf(format string, v ...interface{}) {
+	p.lines = append(p.lines, fmt.Sprintf(format, v...))
+}
+
+func TestStrictModeUnexpectedChunk(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	_, err := tempA.Write(randomBytes(128 * 1024))
+	check(t, "writing data", err)
+	check(t, "closing tempA", tempA.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	tempX := storeA.Create("Wrong chunk")
+	defer tempX.Dispose()
+	_, err = tempX.Write(randomBytes(1024))
+	check(t, "writing wrong chunk", err)
+	check(t, "closing tempX", tempX.Close())
+	fileX := tempX.File()
+	defer fileX.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	syncinf.SetChunksFromFile(fileA)
+	if len(syncinf.Chunks) < 4 {
+		t.Fatalf("Expected file to consist of at least 4 chunks, got %d", len(syncinf.Chunks))
+	}
+
+	printer := &recordingPrinter{}
+	builder := NewBuilder(storeB, syncinf, 8, "Recovered A").WithStrictMode(printer)
+
+	pipeReader1, pipeWriter1 := io.Pipe()
+	pipeReader2, pipeWriter2 := io.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = pipeWriter1.CloseWithError(builder.WriteWishList(NopFlushWriter{pipeWriter1}))
+	}()
+	go func() {
+		defer wg.Done()
+		chunks := &substitutingChunks{ChunksOfFile(fileA), len(syncinf.Chunks) / 2, fileX}
+		defer chunks.Dispose()
+		_ = pipeWriter2.CloseWithError(WriteChunkData(chunks, fileA.Size(), bufio.NewReader(pipeReader1), perm, NopFlushWriter{pipeWriter2}, nil))
+	}()
+
+	f, err := builder.ReconstructFileFromRequestedChunks(pipeReader2)
+	if f != nil {
+		f.Dispose()
+	}
+	if !errors.Is(err, ErrUnexpectedChunk) || !errors.Is(err, ErrProtocolViolation) {
+		t.Errorf("Expected ErrUnexpectedChunk, got: %v", err)
+	}
+	var uce *UnexpectedChunkError
+	if !errors.As(err, &uce) {
+		t.Fatalf("Expected UnexpectedChunkError, got: %v", err)
+	}
+	if uce.ActualKey != fileX.Key() || uce.ActualSize != fileX.Size() {
+		t.Errorf("Expected actual chunk %v (%d bytes), got %v (%d bytes)", fileX.Key(), fileX.Size(), uce.ActualKey, uce.ActualSize)
+	}
+	if !reflect.DeepEqual(syncinf.Chunks[len(syncinf.Chunks)/2], ChunkInfo{uce.ExpectedKey, int(uce.ExpectedSize)}) {
+		t.Errorf("Expected the substituted chunk, got %v (%d bytes)", uce.ExpectedKey, uce.ExpectedSize)
+	}
+	if uce.Reason != "key mismatch" && uce.Reason != "size mismatch" {
+		t.Errorf("Unexpected reason: %v", uce.Reason)
+	}
+
+	// Tear down the connection first, so that no goroutine remains blocked on a pipe
+	_ = pipeReader2.CloseWithError(err)
+	_ = pipeReader1.CloseWithError(err)
+	builder.Dispose()
+	wg.Wait()
+
+	if len(printer.lines) != 1 {
+		t.Fatalf("Expected exactly one line of output, got: %v", printer.lines)
+	}
+	if !strings.Contains(printer.lines[0], fileX.Key().String()) {
+		t.Errorf("Expected output to contain key of wrong chunk, got: %v", printer.lines[0])
+	}
+}
+
+// Function receiveFrom reconstructs a file from chunk data `data`, using a fresh Builder.
+func receiveFrom(t *testing.T, store cafs.FileStorage, syncinf *SyncInfo, data []byte) error {
+	builder := NewBuilder(store, syncinf, len(syncinf.Chunks)+len(syncinf.Perm), "Recovered A")
+	defer builder.Dispose()
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{ioutil.Discard}))
+	f, err := builder.ReconstructFileFromRequestedChunks(bytes.NewReader(data))
+	if f != nil {
+		f.Dispose()
+	}
+	return err
+}
+
+func TestTruncatedChunkData(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+	fileA := addRandomFile(t, storeA, 64*1024)
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	// Generate the complete chunk data stream sequentially.
+	builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A")
+	var wishlist, chunkData bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+	builder.Dispose()
+	chunks := ChunksOfFile(fileA)
+	check(t, "writing chunk data", WriteChunkData(chunks, fileA.Size(), &wishlist, perm, NopFlushWriter{&chunkData}, nil))
+	chunks.Dispose()
+	data := chunkData.Bytes()
+
+	// Find the end of the first chunk
+	length, n := binary.Varint(data)
+	firstChunkEnd := n + int(length)
+
+	for _, cut := range []int{0, 1, n, n + 1, firstChunkEnd, firstChunkEnd + 1, len(data) / 2, len(data) - 1} {
+		if err := receiveFrom(t, storeB, syncinf, data[:cut]); err != ErrTransferInterrupted {
+			t.Errorf("Truncated at %d of %d bytes: expected ErrTransferInterrupted, got: %v", cut, len(data), err)
+		}
+		storeB.FreeCache()
+	}
+
+	// The complete stream is accepted
+	check(t, "receiving complete data", receiveFrom(t, storeB, syncinf, data))
+	storeB.FreeCache()
+}
+
+// Struct stallingReader returns its data, then blocks until released.
+type stallingReader struct {
+	data     []byte
+	released chan struct{}
+}
+
+func (s *stallingReader) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		<-s.released
+		return 0, io.EOF
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+// Struct slowReader waits before returning each small portion of its data.
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(s.delay)
+	if len(p) > 4096 {
+		p = p[:4096]
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+// Function fuzzSyncInfo returns a SyncInfo describing a small file made of short chunks, one of
+// which occurs twice, along with the file's content and a valid chunk data stream transferring it
+// into empty storage.
+func fuzzSyncInfo() (*SyncInfo, []byte, []byte) {
+	chunks := [][]byte{[]byte("alpha"), []byte("beta"), []byte("alpha"), bytes.Repeat([]byte("gamma"), 30)}
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(shuffle.Permutation{2, 0, 1})
+	var content, stream bytes.Buffer
+	for _, chunk := range chunks {
+		_ = syncinf.addChunk(cafs.KeyOf(chunk), int64(len(chunk)))
+		content.Write(chunk)
+	}
+	// Generate the stream as the sender would
+	var wishlist bytes.Buffer
+	builder := NewBuilder(NewRamStorage(1<<20), syncinf, 16, "fuzz")
+	_ = builder.WriteWishList(NopFlushWriter{&wishlist})
+	builder.Dispose()
+	_ = syncinf.WriteChunkData(context.Background(), &sliceChunks{chunks}, &wishlist, NopFlushWriter{&stream}, nil)
+	return syncinf, content.Bytes(), stream.Bytes()
+}
+
+// Struct sliceChunks implements Chunks, returning byte slices as chunks.
+type sliceChunks struct {
+	chunks [][]byte
+}
+
+func (c *sliceChunks) NextChunk() (cafs.File, error) {
+	if len(c.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := cafs.FileFromBytes(c.chunks[0])
+	c.chunks = c.chunks[1:]
+	return chunk, nil
+}
+
+func (c *sliceChunks) Dispose() {}
+
+func TestOversizedPermutation(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	for _, size := range []int{0, 100, 20000} {
+		fileA := addRandomFile(t, storeA, size)
+		for _, clamp := range []bool{false, true} {
+			storeB := NewRamStorage(1024 * 1024)
+			syncinf := &SyncInfo{}
+			syncinf.SetPermutation(rand.Perm(256))
+			check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+			if clamp {
+				syncinf.ClampPermutation()
+				if len(syncinf.Perm) != len(syncinf.Chunks) || !syncinf.Perm.IsValid() {
+					t.Errorf("Size %d: expected valid permutation of length %d, got %v", size, len(syncinf.Chunks), syncinf.Perm)
+				}
+			}
+			builder := NewBuilder(storeB, syncinf, 8, "Recovered A")
+			fileB := transfer(t, builder, fileA)
+			builder.Dispose()
+			if fileB.Key() != fileA.Key() {
+				t.Errorf("Size %d, clamped: %v: transferred file differs", size, clamp)
+			}
+			fileB.Dispose()
+			reportUsage(t, "B", storeB)
+		}
+		fileA.Dispose()
+	}
+}
+
+func TestSeed(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storePartial := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "partial", storePartial)
+	defer reportUsage(t, "B", storeB)
+
+	data := randomBytes(200000)
+	fileA, err := cafs.Ingest(storeA, bytes.NewReader(data), "complete")
+	check(t, "ingesting complete file", err)
+	defer fileA.Dispose()
+	partial, err := cafs.Ingest(storePartial, bytes.NewReader(data[:180000]), "partial")
+	check(t, "ingesting partial file", err)
+	defer partial.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(5))
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+	prefixChunks, prefixSize := syncinf.MatchingPrefix(partial)
+	if prefixChunks == 0 || prefixChunks == len(syncinf.Chunks) || prefixSize > 180000 {
+		t.Fatalf("Unexpected matching prefix of %d of %d chunks, %d bytes", prefixChunks, len(syncinf.Chunks), prefixSize)
+	}
+
+	var bytesTransferred int64
+	builder := NewBuilder(storeB, syncinf, 8, "Recovered A").WithChunkCallback(func(ci ChunkInfo, transferred bool) {
+		if transferred {
+			bytesTransferred += int64(ci.Size)
+		}
+	})
+	defer builder.Dispose()
+	n, err := builder.Seed(partial)
+	check(t, "seeding", err)
+	if n != prefixChunks {
+		t.Errorf("Seeded %d chunks, expected %d", n, prefixChunks)
+	}
+
+	fileB := transfer(t, builder, fileA)
+	defer fileB.Dispose()
+	if fileB.Key() != fileA.Key() {
+		t.Errorf("Transferred file differs")
+	}
+	if expected := fileA.Size() - prefixSize; bytesTransferred != expected {
+		t.Errorf("Transferred %d bytes, expected only the %d bytes following the prefix", bytesTransferred, expected)
+	}
+}
+
+func TestSkippedChunksReportedInBulk(t *testing.T) {
+	chunks := [][]byte{[]byte("a"), []byte("bb"), []byte("ccc"), []byte("dddd"), []byte("eeeee")}
+	// Request only the third chunk
+	wishlist := []byte{0x20}
+
+	type status struct{ toTransfer, transferred int64 }
+	var calls []status
+	var chunkData bytes.Buffer
+	err := WriteChunkData(&sliceChunks{chunks}, 15, bytes.NewReader(wishlist), shuffle.Permutation{0}, NopFlushWriter{&chunkData}, func(toTransfer, transferred int64) {
+		calls = append(calls, status{toTransfer, transferred})
+	})
+	check(t, "writing chunk data", err)
+
+	expected := []status{{15, 0}, {12, 3}, {3, 3}}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected callbacks %v, got %v", expected, calls)
+	}
+	if data := chunkData.Bytes(); len(data) != 4 || !bytes.HasSuffix(data, []byte("ccc")) {
+		t.Errorf("Unexpected chunk data: %q", data)
+	}
+}
+
+func FuzzReconstruct(f *testing.F) {
+	syncinf, content, valid := fuzzSyncInfo()
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add(append(append([]byte{}, valid...), valid...))
+	f.Add([]byte{})
+	f.Add([]byte{0x01})
+	f.Add([]byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte{0x0a, 'a', 'l', 'p', 'h', 'a'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		store := NewRamStorage(64 * 1024)
+		builder := NewBuilder(store, syncinf, len(syncinf.Chunks)+len(syncinf.Perm), "fuzz")
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{ioutil.Discard}))
+
+		type result struct {
+			file cafs.File
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			file, err := builder.ReconstructFileFromRequestedChunks(bytes.NewReader(data))
+			done <- result{file, err}
+		}()
+		var res result
+		select {
+		case res = <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("ReconstructFileFromRequestedChunks hangs")
+		}
+		builder.Dispose()
+
+		if res.err == nil {
+			r := res.file.Open()
+			received, err := ioutil.ReadAll(r)
+			r.Close()
+			check(t, "reading reconstructed file", err)
+			if !bytes.Equal(received, content) {
+				t.Errorf("Reconstructed file differs")
+			}
+			res.file.Dispose()
+		} else if res.file != nil {
+			t.Errorf("Got file along with error %v", res.err)
+		} else if bytes.Equal(data, valid) {
+			t.Errorf("Valid stream rejected: %v", res.err)
+		}
+		reportUsage(t, "store", store)
+	})
+}
+
+func TestChunkTimeout(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+	fileA := addRandomFile(t, storeA, 256*1024)
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	// Generate the complete chunk data stream sequentially.
+	builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A")
+	var wishlist, chunkData bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+	builder.Dispose()
+	chunks := ChunksOfFile(fileA)
+	check(t, "writing chunk data", WriteChunkData(chunks, fileA.Size(), &wishlist, perm, NopFlushWriter{&chunkData}, nil))
+	chunks.Dispose()
+	data := chunkData.Bytes()
+
+	receive := func(r io.Reader) error {
+		builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A").WithChunkTimeout(100 * time.Millisecond)
+		defer builder.Dispose()
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{ioutil.Discard}))
+		f, err := builder.ReconstructFileFromRequestedChunks(r)
+		if f != nil {
+			f.Dispose()
+		}
+		return err
+	}
+
+	// A stream stalling within the data of a chunk times out
+	stalling := &stallingReader{data: data[:len(data)/2], released: make(chan struct{})}
+	defer close(stalling.released)
+	start := time.Now()
+	if err := receive(stalling); err != ErrChunkTimeout {
+		t.Errorf("Expected ErrChunkTimeout, got: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Timeout took too long: %v", d)
+	}
+	storeB.FreeCache()
+
+	// A stream that is slow as a whole, but delivers each chunk in time, is accepted
+	slow := &slowReader{data: data, delay: 2 * time.Millisecond}
+	start = time.Now()
+	check(t, "receiving slow stream", receive(slow))
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Expected the transfer to take longer than the chunk timeout, took %v", d)
+	}
+	storeB.FreeCache()
+}
+
+func TestProtocolViolation(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+	fileA := addRandomFile(t, storeA, 64*1024)
+	defer fileA.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(5))
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	varint := func(v int64) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return buf[:binary.PutVarint(buf, v)]
+	}
+	cases := map[string][]byte{
+		"negative length":  varint(-1),
+		"excessive length": varint(chunking.MaxChunkSize + 1),
+		"wrong chunk":      append(varint(4), 1, 2, 3, 4),
+	}
+	for name, data := range cases {
+		err := receiveFrom(t, storeB, syncinf, data)
+		if !errors.Is(err, ErrProtocolViolation) {
+			t.Errorf("Case %v: expected ErrProtocolViolation, got: %v", name, err)
+		}
+		if errors.Is(err, ErrUnexpectedChunk) != (name == "wrong chunk") {
+			t.Errorf("Case %v: unexpected match of ErrUnexpectedChunk: %v", name, err)
+		}
+		storeB.FreeCache()
+	}
+
+	var uce *UnexpectedChunkError
+	if err := receiveFrom(t, storeB, syncinf, cases["wrong chunk"]); !errors.As(err, &uce) {
+		t.Fatalf("Expected UnexpectedChunkError, got: %v", err)
+	}
+	if uce.Reason != "size mismatch" || uce.ActualSize != 4 || uce.ExpectedSize == 4 {
+		t.Errorf("Expected size mismatch with a 4-byte chunk, got: %v", uce)
+	}
+}
+
+func TestScratchStorage(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	scratch := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "scratch", scratch)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 32))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	// A failed transfer leaves no traces in the main storage
+	usedBefore := storeB.GetUsageInfo().Used
+	builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A").WithScratchStorage(scratch)
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{ioutil.Discard}))
+	if _, err := builder.ReconstructFileFromRequestedChunks(bytes.NewReader(nil)); err != ErrTransferInterrupted {
+		t.Errorf("Expected ErrTransferInterrupted, got: %v", err)
+	}
+	builder.Dispose()
+	if used := storeB.GetUsageInfo().Used; used != usedBefore {
+		t.Errorf("Expected main storage to use %d bytes after failed transfer, got %d", usedBefore, used)
+	}
+
+	// A successful transfer ends up in the main storage
+	builder = NewBuilder(storeB, syncinf, 8, "Recovered A").WithScratchStorage(scratch)
+	defer builder.Dispose()
+	fileC := transfer(t, builder, fileA)
+	defer fileC.Dispose()
+	assertEqual(t, fileA.Open(), fileC.Open())
+	if f, err := storeB.Get(&syncinf.Chunks[0].Key); err != nil {
+		t.Errorf("Expected chunks of reconstructed file in main storage, got: %v", err)
+	} else {
+		f.Dispose()
+	}
+	scratch.FreeCache()
+	if used := scratch.GetUsageInfo().Used; used != 0 {
+		t.Errorf("Expected scratch storage to be empty, got %d bytes used", used)
+	}
+}
+
+func TestEstimateTransfer(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 32))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	estimatedBytes, estimatedChunks := EstimateTransfer(syncinf, storeB)
+
+	builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A")
+	defer builder.Dispose()
+	var wishlist bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+
+	requested := 0
+	for _, b := range wishlist.Bytes() {
+		for ; b != 0; b &= b - 1 {
+			requested++
+		}
+	}
+	if estimatedChunks != requested {
+		t.Errorf("Estimated %d chunks, but %d were requested", estimatedChunks, requested)
+	}
+
+	var transferred int64
+	chunks := ChunksOfFile(fileA)
+	defer chunks.Dispose()
+	check(t, "writing chunk data", WriteChunkData(chunks, 0, &wishlist, perm, NopFlushWriter{ioutil.Discard}, func(_, n int64) {
+		transferred = n
+	}))
+	if estimatedBytes != transferred {
+		t.Errorf("Estimated %d bytes, but %d were transferred", estimatedBytes, transferred)
+	}
+	if estimatedBytes == 0 || estimatedBytes >= fileA.Size() {
+		t.Errorf("Expected a partial transfer, got %d of %d bytes", estimatedBytes, fileA.Size())
+	}
+}
+
+// Tests that the download callback is called exactly once, right before the first chunk is
+// received, and not at all if all chunks are present.
+func TestDownloadCallback(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 32))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(5))
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	for _, store := range []cafs.BoundedStorage{storeB, storeA} {
+		var processed []bool // Whether each chunk processed so far was transferred
+		calls, callsAt := 0, -1
+		builder := NewBuilder(store, syncinf, len(syncinf.Chunks)+len(syncinf.Perm), "Recovered A").
+			WithChunkCallback(func(ci ChunkInfo, transferred bool) {
+				processed = append(processed, transferred)
+			}).
+			WithDownloadCallback(func() {
+				calls++
+				callsAt = len(processed)
+			})
+		var wishlist, chunkData bytes.Buffer
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+		chunks := ChunksOfFile(fileA)
+		check(t, "writing chunk data", syncinf.WriteChunkData(context.Background(), chunks, &wishlist, NopFlushWriter{&chunkData}, nil))
+		chunks.Dispose()
+		fileC, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+		check(t, "reconstructing", err)
+		fileC.Dispose()
+		builder.Dispose()
+
+		firstTransferred := -1
+		for i, transferred := range processed {
+			if transferred {
+				firstTransferred = i
+				break
+			}
+		}
+		if firstTransferred < 0 && calls != 0 {
+			t.Errorf("Expected no call without chunks transferred, got %d", calls)
+		} else if firstTransferred >= 0 && (calls != 1 || callsAt != firstTransferred) {
+			t.Errorf("Expected a single call before chunk %d, got %d calls, the last before chunk %d",
+				firstTransferred, calls, callsAt)
+		}
+		if store == storeB && firstTransferred < 0 {
+			t.Errorf("Expected chunks to be transferred")
+		}
+	}
+}
+
+func TestChunkCallback(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 32))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	var received []ChunkInfo
+	var bytesReceived, bytesSkipped int64
+	builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A").WithChunkCallback(func(ci ChunkInfo, transferred bool) {
+		received = append(received, ci)
+		if transferred {
+			bytesReceived += int64(ci.Size)
 		} else {
-			_ = pipeWriter1.Close()
+			bytesSkipped += int64(ci.Size)
 		}
-	}()
+	})
+	defer builder.Dispose()
+	var wishlist, chunkData bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
 
-	go func() {
+	var bytesToTransfer, bytesTransferred int64
+	chunks := ChunksOfFile(fileA)
+	defer chunks.Dispose()
+	check(t, "writing chunk data", syncinf.WriteChunkData(context.Background(), chunks, &wishlist, NopFlushWriter{&chunkData}, func(toTransfer, transferred int64) {
+		bytesToTransfer, bytesTransferred = toTransfer, transferred
+	}))
+
+	fileC, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+	check(t, "reconstructing", err)
+	defer fileC.Dispose()
+
+	if len(received) != syncinf.ChunkCount() {
+		t.Errorf("Expected callback for each of %d chunks, got %d calls", syncinf.ChunkCount(), len(received))
+	}
+	if bytesReceived != bytesTransferred || bytesReceived != bytesToTransfer {
+		t.Errorf("Receiver reported %d bytes transferred, sender reported %d of %d", bytesReceived, bytesTransferred, bytesToTransfer)
+	}
+	if bytesReceived+bytesSkipped != fileA.Size() {
+		t.Errorf("Expected %d bytes in total, got %d received and %d skipped", fileA.Size(), bytesReceived, bytesSkipped)
+	}
+	if bytesReceived == 0 || bytesSkipped == 0 {
+		t.Errorf("Expected a partial transfer, got %d bytes received and %d skipped", bytesReceived, bytesSkipped)
+	}
+}
+
+// Type corruptingStorage simulates storage corruption by flipping a bit in the content of a chunk.
+type corruptingStorage struct {
+	cafs.FileStorage
+	corrupt cafs.SKey
+}
+
+func (s corruptingStorage) Get(key *cafs.SKey) (cafs.File, error) {
+	f, err := s.FileStorage.Get(key)
+	if err == nil && *key == s.corrupt {
+		f = corruptFile{f}
+	}
+	return f, err
+}
+
+type corruptFile struct {
+	cafs.File
+}
+
+func (f corruptFile) Open() io.ReadCloser {
+	r := f.File.Open()
+	defer r.Close()
+	data, _ := ioutil.ReadAll(r)
+	data[0] ^= 1
+	return ioutil.NopCloser(bytes.NewReader(data))
+}
+
+func (f corruptFile) Duplicate() cafs.File {
+	return corruptFile{f.File.Duplicate()}
+}
+
+func TestVerifyPresentChunks(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+
+	fileA := addRandomFile(t, storeA, 200000)
+	defer fileA.Dispose()
+	syncinf := &SyncInfo{}
+	syncinf.SetTrivialPermutation()
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+	if len(syncinf.Chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(syncinf.Chunks))
+	}
+
+	// Storage B contains all of file A's chunks, one of which is corrupted
+	r := fileA.Open()
+	defer r.Close()
+	copied, err := cafs.Ingest(storeB, r, "copy of A")
+	check(t, "copying file A", err)
+	defer copied.Dispose()
+	corrupt := syncinf.Chunks[1]
+	storage := corruptingStorage{storeB, corrupt.Key}
+
+	for _, verify := range []bool{false, true} {
+		var transferred []ChunkInfo
+		builder := NewBuilder(storage, syncinf, len(syncinf.Chunks)+1, "Recovered A").
+			WithVerifyPresentChunks(verify).
+			WithChunkCallback(func(ci ChunkInfo, sent bool) {
+				if sent {
+					transferred = append(transferred, ci)
+				}
+			})
+		fileB := transfer(t, builder, fileA)
+		builder.Dispose()
+		if verify {
+			if len(transferred) != 1 || transferred[0] != corrupt {
+				t.Errorf("Expected only the corrupt chunk to be transferred, got %v", transferred)
+			}
+			assertEqual(t, fileA.Open(), fileB.Open())
+		} else {
+			if len(transferred) != 0 {
+				t.Errorf("Expected no chunks to be transferred without verification, got %v", transferred)
+			}
+			if fileB.Key() == fileA.Key() {
+				t.Errorf("Expected corruption to go unnoticed without verification")
+			}
+		}
+		fileB.Dispose()
+	}
+}
+
+func TestRequestQuota(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+
+	fileA := addRandomFile(t, storeA, 200000)
+	defer fileA.Dispose()
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	// Function receive transfers file A sequentially, also returning the number of bytes transferred.
+	receive := func(quota int64) (cafs.File, int64, error) {
+		var received int64
+		builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A").
+			WithRequestQuota(quota).
+			WithChunkCallback(func(ci ChunkInfo, transferred bool) {
+				if transferred {
+					received += int64(ci.Size)
+				}
+			})
+		defer builder.Dispose()
+		var wishlist, chunkData bytes.Buffer
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
 		chunks := ChunksOfFile(fileA)
 		defer chunks.Dispose()
-		if err := WriteChunkData(chunks, fileA.Size(), bufio.NewReader(pipeReader1), perm, NopFlushWriter{pipeWriter2}, nil); err != nil {
-			_ = pipeWriter2.CloseWithError(fmt.Errorf("Error sending requested chunk data: %v", err))
-		} else {
-			_ = pipeWriter2.Close()
+		check(t, "writing chunk data", syncinf.WriteChunkData(context.Background(), chunks, &wishlist, NopFlushWriter{&chunkData}, nil))
+		file, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+		return file, received, err
+	}
+
+	quota := fileA.Size() / 2
+	file, first, err := receive(quota)
+	if err != ErrQuotaExceeded {
+		t.Fatalf("Expected ErrQuotaExceeded, got: %v", err)
+	}
+	if file != nil {
+		t.Errorf("Expected no file")
+	}
+	if first == 0 || first > quota {
+		t.Errorf("Expected between 1 and %d bytes to be transferred, got %d", quota, first)
+	}
+
+	// Chunks received before are reused
+	file, second, err := receive(fileA.Size())
+	check(t, "receiving remainder", err)
+	defer file.Dispose()
+	if first+second != fileA.Size() {
+		t.Errorf("Expected %d bytes to be transferred in total, got %d + %d", fileA.Size(), first, second)
+	}
+	assertEqual(t, fileA.Open(), file.Open())
+}
+
+func TestMissingChunks(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 32))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	transferred := make(map[cafs.SKey]bool)
+	builder := NewBuilder(storeB, syncinf, len(syncinf.Chunks)+len(perm), "Recovered A").WithChunkCallback(func(ci ChunkInfo, t bool) {
+		if t {
+			transferred[ci.Key] = true
 		}
+	})
+	defer builder.Dispose()
+	missing, err := builder.MissingChunks()
+	check(t, "listing missing chunks", err)
+
+	// The Builder can still be used for the transfer, which requests exactly the missing chunks
+	fileC := transfer(t, builder, fileA)
+	defer fileC.Dispose()
+	var expected []cafs.SKey
+	for _, ci := range syncinf.Chunks {
+		if transferred[ci.Key] {
+			expected = append(expected, ci.Key)
+			delete(transferred, ci.Key)
+		}
+	}
+	if len(expected) == 0 || len(expected) == len(syncinf.Chunks) {
+		t.Errorf("Expected a partial transfer, got %d of %d chunks", len(expected), len(syncinf.Chunks))
+	}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("Expected missing chunks %v in file order, got %v", expected, missing)
+	}
+
+	// Nothing is missing after the transfer
+	builder2 := NewBuilder(storeB, syncinf, 8, "Recovered A")
+	if missing, err := builder2.MissingChunks(); err != nil || len(missing) != 0 {
+		t.Errorf("Expected no missing chunks, got %v, %v", missing, err)
+	}
+	builder2.Dispose()
+	if _, err := builder2.MissingChunks(); err != ErrDisposed {
+		t.Errorf("Expected ErrDisposed, got %v", err)
+	}
+}
+
+func TestEstimateTransferRepeatedChunks(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "", store)
+	file := addRandomFile(t, store, 1000)
+	defer file.Dispose()
+
+	present := ChunkInfo{Key: file.Key(), Size: int(file.Size())}
+	missing1 := ChunkInfo{Key: cafs.SKey{1}, Size: 100}
+	missing2 := ChunkInfo{Key: cafs.SKey{2}, Size: 200}
+	syncinf := &SyncInfo{Chunks: []ChunkInfo{missing1, present, missing2, missing1, present, missing1}}
+	if bytes, chunks := EstimateTransfer(syncinf, store); bytes != 300 || chunks != 2 {
+		t.Errorf("Expected 300 bytes in 2 chunks, got %d bytes in %d chunks", bytes, chunks)
+	}
+}
+
+func TestChunkCoordinator(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+	fileA := addRandomFile(t, storeA, 128*1024)
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(5))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+	windowSize := len(syncinf.Chunks) + len(perm)
+
+	coord := NewChunkCoordinator()
+	builder1 := NewBuilder(storeB, syncinf, windowSize, "Recovered A #1").WithChunkCoordinator(coord)
+	defer builder1.Dispose()
+	builder2 := NewBuilder(storeB, syncinf, windowSize, "Recovered A #2").WithChunkCoordinator(coord)
+	defer builder2.Dispose()
+
+	// The younger builder doesn't request any of the chunks the older builder has requested
+	var wishlist1, wishlist2 bytes.Buffer
+	check(t, "writing wishlist 1", builder1.WriteWishList(NopFlushWriter{&wishlist1}))
+	check(t, "writing wishlist 2", builder2.WriteWishList(NopFlushWriter{&wishlist2}))
+	var transferred2 int64
+	var chunkData2 bytes.Buffer
+	chunks := ChunksOfFile(fileA)
+	check(t, "writing chunk data 2", WriteChunkData(chunks, 0, &wishlist2, perm, NopFlushWriter{&chunkData2}, func(_, n int64) {
+		transferred2 = n
+	}))
+	chunks.Dispose()
+	if transferred2 != 0 {
+		t.Errorf("Expected no chunk data to be sent to builder 2, got %d bytes", transferred2)
+	}
+
+	// The younger builder waits for the older one
+	type result struct {
+		file cafs.File
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		f, err := builder2.ReconstructFileFromRequestedChunks(&chunkData2)
+		results <- result{f, err}
 	}()
 
-	var fileB cafs.File
-	if f, err := builder.ReconstructFileFromRequestedChunks(pipeReader2); err != nil {
-		t.Fatalf("Error reconstructing: %v", err)
-	} else {
-		fileB = f
-		defer f.Dispose()
+	var chunkData1 bytes.Buffer
+	chunks = ChunksOfFile(fileA)
+	check(t, "writing chunk data 1", WriteChunkData(chunks, 0, &wishlist1, perm, NopFlushWriter{&chunkData1}, nil))
+	chunks.Dispose()
+	file1, err := builder1.ReconstructFileFromRequestedChunks(&chunkData1)
+	check(t, "reconstructing 1", err)
+	defer file1.Dispose()
+	assertEqual(t, fileA.Open(), file1.Open())
+
+	r := <-results
+	check(t, "reconstructing 2", r.err)
+	defer r.file.Dispose()
+	assertEqual(t, fileA.Open(), r.file.Open())
+}
+
+func TestChunkCoordinatorOwnerFails(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+	fileA := addRandomFile(t, storeA, 128*1024)
+	defer fileA.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(5))
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+	windowSize := len(syncinf.Chunks) + len(syncinf.Perm)
+
+	coord := NewChunkCoordinator()
+	builder1 := NewBuilder(storeB, syncinf, windowSize, "Recovered A #1").WithChunkCoordinator(coord)
+	builder2 := NewBuilder(storeB, syncinf, windowSize, "Recovered A #2").WithChunkCoordinator(coord)
+	defer builder2.Dispose()
+	check(t, "writing wishlist 1", builder1.WriteWishList(NopFlushWriter{ioutil.Discard}))
+	check(t, "writing wishlist 2", builder2.WriteWishList(NopFlushWriter{ioutil.Discard}))
+
+	// The older builder's transfer is interrupted
+	if _, err := builder1.ReconstructFileFromRequestedChunks(bytes.NewReader(nil)); err != ErrTransferInterrupted {
+		t.Errorf("Expected ErrTransferInterrupted for builder 1, got: %v", err)
 	}
+	builder1.Dispose()
 
-	_ = fileB
-	assertEqual(t, fileA.Open(), fileB.Open())
+	// ... which interrupts the younger builder's transfer, too
+	if _, err := builder2.ReconstructFileFromRequestedChunks(bytes.NewReader(nil)); err != ErrTransferInterrupted {
+		t.Errorf("Expected ErrTransferInterrupted for builder 2, got: %v", err)
+	}
+}
+
+func TestSyncInfoWriteChunkData(t *testing.T) {
+	storeA := NewRamStorage(1024 * 1024)
+	storeB := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+	fileA := addRandomFile(t, storeA, 64*1024)
+	defer fileA.Dispose()
+	fileX := addRandomFile(t, storeA, 64*1024)
+	defer fileX.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(5))
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+	shortened := &SyncInfo{Chunks: syncinf.Chunks[:len(syncinf.Chunks)-1], Perm: syncinf.Perm}
+
+	for _, c := range []struct {
+		name    string
+		syncinf *SyncInfo
+		file    cafs.File
+		err     error
+	}{
+		{"matching", syncinf, fileA, nil},
+		{"other file", syncinf, fileX, ErrChunksMismatch},
+		{"extra chunk", shortened, fileA, ErrChunksMismatch},
+	} {
+		builder := NewBuilder(storeB, c.syncinf, len(c.syncinf.Chunks)+len(c.syncinf.Perm), "Recovered A")
+		var wishlist bytes.Buffer
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+		builder.Dispose()
+
+		chunks := ChunksOfFile(c.file)
+		err := c.syncinf.WriteChunkData(context.Background(), chunks, &wishlist, NopFlushWriter{ioutil.Discard}, nil)
+		chunks.Dispose()
+		if err != c.err {
+			t.Errorf("Case %v: expected %v, got %v", c.name, c.err, err)
+		}
+		storeB.FreeCache()
+	}
+}
+
+func addRandomFile(t *testing.T, store cafs.FileStorage, size int) cafs.File {
+	temp := store.Create(fmt.Sprintf("%v random bytes", size))
+	defer temp.Dispose()
+	_, err := temp.Write(randomBytes(size))
+	check(t, "writing data", err)
+	check(t, "closing temporary", temp.Close())
+	return temp.File()
 }
 
 func assertEqual(t *testing.T, a, b io.ReadCloser) {
@@ -194,3 +1932,385 @@ func reportUsage(t *testing.T, name string, store cafs.BoundedStorage) {
 		t.FailNow()
 	}
 }
+
+func benchmarkReadBufferSize(b *testing.B, bufSize int) {
+	storeA := NewRamStorage(64 * 1024 * 1024)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	_, err := tempA.Write(randomBytes(16 * 1024 * 1024))
+	if err != nil {
+		b.Fatalf("Error writing data: %v", err)
+	}
+	if err := tempA.Close(); err != nil {
+		b.Fatalf("Error closing tempA: %v", err)
+	}
+	fileA := tempA.File()
+	defer fileA.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(10))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	syncinf.SetChunksFromFile(fileA)
+
+	b.SetBytes(fileA.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Use a fresh receiving store each time so that all chunks are requested
+		storeB := NewRamStorage(64 * 1024 * 1024)
+		builder := NewBuilder(storeB, syncinf, 8, "Recovered A").WithReadBufferSize(bufSize)
+		transfer(b, builder, fileA).Dispose()
+		builder.Dispose()
+	}
+}
+
+func BenchmarkReadBufferSize4K(b *testing.B) {
+	benchmarkReadBufferSize(b, 4*1024)
+}
+
+func BenchmarkReadBufferSize64K(b *testing.B) {
+	benchmarkReadBufferSize(b, 64*1024)
+}
+
+func BenchmarkReadBufferSize1M(b *testing.B) {
+	benchmarkReadBufferSize(b, 1024*1024)
+}
+
+// Function benchmarkPermutation measures the throughput of transfers permuted by `perm`, with
+// about 15 of 16 chunks already present at the receiver.
+func benchmarkPermutation(b *testing.B, perm shuffle.Permutation) {
+	storeA := NewRamStorage(64 * 1024 * 1024)
+	storeB := NewRamStorage(64 * 1024 * 1024)
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	if err := createSimilarData(tempA, tempB, 15.0/16, 0, 8192, 2048); err != nil {
+		b.Fatalf("Error creating data: %v", err)
+	}
+	if err := tempA.Close(); err != nil {
+		b.Fatalf("Error closing tempA: %v", err)
+	}
+	if err := tempB.Close(); err != nil {
+		b.Fatalf("Error closing tempB: %v", err)
+	}
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	syncinf.SetChunksFromFile(fileA)
+
+	b.SetBytes(fileA.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		builder := NewBuilder(storeB, syncinf, 32, "Recovered A")
+		transfer(b, builder, fileA).Dispose()
+		builder.Dispose()
+		b.StopTimer()
+		storeB.FreeCache()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkTrivialPermutation(b *testing.B) {
+	benchmarkPermutation(b, shuffle.Permutation{0})
+}
+
+func BenchmarkPermutation64(b *testing.B) {
+	benchmarkPermutation(b, shuffle.Permutation(rand.Perm(64)))
+}
+
+// Struct countingChunks counts the chunks retrieved from SkippableChunks.
+type countingChunks struct {
+	SkippableChunks
+	retrieved int
+}
+
+func (c *countingChunks) NextChunk() (cafs.File, error) {
+	c.retrieved++
+	return c.SkippableChunks.NextChunk()
+}
+
+func (c *countingChunks) Current() (cafs.File, error) {
+	c.retrieved++
+	return c.SkippableChunks.Current()
+}
+
+func TestPermutedSkipWithoutRetrieval(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "B", storeB)
+	defer reportUsage(t, "A", storeA)
+	data := randomBytes(1024 * 1024)
+	fileA, err := cafs.Ingest(storeA, bytes.NewReader(data), "A")
+	check(t, "ingesting A", err)
+	defer fileA.Dispose()
+	// The receiver has the first half of the file already
+	fileB, err := cafs.Ingest(storeB, bytes.NewReader(data[:len(data)/2]), "B")
+	check(t, "ingesting B", err)
+	defer fileB.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(16))
+	check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+	builder := NewBuilder(storeB, syncinf, 8, "Recovered A").WithStandaloneWishList()
+	defer builder.Dispose()
+	var wishlist, chunkData bytes.Buffer
+	check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+	requested := 0
+	for _, b := range wishlist.Bytes() {
+		for ; b != 0; b &= b - 1 {
+			requested++
+		}
+	}
+
+	// With the whole wishlist available, only the requested chunks are retrieved, plus the first
+	// one, which is put into the shuffler before the wishlist is read at all.
+	chunks := &countingChunks{SkippableChunks: ChunksOfFile(fileA).(SkippableChunks)}
+	err = syncinf.WriteChunkData(context.Background(), chunks, bufio.NewReader(&wishlist), NopFlushWriter{&chunkData}, nil)
+	chunks.Dispose()
+	check(t, "writing chunk data", err)
+	if chunks.retrieved > requested+1 {
+		t.Errorf("Expected at most %d of %d chunks to be retrieved, got %d", requested+1, len(syncinf.Chunks), chunks.retrieved)
+	}
+
+	fileC, err := builder.ReconstructFileFromRequestedChunks(&chunkData)
+	check(t, "reconstructing", err)
+	defer fileC.Dispose()
+	assertEqual(t, fileA.Open(), fileC.Open())
+}
+
+// Function benchmarkAllPresent measures the sender's overhead when the receiver already has all
+// chunks of a file, i.e. when the wishlist consists of zeros only.
+func benchmarkAllPresent(b *testing.B, perm shuffle.Permutation) {
+	store := NewRamStorage(64 * 1024 * 1024)
+	file := addRandomFileB(b, store, 16*1024*1024)
+	defer file.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	if err := syncinf.SetChunksFromFile(file); err != nil {
+		b.Fatalf("Error computing chunks: %v", err)
+	}
+	builder := NewBuilder(store, syncinf, len(syncinf.Chunks)+len(perm), "Receiver")
+	defer builder.Dispose()
+	var wishlist bytes.Buffer
+	if err := builder.WriteWishList(NopFlushWriter{&wishlist}); err != nil {
+		b.Fatalf("Error writing wishlist: %v", err)
+	}
+
+	var bytesToTransfer int64
+	cb := func(toTransfer, transferred int64) {
+		bytesToTransfer = toTransfer
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chunks := ChunksOfFile(file)
+		err := syncinf.WriteChunkData(context.Background(), chunks, bufio.NewReader(bytes.NewReader(wishlist.Bytes())), NopFlushWriter{ioutil.Discard}, cb)
+		chunks.Dispose()
+		if err != nil {
+			b.Fatalf("Error sending chunk data: %v", err)
+		}
+		if bytesToTransfer != 0 {
+			b.Fatalf("Expected nothing to transfer, got %d bytes", bytesToTransfer)
+		}
+	}
+	b.ReportMetric(float64(len(syncinf.Chunks)), "chunks/op")
+}
+
+func BenchmarkAllPresentTrivialPermutation(b *testing.B) {
+	benchmarkAllPresent(b, shuffle.Permutation{0})
+}
+
+func BenchmarkAllPresentPermutation64(b *testing.B) {
+	benchmarkAllPresent(b, shuffle.Permutation(rand.Perm(64)))
+}
+
+// Function benchmarkRemoteSync measures the throughput of the two phases of a transfer of a file
+// of about `size` bytes, of which a fraction of about `overlap` is already present at the receiver.
+// Throughput is reported relative to the size of the file being synchronized.
+func benchmarkRemoteSync(b *testing.B, size int, overlap float64) {
+	storeA := NewRamStorage(int64(4 * size))
+	storeB := NewRamStorage(int64(4 * size))
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	if err := createSimilarData(tempA, tempB, overlap, 0.25, 8192, size/8192); err != nil {
+		b.Fatalf("Error creating data: %v", err)
+	}
+	if err := tempA.Close(); err != nil {
+		b.Fatalf("Error closing tempA: %v", err)
+	}
+	if err := tempB.Close(); err != nil {
+		b.Fatalf("Error closing tempB: %v", err)
+	}
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	// Keep file B so that its chunks stay available at the receiver
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	perm := shuffle.Permutation(rand.Perm(100))
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(perm)
+	if err := syncinf.SetChunksFromFile(fileA); err != nil {
+		b.Fatalf("Error computing chunks: %v", err)
+	}
+	// Make the window large enough for the wishlist not to block when generated sequentially.
+	windowSize := len(syncinf.Chunks) + len(perm)
+
+	b.Run("wishlist", func(b *testing.B) {
+		b.SetBytes(fileA.Size())
+		for i := 0; i < b.N; i++ {
+			builder := NewBuilder(storeB, syncinf, windowSize, "Recovered A")
+			if err := builder.WriteWishList(NopFlushWriter{ioutil.Discard}); err != nil {
+				b.Fatalf("Error writing wishlist: %v", err)
+			}
+			b.StopTimer()
+			builder.Dispose()
+			b.StartTimer()
+		}
+	})
+
+	b.Run("chunkdata", func(b *testing.B) {
+		b.SetBytes(fileA.Size())
+		b.StopTimer()
+		for i := 0; i < b.N; i++ {
+			builder := NewBuilder(storeB, syncinf, windowSize, "Recovered A")
+			var wishlist bytes.Buffer
+			if err := builder.WriteWishList(NopFlushWriter{&wishlist}); err != nil {
+				b.Fatalf("Error writing wishlist: %v", err)
+			}
+
+			b.StartTimer()
+			pipeReader, pipeWriter := io.Pipe()
+			go func() {
+				chunks := ChunksOfFile(fileA)
+				defer chunks.Dispose()
+				_ = pipeWriter.CloseWithError(WriteChunkData(chunks, fileA.Size(), &wishlist, perm, NopFlushWriter{pipeWriter}, nil))
+			}()
+			file, err := builder.ReconstructFileFromRequestedChunks(pipeReader)
+			b.StopTimer()
+
+			if err != nil {
+				b.Fatalf("Error reconstructing: %v", err)
+			}
+			file.Dispose()
+			builder.Dispose()
+			// Evict the received chunks so that they are requested again in the next iteration
+			storeB.FreeCache()
+		}
+	})
+}
+
+func BenchmarkRemoteSync1MOverlap0(b *testing.B) {
+	benchmarkRemoteSync(b, 1024*1024, 0)
+}
+
+func BenchmarkRemoteSync1MOverlap50(b *testing.B) {
+	benchmarkRemoteSync(b, 1024*1024, 0.5)
+}
+
+func BenchmarkRemoteSync1MOverlap90(b *testing.B) {
+	benchmarkRemoteSync(b, 1024*1024, 0.9)
+}
+
+func BenchmarkRemoteSync16MOverlap0(b *testing.B) {
+	benchmarkRemoteSync(b, 16*1024*1024, 0)
+}
+
+func BenchmarkRemoteSync16MOverlap50(b *testing.B) {
+	benchmarkRemoteSync(b, 16*1024*1024, 0.5)
+}
+
+func BenchmarkRemoteSync16MOverlap90(b *testing.B) {
+	benchmarkRemoteSync(b, 16*1024*1024, 0.9)
+}
+
+func TestWriteChunkDataCanceled(t *testing.T) {
+	store := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", store)
+	fileA := addRandomFile(t, store, 64*1024)
+	defer fileA.Dispose()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	chunks := ChunksOfFile(fileA)
+	defer chunks.Dispose()
+	err := WriteChunkDataWithContext(ctx, chunks, fileA.Size(), bytes.NewReader(nil), shuffle.Permutation{0}, NopFlushWriter{ioutil.Discard}, nil)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+}
+
+// Struct slowFlushWriter simulates a receiver reading slowly.
+type slowFlushWriter struct {
+	delay time.Duration
+}
+
+func (s slowFlushWriter) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return len(p), nil
+}
+
+func (s slowFlushWriter) Flush() {}
+
+func TestWriteChunkDataTimeout(t *testing.T) {
+	store := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "A", store)
+	fileA := addRandomFile(t, store, 1024*1024)
+	defer fileA.Dispose()
+
+	// Request all chunks
+	wishlist := bytes.Repeat([]byte{0xff}, int(fileA.NumChunks()/8+1))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	chunks := ChunksOfFile(fileA)
+	defer chunks.Dispose()
+	start := time.Now()
+	err := WriteChunkDataWithContext(ctx, chunks, fileA.Size(), bytes.NewReader(wishlist), shuffle.Permutation{0},
+		slowFlushWriter{10 * time.Millisecond}, nil)
+	if err != ErrTransferTimeout {
+		t.Errorf("Expected ErrTransferTimeout, got: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Transfer took %v despite timeout", d)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	store := NewRamStorage(1024 * 1024)
+	defer reportUsage(t, "A", store)
+	fileA := addRandomFile(t, store, 64*1024)
+	defer fileA.Dispose()
+	syncinf := &SyncInfo{}
+	syncinf.SetTrivialPermutation()
+	check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+
+	for _, verbose := range []bool{false, true} {
+		buf.Reset()
+		storeB := NewRamStorage(1024 * 1024)
+		builder := NewBuilder(storeB, syncinf, 8, "Recovered A").WithVerbose(verbose)
+		transfer(t, builder, fileA).Dispose()
+		builder.Dispose()
+		if logged := strings.Contains(buf.String(), "Receiver: Begin"); logged != verbose {
+			t.Errorf("Verbose builder: %v, but receiver logged: %v", verbose, logged)
+		}
+
+		buf.Reset()
+		chunks := ChunksOfFile(fileA)
+		_ = WriteChunkDataWithContext(WithVerbose(context.Background(), verbose), chunks, 0, bytes.NewReader(nil),
+			syncinf.Perm, NopFlushWriter{ioutil.Discard}, nil)
+		chunks.Dispose()
+		if logged := strings.Contains(buf.String(), "Sender: Begin"); logged != verbose {
+			t.Errorf("Verbose context: %v, but sender logged: %v", verbose, logged)
+		}
+	}
+}
@@ -17,18 +17,41 @@
 package remotesync
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/remotesync/shuffle"
 	"io"
 	"log"
+	"time"
 )
 
 // By passing a callback function to some of the transmissions functions,
 // the caller may subscribe to the current transmission status.
 type TransferStatusCallback func(bytesToTransfer, bytesTransferred int64)
 
+// Error ErrPermutationMismatch is returned by the sender when the wishlist doesn't match the
+// permutation used for sending chunks, i.e. when sender and receiver disagree on the permutation.
+// It is detected when the wishlist requests a placeholder inserted by the permutation. Permutations
+// of different lengths also imply wishlists of different lengths, which the sender can't tell from
+// a wishlist with too few or too many bits. If no placeholder is requested before the length
+// becomes apparent, the mismatch is therefore reported as ErrMalformedWishlist instead.
+var ErrPermutationMismatch = errors.New("wishlist doesn't match permutation")
+
+// Error ErrMalformedWishlist is returned by the sender when the wishlist contains fewer or more
+// bits than there are chunks (including the placeholders inserted by the permutation), or when
+// the padding of its last byte isn't zero.
+var ErrMalformedWishlist = errors.New("malformed wishlist")
+
+// Error ErrChunksMismatch is returned by SyncInfo.WriteChunkData when the chunks to send don't
+// match the SyncInfo.
+var ErrChunksMismatch = errors.New("chunks don't match SyncInfo")
+
+// Error ErrTransferTimeout is returned by the sender when the deadline of the context passed to
+// WriteChunkDataWithContext or SyncInfo.WriteChunkData expires before all chunks have been sent.
+var ErrTransferTimeout = errors.New("transfer timed out")
+
 // Interface Chunks allows iterating over any sequence of chunks.
 type Chunks interface {
 	// Function NextChunk returns either of three cases:
@@ -42,6 +65,21 @@ type Chunks interface {
 	Dispose()
 }
 
+// Interface SkippableChunks is optionally implemented by Chunks that can advance to the next chunk
+// without retrieving it as a File. When no permutation is used, the sender takes advantage of this
+// to skip chunks not requested by the receiver more cheaply.
+type SkippableChunks interface {
+	Chunks
+
+	// Function Advance advances to the next chunk and returns its key and size, or io.EOF at the
+	// end of stream.
+	Advance() (key cafs.SKey, size int64, err error)
+
+	// Function Current returns the chunk last advanced to using Advance, or an error if it can't
+	// be retrieved. It is the caller's duty to call Dispose() on the file returned.
+	Current() (cafs.File, error)
+}
+
 // Function ChunksOfFiles returns the chunks of a File as an implementation of the Chunks
 // interface. It's the caller's responsibility to call Dispose() on the returned object.
 func ChunksOfFile(file cafs.File) Chunks {
@@ -65,71 +103,284 @@ func (c chunksOfFile) Dispose() {
 	c.iter.Dispose()
 }
 
+func (c chunksOfFile) Advance() (cafs.SKey, int64, error) {
+	if c.iter.Next() {
+		return c.iter.Key(), c.iter.Size(), nil
+	}
+	return cafs.SKey{}, 0, io.EOF
+}
+
+func (c chunksOfFile) Current() (cafs.File, error) {
+	return c.iter.File(), nil
+}
+
+// Function skippable returns `chunks` as SkippableChunks, wrapping it if necessary. The result must
+// be disposed, but doesn't dispose `chunks`.
+func skippable(chunks Chunks) SkippableChunks {
+	if sc, ok := chunks.(SkippableChunks); ok {
+		return nopDisposeChunks{sc}
+	}
+	return &fetchingChunks{chunks: chunks}
+}
+
+// Struct fetchingChunks implements SkippableChunks for Chunks that don't, by retrieving every chunk.
+// Dispose() only disposes the chunk held, not the wrapped Chunks.
+type fetchingChunks struct {
+	chunks  Chunks
+	current cafs.File
+}
+
+func (c *fetchingChunks) NextChunk() (cafs.File, error) {
+	c.release()
+	return c.chunks.NextChunk()
+}
+
+func (c *fetchingChunks) Advance() (cafs.SKey, int64, error) {
+	c.release()
+	chunk, err := c.chunks.NextChunk()
+	if err != nil {
+		return cafs.SKey{}, 0, err
+	}
+	c.current = chunk
+	return chunk.Key(), chunk.Size(), nil
+}
+
+func (c *fetchingChunks) Current() (cafs.File, error) {
+	chunk := c.current
+	c.current = nil
+	return chunk, nil
+}
+
+func (c *fetchingChunks) Dispose() {
+	c.release()
+}
+
+func (c *fetchingChunks) release() {
+	if c.current != nil {
+		c.current.Dispose()
+		c.current = nil
+	}
+}
+
+// Struct nopDisposeChunks wraps SkippableChunks, ignoring calls to Dispose().
+type nopDisposeChunks struct {
+	SkippableChunks
+}
+
+func (nopDisposeChunks) Dispose() {}
+
 // Iterates over a wishlist (read from `r` and pertaining to a permuted order of hashes),
-// and calls `f` for each chunk of `file`, requested or not.
-// If `f` returns an error, aborts the iteration and also returns the error.
-func forEachChunk(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, f func(chunk cafs.File, requested bool) error) error {
-	bits := newBitReader(r)
+// and calls `send` for each chunk of `file` requested, and `skip` with the size of each chunk not
+// requested.
+// If `send` returns an error, aborts the iteration and also returns the error.
+// Aborts with the context's error once `ctx` is done.
+func forEachChunk(ctx context.Context, chunks Chunks, r io.ByteReader, perm shuffle.Permutation, send func(chunk cafs.File) error, skip func(size int64)) error {
+	bits := NewBitReader(r)
+	if perm.IsTrivial() {
+		// Fast path: Without a permutation, chunks are consumed in natural order, so a chunk's
+		// wishlist bit can be read before retrieving it, and chunks not requested needn't be
+		// retrieved at all.
+		if err := forEachChunkInOrder(ctx, skippable(chunks), bits, send, skip); err != nil {
+			return err
+		}
+		return checkWishlistEnd(bits, r)
+	}
+
+	// With a permutation, a chunk's wishlist bit follows up to len(perm)-1 bits later. Waiting for
+	// it would deadlock, as the receiver doesn't write it before having received the chunks
+	// requested earlier. But if the bit has been received already, e.g. because the receiver has
+	// most chunks and writes its wishlist ahead, a chunk not requested needn't be retrieved.
+	wishlist := &wishlistLookahead{bits: bits}
+	if b, ok := r.(interface{ Buffered() int }); ok {
+		wishlist.src = b
+	}
 
 	// Prepare shuffler for iterating the file's chunks in shuffled order, matching them with
-	// whishlist bits and calling `f` for each chunk, requested or not.
-	shuffler := shuffle.NewStreamShuffler(perm, nil, func(v interface{}) error {
-		var requested bool
-		if b, err := bits.ReadBit(); err != nil {
-			return fmt.Errorf("error reading from wishlist bitstream: %v", err)
-		} else {
-			requested = b
+	// whishlist bits and calling `send` or `skip` for each chunk.
+	consume := func(v interface{}) error {
+		requested, err := wishlist.read()
+		if err != nil {
+			// The chunk has already left the shuffler, so we're responsible for disposing it
+			if chunk, ok := v.(cafs.File); ok {
+				chunk.Dispose()
+			}
+			return err
 		}
 
-		if v == nil {
+		switch v := v.(type) {
+		case nil:
 			// This is a placeholder key generated by the shuffler. Require that the receiver
 			// signalled not to request the corresponding chunk.
 			if requested {
-				return errors.New("receiver requested the empty chunk")
+				// The receiver seems to have placed its placeholders differently
+				return ErrPermutationMismatch
 			}
 			// otherwise, there's nothing to do
 			return nil
+		case skippedChunk:
+			// The chunk wasn't retrieved, as its bit was known not to request it
+			skip(int64(v))
+			return nil
 		}
 
 		// We have a chunk with a corresponding wishlist bit. Dispatch to delegate function.
 		chunk := v.(cafs.File)
-		err := f(chunk, requested)
+		if requested {
+			err = send(chunk)
+		} else {
+			skip(chunk.Size())
+		}
 		chunk.Dispose()
 		return err
-	})
+	}
+	shuffler := shuffle.NewShuffler(perm)
+	stream := shuffler.Stream(nil, consume)
 
 	// At the end of this function, we must make sure that all chunks still stored
 	// in the shuffler are disposed of.
 	defer func() {
-		s := shuffler.WithFunc(func(v interface{}) error {
-			if v != nil {
-				v.(cafs.File).Dispose()
+		s := stream.WithFunc(func(v interface{}) error {
+			if chunk, ok := v.(cafs.File); ok {
+				chunk.Dispose()
 			}
 			return nil
 		})
 		_ = s.End()
 	}()
 
-	// Iterate through the chunks and put their keys into the shuffler.
-	for {
-		if chunk, err := chunks.NextChunk(); err == nil {
-			if err := shuffler.Put(chunk); err != nil {
+	// Iterate through the chunks and put them into the shuffler, or just their sizes if they are
+	// known not to be requested.
+	sc := skippable(chunks)
+	defer sc.Dispose()
+	k := len(perm)
+	for idx := 0; ; idx++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, size, err := sc.Advance()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		// The shuffler emits the chunk put at idx when it is put at the slot given by perm
+		pos := idx + (perm[idx%k]-idx%k+k)%k
+		if requested, known := wishlist.peek(pos); known && !requested {
+			if err := stream.Put(skippedChunk(size)); err != nil {
 				return err
 			}
-		} else if err == io.EOF {
-			break
-		} else {
+			continue
+		}
+		chunk, err := sc.Current()
+		if err != nil {
+			return err
+		}
+		if err := stream.Put(chunk); err != nil {
 			return err
 		}
-
 	}
-	if err := shuffler.End(); err != nil {
+	if err := stream.End(); err != nil {
 		return err
 	}
+	return checkWishlistEnd(bits, r)
+}
+
+// Type skippedChunk stands in for a chunk of the given size that isn't requested and hasn't been
+// retrieved.
+type skippedChunk int64
+
+// Struct wishlistLookahead reads a wishlist bit by bit, allowing to peek at bits further ahead as
+// long as this doesn't block.
+type wishlistLookahead struct {
+	bits  *BitReader
+	src   interface{ Buffered() int } // Reports the bytes readable without blocking, if known
+	ahead []bool                      // Bits peeked at but not read yet
+	pos   int                         // Position of the next bit to be read
+}
+
+// Returns the next bit, returning ErrMalformedWishlist if there is none.
+func (w *wishlistLookahead) read() (bool, error) {
+	if len(w.ahead) > 0 {
+		bit := w.ahead[0]
+		w.ahead = w.ahead[1:]
+		w.pos++
+		return bit, nil
+	}
+	bit, err := readWishlistBit(w.bits)
+	if err == nil {
+		w.pos++
+	}
+	return bit, err
+}
+
+// Returns the bit at position `pos`, and true if it could be determined without blocking.
+func (w *wishlistLookahead) peek(pos int) (bool, bool) {
+	for w.pos+len(w.ahead) <= pos {
+		if !w.bits.hasBuffered() && (w.src == nil || w.src.Buffered() == 0) {
+			return false, false
+		}
+		bit, err := w.bits.ReadBit()
+		if err != nil {
+			return false, false
+		}
+		w.ahead = append(w.ahead, bit)
+	}
+	return w.ahead[pos-w.pos], true
+}
+
+// Like forEachChunk, but for the trivial permutation. Only chunks requested are retrieved as files.
+func forEachChunkInOrder(ctx context.Context, chunks SkippableChunks, bits *BitReader, send func(chunk cafs.File) error, skip func(size int64)) error {
+	defer chunks.Dispose()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, size, err := chunks.Advance()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		requested, err := readWishlistBit(bits)
+		if err != nil {
+			return err
+		}
+		if !requested {
+			skip(size)
+			continue
+		}
+		chunk, err := chunks.Current()
+		if err != nil {
+			return err
+		}
+		err = send(chunk)
+		chunk.Dispose()
+		if err != nil {
+			return err
+		}
+	}
+}
 
-	// Expect whishlist byte stream to be read completely
+// Reads the wishlist bit for the next chunk, returning ErrMalformedWishlist if there is none.
+func readWishlistBit(bits *BitReader) (bool, error) {
+	requested, err := bits.ReadBit()
+	if err == io.EOF {
+		// The wishlist is shorter than the number of chunks
+		return false, ErrMalformedWishlist
+	} else if err != nil {
+		return false, fmt.Errorf("error reading from wishlist bitstream: %v", err)
+	}
+	return requested, nil
+}
+
+// Expects the whishlist byte stream to be read completely, with only zero bits remaining in the
+// last byte. Otherwise, the wishlist is longer than the number of chunks.
+func checkWishlistEnd(bits *BitReader, r io.ByteReader) error {
+	if !bits.PaddingIsZero() {
+		return ErrMalformedWishlist
+	}
 	if _, err := r.ReadByte(); err != io.EOF {
-		return errors.New("wishlist too long")
+		return ErrMalformedWishlist
 	}
 	return nil
 }
@@ -137,44 +388,182 @@ func forEachChunk(chunks Chunks, r io.ByteReader, perm shuffle.Permutation, f fu
 // Writes a stream of chunk length / data pairs, permuted by a shuffler corresponding to `perm`,
 // into an io.Writer, based on the chunks of a file and a matching permuted wishlist of requested chunks,
 // read from `r`.
+// Only the chunks requested in the wishlist are sent. A chunk occurring multiple times within the
+// file is sent at most once, even if the wishlist requests it repeatedly: Requests for a chunk that
+// has already been sent are skipped, and the receiver takes the chunk from the copy received before.
+// The permutation must be the one used by the receiver. Prefer SyncInfo.WriteChunkData, which
+// takes it from the SyncInfo shared with the receiver.
+// Returns ErrMalformedWishlist if the wishlist doesn't contain exactly one bit per chunk, and
+// ErrPermutationMismatch if it requests a placeholder inserted by the permutation.
 func WriteChunkData(chunks Chunks, bytesToTransfer int64, r io.ByteReader, perm shuffle.Permutation, w FlushWriter, cb TransferStatusCallback) error {
-	if LoggingEnabled {
+	return WriteChunkDataWithContext(context.Background(), chunks, bytesToTransfer, r, perm, w, cb)
+}
+
+// Like WriteChunkData, but aborts with the context's error once `ctx` is done, e.g. because the
+// receiver has disconnected. Chunks implementations blocking in NextChunk should observe the same
+// context in order to be interrupted promptly. If the context's deadline expires, e.g. because
+// the receiver reads too slowly, returns ErrTransferTimeout. Writes and reads blocking on the
+// receiver aren't interrupted by the context, so callers should also set matching I/O deadlines
+// where available. The caller remains responsible for disposing `chunks`. Detailed logging can be
+// controlled per call using WithVerbose, the framing of chunk data using WithChunkFramer and its
+// buffering using WithWriteBuffer.
+func WriteChunkDataWithContext(ctx context.Context, chunks Chunks, bytesToTransfer int64, r io.ByteReader, perm shuffle.Permutation, w FlushWriter, cb TransferStatusCallback) (err error) {
+	if isVerbose(ctx) {
 		log.Printf("Sender: Begin WriteChunkData")
 		defer log.Printf("Sender: End WriteChunkData")
 	}
 
+	totalBytes := bytesToTransfer
+
 	// Determine the number of bytes to transmit by starting at the maximum and subtracting chunk
 	// total whenever we read a 0 (chunk not requested)
 	if cb != nil {
 		cb(bytesToTransfer, 0)
 	}
 
-	// Iterate requested chunks. Write the chunk's length (as varint) and the chunk data
+	// Iterate requested chunks. Write each chunk's data, framed by the context's ChunkFramer,
 	// into the output writer. Update the number of bytes transferred on the go.
+	framer := chunkFramer(ctx)
 	var bytesTransferred int64
-	return forEachChunk(chunks, r, perm, func(chunk cafs.File, requested bool) error {
-		if requested {
-			if err := writeVarint(w, chunk.Size()); err != nil {
-				return err
-			}
-			r := chunk.Open()
-			if n, err := io.Copy(w, r); err != nil {
-				_ = r.Close()
-				return err
-			} else {
-				w.Flush()
-				bytesTransferred += n
-			}
-			if err := r.Close(); err != nil {
-				return err
-			}
-		} else {
-			bytesToTransfer -= chunk.Size()
-		}
+	ctx, span := StartSpan(ctx, "remotesync.WriteChunkData")
+	defer func() {
+		span.SetAttribute("bytes_transferred", bytesTransferred)
+		span.SetAttribute("bytes_skipped", totalBytes-bytesToTransfer)
+		span.End(err)
+	}()
+
+	// Runs of chunks not requested are reported to the callback in bulk, once the run ends or
+	// amounts to cafs.ProgressInterval bytes.
+	var bytesSkippedUnreported int64
+	notify := func() {
+		bytesSkippedUnreported = 0
 		if cb != nil {
-			// Notify callback of status
 			cb(bytesToTransfer, bytesTransferred)
 		}
+	}
+	// Unless disabled, chunk data is buffered and flushed only before waiting for the wishlist.
+	var buffered *bufferedFlushWriter
+	out := w
+	if size := writeBufferSize(ctx); size > 0 {
+		buffered = newBufferedFlushWriter(w, size)
+		out = buffered
+		r = flushingByteReader{r: r, w: buffered}
+	}
+	skip := func(size int64) {
+		bytesToTransfer -= size
+		bytesSkippedUnreported += size
+		if bytesSkippedUnreported >= cafs.ProgressInterval {
+			notify()
+		}
+	}
+	// Keys of the chunks sent so far
+	sent := make(map[cafs.SKey]bool)
+	err = forEachChunk(ctx, chunks, r, perm, func(chunk cafs.File) error {
+		if sent[chunk.Key()] {
+			skip(chunk.Size())
+			return nil
+		}
+		sent[chunk.Key()] = true
+		r := chunk.Open()
+		err := framer.WriteChunk(out, chunk.Size(), r)
+		if errClose := r.Close(); err == nil {
+			err = errClose
+		}
+		if err != nil {
+			return err
+		}
+		if buffered == nil {
+			w.Flush()
+		}
+		bytesTransferred += chunk.Size()
+		notify()
 		return nil
-	})
+	}, skip)
+	if bytesSkippedUnreported > 0 {
+		notify()
+	}
+	if err == nil && buffered != nil {
+		err = buffered.flush()
+	}
+	if err != nil && deadlineExpired(ctx) {
+		return ErrTransferTimeout
+	}
+	return err
+}
+
+// Function deadlineExpired returns true if `ctx` has a deadline that has passed. Unlike checking for
+// context.DeadlineExceeded, this also holds if the context was canceled by a parent in reaction to
+// I/O failing at the same deadline.
+func deadlineExpired(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// Like WriteChunkDataWithContext, but takes the permutation and the number of bytes to transfer
+// from the SyncInfo, which must be the one the receiver uses. This rules out that sender and
+// receiver disagree on the permutation. Additionally, the chunks are verified against the SyncInfo
+// while sending, failing with ErrChunksMismatch if they differ.
+func (s *SyncInfo) WriteChunkData(ctx context.Context, chunks Chunks, r io.ByteReader, w FlushWriter, cb TransferStatusCallback) error {
+	checked := &checkedChunks{chunks: chunks, syncinf: s}
+	return WriteChunkDataWithContext(ctx, checked, s.TotalSize(), r, s.Perm, w, cb)
+}
+
+// Struct checkedChunks wraps a Chunks and verifies that the chunks match a SyncInfo.
+type checkedChunks struct {
+	chunks  Chunks
+	skip    SkippableChunks // Created from chunks on first call to Advance
+	syncinf *SyncInfo
+	idx     int
+}
+
+func (c *checkedChunks) NextChunk() (cafs.File, error) {
+	chunk, err := c.chunks.NextChunk()
+	if err != nil {
+		return nil, c.check(cafs.SKey{}, 0, err)
+	}
+	if err := c.check(chunk.Key(), chunk.Size(), nil); err != nil {
+		chunk.Dispose()
+		return nil, err
+	}
+	return chunk, nil
+}
+
+func (c *checkedChunks) Advance() (cafs.SKey, int64, error) {
+	if c.skip == nil {
+		c.skip = skippable(c.chunks)
+	}
+	key, size, err := c.skip.Advance()
+	if err := c.check(key, size, err); err != nil {
+		return cafs.SKey{}, 0, err
+	}
+	return key, size, nil
+}
+
+func (c *checkedChunks) Current() (cafs.File, error) {
+	return c.skip.Current()
+}
+
+func (c *checkedChunks) Dispose() {
+	if c.skip != nil {
+		c.skip.Dispose()
+	}
+	c.chunks.Dispose()
+}
+
+// Verifies the next chunk, given the error returned when retrieving it.
+func (c *checkedChunks) check(key cafs.SKey, size int64, err error) error {
+	if err == io.EOF && c.idx != len(c.syncinf.Chunks) {
+		return ErrChunksMismatch
+	} else if err != nil {
+		return err
+	}
+	if c.idx >= len(c.syncinf.Chunks) {
+		return ErrChunksMismatch
+	}
+	ci := c.syncinf.Chunks[c.idx]
+	if key != ci.Key || size != int64(ci.Size) {
+		return ErrChunksMismatch
+	}
+	c.idx++
+	return nil
 }
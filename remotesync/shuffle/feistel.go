@@ -0,0 +1,118 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2017  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package shuffle
+
+// Number of rounds of the Feistel network. Four rounds make a pseudo-random permutation.
+const feistelRounds = 4
+
+// Struct feistelPermutation computes a pseudo-random permutation of 0..n-1 on the fly, using a
+// Feistel network keyed by a seed. It needs constant memory regardless of n. Values outside of
+// 0..n-1 are mapped back into range by applying the network repeatedly ("cycle walking").
+type feistelPermutation struct {
+	seed     uint64
+	n        int
+	halfBits uint // Number of bits in each half of the network's domain
+	inverted bool // If true, implements the complimentary permutation (see Permutation.Inverse)
+}
+
+// Creates a new Shuffler based on a pseudo-random permutation of given size, determined by `seed`.
+// Unlike a Shuffler based on a Permutation, the permutation isn't stored but computed in constant
+// time per element. Only the shuffler's buffer, holding up to `size` elements in transit, remains.
+// The Shuffler's Inverse needs no additional memory either.
+func NewFeistelShuffler(seed uint64, size int) *Shuffler {
+	if size < 1 {
+		panic("size must be positive")
+	}
+	halfBits := uint(1)
+	for (1 << (2 * halfBits)) < size {
+		halfBits++
+	}
+	return newShuffler(&feistelPermutation{seed: seed, n: size, halfBits: halfBits})
+}
+
+func (p *feistelPermutation) at(i int) int {
+	if !p.inverted {
+		return p.forward(i)
+	}
+	return (p.n - 1 + p.backward(i)) % p.n
+}
+
+func (p *feistelPermutation) size() int {
+	return p.n
+}
+
+func (p *feistelPermutation) inverse() permuter {
+	if p.inverted {
+		// Rarely needed: fall back to an explicit representation
+		perm := make(Permutation, p.n)
+		for i := range perm {
+			perm[i] = p.at(i)
+		}
+		return perm.Inverse()
+	}
+	inv := *p
+	inv.inverted = true
+	return &inv
+}
+
+// Function forward maps i to its position within the permutation.
+func (p *feistelPermutation) forward(i int) int {
+	x := uint64(i)
+	for {
+		x = p.encrypt(x)
+		if x < uint64(p.n) {
+			return int(x)
+		}
+	}
+}
+
+// Function backward is the inverse of forward.
+func (p *feistelPermutation) backward(i int) int {
+	x := uint64(i)
+	for {
+		x = p.decrypt(x)
+		if x < uint64(p.n) {
+			return int(x)
+		}
+	}
+}
+
+func (p *feistelPermutation) encrypt(x uint64) uint64 {
+	mask := uint64(1)<<p.halfBits - 1
+	l, r := x>>p.halfBits, x&mask
+	for round := uint64(0); round < feistelRounds; round++ {
+		l, r = r, l^(p.round(round, r)&mask)
+	}
+	return l<<p.halfBits | r
+}
+
+func (p *feistelPermutation) decrypt(x uint64) uint64 {
+	mask := uint64(1)<<p.halfBits - 1
+	l, r := x>>p.halfBits, x&mask
+	for round := uint64(feistelRounds); round > 0; round-- {
+		l, r = r^(p.round(round-1, l)&mask), l
+	}
+	return l<<p.halfBits | r
+}
+
+// Function round is the Feistel network's round function, based on the SplitMix64 finalizer.
+func (p *feistelPermutation) round(round, v uint64) uint64 {
+	z := p.seed + (round+1)*0x9e3779b97f4a7c15 + v
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,57 @@
+package shuffle
+
+import (
+	"testing"
+)
+
+func TestFeistelPermutation(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 4, 5, 17, 100, 1000, 65537} {
+		p := NewFeistelShuffler(42, size).perm
+		inv := p.inverse()
+		seen := make([]bool, size)
+		for i := 0; i < size; i++ {
+			j := p.at(i)
+			if j < 0 || j >= size || seen[j] {
+				t.Fatalf("Size %d: not a permutation, %d maps to %d", size, i, j)
+			}
+			seen[j] = true
+			// The complimentary permutation relates to the forward one like for Permutation.Inverse
+			if k := inv.at(j); k != (size-1+i)%size {
+				t.Fatalf("Size %d: inverse maps %d to %d, expected %d", size, j, k, (size-1+i)%size)
+			}
+		}
+	}
+}
+
+func TestFeistelSeed(t *testing.T) {
+	a, b, c := NewFeistelShuffler(1, 1000).perm, NewFeistelShuffler(1, 1000).perm, NewFeistelShuffler(2, 1000).perm
+	differs := false
+	for i := 0; i < 1000; i++ {
+		if a.at(i) != b.at(i) {
+			t.Fatalf("Permutations with equal seeds differ at %d", i)
+		}
+		differs = differs || a.at(i) != c.at(i)
+	}
+	if !differs {
+		t.Errorf("Permutations with different seeds are equal")
+	}
+}
+
+func TestFeistelStreamShuffler(t *testing.T) {
+	strings := []string{
+		"",
+		"x",
+		"xyz",
+		"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	}
+	for _, size := range []int{1, 2, 7, 100} {
+		for _, original := range strings {
+			shuffled := shuffleString(t, original, NewFeistelShuffler(7, size).Stream('_', nil))
+			unshuffled := shuffleString(t, shuffled, NewFeistelShuffler(7, size).InverseStream('_', nil))
+			if original != unshuffled {
+				t.Fatalf("Size %d: shuffling and unshuffling returned %#v. Expected: %#v. Shuffled: %#v",
+					size, unshuffled, original, shuffled)
+			}
+		}
+	}
+}
@@ -18,7 +18,12 @@
 // cyclic permutation on a possibly infinite stream of data elements.
 package shuffle
 
-import "math/rand"
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+)
 
 // Type Permutation contains a permutation of integer numbers 0..k-1,
 // where k is the length of the permutation cycle.
@@ -33,11 +38,21 @@ type Permutation []int
 // it is put in. A stream of data elemnts shuffled this way is
 // reversible to its original order.
 type Shuffler struct {
-	perm   Permutation
+	perm   permuter
 	buffer []interface{}
 	idx    int
 }
 
+// Interface permuter abstracts over the ways a permutation can be represented.
+type permuter interface {
+	// Returns the position element i is moved to.
+	at(i int) int
+	// Returns the number of elements permuted.
+	size() int
+	// Returns the complimentary permuter, as described for Permutation.Inverse.
+	inverse() permuter
+}
+
 // Interface StreamShuffler is common for shufflers and unshufflers working on a
 // stream with a well-defined beginning and end.
 type StreamShuffler interface {
@@ -65,11 +80,46 @@ type streamShuffler struct {
 	apply    applyFunc
 }
 
-// Creates a random permutation of given length.
+// Creates a random permutation of given length. The permutation is reproducible if `r` has been
+// created from a seeded source, see RandomSeeded.
 func Random(size int, r *rand.Rand) Permutation {
 	return r.Perm(size)
 }
 
+// Creates a random permutation of given length, derived deterministically from `seed`. The same
+// seed yields the same permutation on every run and platform, which makes tests and experiments
+// reproducible. For real transfers, use CryptoRandom, or a seed agreed upon by sender and receiver
+// that an attacker can't predict.
+func RandomSeeded(size int, seed int64) Permutation {
+	return Random(size, rand.New(rand.NewSource(seed)))
+}
+
+// Creates a permutation of given length that is unpredictable, using a cryptographically secure
+// source of randomness. See remotesync.SyncInfo.SetCryptoRandomPermutation for when this matters.
+func CryptoRandom(size int) Permutation {
+	return Random(size, rand.New(cryptoSource{}))
+}
+
+// Type cryptoSource implements rand.Source64 by reading from crypto/rand.
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		// The system's secure random number generator is unavailable, which is not recoverable
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func (s cryptoSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (cryptoSource) Seed(int64) {
+	panic("cryptoSource can't be seeded")
+}
+
 // Given a permutation p, creates a complimentary permutation p'
 // such that using the output of a Shuffler based on p as the input
 // of a Shuffler based on p' restores the original stream order
@@ -82,11 +132,98 @@ func (p Permutation) Inverse() Permutation {
 	return inv
 }
 
-// Creates a new Shuffler based on permutation p.
+// Returns true if p is a bijection of 0..k-1 for some k > 0. Shufflers require a valid permutation.
+func (p Permutation) IsValid() bool {
+	if len(p) == 0 {
+		return false
+	}
+	seen := make([]bool, len(p))
+	for _, j := range p {
+		if j < 0 || j >= len(p) || seen[j] {
+			return false
+		}
+		seen[j] = true
+	}
+	return true
+}
+
+// Returns a permutation of length n, consisting of the elements of p less than n, in the same
+// order. If p is valid, so is the result. Returns a copy of p if n >= len(p), and the trivial
+// permutation {0} if n < 1. Useful for shortening a permutation to the number of elements to be
+// shuffled, as longer permutations only add delay and placeholders.
+func (p Permutation) Truncate(n int) Permutation {
+	if n < 1 {
+		return Permutation{0}
+	}
+	if n >= len(p) {
+		return append(Permutation(nil), p...)
+	}
+	result := make(Permutation, 0, n)
+	for _, j := range p {
+		if j < n {
+			result = append(result, j)
+		}
+	}
+	return result
+}
+
+// Returns true if p is the trivial permutation {0}, for which a Shuffler passes data elements
+// through unchanged and without delay.
+func (p Permutation) IsTrivial() bool {
+	return len(p) == 1 && p[0] == 0
+}
+
+// Returns the order in which a StreamShuffler based on perm emits the elements 0..n-1 when they are
+// put into it in ascending order, followed by End. The result has length n+k-1, where k is the
+// length of perm, with -1 marking the positions where placeholders are emitted. Useful for
+// analyzing a permutation without shuffling actual data. Panics if perm is not a valid permutation.
+func Order(perm Permutation, n int) []int {
+	if !perm.IsValid() {
+		panic(fmt.Sprintf("shuffle: invalid permutation of length %d", len(perm)))
+	}
+	k := len(perm)
+	buffer := make([]int, k)
+	for i := range buffer {
+		buffer[i] = -1
+	}
+	result := make([]int, 0, n+k-1)
+	for i := 0; i < n+k-1; i++ {
+		v := -1
+		if i < n {
+			v = i
+		}
+		// Mirrors Shuffler.Put
+		idx := i % k
+		buffer[perm[idx]] = v
+		result = append(result, buffer[idx])
+	}
+	return result
+}
+
+func (p Permutation) at(i int) int {
+	return p[i]
+}
+
+func (p Permutation) size() int {
+	return len(p)
+}
+
+func (p Permutation) inverse() permuter {
+	return p.Inverse()
+}
+
+// Creates a new Shuffler based on permutation p. Panics if p is not a valid permutation.
 func NewShuffler(p Permutation) *Shuffler {
+	if !p.IsValid() {
+		panic(fmt.Sprintf("shuffle: invalid permutation of length %d", len(p)))
+	}
+	return newShuffler(p)
+}
+
+func newShuffler(p permuter) *Shuffler {
 	result := new(Shuffler)
 	result.perm = p
-	result.buffer = make([]interface{}, len(p))
+	result.buffer = make([]interface{}, p.size())
 	return result
 }
 
@@ -99,14 +236,14 @@ func (s *Shuffler) Put(v interface{}) interface{} {
 	if s.idx == len(s.buffer) {
 		s.idx = 0
 	}
-	s.buffer[s.perm[i]] = v
+	s.buffer[s.perm.at(i)] = v
 	return s.buffer[i]
 }
 
 // Returns a complimentary shuffler that reverses the permutation (except
 // for a delay of k-1 steps).
 func (s *Shuffler) Inverse() *Shuffler {
-	return NewShuffler(s.perm.Inverse())
+	return newShuffler(s.perm.inverse())
 }
 
 // Returns the length k of the permutation buffer used by the shuffler.
@@ -116,10 +253,17 @@ func (s *Shuffler) Length() int {
 
 // Creates a StreamShuffler applying a permutation to a stream. Argument `placeholder`
 // specifies a value that is inserted into the permuted stream in order to symbolize blank space.
+// Panics if p is not a valid permutation.
 func NewStreamShuffler(p Permutation, placeholder interface{}, consume ConsumeFunc) StreamShuffler {
+	return NewShuffler(p).Stream(placeholder, consume)
+}
+
+// Creates a StreamShuffler applying the Shuffler's permutation to a stream. The Shuffler must be
+// fresh and is owned by the StreamShuffler afterwards. See NewStreamShuffler.
+func (s *Shuffler) Stream(placeholder interface{}, consume ConsumeFunc) StreamShuffler {
 	return &streamShuffler{
 		consume:  consume,
-		shuffler: NewShuffler(p),
+		shuffler: s,
 		apply: func(f ConsumeFunc, v interface{}) error {
 			if v == nil {
 				v = placeholder
@@ -154,11 +298,17 @@ func (e *streamShuffler) WithFunc(consume ConsumeFunc) StreamShuffler {
 // Creates a StreamShuffler applying the inverse permutation and thereby restoring
 // the original stream order. Argument `placeholder` specifies blank space inserted
 // into the stream by the original shuffler. Values equal to `placeholder` will not
-// be forwarded to `consume`.
+// be forwarded to `consume`. Panics if p is not a valid permutation.
 func NewInverseStreamShuffler(p Permutation, placeholder interface{}, consume ConsumeFunc) StreamShuffler {
+	return NewShuffler(p).InverseStream(placeholder, consume)
+}
+
+// Creates a StreamShuffler restoring the original order of a stream permuted by a Shuffler
+// equivalent to `s`. See NewInverseStreamShuffler.
+func (s *Shuffler) InverseStream(placeholder interface{}, consume ConsumeFunc) StreamShuffler {
 	return &streamShuffler{
 		consume:  consume,
-		shuffler: NewShuffler(p.Inverse()),
+		shuffler: s.Inverse(),
 		apply: func(f ConsumeFunc, v interface{}) error {
 			if v == nil || v == placeholder {
 				return nil
@@ -2,6 +2,7 @@ package shuffle
 
 import (
 	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -41,6 +42,188 @@ func TestShuffler(t *testing.T) {
 	}
 }
 
+// Tests for random permutations and data lengths, including data shorter than the permutation,
+// that shuffling and unshuffling restores the original stream with a delay of exactly k-1 steps,
+// and that the shuffled stream contains every data element exactly once.
+func TestShuffleRoundTrip(t *testing.T) {
+	rgen := rand.New(rand.NewSource(2))
+	newShufflers := func(k int) (*Shuffler, *Shuffler) {
+		if rgen.Intn(2) == 0 {
+			seed := rgen.Uint64()
+			return NewFeistelShuffler(seed, k), NewFeistelShuffler(seed, k)
+		}
+		perm := Random(k, rgen)
+		return NewShuffler(perm), NewShuffler(perm)
+	}
+	for repeat := 0; repeat < 300; repeat++ {
+		k := 1 + rgen.Intn(1<<uint(rgen.Intn(14)))
+		n := rgen.Intn(3 * k)
+		forward, inverse := newShufflers(k)
+		delay := k - 1
+
+		// Shuffle. Placeholders are represented by -1.
+		var shuffled []interface{}
+		stream := forward.Stream(-1, func(v interface{}) error {
+			shuffled = append(shuffled, v)
+			return nil
+		})
+		for i := 0; i < n; i++ {
+			_ = stream.Put(i)
+		}
+		_ = stream.End()
+		if len(shuffled) != n+delay {
+			t.Fatalf("k=%d, n=%d: expected %d shuffled elements, got %d", k, n, n+delay, len(shuffled))
+		}
+		seen := make([]bool, n)
+		for _, v := range shuffled {
+			if v == -1 {
+				continue
+			}
+			if i := v.(int); seen[i] {
+				t.Fatalf("k=%d, n=%d: element %d duplicated", k, n, i)
+			} else {
+				seen[i] = true
+			}
+		}
+		for i, ok := range seen {
+			if !ok {
+				t.Fatalf("k=%d, n=%d: element %d lost", k, n, i)
+			}
+		}
+
+		// Unshuffle. Element i is restored after exactly i+delay steps.
+		inv := inverse.Inverse()
+		for i, v := range shuffled {
+			w := inv.Put(v)
+			if i < delay {
+				continue
+			}
+			if j := i - delay; j < n && w != j {
+				t.Fatalf("k=%d, n=%d: expected %d at step %d, got %v", k, n, j, i, w)
+			} else if j >= n && w != -1 {
+				t.Fatalf("k=%d, n=%d: expected placeholder at step %d, got %v", k, n, i, w)
+			}
+		}
+	}
+}
+
+func TestPermutationIsValid(t *testing.T) {
+	for _, p := range []Permutation{{0}, {1, 0}, {3, 4, 2, 1, 0}, Random(100, rand.New(rand.NewSource(0)))} {
+		if !p.IsValid() {
+			t.Errorf("Expected %v to be valid", p)
+		}
+		if !p.Inverse().IsValid() {
+			t.Errorf("Expected inverse of %v to be valid", p)
+		}
+	}
+	for _, p := range []Permutation{nil, {}, {1}, {-1}, {0, 0}, {1, 2}, {0, 2, 1, 1}} {
+		if p.IsValid() {
+			t.Errorf("Expected %v to be invalid", p)
+		}
+	}
+}
+
+func TestCryptoRandom(t *testing.T) {
+	for _, size := range []int{1, 2, 10, 100} {
+		if p := CryptoRandom(size); len(p) != size || !p.IsValid() {
+			t.Errorf("Expected valid permutation of size %d, got %v", size, p)
+		}
+	}
+	// The chance of drawing the same permutation of 100 elements twice is negligible
+	a, b := CryptoRandom(100), CryptoRandom(100)
+	if reflect.DeepEqual(a, b) {
+		t.Errorf("Expected different permutations, got %v twice", a)
+	}
+}
+
+func TestRandomSeeded(t *testing.T) {
+	for _, size := range []int{1, 2, 10, 100} {
+		if p := RandomSeeded(size, 42); len(p) != size || !p.IsValid() {
+			t.Errorf("Expected valid permutation of size %d, got %v", size, p)
+		}
+	}
+	if a, b := RandomSeeded(100, 1), RandomSeeded(100, 1); !reflect.DeepEqual(a, b) {
+		t.Errorf("Expected equal permutations for equal seeds, got %v and %v", a, b)
+	}
+	if a, b := RandomSeeded(100, 1), RandomSeeded(100, 2); reflect.DeepEqual(a, b) {
+		t.Errorf("Expected different permutations for different seeds, got %v twice", a)
+	}
+	// Permutations must not change between releases, or reproducibility would be lost
+	if p := RandomSeeded(8, 42); !reflect.DeepEqual(p, Permutation{7, 5, 3, 4, 2, 1, 6, 0}) {
+		t.Errorf("Unexpected permutation for seed 42: %#v", p)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	p := Permutation{4, 2, 0, 3, 1}
+	if q := p.Truncate(3); !reflect.DeepEqual(q, Permutation{2, 0, 1}) {
+		t.Errorf("Unexpected truncated permutation: %v", q)
+	}
+	if !reflect.DeepEqual(p, Permutation{4, 2, 0, 3, 1}) {
+		t.Errorf("Truncate modified the original permutation: %v", p)
+	}
+	for n := -1; n <= len(p)+1; n++ {
+		q := p.Truncate(n)
+		expectedLen := n
+		if n < 1 {
+			expectedLen = 1
+		} else if n > len(p) {
+			expectedLen = len(p)
+		}
+		if len(q) != expectedLen || !q.IsValid() {
+			t.Errorf("Truncate(%d): expected valid permutation of length %d, got %v", n, expectedLen, q)
+		}
+	}
+}
+
+// Function expectPanic calls f and fails if it doesn't panic.
+// Tests that Order predicts the output of a StreamShuffler, including placeholders, for random
+// permutations and data shorter and longer than the permutation.
+func TestOrder(t *testing.T) {
+	rgen := rand.New(rand.NewSource(3))
+	for _, k := range []int{1, 2, 3, 7, 64, 257} {
+		perm := Random(k, rgen)
+		for _, n := range []int{0, 1, k - 1, k, 3*k + 1} {
+			actual := []int{}
+			s := NewStreamShuffler(perm, -1, func(v interface{}) error {
+				actual = append(actual, v.(int))
+				return nil
+			})
+			for i := 0; i < n; i++ {
+				_ = s.Put(i)
+			}
+			_ = s.End()
+			if order := Order(perm, n); !reflect.DeepEqual(order, actual) {
+				t.Fatalf("k=%d, n=%d: Order returned %v, shuffler emitted %v", k, n, order, actual)
+			}
+		}
+	}
+	if order := Order(Permutation{0}, 3); !reflect.DeepEqual(order, []int{0, 1, 2}) {
+		t.Errorf("Expected trivial permutation to preserve order, got %v", order)
+	}
+	if order := Order(Permutation{1, 0}, 2); !reflect.DeepEqual(order, []int{-1, 0, 1}) {
+		t.Errorf("Expected [-1 0 1], got %v", order)
+	}
+}
+
+func expectPanic(t *testing.T, name string, f func()) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected %v to panic", name)
+		}
+	}()
+	f()
+}
+
+func TestInvalidPermutationPanics(t *testing.T) {
+	for _, p := range []Permutation{nil, {1}, {0, 0}, {2, 0, 3}} {
+		expectPanic(t, "NewShuffler", func() { NewShuffler(p) })
+		expectPanic(t, "NewStreamShuffler", func() { NewStreamShuffler(p, nil, nil) })
+		expectPanic(t, "NewInverseStreamShuffler", func() { NewInverseStreamShuffler(p, nil, nil) })
+		expectPanic(t, "Order", func() { Order(p, 1) })
+	}
+}
+
 func TestStreamShuffler(t *testing.T) {
 	permutations := []Permutation{
 		{0},
@@ -160,3 +343,23 @@ func TestTransmission(t *testing.T) {
 	t.Logf("Expected:           % 5.2f", 1+float64(NTRANSMISSIONS-1)*float64(BUFFER_SIZE)/float64(PERMUTATION_SIZE))
 	// TODO: Add actual test here
 }
+
+func benchmarkStreamShuffler(b *testing.B, p Permutation) {
+	sum := 0
+	s := NewStreamShuffler(p, -1, func(v interface{}) error {
+		sum += v.(int)
+		return nil
+	})
+	for i := 0; i < b.N; i++ {
+		_ = s.Put(i)
+	}
+	_ = s.End()
+}
+
+func BenchmarkStreamShufflerTrivial(b *testing.B) {
+	benchmarkStreamShuffler(b, Permutation{0})
+}
+
+func BenchmarkStreamShuffler64(b *testing.B) {
+	benchmarkStreamShuffler(b, Random(64, rand.New(rand.NewSource(0))))
+}
@@ -18,6 +18,9 @@ package remotesync
 
 import (
 	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/chunking"
@@ -25,11 +28,74 @@ import (
 	"io"
 )
 
+// Error ErrInvalidPermutation is returned when a SyncInfo received from a remote contains a
+// permutation that isn't valid (see shuffle.Permutation.IsValid).
+var ErrInvalidPermutation = errors.New("invalid permutation")
+
+// Error ErrChunkTooLarge is returned when a SyncInfo would contain a chunk exceeding
+// chunking.MaxChunkSize, e.g. because it is built from a file or stream not chunked by this package.
+var ErrChunkTooLarge = errors.New("chunk exceeds maximum chunk size")
+
+// Error ErrUnsupportedSyncInfoVersion is returned when decoding a SyncInfo whose JSON encoding
+// has a version this package doesn't understand.
+var ErrUnsupportedSyncInfoVersion = errors.New("unsupported SyncInfo version")
+
+// The version of the JSON encoding of SyncInfo written by this package. Must be incremented
+// whenever the encoding changes in a way older peers can't handle.
+const SyncInfoVersion = 1
+
+// The version assigned to SyncInfos decoded from JSON lacking a version. That encoding was written
+// before versioning was introduced and is otherwise identical to version 1.
+const LegacySyncInfoVersion = 0
+
 // Struct SyncInfo contains information which two CAFS instances have to agree on before
 // transmitting a file.
 type SyncInfo struct {
-	Chunks []ChunkInfo         // hashes and sizes of chunks
-	Perm   shuffle.Permutation // the permutation of chunks to use when transferring
+	Version int                 // version of the encoding decoded from, 0 if legacy or not decoded
+	Chunks  []ChunkInfo         // hashes and sizes of chunks
+	Perm    shuffle.Permutation // the permutation of chunks to use when transferring
+}
+
+var _ json.Marshaler = SyncInfo{}
+var _ json.Unmarshaler = &SyncInfo{}
+
+// Struct syncInfoJSON defines the JSON encoding of SyncInfo.
+type syncInfoJSON struct {
+	Version *int `json:",omitempty"`
+	Chunks  []ChunkInfo
+	Perm    shuffle.Permutation
+}
+
+// Encodes the SyncInfo as JSON, always using version SyncInfoVersion regardless of the Version field.
+func (s SyncInfo) MarshalJSON() ([]byte, error) {
+	version := SyncInfoVersion
+	return json.Marshal(syncInfoJSON{Version: &version, Chunks: s.Chunks, Perm: s.Perm})
+}
+
+// Decodes a SyncInfo from JSON, setting the Version field to the version found, or to
+// LegacySyncInfoVersion if there is none. Returns ErrUnsupportedSyncInfoVersion for any version
+// other than SyncInfoVersion, and ErrChunkTooLarge if a chunk exceeds chunking.MaxChunkSize.
+func (s *SyncInfo) UnmarshalJSON(b []byte) error {
+	var v syncInfoJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	version := LegacySyncInfoVersion
+	if v.Version != nil {
+		if *v.Version != SyncInfoVersion {
+			return ErrUnsupportedSyncInfoVersion
+		}
+		version = *v.Version
+	}
+	s.Version = version
+	s.Chunks = s.Chunks[:0]
+	for _, ci := range v.Chunks {
+		if err := s.addChunk(ci.Key, int64(ci.Size)); err != nil {
+			return err
+		}
+	}
+	s.Perm = v.Perm
+	return nil
 }
 
 // Func SetNoPermutation sets the prmutation to the trivial permutation (the one that doesn't permute).
@@ -37,35 +103,68 @@ func (s *SyncInfo) SetTrivialPermutation() {
 	s.Perm = []int{0}
 }
 
-// Func SetPermutation sets the permutation to use when transferring chunks.
+// Func SetPermutation sets the permutation to use when transferring chunks. A permutation longer than
+// the number of chunks works, but makes sender and receiver buffer and iterate over placeholders
+// needlessly. See ClampPermutation.
 func (s *SyncInfo) SetPermutation(perm shuffle.Permutation) {
 	s.Perm = append(s.Perm[:0], perm...)
 }
 
+// Func ClampPermutation shortens the permutation to the number of chunks if it is longer, using
+// shuffle.Permutation.Truncate. As sender and receiver must use the same permutation, this must
+// be done by whoever creates the SyncInfo, after setting its chunks and before sharing it. It isn't
+// done automatically because it changes the SyncInfo's Digest.
+func (s *SyncInfo) ClampPermutation() {
+	if len(s.Perm) > len(s.Chunks) {
+		s.Perm = s.Perm.Truncate(len(s.Chunks))
+	}
+}
+
+// Func SetCryptoRandomPermutation sets the permutation to a random permutation of length `size`,
+// generated using a cryptographically secure source of randomness.
+//
+// The permutation determines the order in which chunks are sent. An eavesdropper who can predict it
+// may correlate the chunk data stream with the chunks of a known file, e.g. to tell which parts of
+// it the receiver already had, or to match up parallel transfers of the same file. This matters when
+// transfers aren't encrypted or their timing and sizes can be observed, and whenever permutations
+// are generated by several parties using the same, insecure random number generator. Otherwise,
+// SetPermutation with a permutation from math/rand is sufficient.
+func (s *SyncInfo) SetCryptoRandomPermutation(size int) {
+	s.SetPermutation(shuffle.CryptoRandom(size))
+}
+
 // Func SetChunksFromFile prepares sync information for a CAFS file.
-func (s *SyncInfo) SetChunksFromFile(file cafs.File) {
+// Returns ErrChunkTooLarge if the file contains a chunk exceeding chunking.MaxChunkSize.
+func (s *SyncInfo) SetChunksFromFile(file cafs.File) error {
+	s.Chunks = s.Chunks[:0]
+	s.reserveChunks(chunking.EstimateChunkCount(file.Size()))
 	if !file.IsChunked() {
-		s.Chunks = append(s.Chunks[:0], ChunkInfo{
-			Key:  file.Key(),
-			Size: intsize(file.Size()),
-		})
-		return
+		return s.addChunk(file.Key(), file.Size())
 	}
 
 	iter := file.Chunks()
-	s.Chunks = s.Chunks[:0]
+	defer iter.Dispose()
 	for iter.Next() {
-		s.addChunk(iter.Key(), iter.Size())
+		if err := s.addChunk(iter.Key(), iter.Size()); err != nil {
+			return err
+		}
 	}
-	iter.Dispose()
+	return nil
 }
 
 // func ReadFromLegacyStream reads chunk hashes from a stream encoded in the format previously used. No permutation
 // data is sent and it is expected that permutation remain the trivial permutation {0}.
+// Returns ErrChunkTooLarge if the stream specifies a chunk exceeding chunking.MaxChunkSize.
 func (s *SyncInfo) ReadFromLegacyStream(stream io.Reader) error {
 	// We need ReadByte
 	r := bufio.NewReader(stream)
 
+	// Each chunk takes at least KeySize+1 bytes. If the stream knows its length, use it to avoid
+	// growing the list of chunks repeatedly.
+	if l, ok := stream.(interface{ Len() int }); ok {
+		s.reserveChunks(l.Len() / (cafs.KeySize + 1))
+	}
+
 	for {
 		// Read a chunk hash and its size
 		var key cafs.SKey
@@ -74,14 +173,14 @@ func (s *SyncInfo) ReadFromLegacyStream(stream io.Reader) error {
 		} else if err != nil {
 			return fmt.Errorf("error reading chunk hash: %v", err)
 		}
-		var size int64
-		if l, err := readChunkLength(r); err != nil {
+		size, err := binary.ReadVarint(r)
+		if err != nil {
 			return fmt.Errorf("error reading size of chunk: %v", err)
-		} else {
-			size = l
 		}
 
-		s.addChunk(key, size)
+		if err := s.addChunk(key, size); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -99,15 +198,141 @@ func (s *SyncInfo) WriteToLegacyStream(stream io.Writer) error {
 	return nil
 }
 
-func (s *SyncInfo) addChunk(key cafs.SKey, size int64) {
-	s.Chunks = append(s.Chunks, ChunkInfo{key, intsize(size)})
+// Func TotalSize returns the size of the file described, i.e. the sum of all chunk sizes.
+func (s *SyncInfo) TotalSize() int64 {
+	var size int64
+	for _, ci := range s.Chunks {
+		size += int64(ci.Size)
+	}
+	return size
+}
+
+// Func ChunkCount returns the number of chunks of the file described, counting repeated chunks
+// each time they occur.
+func (s *SyncInfo) ChunkCount() int {
+	return len(s.Chunks)
+}
+
+// Func ChunkOffset returns the byte offset at which chunk i starts within the file. Passing
+// i == len(s.Chunks) yields the total size of the file. Panics if i is out of range.
+func (s *SyncInfo) ChunkOffset(i int) int64 {
+	if i < 0 || i > len(s.Chunks) {
+		panic("chunk index out of range")
+	}
+	var offset int64
+	for _, ci := range s.Chunks[:i] {
+		offset += int64(ci.Size)
+	}
+	return offset
 }
 
-func intsize(size int64) int {
-	if size < 0 || size > chunking.MaxChunkSize {
-		panic("invalid chunk total")
+// Func ChunkContaining returns the index of the chunk containing the byte at the given offset,
+// along with the position of that byte within the chunk. Returns -1 if the offset lies outside
+// of the file.
+func (s *SyncInfo) ChunkContaining(offset int64) (index int, within int64) {
+	if offset < 0 {
+		return -1, 0
+	}
+	var start int64
+	for i, ci := range s.Chunks {
+		end := start + int64(ci.Size)
+		if offset < end {
+			return i, offset - start
+		}
+		start = end
+	}
+	return -1, 0
+}
+
+// Func OverlapWith counts how many of the chunks are already present in `storage`, giving an
+// estimate of how much of a file would have to be transferred. Unlike WriteWishList, repeated
+// chunks are counted each time they occur. Leaves storages implementing cafs.PresenceStorage
+// unaffected, see cafs.Contains.
+func (s *SyncInfo) OverlapWith(storage cafs.FileStorage) (present, total int) {
+	for _, ci := range s.Chunks {
+		if cafs.Contains(storage, ci.Key) {
+			present++
+		}
+	}
+	return present, len(s.Chunks)
+}
+
+// Func MatchingPrefix returns the number of leading chunks of `file` matching the chunks of the
+// SyncInfo, and their total size. For a file that is a prefix of the file described, e.g. the
+// result of an interrupted download, this covers all but usually the last chunk, which is cut
+// short. See Builder.Seed.
+func (s *SyncInfo) MatchingPrefix(file cafs.File) (chunks int, size int64) {
+	iter := file.Chunks()
+	defer iter.Dispose()
+	for chunks < len(s.Chunks) && iter.Next() {
+		ci := s.Chunks[chunks]
+		if iter.Key() != ci.Key || iter.Size() != int64(ci.Size) {
+			break
+		}
+		chunks++
+		size += int64(ci.Size)
 	}
-	return int(size)
+	return
+}
+
+// Func Digest returns a hash over a canonical binary encoding of the SyncInfo, covering both the
+// chunks and the permutation. Unlike the JSON encoding, it doesn't depend on formatting details and
+// can therefore be used for verifying a SyncInfo obtained from an untrusted source.
+//
+// The encoding consists of the encoding hashed by ContentDigest, followed by the number of
+// elements of the permutation and the elements themselves, each as an unsigned varint. The
+// Version field is not covered.
+func (s *SyncInfo) Digest() cafs.SKey {
+	h := cafs.NewKeyHash()
+	s.writeCanonicalChunks(h)
+	writeUvarint(h, uint64(len(s.Perm)))
+	for _, p := range s.Perm {
+		writeUvarint(h, uint64(p))
+	}
+	return cafs.SumKey(h)
+}
+
+// Func ContentDigest returns a hash over a canonical binary encoding of the SyncInfo's chunks only.
+// SyncInfos describing the same file yield the same content digest, regardless of their
+// permutations and versions, which makes it suitable for discovering peers offering a file.
+//
+// The encoding consists of the number of chunks as an unsigned varint, followed by each chunk in
+// file order, encoded as its key and its size as an unsigned varint. Chunks are never sorted, as
+// their order is part of the file's content.
+func (s *SyncInfo) ContentDigest() cafs.SKey {
+	h := cafs.NewKeyHash()
+	s.writeCanonicalChunks(h)
+	return cafs.SumKey(h)
+}
+
+// Writes the canonical encoding of the chunks hashed by ContentDigest.
+func (s *SyncInfo) writeCanonicalChunks(w io.Writer) {
+	writeUvarint(w, uint64(len(s.Chunks)))
+	for _, ci := range s.Chunks {
+		w.Write(ci.Key[:])
+		writeUvarint(w, uint64(ci.Size))
+	}
+}
+
+// Grows the capacity of the list of chunks, if necessary, to hold `n` more chunks without
+// reallocation.
+func (s *SyncInfo) reserveChunks(n int) {
+	if cap(s.Chunks)-len(s.Chunks) < n {
+		chunks := make([]ChunkInfo, len(s.Chunks), len(s.Chunks)+n)
+		copy(chunks, s.Chunks)
+		s.Chunks = chunks
+	}
+}
+
+// Appends a chunk. Returns ErrChunkTooLarge if the size exceeds chunking.MaxChunkSize.
+func (s *SyncInfo) addChunk(key cafs.SKey, size int64) error {
+	if size > chunking.MaxChunkSize {
+		return ErrChunkTooLarge
+	} else if size < 0 {
+		return fmt.Errorf("invalid size of chunk %v: %d bytes", key, size)
+	}
+	s.Chunks = append(s.Chunks, ChunkInfo{key, int(size)})
+	return nil
 }
 
 // Applies the permutation contained within the receiver to it's own list of chunks, returning
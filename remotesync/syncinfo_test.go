@@ -2,8 +2,12 @@ package remotesync
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking"
+	"github.com/indyjo/cafs/ram"
 	"testing"
 )
 
@@ -32,3 +36,306 @@ func TestSyncInfoJSON(t *testing.T) {
 		t.Fatalf("Encoding differs")
 	}
 }
+
+func TestSyncInfoJSONVersion(t *testing.T) {
+	s := SyncInfo{}
+	s.SetTrivialPermutation()
+	s.addChunk(cafs.SKey{11, 22, 33, 44, 55, 66, 77, 88}, 1337)
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if !bytes.Contains(b, []byte(`"Version":1`)) {
+		t.Errorf("Expected version to be encoded: %s", b)
+	}
+	var s2 SyncInfo
+	if err := json.Unmarshal(b, &s2); err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if s2.Version != SyncInfoVersion || s2.Digest() != s.Digest() {
+		t.Errorf("Decoded SyncInfo differs: %v", s2)
+	}
+
+	// JSON written before versioning was introduced is decoded as legacy version
+	legacy := bytes.Replace(b, []byte(`"Version":1,`), nil, 1)
+	var s3 SyncInfo
+	if err := json.Unmarshal(legacy, &s3); err != nil {
+		t.Fatalf("Error decoding legacy JSON %s: %v", legacy, err)
+	}
+	if s3.Version != LegacySyncInfoVersion || s3.Digest() != s.Digest() {
+		t.Errorf("Decoded legacy SyncInfo differs: %v", s3)
+	}
+
+	for _, version := range []string{"0", "2", "-1"} {
+		other := bytes.Replace(b, []byte(`"Version":1`), []byte(`"Version":`+version), 1)
+		if err := json.Unmarshal(other, &SyncInfo{}); err != ErrUnsupportedSyncInfoVersion {
+			t.Errorf("Version %v: expected ErrUnsupportedSyncInfoVersion, got: %v", version, err)
+		}
+	}
+}
+
+func TestSyncInfoTotalSize(t *testing.T) {
+	s := SyncInfo{}
+	if s.TotalSize() != 0 || s.ChunkCount() != 0 {
+		t.Errorf("Expected empty SyncInfo, got %v bytes in %v chunks", s.TotalSize(), s.ChunkCount())
+	}
+	s.addChunk(cafs.SKey{1}, 100)
+	s.addChunk(cafs.SKey{2}, 1)
+	s.addChunk(cafs.SKey{1}, 100)
+	if s.TotalSize() != 201 || s.ChunkCount() != 3 {
+		t.Errorf("Expected 201 bytes in 3 chunks, got %v bytes in %v chunks", s.TotalSize(), s.ChunkCount())
+	}
+
+	// Files not stored in chunks consist of a single chunk
+	store := ram.NewRamStorage(1 << 20)
+	for _, size := range []int{0, 1000, 200000} {
+		temp := store.Create("test")
+		if _, err := temp.Write(make([]byte, size)); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		if err := temp.Close(); err != nil {
+			t.Fatalf("Error closing: %v", err)
+		}
+		file := temp.File()
+		temp.Dispose()
+
+		s := SyncInfo{}
+		if err := s.SetChunksFromFile(file); err != nil {
+			t.Fatalf("Error in SetChunksFromFile: %v", err)
+		}
+		if s.TotalSize() != file.Size() || int64(s.ChunkCount()) != file.NumChunks() {
+			t.Errorf("Expected %v bytes in %v chunks, got %v bytes in %v chunks", file.Size(), file.NumChunks(), s.TotalSize(), s.ChunkCount())
+		}
+		if !file.IsChunked() && s.ChunkCount() != 1 {
+			t.Errorf("Expected a single chunk for a non-chunked file of %v bytes, got %v", size, s.ChunkCount())
+		}
+		file.Dispose()
+	}
+}
+
+func TestSyncInfoChunkOffsets(t *testing.T) {
+	s := SyncInfo{}
+	s.addChunk(cafs.SKey{1}, 100)
+	s.addChunk(cafs.SKey{2}, 1)
+	s.addChunk(cafs.SKey{3}, 50)
+
+	offsets := []int64{0, 100, 101, 151}
+	for i, expected := range offsets {
+		if offset := s.ChunkOffset(i); offset != expected {
+			t.Errorf("ChunkOffset(%v): expected %v, got %v", i, expected, offset)
+		}
+	}
+
+	cases := []struct {
+		offset int64
+		index  int
+		within int64
+	}{
+		{-1, -1, 0},
+		{0, 0, 0},
+		{99, 0, 99},
+		{100, 1, 0},
+		{101, 2, 0},
+		{150, 2, 49},
+		{151, -1, 0},
+		{1000, -1, 0},
+	}
+	for _, c := range cases {
+		index, within := s.ChunkContaining(c.offset)
+		if index != c.index || within != c.within {
+			t.Errorf("ChunkContaining(%v): expected (%v, %v), got (%v, %v)",
+				c.offset, c.index, c.within, index, within)
+		}
+	}
+
+	empty := SyncInfo{}
+	if offset := empty.ChunkOffset(0); offset != 0 {
+		t.Errorf("ChunkOffset(0) of empty SyncInfo: expected 0, got %v", offset)
+	}
+	if index, _ := empty.ChunkContaining(0); index != -1 {
+		t.Errorf("ChunkContaining(0) of empty SyncInfo: expected -1, got %v", index)
+	}
+}
+
+func TestSyncInfoCryptoRandomPermutation(t *testing.T) {
+	s := SyncInfo{}
+	s.SetCryptoRandomPermutation(10)
+	if len(s.Perm) != 10 || !s.Perm.IsValid() {
+		t.Errorf("Expected valid permutation of size 10, got %v", s.Perm)
+	}
+}
+
+func TestSyncInfoInvalidChunkSize(t *testing.T) {
+	s := SyncInfo{}
+	if err := s.addChunk(cafs.SKey{1}, chunking.MaxChunkSize); err != nil {
+		t.Errorf("Expected chunk of maximum size to be accepted, got: %v", err)
+	}
+	if err := s.addChunk(cafs.SKey{2}, chunking.MaxChunkSize+1); err != ErrChunkTooLarge {
+		t.Errorf("Expected oversized chunk to be rejected with ErrChunkTooLarge, got: %v", err)
+	}
+	if err := s.addChunk(cafs.SKey{3}, -1); err == nil {
+		t.Errorf("Expected chunk of negative size to be rejected")
+	}
+	if len(s.Chunks) != 1 {
+		t.Errorf("Expected only valid chunks to be added, got %d chunks", len(s.Chunks))
+	}
+}
+
+func TestSyncInfoOversizedChunk(t *testing.T) {
+	// A crafted legacy stream announcing a single chunk of excessive size
+	var buf bytes.Buffer
+	key := cafs.SKey{1}
+	buf.Write(key[:])
+	var size [binary.MaxVarintLen64]byte
+	buf.Write(size[:binary.PutVarint(size[:], 1<<40)])
+	s := SyncInfo{}
+	if err := s.ReadFromLegacyStream(&buf); err != ErrChunkTooLarge {
+		t.Errorf("Expected ErrChunkTooLarge from legacy stream, got: %v", err)
+	}
+
+	data := fmt.Sprintf(`{"Version":1,"Chunks":[{"Key":"%v","Size":%d}],"Perm":[0]}`,
+		key, chunking.MaxChunkSize+1)
+	if err := json.Unmarshal([]byte(data), &s); err != ErrChunkTooLarge {
+		t.Errorf("Expected ErrChunkTooLarge from JSON, got: %v", err)
+	}
+}
+
+func TestSyncInfoDigest(t *testing.T) {
+	s := SyncInfo{}
+	s.SetPermutation([]int{2, 0, 1})
+	s.addChunk(cafs.SKey{1}, 1337)
+	s.addChunk(cafs.SKey{2}, 42)
+
+	// The digest survives a JSON round trip
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	s2 := SyncInfo{}
+	if err := json.Unmarshal(b, &s2); err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if s.Digest() != s2.Digest() {
+		t.Errorf("Digest differs after JSON round trip")
+	}
+
+	// Every modification changes the digest
+	modifications := []func(s *SyncInfo){
+		func(s *SyncInfo) { s.Chunks[0].Key[0] = 3 },
+		func(s *SyncInfo) { s.Chunks[1].Size++ },
+		func(s *SyncInfo) { s.Chunks = s.Chunks[:1] },
+		func(s *SyncInfo) { s.SetPermutation([]int{1, 0, 2}) },
+		func(s *SyncInfo) { s.SetTrivialPermutation() },
+	}
+	for i, modify := range modifications {
+		s3 := SyncInfo{}
+		if err := json.Unmarshal(b, &s3); err != nil {
+			t.Fatalf("Error decoding: %v", err)
+		}
+		modify(&s3)
+		if s.Digest() == s3.Digest() {
+			t.Errorf("Modification #%d didn't change digest", i)
+		}
+	}
+}
+
+func TestSyncInfoContentDigest(t *testing.T) {
+	store := ram.NewRamStorage(1024 * 1024)
+	file := addRandomFile(t, store, 100000)
+	defer file.Dispose()
+
+	s1, s2 := SyncInfo{}, SyncInfo{}
+	if err := s1.SetChunksFromFile(file); err != nil {
+		t.Fatalf("Error building SyncInfo: %v", err)
+	}
+	if err := s2.SetChunksFromFile(file); err != nil {
+		t.Fatalf("Error building SyncInfo: %v", err)
+	}
+	s1.SetPermutation([]int{2, 0, 1})
+	s2.SetTrivialPermutation()
+	s2.Version = SyncInfoVersion
+
+	if s1.ContentDigest() != s2.ContentDigest() {
+		t.Errorf("Content digest depends on permutation or version")
+	}
+	if s1.Digest() == s2.Digest() {
+		t.Errorf("Digest doesn't depend on permutation")
+	}
+
+	// Reordering chunks changes the content digest
+	if len(s2.Chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(s2.Chunks))
+	}
+	s2.Chunks[0], s2.Chunks[1] = s2.Chunks[1], s2.Chunks[0]
+	if s1.ContentDigest() == s2.ContentDigest() {
+		t.Errorf("Content digest doesn't depend on chunk order")
+	}
+}
+
+func TestSyncInfoOverlapWith(t *testing.T) {
+	store := ram.NewRamStorage(1024 * 1024)
+	temp := store.Create("present")
+	if _, err := temp.Write([]byte("present chunk")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	file := temp.File()
+	temp.Dispose()
+	defer file.Dispose()
+
+	s := SyncInfo{}
+	s.addChunk(file.Key(), file.Size())
+	s.addChunk(cafs.SKey{1}, 100)
+	s.addChunk(file.Key(), file.Size())
+	lockedBefore := store.GetUsageInfo().Locked
+	if present, total := s.OverlapWith(store); present != 2 || total != 3 {
+		t.Errorf("Expected 2 of 3 chunks present, got %d of %d", present, total)
+	}
+	if locked := store.GetUsageInfo().Locked; locked != lockedBefore {
+		t.Errorf("Expected %d bytes to remain locked, got %d", lockedBefore, locked)
+	}
+}
+
+// Function benchmarkSyncInfoConstruction measures building the SyncInfo of a 64 MB file, either
+// from the file itself or from a legacy stream.
+func benchmarkSyncInfoConstruction(b *testing.B, legacy bool) {
+	store := ram.NewRamStorage(128 * 1024 * 1024)
+	file := addRandomFileB(b, store, 64*1024*1024)
+	defer file.Dispose()
+	var stream []byte
+	if legacy {
+		var s SyncInfo
+		if err := s.SetChunksFromFile(file); err != nil {
+			b.Fatalf("Error setting chunks: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := s.WriteToLegacyStream(&buf); err != nil {
+			b.Fatalf("Error writing legacy stream: %v", err)
+		}
+		stream = buf.Bytes()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var s SyncInfo
+		var err error
+		if legacy {
+			err = s.ReadFromLegacyStream(bytes.NewReader(stream))
+		} else {
+			err = s.SetChunksFromFile(file)
+		}
+		if err != nil {
+			b.Fatalf("Error constructing SyncInfo: %v", err)
+		}
+	}
+}
+
+func BenchmarkSetChunksFromFile(b *testing.B) {
+	benchmarkSyncInfoConstruction(b, false)
+}
+
+func BenchmarkReadFromLegacyStream(b *testing.B) {
+	benchmarkSyncInfoConstruction(b, true)
+}
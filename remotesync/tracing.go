@@ -0,0 +1,61 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import "context"
+
+// Interface Tracer creates spans for the phases of a transfer, allowing it to be followed in a
+// distributed tracing system. This package doesn't depend on any such system. Instead, callers
+// implement Tracer, e.g. by adapting an OpenTelemetry trace.Tracer, and pass it using WithTracer.
+type Tracer interface {
+	// Starts a span named `name` as a child of the span carried by `ctx`, if any. Returns a
+	// context carrying the new span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Interface Span represents a phase of a transfer. See Tracer.
+type Span interface {
+	// Sets an attribute of the span. Values are of type int, int64, string or bool.
+	SetAttribute(key string, value interface{})
+	// Ends the span, recording `err` unless it is nil. Must be called exactly once.
+	End(err error)
+}
+
+type tracerKey struct{}
+
+// Function WithTracer returns a context that makes functions it is passed to create spans using
+// `tracer`. These are WriteChunkDataWithContext, SyncInfo.WriteChunkData and Builder.WithTraceContext
+// in this package, and the functions for syncing over HTTP in package httpsync.
+func WithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// Function StartSpan starts a span using the Tracer carried by `ctx`. If there is none, returns
+// `ctx` and a span that does nothing.
+func StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	if tracer, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return tracer.StartSpan(ctx, name)
+	}
+	return ctx, nopSpan{}
+}
+
+// Struct nopSpan is the Span returned by StartSpan when there is no Tracer.
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (nopSpan) End(error) {}
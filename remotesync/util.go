@@ -19,11 +19,11 @@ package remotesync
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
 	"github.com/indyjo/cafs"
 	"github.com/indyjo/cafs/chunking"
 	"io"
 	"net/http"
+	"time"
 )
 
 // Interface FlushWriter acts like an io.Writer with an additional Flush method.
@@ -60,7 +60,7 @@ func (f NopFlushWriter) Flush() {
 
 // The key pertaining to the SHA256 of an empty string is used to represent placeholders
 // for empty slots generated by shuffled transmissions.
-var emptyKey = *cafs.MustParseKey("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+var emptyKey = cafs.KeyOf(nil)
 
 // Type ChunkInfo contains a chunk's hash and size.
 type ChunkInfo struct {
@@ -74,7 +74,7 @@ func readChunkLength(r *bufio.Reader) (int64, error) {
 	if l, err := binary.ReadVarint(r); err != nil {
 		return 0, err
 	} else if l < 0 || l > chunking.MaxChunkSize {
-		return 0, fmt.Errorf("Illegal chunk length: %v", l)
+		return 0, ErrProtocolViolation
 	} else {
 		return l, nil
 	}
@@ -86,83 +86,105 @@ func writeVarint(w io.Writer, value int64) error {
 	return err
 }
 
-type bitWriter struct {
-	w   FlushWriter
-	n   int
-	buf [1]byte
-}
-
-func newBitWriter(writer FlushWriter) *bitWriter {
-	return &bitWriter{w: writer}
+func writeUvarint(w io.Writer, value uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.Write(buf[:binary.PutUvarint(buf[:], value)])
+	return err
 }
 
-func (w *bitWriter) WriteBit(b bool) (err error) {
-	if b {
-		w.buf[0] = (w.buf[0] << 1) | 1
-	} else {
-		w.buf[0] = w.buf[0] << 1
+// Function readChunk reads a single chunk worth of data from stream `r` into a new
+// file on FileStorage `s`, using `framer` to decode it.
+func readChunk(s cafs.FileStorage, r *bufio.Reader, framer ChunkFramer, info string) (cafs.File, error) {
+	tempChunk := s.Create(info)
+	defer tempChunk.Dispose()
+	if err := framer.ReadChunk(r, tempChunk); err != nil {
+		return nil, err
 	}
-	w.n++
-	if w.n == 8 {
-		_, err = w.w.Write(w.buf[:])
-		if err == nil {
-			w.w.Flush()
-		}
-		w.n = 0
+	if err := tempChunk.Close(); err != nil {
+		return nil, err
 	}
-	return
+	return tempChunk.File(), nil
 }
 
-func (w *bitWriter) Flush() (err error) {
-	for err == nil && w.n != 0 {
-		err = w.WriteBit(false)
+// Function contentMatchesKey re-hashes a file's content and returns true if it matches the
+// file's key.
+func contentMatchesKey(file cafs.File) bool {
+	r := file.Open()
+	//noinspection GoUnhandledErrorResult
+	defer r.Close()
+	h := cafs.NewKeyHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return false
 	}
-	return
+	return cafs.SumKey(h) == file.Key()
 }
 
-type bitReader struct {
-	r io.ByteReader
-	n uint
-	b byte
+// Struct deadlineReader reads from an io.Reader in a separate goroutine, allowing a deadline to
+// be imposed on reads that would otherwise block indefinitely. Reads fail with ErrChunkTimeout
+// once the deadline has passed. Data read by the goroutine is never lost, so reading may continue
+// after a timeout.
+type deadlineReader struct {
+	results  chan readResult
+	quit     chan struct{}
+	current  readResult // Partially consumed result of the last read
+	deadline time.Time
 }
 
-func newBitReader(r io.ByteReader) *bitReader {
-	return &bitReader{r: r, n: 0, b: 0}
+type readResult struct {
+	data []byte
+	err  error
 }
 
-func (r *bitReader) ReadBit() (bit bool, err error) {
-	if r.n == 8 {
-		r.n = 0
+func newDeadlineReader(r io.Reader, bufSize int) *deadlineReader {
+	d := &deadlineReader{
+		results: make(chan readResult),
+		quit:    make(chan struct{}),
 	}
-	if r.n == 0 {
-		r.b, err = r.r.ReadByte()
-		if err != nil {
-			return
+	go func() {
+		for {
+			buf := make([]byte, bufSize)
+			n, err := r.Read(buf)
+			select {
+			case d.results <- readResult{buf[:n], err}:
+			case <-d.quit:
+				return
+			}
+			if err != nil {
+				return
+			}
 		}
-	}
-	n := r.n
-	r.n++
-	bit = 0 != (0x80 & (r.b << n))
-	return
+	}()
+	return d
 }
 
-// Function readChunk reads a single chunk worth of data from stream `r` into a new
-// file on FileStorage `s`.
-// The expected encoding is (varint, data...).
-func readChunk(s cafs.FileStorage, r *bufio.Reader, info string) (cafs.File, error) {
-	var length int64
-	if n, err := readChunkLength(r); err != nil {
-		return nil, err
-	} else {
-		length = n
-	}
-	tempChunk := s.Create(info)
-	defer tempChunk.Dispose()
-	if _, err := io.CopyN(tempChunk, r, length); err != nil {
-		return nil, err
+// Sets the deadline for subsequent reads. A zero value means that reads don't time out.
+func (d *deadlineReader) SetDeadline(t time.Time) {
+	d.deadline = t
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if len(d.current.data) == 0 && d.current.err == nil {
+		var timeout <-chan time.Time
+		if !d.deadline.IsZero() {
+			timer := time.NewTimer(time.Until(d.deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case d.current = <-d.results:
+		case <-timeout:
+			return 0, ErrChunkTimeout
+		}
 	}
-	if err := tempChunk.Close(); err != nil {
-		return nil, err
+	n := copy(p, d.current.data)
+	d.current.data = d.current.data[n:]
+	if len(d.current.data) == 0 && d.current.err != nil {
+		return n, d.current.err
 	}
-	return tempChunk.File(), nil
+	return n, nil
+}
+
+// Makes the reading goroutine terminate once its pending read returns.
+func (d *deadlineReader) Close() {
+	close(d.quit)
 }
@@ -0,0 +1,147 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"sync"
+	"time"
+)
+
+// The wishlist is flushed in bytes of 8 bits. With fewer chunks in flight, the receiver could
+// wait for chunk data the sender can't send because it hasn't seen the chunk's wishlist bit yet.
+const minWindow = 8
+
+// Struct adaptiveWindow limits the number of chunks in flight between WriteWishList and
+// ReconstructFileFromRequestedChunks, and the number of bytes they pin in storage. The limit is
+// adjusted by hill climbing: after each epoch of `limit` chunks, it keeps moving in the direction
+// that last improved throughput, and reverses direction otherwise.
+type adaptiveWindow struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	max      int   // Upper bound for limit
+	budget   int64 // Maximum number of bytes pinned by chunks in flight, or 0 if unbounded
+	limit    int   // Current maximum number of chunks in flight
+	inflight int   // Number of chunks in flight
+	pinned   int64 // Number of bytes pinned by chunks in flight
+
+	growing    bool      // Direction of the last adjustment
+	epochStart time.Time // Start of the current epoch
+	epochCount int       // Number of chunks processed in the current epoch
+	epochBytes int64     // Number of bytes processed in the current epoch
+	lastRate   float64   // Throughput of the last epoch, in bytes per second
+}
+
+func newAdaptiveWindow(max int, budget int64) *adaptiveWindow {
+	if max < minWindow {
+		max = minWindow
+	}
+	w := &adaptiveWindow{
+		max:     max,
+		budget:  budget,
+		limit:   minWindow,
+		growing: true,
+	}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+// Function acquire blocks until a chunk pinning `pinned` bytes in storage may enter the window.
+// The budget may be exceeded in order to keep minWindow chunks in flight. Returns ErrDisposed if
+// the window is closed meanwhile.
+func (w *adaptiveWindow) acquire(pinned int64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for !w.closed && w.inflight > 0 && (w.inflight >= w.limit ||
+		w.inflight >= minWindow && w.budget > 0 && pinned > 0 && w.pinned+pinned > w.budget) {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return ErrDisposed
+	}
+	w.inflight++
+	w.pinned += pinned
+	return nil
+}
+
+// Function release is called when a chunk of `size` bytes, pinning `pinned` bytes, has been
+// processed and leaves the window.
+func (w *adaptiveWindow) release(size, pinned int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.inflight--
+	w.pinned -= pinned
+	w.adapt(size)
+	w.cond.Broadcast()
+}
+
+// Function adapt accounts for a processed chunk and adjusts the limit at the end of an epoch.
+func (w *adaptiveWindow) adapt(size int64) {
+	now := time.Now()
+	if w.epochStart.IsZero() {
+		w.epochStart = now
+	}
+	w.epochCount++
+	w.epochBytes += size
+	if w.epochCount < w.limit {
+		return
+	}
+	elapsed := now.Sub(w.epochStart).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(w.epochBytes) / elapsed
+	if rate < w.lastRate {
+		w.growing = !w.growing
+	}
+	if w.growing {
+		w.limit *= 2
+	} else {
+		w.limit -= w.limit / 4
+	}
+	if w.limit > w.max {
+		w.limit = w.max
+	} else if w.limit < minWindow {
+		w.limit = minWindow
+	}
+	w.lastRate = rate
+	w.epochStart, w.epochCount, w.epochBytes = now, 0, 0
+}
+
+// Function size returns the current limit.
+func (w *adaptiveWindow) size() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.limit
+}
+
+// Function reset prepares the window for another transfer, keeping the limit adapted to so far.
+// There must be no chunks in flight.
+func (w *adaptiveWindow) reset() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.inflight, w.pinned = 0, 0
+	w.epochStart, w.epochCount, w.epochBytes = time.Time{}, 0, 0
+}
+
+// Function close wakes up all callers of acquire, making them return ErrDisposed.
+func (w *adaptiveWindow) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
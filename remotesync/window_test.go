@@ -0,0 +1,199 @@
+package remotesync
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/indyjo/cafs"
+	. "github.com/indyjo/cafs/ram"
+	"github.com/indyjo/cafs/remotesync/shuffle"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveWindow(t *testing.T) {
+	storeA := NewRamStorage(8 * 1024 * 1024)
+	storeB := NewRamStorage(8 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	defer reportUsage(t, "B", storeB)
+
+	tempA := storeA.Create("Data A")
+	defer tempA.Dispose()
+	tempB := storeB.Create("Data B")
+	defer tempB.Dispose()
+	check(t, "creating similar data", createSimilarData(tempA, tempB, 0.5, 0.25, 8192, 200))
+	check(t, "closing tempA", tempA.Close())
+	check(t, "closing tempB", tempB.Close())
+	fileA := tempA.File()
+	defer fileA.Dispose()
+	fileB := tempB.File()
+	defer fileB.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(rand.Perm(10))
+	check(t, "computing chunks", syncinf.SetChunksFromFile(fileA))
+
+	builder := NewBuilder(storeB, syncinf, 64, "Recovered A").WithAdaptiveWindow(32 * 1024)
+	if size := builder.WindowSize(); size != minWindow {
+		t.Errorf("Expected window to start at %d, got %d", minWindow, size)
+	}
+	fileC := transfer(t, builder, fileA)
+	defer fileC.Dispose()
+	if size := builder.WindowSize(); size < minWindow || size > 64 {
+		t.Errorf("Expected window size in range %d..64, got %d", minWindow, size)
+	}
+	builder.Dispose()
+	assertEqual(t, fileA.Open(), fileC.Open())
+}
+
+func TestAdaptiveWindowBudget(t *testing.T) {
+	w := newAdaptiveWindow(64, 1000)
+	w.limit = 64
+	for i := 0; i < minWindow; i++ {
+		check(t, "acquiring", w.acquire(500))
+	}
+	acquired := make(chan error)
+	go func() {
+		acquired <- w.acquire(500)
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("Expected acquire to block while over budget, got: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Chunks not pinning storage are only subject to the limit
+	check(t, "acquiring unpinned", w.acquire(0))
+	for i := 0; i < minWindow; i++ {
+		w.release(500, 500)
+	}
+	check(t, "acquiring after release", <-acquired)
+
+	// Close wakes up waiting callers
+	w = newAdaptiveWindow(64, 0)
+	for i := 0; i < minWindow; i++ {
+		check(t, "acquiring", w.acquire(0))
+	}
+	go func() {
+		acquired <- w.acquire(0)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	w.close()
+	if err := <-acquired; err != ErrDisposed {
+		t.Errorf("Expected ErrDisposed, got: %v", err)
+	}
+}
+
+// Function latencyPipe returns a pipe delivering each write after a delay of `latency`,
+// without blocking the writer.
+func latencyPipe(latency time.Duration) (io.Reader, io.WriteCloser) {
+	pr, pw := io.Pipe()
+	lw := &latencyWriter{latency, make(chan delayedWrite, 1024)}
+	go func() {
+		for d := range lw.writes {
+			time.Sleep(time.Until(d.due))
+			if _, err := pw.Write(d.data); err != nil {
+				break
+			}
+		}
+		_ = pw.Close()
+	}()
+	return pr, lw
+}
+
+type delayedWrite struct {
+	data []byte
+	due  time.Time
+}
+
+type latencyWriter struct {
+	latency time.Duration
+	writes  chan delayedWrite
+}
+
+func (w *latencyWriter) Write(p []byte) (int, error) {
+	w.writes <- delayedWrite{append([]byte(nil), p...), time.Now().Add(w.latency)}
+	return len(p), nil
+}
+
+func (w *latencyWriter) Close() error {
+	close(w.writes)
+	return nil
+}
+
+// Function benchmarkWindowSize measures the throughput of transfers with a wishlist latency of
+// 1ms, using a fixed window of `windowSize` chunks, or an adaptive window if `adaptive` is set.
+func benchmarkWindowSize(b *testing.B, windowSize int, adaptive bool) {
+	storeA := NewRamStorage(16 * 1024 * 1024)
+	fileA := addRandomFileB(b, storeA, 2*1024*1024)
+	defer fileA.Dispose()
+
+	syncinf := &SyncInfo{}
+	syncinf.SetPermutation(shuffle.Permutation(rand.Perm(10)))
+	if err := syncinf.SetChunksFromFile(fileA); err != nil {
+		b.Fatalf("Error computing chunks: %v", err)
+	}
+
+	b.SetBytes(fileA.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Use a fresh receiving store each time so that all chunks are requested
+		storeB := NewRamStorage(16 * 1024 * 1024)
+		builder := NewBuilder(storeB, syncinf, windowSize, "Recovered A")
+		if adaptive {
+			builder.WithAdaptiveWindow(0)
+		}
+
+		wishlistReader, wishlistWriter := latencyPipe(time.Millisecond)
+		dataReader, dataWriter := io.Pipe()
+		go func() {
+			_ = builder.WriteWishList(NopFlushWriter{wishlistWriter})
+			_ = wishlistWriter.Close()
+		}()
+		go func() {
+			chunks := ChunksOfFile(fileA)
+			defer chunks.Dispose()
+			err := syncinf.WriteChunkData(context.Background(), chunks, bufio.NewReader(wishlistReader), NopFlushWriter{dataWriter}, nil)
+			_ = dataWriter.CloseWithError(err)
+		}()
+		f, err := builder.ReconstructFileFromRequestedChunks(dataReader)
+		if err != nil {
+			b.Fatalf("Error reconstructing: %v", err)
+		}
+		f.Dispose()
+		builder.Dispose()
+	}
+}
+
+func addRandomFileB(b *testing.B, store cafs.FileStorage, size int) cafs.File {
+	temp := store.Create(fmt.Sprintf("%v random bytes", size))
+	defer temp.Dispose()
+	if _, err := temp.Write(randomBytes(size)); err != nil {
+		b.Fatalf("Error writing data: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		b.Fatalf("Error closing temporary: %v", err)
+	}
+	return temp.File()
+}
+
+func BenchmarkWindowSize8(b *testing.B) {
+	benchmarkWindowSize(b, 8, false)
+}
+
+func BenchmarkWindowSize32(b *testing.B) {
+	benchmarkWindowSize(b, 32, false)
+}
+
+func BenchmarkWindowSize128(b *testing.B) {
+	benchmarkWindowSize(b, 128, false)
+}
+
+func BenchmarkWindowSize512(b *testing.B) {
+	benchmarkWindowSize(b, 512, false)
+}
+
+func BenchmarkWindowSizeAdaptive(b *testing.B) {
+	benchmarkWindowSize(b, 512, true)
+}
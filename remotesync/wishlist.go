@@ -0,0 +1,104 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2018 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import "io"
+
+// The wishlist is a bit stream containing one bit per chunk, in shuffled order, with '1' meaning
+// that the chunk is requested. Bits are packed into bytes most significant bit first. The last
+// byte is padded with '0' bits.
+
+// Struct BitWriter encodes a wishlist. Each completed byte is written and flushed immediately,
+// so that the sender can start transmitting chunk data as early as possible.
+type BitWriter struct {
+	w   FlushWriter
+	n   int
+	buf [1]byte
+}
+
+// Function NewBitWriter returns a BitWriter writing to `writer`.
+func NewBitWriter(writer FlushWriter) *BitWriter {
+	return &BitWriter{w: writer}
+}
+
+// Appends a bit to the wishlist.
+func (w *BitWriter) WriteBit(b bool) (err error) {
+	if b {
+		w.buf[0] = (w.buf[0] << 1) | 1
+	} else {
+		w.buf[0] = w.buf[0] << 1
+	}
+	w.n++
+	if w.n == 8 {
+		_, err = w.w.Write(w.buf[:])
+		if err == nil {
+			w.w.Flush()
+		}
+		w.n = 0
+	}
+	return
+}
+
+// Pads the last byte with '0' bits and writes it. Must be called after the last bit.
+func (w *BitWriter) Flush() (err error) {
+	for err == nil && w.n != 0 {
+		err = w.WriteBit(false)
+	}
+	return
+}
+
+// Struct BitReader decodes a wishlist.
+type BitReader struct {
+	r io.ByteReader
+	n uint
+	b byte
+}
+
+// Function NewBitReader returns a BitReader reading from `r`.
+func NewBitReader(r io.ByteReader) *BitReader {
+	return &BitReader{r: r, n: 0, b: 0}
+}
+
+// Reads the next bit of the wishlist. Returns io.EOF when the stream ends at a byte boundary.
+func (r *BitReader) ReadBit() (bit bool, err error) {
+	if r.n == 8 {
+		r.n = 0
+	}
+	if r.n == 0 {
+		r.b, err = r.r.ReadByte()
+		if err != nil {
+			return
+		}
+	}
+	n := r.n
+	r.n++
+	bit = 0 != (0x80 & (r.b << n))
+	return
+}
+
+// Returns true if the next bit can be read without reading another byte.
+func (r *BitReader) hasBuffered() bool {
+	return r.n != 0 && r.n != 8
+}
+
+// Returns true if all bits remaining in the byte last read are zero.
+func (r *BitReader) PaddingIsZero() bool {
+	if r.n == 0 || r.n == 8 {
+		return true
+	}
+	return r.b<<r.n == 0
+}
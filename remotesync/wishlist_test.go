@@ -0,0 +1,59 @@
+package remotesync
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestBitWriterReader(t *testing.T) {
+	for _, n := range []int{0, 1, 7, 8, 9, 100} {
+		bits := make([]bool, n)
+		for i := range bits {
+			bits[i] = rand.Intn(2) == 1
+		}
+
+		var buf bytes.Buffer
+		w := NewBitWriter(NopFlushWriter{&buf})
+		for _, b := range bits {
+			check(t, "writing bit", w.WriteBit(b))
+		}
+		check(t, "flushing", w.Flush())
+		if expected := (n + 7) / 8; buf.Len() != expected {
+			t.Errorf("%d bits: expected %d bytes, got %d", n, expected, buf.Len())
+		}
+
+		r := NewBitReader(&buf)
+		for i, b := range bits {
+			if bit, err := r.ReadBit(); err != nil {
+				t.Fatalf("%d bits: error reading bit %d: %v", n, i, err)
+			} else if bit != b {
+				t.Errorf("%d bits: bit %d is %v, expected %v", n, i, bit, b)
+			}
+		}
+		if !r.PaddingIsZero() {
+			t.Errorf("%d bits: expected zero padding", n)
+		}
+		for i := n; i%8 != 0; i++ {
+			if bit, err := r.ReadBit(); err != nil || bit {
+				t.Errorf("%d bits: expected padding bit %d to be 0, got %v (%v)", n, i, bit, err)
+			}
+		}
+		if _, err := r.ReadBit(); err != io.EOF {
+			t.Errorf("%d bits: expected EOF, got %v", n, err)
+		}
+	}
+}
+
+func TestBitReaderPadding(t *testing.T) {
+	r := NewBitReader(bytes.NewReader([]byte{0xa1}))
+	for i := 0; i < 3; i++ {
+		if _, err := r.ReadBit(); err != nil {
+			t.Fatalf("Error reading bit: %v", err)
+		}
+	}
+	if r.PaddingIsZero() {
+		t.Errorf("Expected nonzero padding to be detected")
+	}
+}
@@ -0,0 +1,107 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019 Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package remotesync
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+// The number of bytes of chunk data buffered by WriteChunkDataWithContext by default. See
+// WithWriteBuffer.
+const DefaultWriteBufferSize = 64 * 1024
+
+type writeBufferKey struct{}
+
+// Function WithWriteBuffer returns a context that makes WriteChunkDataWithContext and
+// SyncInfo.WriteChunkData buffer up to `size` bytes of chunk data, instead of
+// DefaultWriteBufferSize, before writing them to the FlushWriter. Buffered data is written and
+// flushed whenever the sender is about to wait for more of the wishlist, so that the receiver is
+// never kept waiting for data the sender already has. A non-positive `size` disables buffering,
+// which makes the sender write and flush every chunk individually.
+func WithWriteBuffer(ctx context.Context, size int) context.Context {
+	return context.WithValue(ctx, writeBufferKey{}, size)
+}
+
+// Function writeBufferSize returns the write buffer size to use with a context.
+func writeBufferSize(ctx context.Context) int {
+	if size, ok := ctx.Value(writeBufferKey{}).(int); ok {
+		return size
+	}
+	return DefaultWriteBufferSize
+}
+
+// Struct bufferedFlushWriter implements FlushWriter by buffering data written to another
+// FlushWriter. Flush writes the buffered data and flushes the other FlushWriter.
+type bufferedFlushWriter struct {
+	buf   *bufio.Writer
+	w     FlushWriter
+	dirty bool // set if data has been written since the last flush
+}
+
+func newBufferedFlushWriter(w FlushWriter, size int) *bufferedFlushWriter {
+	return &bufferedFlushWriter{buf: bufio.NewWriterSize(w, size), w: w}
+}
+
+func (b *bufferedFlushWriter) Write(p []byte) (int, error) {
+	b.dirty = true
+	return b.buf.Write(p)
+}
+
+func (b *bufferedFlushWriter) Flush() {
+	_ = b.flush()
+}
+
+// Writes the buffered data and flushes the underlying FlushWriter, unless nothing has been
+// written since the last call. Errors are sticky and also returned by subsequent writes.
+func (b *bufferedFlushWriter) flush() error {
+	if !b.dirty {
+		return nil
+	}
+	b.dirty = false
+	if err := b.buf.Flush(); err != nil {
+		return err
+	}
+	b.w.Flush()
+	return nil
+}
+
+// Struct flushingByteReader wraps the wishlist reader and flushes a bufferedFlushWriter before
+// reading might block. Readers that don't report buffered data, unlike bufio.Reader, are assumed
+// to block on every read.
+type flushingByteReader struct {
+	r io.ByteReader
+	w *bufferedFlushWriter
+}
+
+func (f flushingByteReader) ReadByte() (byte, error) {
+	if b, ok := f.r.(interface{ Buffered() int }); !ok || b.Buffered() == 0 {
+		if err := f.w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return f.r.ReadByte()
+}
+
+// Returns the number of bytes readable from the wrapped reader without blocking, if it reports it.
+func (f flushingByteReader) Buffered() int {
+	if b, ok := f.r.(interface{ Buffered() int }); ok {
+		return b.Buffered()
+	}
+	return 0
+}
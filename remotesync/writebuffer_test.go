@@ -0,0 +1,167 @@
+package remotesync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/chunking"
+	. "github.com/indyjo/cafs/ram"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// Struct countingFlushWriter counts the writes and flushes passed through to a Writer.
+type countingFlushWriter struct {
+	w       io.Writer
+	writes  int
+	flushes int
+}
+
+func (c *countingFlushWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.w.Write(p)
+}
+
+func (c *countingFlushWriter) Flush() {
+	c.flushes++
+}
+
+func TestWriteBuffer(t *testing.T) {
+	storeA := NewRamStorage(4 * 1024 * 1024)
+	defer reportUsage(t, "A", storeA)
+	fileA := addRandomFile(t, storeA, 1024*1024)
+	defer fileA.Dispose()
+	syncinf := &SyncInfo{}
+	syncinf.SetTrivialPermutation()
+	check(t, "setting chunks", syncinf.SetChunksFromFile(fileA))
+	numChunks := int(fileA.NumChunks())
+
+	for _, size := range []int{0, DefaultWriteBufferSize} {
+		storeB := NewRamStorage(4 * 1024 * 1024)
+		builder := NewBuilder(storeB, syncinf, numChunks+1, "Recovered A")
+		var wishlist bytes.Buffer
+		check(t, "writing wishlist", builder.WriteWishList(NopFlushWriter{&wishlist}))
+
+		var data bytes.Buffer
+		w := &countingFlushWriter{w: &data}
+		chunks := ChunksOfFile(fileA)
+		check(t, "writing chunk data", syncinf.WriteChunkData(WithWriteBuffer(context.Background(), size),
+			chunks, bufio.NewReader(&wishlist), w, nil))
+		chunks.Dispose()
+
+		if size == 0 && w.flushes != numChunks {
+			t.Errorf("Unbuffered: expected a flush per chunk (%d), got %d", numChunks, w.flushes)
+		} else if size > 0 && w.writes > int(fileA.Size())/size+2 {
+			t.Errorf("Buffered: expected few large writes, got %d writes for %d chunks", w.writes, numChunks)
+		}
+
+		f, err := builder.ReconstructFileFromRequestedChunks(&data)
+		check(t, "reconstructing", err)
+		if f.Key() != fileA.Key() {
+			t.Errorf("Buffer size %d: reconstructed file differs", size)
+		}
+		f.Dispose()
+		builder.Dispose()
+	}
+}
+
+// Struct connFlushWriter implements FlushWriter like an http.ResponseWriter does: data is collected
+// in a small buffer, and every flush writes it to the connection.
+type connFlushWriter struct {
+	w *bufio.Writer
+}
+
+func (c connFlushWriter) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c connFlushWriter) Flush() {
+	_ = c.w.Flush()
+}
+
+// Struct storedChunks implements Chunks, retrieving the chunks listed from a storage.
+type storedChunks struct {
+	storage cafs.FileStorage
+	chunks  []ChunkInfo
+}
+
+func (c *storedChunks) NextChunk() (cafs.File, error) {
+	if len(c.chunks) == 0 {
+		return nil, io.EOF
+	}
+	key := c.chunks[0].Key
+	c.chunks = c.chunks[1:]
+	return c.storage.Get(&key)
+}
+
+func (c *storedChunks) Dispose() {}
+
+// Function benchmarkWriteBuffer measures the sender's throughput when writing chunks of
+// `chunkSize` bytes each to a loopback TCP connection, flushing the connection on every
+// flush of the FlushWriter, with chunk data buffered up to `size` bytes.
+func benchmarkWriteBuffer(b *testing.B, chunkSize, size int) {
+	const total = 16 * 1024 * 1024
+	storeA := NewRamStorage(256 * 1024 * 1024)
+	syncinf := &SyncInfo{}
+	syncinf.SetTrivialPermutation()
+	for i := 0; i < total/chunkSize; i++ {
+		chunk := addRandomFileB(b, storeA, chunkSize)
+		if err := syncinf.addChunk(chunk.Key(), chunk.Size()); err != nil {
+			b.Fatalf("Error adding chunk: %v", err)
+		}
+		chunk.Dispose()
+	}
+	wishlist := bytes.Repeat([]byte{0xff}, len(syncinf.Chunks)/8)
+	if n := len(syncinf.Chunks) % 8; n > 0 {
+		wishlist = append(wishlist, byte(0xff<<uint(8-n)))
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skipf("Unable to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("Error dialing: %v", err)
+	}
+	defer conn.Close()
+	w := connFlushWriter{bufio.NewWriterSize(conn, 4096)}
+
+	ctx := WithWriteBuffer(context.Background(), size)
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chunks := &storedChunks{storage: storeA, chunks: syncinf.Chunks}
+		err := syncinf.WriteChunkData(ctx, chunks, bufio.NewReader(bytes.NewReader(wishlist)), w, nil)
+		if err != nil {
+			b.Fatalf("Error writing chunk data: %v", err)
+		}
+	}
+}
+
+func BenchmarkWriteBuffer(b *testing.B) {
+	for _, chunkSize := range []int{chunking.MinChunkSize, 1024, chunking.AvgChunkSize} {
+		for _, size := range []int{0, 4 * 1024, DefaultWriteBufferSize} {
+			b.Run(fmt.Sprintf("chunk=%d/buffer=%dK", chunkSize, size/1024), func(b *testing.B) {
+				benchmarkWriteBuffer(b, chunkSize, size)
+			})
+		}
+	}
+}
@@ -0,0 +1,133 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import (
+	"hash"
+	"io"
+)
+
+// Function OpenVerified opens `file` for reading like File.Open, but re-hashes the content while
+// it is being read. For chunked files, each chunk is compared to its expected key and size as
+// soon as it has been read completely; for all files, the whole content is compared to the file's
+// key at the end. On a mismatch, Read fails with ErrHashMismatch instead of continuing the stream.
+// Note that the bytes of a chunk are passed on before the chunk is verified, so a consumer must
+// not trust any data read before an error occurred. The caller remains responsible for
+// disposing `file`, which must outlive the returned reader.
+func OpenVerified(file File) io.ReadCloser {
+	v := &verifiedReader{key: file.Key(), size: file.Size(), whole: NewKeyHash()}
+	if file.IsChunked() {
+		v.iter = file.Chunks()
+		v.chunk = NewKeyHash()
+	} else {
+		v.r = file.Open()
+	}
+	return v
+}
+
+// Struct verifiedReader implements the io.ReadCloser returned by OpenVerified.
+type verifiedReader struct {
+	key   SKey
+	size  int64
+	whole hash.Hash
+	read  int64
+
+	// Only used with chunked files.
+	iter      FileIterator
+	chunkFile File
+	chunk     hash.Hash
+	chunkRead int64
+
+	// The reader of the current chunk or, for non-chunked files, of the whole file.
+	r   io.ReadCloser
+	err error
+}
+
+func (v *verifiedReader) Read(b []byte) (int, error) {
+	if len(b) == 0 && v.err == nil {
+		return 0, nil
+	}
+	for v.err == nil {
+		if v.r == nil {
+			v.nextChunk()
+			continue
+		}
+		n, err := v.r.Read(b)
+		v.whole.Write(b[:n])
+		v.read += int64(n)
+		if v.chunk != nil {
+			v.chunk.Write(b[:n])
+			v.chunkRead += int64(n)
+		}
+		if err == io.EOF {
+			v.endOfChunk()
+		} else if err != nil {
+			v.err = err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, v.err
+}
+
+// Advances to the next chunk or, if there is none, verifies the whole file.
+func (v *verifiedReader) nextChunk() {
+	if v.iter == nil || !v.iter.Next() {
+		if v.read != v.size || SumKey(v.whole) != v.key {
+			v.err = ErrHashMismatch
+		} else {
+			v.err = io.EOF
+		}
+		return
+	}
+	v.chunkFile = v.iter.File()
+	v.r = v.chunkFile.Open()
+	v.chunk.Reset()
+	v.chunkRead = 0
+}
+
+// Closes the current chunk and, for chunked files, verifies it.
+func (v *verifiedReader) endOfChunk() {
+	v.closeChunk()
+	if v.iter != nil && (v.chunkRead != v.iter.Size() || SumKey(v.chunk) != v.iter.Key()) {
+		v.err = ErrHashMismatch
+	}
+}
+
+func (v *verifiedReader) closeChunk() {
+	if v.r != nil {
+		_ = v.r.Close()
+		v.r = nil
+	}
+	if v.chunkFile != nil {
+		v.chunkFile.Dispose()
+		v.chunkFile = nil
+	}
+}
+
+func (v *verifiedReader) Close() error {
+	v.closeChunk()
+	if v.iter != nil {
+		v.iter.Dispose()
+		v.iter = nil
+	}
+	if v.err == nil {
+		v.err = ErrInvalidState
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package cafs_test
+
+import (
+	"bytes"
+	. "github.com/indyjo/cafs"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestOpenVerified(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, size := range []int{0, 100, 500000} {
+		data := randomBytes(r, size)
+		f := FileFromBytes(data)
+		v := OpenVerified(f)
+		if n, err := v.Read(nil); n != 0 || err != nil {
+			t.Errorf("%d bytes: expected empty read to return 0 and no error, got %v and %v", size, n, err)
+		}
+		read, err := ioutil.ReadAll(v)
+		_ = v.Close()
+		if err != nil {
+			t.Errorf("%d bytes: unexpected error %v", size, err)
+		} else if !bytes.Equal(read, data) {
+			t.Errorf("%d bytes: content differs", size)
+		}
+	}
+}
+
+func TestOpenVerifiedDetectsCorruption(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, size := range []int{100, 500000} {
+		data := randomBytes(r, size)
+		f := FileFromBytes(data)
+		if size > 100 && f.NumChunks() < 3 {
+			t.Fatalf("Expected a file with several chunks, got %d", f.NumChunks())
+		}
+
+		// Corrupt a byte in the second half of the first chunk
+		iter := f.Chunks()
+		iter.Next()
+		firstChunk := iter.Size()
+		iter.Dispose()
+		data[firstChunk/2] ^= 0xff
+
+		v := OpenVerified(f)
+		n, err := io.Copy(ioutil.Discard, v)
+		_ = v.Close()
+		if err != ErrHashMismatch {
+			t.Errorf("%d bytes: expected ErrHashMismatch, got %v", size, err)
+		}
+		// The error is reported as soon as the corrupted chunk has been read
+		if n > firstChunk {
+			t.Errorf("%d bytes: read %d bytes beyond the corrupted chunk of size %d", size, n-firstChunk, firstChunk)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//  BitWrk - A Bitcoin-friendly, anonymous marketplace for computing power
+//  Copyright (C) 2013-2019  Jonas Eschenburg <jonas@bitwrk.net>
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cafs
+
+import "io"
+
+// Function WalkChunks iterates over the chunks of `file` in order and calls `fn` with each chunk's
+// key, its offset within the file and its data, which is only valid until `fn` returns. A file
+// that isn't chunked is treated as a single chunk. Stops at the first error returned by `fn` and
+// returns it.
+func WalkChunks(file File, fn func(key SKey, offset int64, data []byte) error) error {
+	if !file.IsChunked() {
+		data, err := readFile(file, nil)
+		if err != nil {
+			return err
+		}
+		return fn(file.Key(), 0, data)
+	}
+
+	iter := file.Chunks()
+	defer iter.Dispose()
+	var buf []byte
+	var offset int64
+	for iter.Next() {
+		chunk := iter.File()
+		data, err := readFile(chunk, buf)
+		chunk.Dispose()
+		if err != nil {
+			return err
+		}
+		if err := fn(iter.Key(), offset, data); err != nil {
+			return err
+		}
+		offset += int64(len(data))
+		buf = data
+	}
+	return nil
+}
+
+// Function readFile reads the contents of `file`, reusing `buf` if it is large enough.
+func readFile(file File, buf []byte) ([]byte, error) {
+	size := int(file.Size())
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	r := file.Open()
+	defer r.Close()
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
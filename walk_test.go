@@ -0,0 +1,57 @@
+package cafs_test
+
+import (
+	"bytes"
+	"errors"
+	. "github.com/indyjo/cafs"
+	"github.com/indyjo/cafs/ram"
+	"math/rand"
+	"testing"
+)
+
+func TestWalkChunks(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	store := ram.NewRamStorage(1 << 20)
+	for _, size := range []int{0, 100, 300000} {
+		data := randomBytes(r, size)
+		f, err := Ingest(store, bytes.NewReader(data), "walk data")
+		if err != nil {
+			t.Fatalf("Error ingesting: %v", err)
+		}
+
+		var walked []byte
+		var chunks int64
+		err = WalkChunks(f, func(key SKey, offset int64, chunk []byte) error {
+			if offset != int64(len(walked)) {
+				t.Errorf("Size %d: chunk %d at offset %d, expected %d", size, chunks, offset, len(walked))
+			}
+			if KeyOf(chunk) != key {
+				t.Errorf("Size %d: chunk %d doesn't match its key", size, chunks)
+			}
+			walked = append(walked, chunk...)
+			chunks++
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Size %d: error in WalkChunks: %v", size, err)
+		}
+		if !bytes.Equal(walked, data) {
+			t.Errorf("Size %d: walked data differs", size)
+		}
+		if chunks != f.NumChunks() {
+			t.Errorf("Size %d: walked %d chunks, expected %d", size, chunks, f.NumChunks())
+		}
+
+		// Errors returned by the callback stop the walk
+		errStop := errors.New("stop")
+		calls := 0
+		if err := WalkChunks(f, func(SKey, int64, []byte) error { calls++; return errStop }); err != errStop || calls != 1 {
+			t.Errorf("Size %d: expected walk to stop with errStop after 1 call, got %v after %d", size, err, calls)
+		}
+		f.Dispose()
+	}
+	store.FreeCache()
+	if locked := store.GetUsageInfo().Locked; locked != 0 {
+		t.Errorf("Expected no bytes to be locked, got: %v", locked)
+	}
+}